@@ -0,0 +1,418 @@
+package aof
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"gedis/config"
+	"gedis/interface/database"
+	"gedis/lib/logger"
+	"gedis/lib/sync/atomic"
+	"gedis/lib/utils"
+	"gedis/redis/connection"
+	"gedis/redis/parser"
+	"gedis/redis/protocol"
+	rdb "github.com/hdt3213/rdb/parser"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// CmdLine 是[][]byte的别名，代表一条命令
+type CmdLine = [][]byte
+
+const (
+	aofQueueSize = 1 << 16
+	// 加载aof时的读缓冲区，不能小于rdb解码器默认的缓冲区大小，否则解码器会重新包装一层
+	aofReadBufferSize = 1 << 16
+	rdbMagic          = "REDIS"
+	rdbChecksumSize   = 8
+)
+
+const (
+	// FsyncAlways 每条命令都进行刷盘
+	FsyncAlways = "always"
+	// FsyncEverySec 每秒刷盘一次
+	FsyncEverySec = "everysec"
+	// FsyncNo 由操作系统决定何时刷盘
+	FsyncNo = "no"
+)
+
+// payload 一条需要写入aof的命令以及它所在的数据库
+type payload struct {
+	cmdLine CmdLine
+	dbIndex int
+	// 不为空时不是命令，之前进入通道的命令全部写入之后关闭
+	written chan struct{}
+	// 重写期间缓存的时间戳标记，追加到新文件时不需要select
+	mark bool
+}
+
+// Persister 负责将写命令追加到aof文件，以及在启动时重放aof文件
+type Persister struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	db     database.DBEngine
+	// 异步写入aof的命令通道
+	aofChan     chan *payload
+	aofFile     *os.File
+	aofFilename string
+	aofFsync    string
+	// aofChan中的命令全部写入之后关闭
+	aofFinished chan struct{}
+	// 暂停aof写入，刷盘等操作时候加锁
+	pausingAof sync.Mutex
+	// aof文件当前所处的数据库，数据库切换时需要写入select
+	currentDB int
+	closeOnce sync.Once
+	// 关闭之后仍然可能有写命令到达，例如正在执行的客户端命令以及过期key的删除
+	// 写入时持有读锁，Close持有写锁设置closed之后再关闭aofChan
+	closing sync.RWMutex
+	closed  bool
+
+	// 创建重写aof时使用的临时数据库
+	tmpDBMaker func() database.DBEngine
+	// 是否正在重写
+	rewriting atomic.Boolean
+	// 重写期间到达的写命令，重写结束时追加到新的aof文件
+	rewriteBuffer []*payload
+	// 上次重写之后aof文件的大小，用于判断是否需要自动重写
+	baseSize int64
+	// 当前正在追加的aof文件的大小
+	aofSize int64
+
+	// 是否在aof中写入时间戳标记，用于按时间点恢复
+	timestamp bool
+	// 上一次写入时间戳标记的时间，unix毫秒
+	lastMarkMs int64
+	// 分段aof的manifest，未开启分段时为nil
+	manifest *Manifest
+	// 增量段超过该大小时切换到新的段
+	segmentSize int64
+}
+
+// NewPersister 打开aof文件，load为true时会先将aof文件重放到db中
+func NewPersister(db database.DBEngine, filename string, load bool, fsync string, tmpDBMaker func() database.DBEngine) (*Persister, error) {
+	persister := &Persister{
+		db:          db,
+		aofFilename: filename,
+		aofFsync:    fsync,
+		currentDB:   0,
+		tmpDBMaker:  tmpDBMaker,
+		timestamp:   config.Properties.AofTimestampEnabled,
+	}
+	if persister.aofFsync == "" {
+		persister.aofFsync = FsyncEverySec
+	}
+	segmentSize, err := config.ParseSize(config.Properties.AofSegmentSize)
+	if err != nil {
+		return nil, err
+	}
+	if segmentSize > 0 {
+		persister.segmentSize = segmentSize
+		if err := persister.openManifest(config.Properties.AppendDirname); err != nil {
+			return nil, err
+		}
+	}
+	if load {
+		if err := persister.checkAof(); err != nil {
+			return nil, err
+		}
+		persister.LoadAof(0)
+	}
+	aofFile, err := os.OpenFile(persister.aofFilename, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	persister.aofFile = aofFile
+	if info, err := aofFile.Stat(); err == nil {
+		persister.aofSize = info.Size()
+	}
+	persister.baseSize = persister.aofTotalSize()
+	persister.aofChan = make(chan *payload, aofQueueSize)
+	persister.aofFinished = make(chan struct{})
+	go func() {
+		persister.listenCmd()
+	}()
+	ctx, cancel := context.WithCancel(context.Background())
+	persister.ctx = ctx
+	persister.cancel = cancel
+	if persister.aofFsync == FsyncEverySec {
+		persister.fsyncEverySecond()
+	}
+	return persister, nil
+}
+
+// SaveCmdLine 将一条写命令追加到aof中
+func (persister *Persister) SaveCmdLine(dbIndex int, cmdLine CmdLine) {
+	persister.closing.RLock()
+	defer persister.closing.RUnlock()
+	// 已经关闭，丢弃之后到达的命令
+	if persister.closed {
+		return
+	}
+	p := &payload{
+		cmdLine: cmdLine,
+		dbIndex: dbIndex,
+	}
+	// always策略下同步写入，保证命令返回之前已经落盘
+	if persister.aofFsync == FsyncAlways {
+		persister.writeAof(p)
+		return
+	}
+	persister.aofChan <- p
+}
+
+// waitWritten 等待已经进入通道的命令全部写入aof文件
+func (persister *Persister) waitWritten() {
+	persister.closing.RLock()
+	if persister.closed || persister.aofFsync == FsyncAlways {
+		persister.closing.RUnlock()
+		return
+	}
+	written := make(chan struct{})
+	persister.aofChan <- &payload{written: written}
+	persister.closing.RUnlock()
+	<-written
+}
+
+// listenCmd 从通道中取出命令写入aof文件
+func (persister *Persister) listenCmd() {
+	for p := range persister.aofChan {
+		if p.written != nil {
+			close(p.written)
+			continue
+		}
+		persister.writeAof(p)
+	}
+	persister.aofFinished <- struct{}{}
+}
+
+func (persister *Persister) writeAof(p *payload) {
+	persister.pausingAof.Lock()
+	defer persister.pausingAof.Unlock()
+	persister.writeTimestamp()
+	// 数据库发生了切换，先写入一条select
+	if p.dbIndex != persister.currentDB {
+		selectCmd := utils.ToCmdLine("SELECT", strconv.Itoa(p.dbIndex))
+		data := protocol.MakeMultiBulkReply(selectCmd).ToBytes()
+		err := persister.write(data)
+		if err != nil {
+			logger.Warn(err)
+			return
+		}
+		persister.currentDB = p.dbIndex
+	}
+	data := protocol.MakeMultiBulkReply(p.cmdLine).ToBytes()
+	err := persister.write(data)
+	if err != nil {
+		logger.Warn(err)
+	}
+	if persister.aofFsync == FsyncAlways {
+		_ = persister.aofFile.Sync()
+	}
+	// 正在重写时缓存命令，重写结束后追加到新文件
+	if persister.rewriteBuffer != nil {
+		persister.rewriteBuffer = append(persister.rewriteBuffer, p)
+	}
+	if persister.manifest != nil && persister.aofSize >= persister.segmentSize {
+		if _, err := persister.rotate(); err != nil {
+			logger.Error("rotate aof segment failed: " + err.Error())
+		}
+	}
+}
+
+// write 写入当前aof文件并记录文件大小
+func (persister *Persister) write(data []byte) error {
+	n, err := persister.aofFile.Write(data)
+	persister.aofSize += int64(n)
+	return err
+}
+
+// LoadAof 通过假连接将aof文件中的命令重放到db中，maxBytes大于0时只读取文件的前maxBytes字节
+// 开启分段时依次加载最后一个快照段以及之后的增量段
+func (persister *Persister) LoadAof(maxBytes int) {
+	if persister.manifest != nil {
+		for _, seg := range persister.manifest.loadSegments() {
+			persister.loadFile(persister.manifest.Path(seg), 0)
+		}
+		return
+	}
+	persister.loadFile(persister.aofFilename, maxBytes)
+}
+
+func (persister *Persister) loadFile(filename string, maxBytes int) {
+	dbIndex, _, err := ReplayFile(persister.db, filename, maxBytes, 0)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return
+		}
+		logger.Error("load aof " + filename + " failed: " + err.Error())
+		return
+	}
+	persister.currentDB = dbIndex
+}
+
+// ReplayFile 通过假连接将aof文件中的命令重放到db中，maxBytes大于0时只读取文件的前maxBytes字节
+// untilMs大于0时遇到晚于untilMs的时间戳标记就停止重放
+// 返回重放结束时所在的数据库，以及是否因为到达untilMs而提前停止
+func ReplayFile(db database.DBEngine, filename string, maxBytes int, untilMs int64) (int, bool, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return 0, false, err
+	}
+	defer file.Close()
+
+	var reader io.Reader
+	if maxBytes > 0 {
+		reader = io.LimitReader(file, int64(maxBytes))
+	} else {
+		reader = file
+	}
+	// rdb解码器与resp解析器共用同一个bufio.Reader，解码完rdb前言之后从当前位置继续解析命令
+	bufReader := bufio.NewReaderSize(reader, aofReadBufferSize)
+	if err := loadRDBPreamble(db, bufReader); err != nil {
+		return 0, false, fmt.Errorf("load rdb preamble failed: %v", err)
+	}
+	ch := parser.ParseStream(bufReader)
+	fakeConn := connection.NewFakeConn()
+	// 开启了密码的情况下，假连接同样需要通过鉴权
+	fakeConn.SetPassword(config.Properties.RequirePass)
+	for p := range ch {
+		if p.Err != nil {
+			if p.Err == io.EOF {
+				break
+			}
+			logger.Error("parse error: " + p.Err.Error())
+			continue
+		}
+		if p.Data == nil {
+			logger.Error("empty payload")
+			continue
+		}
+		r, ok := p.Data.(*protocol.MultiBulkReply)
+		if !ok {
+			logger.Error("require multi bulk protocol")
+			continue
+		}
+		if ts, ok := parseTimestamp(r.Args); ok {
+			if untilMs > 0 && ts > untilMs {
+				// 剩余的命令不再需要，关闭文件之后解析协程会因为读取失败而退出
+				_ = file.Close()
+				for range ch {
+				}
+				return fakeConn.GetDBIndex(), true, nil
+			}
+			continue
+		}
+		ret := db.Exec(fakeConn, r.Args)
+		if protocol.IsErrorReply(ret) {
+			logger.Error("exec err", string(ret.ToBytes()))
+		}
+	}
+	return fakeConn.GetDBIndex(), false, nil
+}
+
+// checkAof 加载之前校验aof文件，结尾的命令不完整时根据aof-load-truncated决定是否截断
+// 文件中间出现错误时无法确定之后的数据是否可信，拒绝加载
+// 开启分段时只有最后一个段允许被截断
+func (persister *Persister) checkAof() error {
+	if persister.manifest != nil {
+		segments := persister.manifest.loadSegments()
+		for i, seg := range segments {
+			if err := checkFile(persister.manifest.Path(seg), i == len(segments)-1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return checkFile(persister.aofFilename, true)
+}
+
+func checkFile(filename string, allowTruncate bool) error {
+	validSize, err := CheckAof(filename)
+	if err == nil || os.IsNotExist(err) {
+		return nil
+	}
+	formatErr, ok := err.(*FormatError)
+	if !ok {
+		return err
+	}
+	if formatErr.Truncated && allowTruncate && config.Properties.AofLoadTruncated {
+		logger.Warn(fmt.Sprintf("!!! Warning: short read while loading the AOF file %s, "+
+			"truncating the AOF at offset %d", filename, validSize))
+		return os.Truncate(filename, validSize)
+	}
+	return fmt.Errorf("bad file format reading the append only file %s: %v. "+
+		"make a backup of your AOF file, then use gedis-check-aof --fix <filename>",
+		filename, err)
+}
+
+// loadRDBPreamble aof文件以REDIS开头时先使用rdb解码器加载前言部分
+func loadRDBPreamble(db database.DBEngine, reader *bufio.Reader) error {
+	header, err := reader.Peek(len(rdbMagic))
+	if err != nil || string(header) != rdbMagic {
+		// 文件过短或者没有前言，全部按照resp命令解析
+		return nil
+	}
+	dec := rdb.NewDecoder(reader)
+	if err := db.LoadRDB(dec); err != nil {
+		return err
+	}
+	// 解码器读到EOF标记就会停止，跳过之后的8字节校验和以及可选的换行符
+	if _, err := reader.Discard(rdbChecksumSize); err != nil {
+		return err
+	}
+	if b, err := reader.Peek(1); err == nil && b[0] == '\n' {
+		_, _ = reader.Discard(1)
+	}
+	return nil
+}
+
+// Fsync 将aof文件刷入磁盘
+func (persister *Persister) Fsync() {
+	persister.pausingAof.Lock()
+	if err := persister.aofFile.Sync(); err != nil {
+		logger.Error("fsync failed: " + err.Error())
+	}
+	persister.pausingAof.Unlock()
+}
+
+// Close 等待通道中的命令全部写入之后关闭aof文件
+func (persister *Persister) Close() {
+	persister.closeOnce.Do(func() {
+		// 等待正在写入的命令完成，之后到达的命令被丢弃
+		persister.closing.Lock()
+		persister.closed = true
+		persister.closing.Unlock()
+		if persister.aofFile != nil {
+			close(persister.aofChan)
+			<-persister.aofFinished
+			if err := persister.aofFile.Sync(); err != nil {
+				logger.Warn(err)
+			}
+			if err := persister.aofFile.Close(); err != nil {
+				logger.Warn(err)
+			}
+		}
+		persister.cancel()
+	})
+}
+
+// fsyncEverySecond 每秒进行一次刷盘
+func (persister *Persister) fsyncEverySecond() {
+	ticker := time.NewTicker(time.Second)
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				persister.Fsync()
+			case <-persister.ctx.Done():
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+}
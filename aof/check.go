@@ -0,0 +1,148 @@
+package aof
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/hdt3213/rdb/model"
+	rdb "github.com/hdt3213/rdb/parser"
+	"io"
+	"os"
+	"strconv"
+)
+
+// FormatError aof文件格式错误，Offset为出错的命令在文件中的起始位置
+type FormatError struct {
+	Offset int64
+	// 为true时代表文件结尾的命令不完整，通常是写入过程中崩溃导致的
+	Truncated bool
+	// 为true时代表rdb格式的前言已经损坏，截断会丢失所有数据，无法修复
+	Preamble bool
+	Reason   string
+}
+
+func (e *FormatError) Error() string {
+	if e.Truncated {
+		return fmt.Sprintf("unexpected end of file at offset %d: %s", e.Offset, e.Reason)
+	}
+	if e.Preamble {
+		return "bad rdb preamble: " + e.Reason
+	}
+	return fmt.Sprintf("bad format at offset %d: %s", e.Offset, e.Reason)
+}
+
+// countingReader 记录已经从底层读取的字节数
+type countingReader struct {
+	reader io.Reader
+	n      int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// CheckAof 校验aof文件的格式，返回最后一条完整命令结束的位置
+// 文件格式有误时返回*FormatError
+func CheckAof(filename string) (int64, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	counter := &countingReader{reader: file}
+	reader := bufio.NewReaderSize(counter, aofReadBufferSize)
+	offset := func() int64 {
+		return counter.n - int64(reader.Buffered())
+	}
+
+	if header, err := reader.Peek(len(rdbMagic)); err == nil && string(header) == rdbMagic {
+		err = rdb.NewDecoder(reader).Parse(func(o model.RedisObject) bool {
+			return true
+		})
+		if err == nil {
+			_, err = reader.Discard(rdbChecksumSize)
+		}
+		if err != nil {
+			return 0, &FormatError{Offset: 0, Preamble: true, Reason: "invalid rdb preamble: " + err.Error()}
+		}
+		if b, err := reader.Peek(1); err == nil && b[0] == '\n' {
+			_, _ = reader.Discard(1)
+		}
+	}
+
+	for {
+		validSize := offset()
+		err := checkCommand(reader)
+		if err == io.EOF {
+			return validSize, nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			return validSize, &FormatError{Offset: validSize, Truncated: true, Reason: "incomplete command"}
+		}
+		if err != nil {
+			return validSize, &FormatError{Offset: validSize, Reason: err.Error()}
+		}
+	}
+}
+
+// checkCommand 读取并校验一条multi bulk格式的命令
+// 在命令开始之前遇到文件结尾时返回io.EOF，命令不完整时返回io.ErrUnexpectedEOF
+func checkCommand(reader *bufio.Reader) error {
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		if err == io.EOF && len(line) == 0 {
+			return io.EOF
+		}
+		return unexpectedEOF(err)
+	}
+	argc, err := parseLength(line, '*')
+	if err != nil {
+		return err
+	}
+	if argc <= 0 {
+		return fmt.Errorf("invalid argument count: %q", line)
+	}
+	crlf := make([]byte, 2)
+	for i := 0; i < argc; i++ {
+		line, err = reader.ReadBytes('\n')
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		bulkLen, err := parseLength(line, '$')
+		if err != nil {
+			return err
+		}
+		if bulkLen < 0 {
+			return fmt.Errorf("invalid bulk length: %q", line)
+		}
+		if _, err = reader.Discard(bulkLen); err != nil {
+			return unexpectedEOF(err)
+		}
+		if _, err = io.ReadFull(reader, crlf); err != nil {
+			return unexpectedEOF(err)
+		}
+		if crlf[0] != '\r' || crlf[1] != '\n' {
+			return fmt.Errorf("bulk string is not terminated by CRLF")
+		}
+	}
+	return nil
+}
+
+func parseLength(line []byte, prefix byte) (int, error) {
+	if len(line) < 3 || line[0] != prefix || line[len(line)-2] != '\r' {
+		return 0, fmt.Errorf("expected '%c', got %q", prefix, line)
+	}
+	n, err := strconv.Atoi(string(line[1 : len(line)-2]))
+	if err != nil {
+		return 0, fmt.Errorf("invalid length: %q", line)
+	}
+	return n, nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
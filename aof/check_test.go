@@ -0,0 +1,107 @@
+package aof
+
+import (
+	"bytes"
+	"github.com/hdt3213/rdb/encoder"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// makeRDBPreamble 生成只包含一个字符串键的rdb前言
+func makeRDBPreamble(t *testing.T) []byte {
+	buf := &bytes.Buffer{}
+	enc := encoder.NewEncoder(buf)
+	if err := enc.WriteHeader(); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.WriteDBHeader(0, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.WriteStringObject("k", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.WriteEnd(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestCheckAof(t *testing.T) {
+	set := "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$1\r\nv\r\n"
+	del := "*2\r\n$3\r\nDEL\r\n$1\r\nk\r\n"
+	preamble := string(makeRDBPreamble(t))
+	cases := []struct {
+		name      string
+		content   string
+		validSize int
+		// 为nil时代表文件格式正确
+		expect *FormatError
+	}{
+		{name: "valid", content: set + del, validSize: len(set + del)},
+		{name: "empty", content: "", validSize: 0},
+		{
+			name:      "truncated tail",
+			content:   set + del[:len(del)-3],
+			validSize: len(set),
+			expect:    &FormatError{Offset: int64(len(set)), Truncated: true},
+		},
+		{
+			name:      "truncated header",
+			content:   set + "*2\r",
+			validSize: len(set),
+			expect:    &FormatError{Offset: int64(len(set)), Truncated: true},
+		},
+		{
+			name:      "corruption in the middle",
+			content:   set + "*2\r\n$3\r\nDEL\r\n$x\r\nk\r\n" + del,
+			validSize: len(set),
+			expect:    &FormatError{Offset: int64(len(set))},
+		},
+		{
+			name:      "missing crlf",
+			content:   set + "*2\r\n$3\r\nDELxx$1\r\nk\r\n" + del,
+			validSize: len(set),
+			expect:    &FormatError{Offset: int64(len(set))},
+		},
+		{name: "rdb preamble", content: preamble + set, validSize: len(preamble + set)},
+		{
+			name:      "rdb preamble with truncated tail",
+			content:   preamble + set + del[:5],
+			validSize: len(preamble + set),
+			expect:    &FormatError{Offset: int64(len(preamble + set)), Truncated: true},
+		},
+		{
+			name:      "corrupt rdb preamble",
+			content:   preamble[:len(preamble)-12] + set,
+			validSize: 0,
+			expect:    &FormatError{Offset: 0, Preamble: true},
+		},
+	}
+	dir := t.TempDir()
+	for _, c := range cases {
+		filename := filepath.Join(dir, "appendonly.aof")
+		if err := ioutil.WriteFile(filename, []byte(c.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		validSize, err := CheckAof(filename)
+		if validSize != int64(c.validSize) {
+			t.Errorf("%s: expect valid size %d actually %d", c.name, c.validSize, validSize)
+		}
+		if c.expect == nil {
+			if err != nil {
+				t.Errorf("%s: expect valid actually %v", c.name, err)
+			}
+			continue
+		}
+		formatErr, ok := err.(*FormatError)
+		if !ok {
+			t.Errorf("%s: expect format error actually %v", c.name, err)
+			continue
+		}
+		if formatErr.Offset != c.expect.Offset || formatErr.Truncated != c.expect.Truncated ||
+			formatErr.Preamble != c.expect.Preamble {
+			t.Errorf("%s: expect %+v actually %+v", c.name, c.expect, formatErr)
+		}
+	}
+}
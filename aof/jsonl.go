@@ -0,0 +1,250 @@
+package aof
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gedis/config"
+	"gedis/datastruct/dict"
+	List "gedis/datastruct/list"
+	"gedis/datastruct/set"
+	SortedSet "gedis/datastruct/sortedset"
+	"gedis/interface/database"
+	"gedis/lib/utils"
+	"gedis/redis/connection"
+	"gedis/redis/protocol"
+	"io"
+	"strconv"
+	"time"
+)
+
+// JSONRecord JSON Lines格式中的一行，代表一个key
+// []byte类型的字段由encoding/json编码为base64，保证二进制数据可以原样恢复
+type JSONRecord struct {
+	DB   int    `json:"db"`
+	Key  []byte `json:"key"`
+	Type string `json:"type"`
+	// string为base64字符串，list与set为base64字符串数组，hash与zset为对象数组
+	Value json.RawMessage `json:"value"`
+	// 剩余的过期时间，单位毫秒，-1代表没有设置过期时间
+	TTL int64 `json:"ttl"`
+}
+
+type jsonHashField struct {
+	Field []byte `json:"field"`
+	Value []byte `json:"value"`
+}
+
+type jsonZSetMember struct {
+	Member []byte `json:"member"`
+	// 使用字符串保存分数，以便表示inf与-inf
+	Score string `json:"score"`
+}
+
+// EntityToJSONRecord 将一个key转换为JSON记录，空的容器以及无法识别的类型返回nil
+func EntityToJSONRecord(dbIndex int, key string, entity *database.DataEntity, expiration *time.Time) (*JSONRecord, error) {
+	if isEmptyEntity(entity) {
+		return nil, nil
+	}
+	record := &JSONRecord{
+		DB:  dbIndex,
+		Key: []byte(key),
+		TTL: -1,
+	}
+	if expiration != nil {
+		record.TTL = expiration.Sub(time.Now()).Milliseconds()
+		if record.TTL <= 0 {
+			// 已经过期的key不需要导出
+			return nil, nil
+		}
+	}
+	var value interface{}
+	switch val := entity.Data.(type) {
+	case []byte:
+		record.Type = "string"
+		value = val
+	case *List.LinkedList:
+		record.Type = "list"
+		values := make([][]byte, 0, val.Len())
+		val.ForEach(func(i int, v interface{}) bool {
+			bytes, _ := v.([]byte)
+			values = append(values, bytes)
+			return true
+		})
+		value = values
+	case *set.Set:
+		record.Type = "set"
+		members := make([][]byte, 0, val.Len())
+		val.ForEach(func(member string) bool {
+			members = append(members, []byte(member))
+			return true
+		})
+		value = members
+	case dict.Dict:
+		record.Type = "hash"
+		fields := make([]jsonHashField, 0, val.Len())
+		val.ForEach(func(field string, v interface{}) bool {
+			bytes, _ := v.([]byte)
+			fields = append(fields, jsonHashField{Field: []byte(field), Value: bytes})
+			return true
+		})
+		value = fields
+	case *SortedSet.SortedSet:
+		record.Type = "zset"
+		members := make([]jsonZSetMember, 0, val.Len())
+		val.ForEach(int64(0), val.Len(), false, func(element *SortedSet.Element) bool {
+			members = append(members, jsonZSetMember{
+				Member: []byte(element.Member),
+				Score:  strconv.FormatFloat(element.Score, 'f', -1, 64),
+			})
+			return true
+		})
+		value = members
+	}
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	record.Value = raw
+	return record, nil
+}
+
+// ExportJSONL 将db中的数据以每行一个key的格式写入writer，dbIndex小于0时导出所有数据库
+func ExportJSONL(writer io.Writer, db database.DBEngine, dbIndex int) error {
+	bufWriter := bufio.NewWriter(writer)
+	encoder := json.NewEncoder(bufWriter)
+	for i := 0; i < config.Properties.Databases; i++ {
+		if dbIndex >= 0 && i != dbIndex {
+			continue
+		}
+		var err error
+		db.ForEach(i, func(key string, entity *database.DataEntity, expiration *time.Time) bool {
+			var record *JSONRecord
+			record, err = EntityToJSONRecord(i, key, entity, expiration)
+			if err != nil {
+				return false
+			}
+			if record == nil {
+				return true
+			}
+			// Encode会在每个对象之后写入换行符
+			err = encoder.Encode(record)
+			return err == nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return bufWriter.Flush()
+}
+
+// ToCmdLines 将JSON记录转换为重建该key的命令，会先删除已经存在的同名key
+func (record *JSONRecord) ToCmdLines() ([]CmdLine, error) {
+	if len(record.Key) == 0 {
+		return nil, errors.New("empty key")
+	}
+	key := record.Key
+	var create CmdLine
+	switch record.Type {
+	case "string":
+		var value []byte
+		if err := json.Unmarshal(record.Value, &value); err != nil {
+			return nil, err
+		}
+		create = utils.ToCmdLine3("SET", key, value)
+	case "list", "set":
+		var values [][]byte
+		if err := json.Unmarshal(record.Value, &values); err != nil {
+			return nil, err
+		}
+		if len(values) == 0 {
+			return nil, errors.New("empty " + record.Type)
+		}
+		name := "RPUSH"
+		if record.Type == "set" {
+			name = "SADD"
+		}
+		create = utils.ToCmdLine3(name, append([][]byte{key}, values...)...)
+	case "hash":
+		var fields []jsonHashField
+		if err := json.Unmarshal(record.Value, &fields); err != nil {
+			return nil, err
+		}
+		if len(fields) == 0 {
+			return nil, errors.New("empty hash")
+		}
+		create = utils.ToCmdLine3("HMSET", key)
+		for _, f := range fields {
+			create = append(create, f.Field, f.Value)
+		}
+	case "zset":
+		var members []jsonZSetMember
+		if err := json.Unmarshal(record.Value, &members); err != nil {
+			return nil, err
+		}
+		if len(members) == 0 {
+			return nil, errors.New("empty zset")
+		}
+		create = utils.ToCmdLine3("ZADD", key)
+		for _, m := range members {
+			if _, err := strconv.ParseFloat(m.Score, 64); err != nil {
+				return nil, errors.New("invalid score " + m.Score)
+			}
+			create = append(create, []byte(m.Score), m.Member)
+		}
+	default:
+		return nil, errors.New("unknown type " + record.Type)
+	}
+	cmdLines := []CmdLine{utils.ToCmdLine3("DEL", key), create}
+	if record.TTL >= 0 {
+		cmdLines = append(cmdLines, utils.ToCmdLine3("PEXPIRE", key, []byte(strconv.FormatInt(record.TTL, 10))))
+	}
+	return cmdLines, nil
+}
+
+// ImportJSONRecord 解析一行JSON记录，并通过Exec在记录所属的数据库中重建该key
+func ImportJSONRecord(db database.DB, line []byte) error {
+	record := &JSONRecord{}
+	if err := json.Unmarshal(line, record); err != nil {
+		return err
+	}
+	if record.DB < 0 || record.DB >= config.Properties.Databases {
+		return fmt.Errorf("db index %d is out of range", record.DB)
+	}
+	cmdLines, err := record.ToCmdLines()
+	if err != nil {
+		return fmt.Errorf("invalid record of key %q: %v", record.Key, err)
+	}
+	fakeConn := connection.NewFakeConn()
+	fakeConn.SetPassword(config.Properties.RequirePass)
+	fakeConn.SelectDB(record.DB)
+	for _, cmdLine := range cmdLines {
+		ret := db.Exec(fakeConn, cmdLine)
+		if protocol.IsErrorReply(ret) {
+			return fmt.Errorf("restore key %q failed: %s", record.Key, string(ret.ToBytes()))
+		}
+	}
+	return nil
+}
+
+// ImportJSONL 逐行导入JSON记录，返回成功导入的key的数量，遇到错误时停止并返回出错的行号
+func ImportJSONL(reader io.Reader, db database.DB) (int, error) {
+	scanner := bufio.NewScanner(reader)
+	// 单个key可能很大，放宽单行长度的限制
+	scanner.Buffer(make([]byte, 0, 64*1024), 512*1024*1024)
+	count := 0
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		if err := ImportJSONRecord(db, line); err != nil {
+			return count, fmt.Errorf("line %d: %v", lineNo, err)
+		}
+		count++
+	}
+	return count, scanner.Err()
+}
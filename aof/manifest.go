@@ -0,0 +1,253 @@
+package aof
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// segmentTypeBase 重写生成的快照段
+	segmentTypeBase = "b"
+	// segmentTypeIncr 追加写命令的增量段
+	segmentTypeIncr = "i"
+)
+
+// Segment 分段aof中的一个文件
+type Segment struct {
+	File string
+	Seq  int64
+	Type string
+	// 段的起始时间，unix毫秒。快照段为开始重写的时间，增量段为创建的时间
+	Start int64
+}
+
+// IsBase 是否为重写生成的快照段
+func (seg *Segment) IsBase() bool {
+	return seg.Type == segmentTypeBase
+}
+
+// Manifest 记录分段aof中所有的文件，按照写入顺序排列
+// 最后一个快照段以及之后的增量段用于启动时恢复数据，之前的文件作为历史保留，用于按时间点恢复
+type Manifest struct {
+	dir      string
+	filename string
+	segments []*Segment
+	nextSeq  int64
+}
+
+// ManifestPath 返回分段aof的manifest文件路径
+func ManifestPath(dir, aofFilename string) string {
+	return filepath.Join(dir, aofFilename+".manifest")
+}
+
+// LoadManifest 读取manifest文件，每一行格式为 file <name> seq <n> type <b|i> start <ms>
+func LoadManifest(path string) (*Manifest, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	manifest := &Manifest{
+		dir:      filepath.Dir(path),
+		filename: strings.TrimSuffix(filepath.Base(path), ".manifest"),
+		nextSeq:  1,
+	}
+	scanner := bufio.NewScanner(file)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		seg, err := parseSegment(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid manifest %s line %d: %v", path, lineNo, err)
+		}
+		manifest.segments = append(manifest.segments, seg)
+		if seg.Seq >= manifest.nextSeq {
+			manifest.nextSeq = seg.Seq + 1
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+func parseSegment(line string) (*Segment, error) {
+	fields := strings.Fields(line)
+	if len(fields)%2 != 0 {
+		return nil, errors.New("odd number of fields")
+	}
+	seg := &Segment{}
+	var err error
+	for i := 0; i < len(fields); i += 2 {
+		value := fields[i+1]
+		switch fields[i] {
+		case "file":
+			seg.File = value
+		case "seq":
+			seg.Seq, err = strconv.ParseInt(value, 10, 64)
+		case "type":
+			if value != segmentTypeBase && value != segmentTypeIncr {
+				return nil, errors.New("unknown segment type " + value)
+			}
+			seg.Type = value
+		case "start":
+			seg.Start, err = strconv.ParseInt(value, 10, 64)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %s", fields[i], value)
+		}
+	}
+	if seg.File == "" || seg.Type == "" {
+		return nil, errors.New("missing file or type")
+	}
+	return seg, nil
+}
+
+// Segments 返回所有的段
+func (manifest *Manifest) Segments() []*Segment {
+	return manifest.segments
+}
+
+// Path 返回段文件的完整路径
+func (manifest *Manifest) Path(seg *Segment) string {
+	return filepath.Join(manifest.dir, seg.File)
+}
+
+// newSegment 分配一个新的段，并不会加入manifest
+func (manifest *Manifest) newSegment(segType string, start int64) *Segment {
+	seq := manifest.nextSeq
+	manifest.nextSeq++
+	kind := "incr"
+	if segType == segmentTypeBase {
+		kind = "base"
+	}
+	return &Segment{
+		File:  fmt.Sprintf("%s.%d.%s.aof", manifest.filename, seq, kind),
+		Seq:   seq,
+		Type:  segType,
+		Start: start,
+	}
+}
+
+// active 返回正在追加的增量段
+func (manifest *Manifest) active() *Segment {
+	if len(manifest.segments) == 0 {
+		return nil
+	}
+	return manifest.segments[len(manifest.segments)-1]
+}
+
+// lastBaseIndex 返回最后一个快照段的位置，没有快照段时返回-1
+func (manifest *Manifest) lastBaseIndex() int {
+	for i := len(manifest.segments) - 1; i >= 0; i-- {
+		if manifest.segments[i].IsBase() {
+			return i
+		}
+	}
+	return -1
+}
+
+// loadSegments 返回启动时需要加载的段：最后一个快照段以及之后的增量段
+func (manifest *Manifest) loadSegments() []*Segment {
+	start := manifest.lastBaseIndex()
+	if start < 0 {
+		start = 0
+	}
+	result := make([]*Segment, len(manifest.segments)-start)
+	copy(result, manifest.segments[start:])
+	return result
+}
+
+// RestoreChain 返回恢复到untilMs时需要按顺序重放的段
+// 选择起始时间不晚于untilMs的最后一个快照段，然后依次重放之后所有的增量段
+func (manifest *Manifest) RestoreChain(untilMs int64) ([]*Segment, error) {
+	start := -1
+	for i, seg := range manifest.segments {
+		if seg.IsBase() && seg.Start <= untilMs {
+			start = i
+		}
+	}
+	if start < 0 {
+		// 最早的历史从空数据库开始，没有快照段也可以恢复
+		if len(manifest.segments) == 0 || manifest.segments[0].IsBase() {
+			return nil, errors.New("no snapshot early enough in the aof history")
+		}
+		start = 0
+	}
+	chain := []*Segment{manifest.segments[start]}
+	for _, seg := range manifest.segments[start+1:] {
+		if !seg.IsBase() {
+			chain = append(chain, seg)
+		}
+	}
+	return chain, nil
+}
+
+// insertBefore 将seg插入到序号为seq的段之前
+func (manifest *Manifest) insertBefore(seg *Segment, seq int64) {
+	for i, s := range manifest.segments {
+		if s.Seq == seq {
+			segments := make([]*Segment, 0, len(manifest.segments)+1)
+			segments = append(segments, manifest.segments[:i]...)
+			segments = append(segments, seg)
+			segments = append(segments, manifest.segments[i:]...)
+			manifest.segments = segments
+			return
+		}
+	}
+	manifest.segments = append(manifest.segments, seg)
+}
+
+// purgeHistory 只保留最近keep代历史，返回被移除的段
+// 每一代从一个快照段开始，包括之后直到下一个快照段的增量段，第一个快照段之前的增量段同样算作一代
+func (manifest *Manifest) purgeHistory(keep int) []*Segment {
+	var starts []int
+	for i, seg := range manifest.segments {
+		if i == 0 || seg.IsBase() {
+			starts = append(starts, i)
+		}
+	}
+	// 最后一代是当前正在使用的数据，不属于历史
+	history := len(starts) - 1
+	if history <= keep {
+		return nil
+	}
+	cut := starts[history-keep]
+	removed := manifest.segments[:cut]
+	manifest.segments = manifest.segments[cut:]
+	return removed
+}
+
+// save 先写临时文件再rename，保证manifest始终完整
+func (manifest *Manifest) save() error {
+	var builder strings.Builder
+	for _, seg := range manifest.segments {
+		builder.WriteString(fmt.Sprintf("file %s seq %d type %s start %d\n", seg.File, seg.Seq, seg.Type, seg.Start))
+	}
+	tmp, err := ioutil.TempFile(manifest.dir, "*.manifest.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.WriteString(builder.String())
+	if err == nil {
+		err = tmp.Sync()
+	}
+	_ = tmp.Close()
+	if err == nil {
+		err = os.Rename(tmp.Name(), ManifestPath(manifest.dir, manifest.filename))
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+	}
+	return err
+}
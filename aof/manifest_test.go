@@ -0,0 +1,123 @@
+package aof
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeManifest(t *testing.T, dir string, content string) string {
+	path := ManifestPath(dir, "appendonly.aof")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadManifest(t *testing.T) {
+	dir := t.TempDir()
+	path := writeManifest(t, dir, "# comment\n"+
+		"file appendonly.aof.1.base.aof seq 1 type b start 1000\n"+
+		"\n"+
+		"  file appendonly.aof.3.incr.aof seq 3 type i start 2000  \n"+
+		"file appendonly.aof.2.incr.aof type i seq 2\n")
+	manifest, err := LoadManifest(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []*Segment{
+		{File: "appendonly.aof.1.base.aof", Seq: 1, Type: segmentTypeBase, Start: 1000},
+		{File: "appendonly.aof.3.incr.aof", Seq: 3, Type: segmentTypeIncr, Start: 2000},
+		{File: "appendonly.aof.2.incr.aof", Seq: 2, Type: segmentTypeIncr},
+	}
+	if !reflect.DeepEqual(manifest.Segments(), expect) {
+		t.Errorf("expect %+v actually %+v", expect, manifest.Segments())
+	}
+	if manifest.Path(expect[0]) != filepath.Join(dir, "appendonly.aof.1.base.aof") {
+		t.Errorf("unexpected segment path %s", manifest.Path(expect[0]))
+	}
+	// 新的段在最大的序号之后分配
+	if seg := manifest.newSegment(segmentTypeIncr, 0); seg.Seq != 4 || seg.File != "appendonly.aof.4.incr.aof" {
+		t.Errorf("expect seq 4 actually %+v", seg)
+	}
+
+	// 保存之后重新读取得到相同的内容
+	if err := manifest.save(); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadManifest(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded.Segments(), expect) {
+		t.Errorf("expect %+v actually %+v", expect, loaded.Segments())
+	}
+}
+
+func TestLoadInvalidManifest(t *testing.T) {
+	invalid := map[string]string{
+		"odd fields":    "file a.aof seq 1 type\n",
+		"unknown type":  "file a.aof seq 1 type x\n",
+		"invalid seq":   "file a.aof seq x type b\n",
+		"invalid start": "file a.aof seq 1 type b start x\n",
+		"missing file":  "seq 1 type b\n",
+		"missing type":  "file a.aof seq 1\n",
+	}
+	dir := t.TempDir()
+	for name, content := range invalid {
+		if _, err := LoadManifest(writeManifest(t, dir, content)); err == nil {
+			t.Errorf("%s: expect error", name)
+		}
+	}
+	if _, err := LoadManifest(filepath.Join(dir, "missing.manifest")); err == nil {
+		t.Error("expect error for missing manifest")
+	}
+}
+
+func TestRestoreChain(t *testing.T) {
+	base := func(seq, start int64) *Segment {
+		return &Segment{Seq: seq, Type: segmentTypeBase, Start: start}
+	}
+	incr := func(seq, start int64) *Segment {
+		return &Segment{Seq: seq, Type: segmentTypeIncr, Start: start}
+	}
+	// 1号增量段在第一次重写之前创建，2号快照段在1000开始重写
+	history := []*Segment{incr(1, 0), base(2, 1000), incr(3, 1000), incr(4, 2000), base(5, 3000), incr(6, 3000)}
+	cases := []struct {
+		name     string
+		segments []*Segment
+		untilMs  int64
+		// 为nil时代表无法恢复
+		expect []int64
+	}{
+		{name: "before first snapshot", segments: history, untilMs: 500, expect: []int64{1, 3, 4, 6}},
+		{name: "first snapshot", segments: history, untilMs: 1000, expect: []int64{2, 3, 4, 6}},
+		{name: "between snapshots", segments: history, untilMs: 2500, expect: []int64{2, 3, 4, 6}},
+		{name: "latest snapshot", segments: history, untilMs: 5000, expect: []int64{5, 6}},
+		{name: "only increments", segments: []*Segment{incr(1, 0), incr(2, 100)}, untilMs: 50, expect: []int64{1, 2}},
+		{name: "too early", segments: []*Segment{base(1, 1000), incr(2, 1000)}, untilMs: 500},
+		{name: "empty", untilMs: 500},
+	}
+	for _, c := range cases {
+		manifest := &Manifest{segments: c.segments}
+		chain, err := manifest.RestoreChain(c.untilMs)
+		if c.expect == nil {
+			if err == nil {
+				t.Errorf("%s: expect error actually %+v", c.name, chain)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		seqs := make([]int64, len(chain))
+		for i, seg := range chain {
+			seqs[i] = seg.Seq
+		}
+		if !reflect.DeepEqual(seqs, c.expect) {
+			t.Errorf("%s: expect %v actually %v", c.name, c.expect, seqs)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package aof
+
+import (
+	"gedis/datastruct/dict"
+	List "gedis/datastruct/list"
+	"gedis/datastruct/set"
+	SortedSet "gedis/datastruct/sortedset"
+	"gedis/interface/database"
+	"gedis/redis/protocol"
+	"strconv"
+	"time"
+)
+
+// EntityToCmd 将一个DataEntity序列化为可以重建它的命令，空的容器类型返回nil
+func EntityToCmd(key string, entity *database.DataEntity) *protocol.MultiBulkReply {
+	if entity == nil {
+		return nil
+	}
+	var cmd *protocol.MultiBulkReply
+	switch val := entity.Data.(type) {
+	case []byte:
+		cmd = stringToCmd(key, val)
+	case *List.LinkedList:
+		cmd = listToCmd(key, val)
+	case *set.Set:
+		cmd = setToCmd(key, val)
+	case dict.Dict:
+		cmd = hashToCmd(key, val)
+	case *SortedSet.SortedSet:
+		cmd = zSetToCmd(key, val)
+	}
+	return cmd
+}
+
+var setCmd = []byte("SET")
+
+func stringToCmd(key string, bytes []byte) *protocol.MultiBulkReply {
+	args := make([][]byte, 3)
+	args[0] = setCmd
+	args[1] = []byte(key)
+	args[2] = bytes
+	return protocol.MakeMultiBulkReply(args)
+}
+
+var rPushAllCmd = []byte("RPUSH")
+
+func listToCmd(key string, list *List.LinkedList) *protocol.MultiBulkReply {
+	if list.Len() == 0 {
+		return nil
+	}
+	args := make([][]byte, 2+list.Len())
+	args[0] = rPushAllCmd
+	args[1] = []byte(key)
+	list.ForEach(func(i int, val interface{}) bool {
+		bytes, _ := val.([]byte)
+		args[2+i] = bytes
+		return true
+	})
+	return protocol.MakeMultiBulkReply(args)
+}
+
+var sAddCmd = []byte("SADD")
+
+func setToCmd(key string, set *set.Set) *protocol.MultiBulkReply {
+	if set.Len() == 0 {
+		return nil
+	}
+	args := make([][]byte, 2, 2+set.Len())
+	args[0] = sAddCmd
+	args[1] = []byte(key)
+	set.ForEach(func(member string) bool {
+		args = append(args, []byte(member))
+		return true
+	})
+	return protocol.MakeMultiBulkReply(args)
+}
+
+var hMSetCmd = []byte("HMSET")
+
+func hashToCmd(key string, hash dict.Dict) *protocol.MultiBulkReply {
+	if hash.Len() == 0 {
+		return nil
+	}
+	args := make([][]byte, 2, 2+hash.Len()*2)
+	args[0] = hMSetCmd
+	args[1] = []byte(key)
+	hash.ForEach(func(field string, val interface{}) bool {
+		bytes, _ := val.([]byte)
+		args = append(args, []byte(field), bytes)
+		return true
+	})
+	return protocol.MakeMultiBulkReply(args)
+}
+
+var zAddCmd = []byte("ZADD")
+
+func zSetToCmd(key string, zset *SortedSet.SortedSet) *protocol.MultiBulkReply {
+	if zset.Len() == 0 {
+		return nil
+	}
+	args := make([][]byte, 2, 2+zset.Len()*2)
+	args[0] = zAddCmd
+	args[1] = []byte(key)
+	zset.ForEach(int64(0), zset.Len(), false, func(element *SortedSet.Element) bool {
+		value := strconv.FormatFloat(element.Score, 'f', -1, 64)
+		args = append(args, []byte(value), []byte(element.Member))
+		return true
+	})
+	return protocol.MakeMultiBulkReply(args)
+}
+
+var pExpireAtBytes = []byte("PEXPIREAT")
+
+// MakeExpireCmd 生成一条设置过期时间的PEXPIREAT命令
+func MakeExpireCmd(key string, expireAt time.Time) *protocol.MultiBulkReply {
+	args := make([][]byte, 3)
+	args[0] = pExpireAtBytes
+	args[1] = []byte(key)
+	args[2] = []byte(strconv.FormatInt(expireAt.UnixNano()/1e6, 10))
+	return protocol.MakeMultiBulkReply(args)
+}
@@ -0,0 +1,167 @@
+package aof
+
+import (
+	"gedis/config"
+	"gedis/datastruct/dict"
+	List "gedis/datastruct/list"
+	"gedis/datastruct/set"
+	SortedSet "gedis/datastruct/sortedset"
+	"gedis/interface/database"
+	"github.com/hdt3213/rdb/encoder"
+	"github.com/hdt3213/rdb/model"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// rdbRedisVersion 写入rdb辅助字段的redis版本，标准工具依赖该字段判断文件格式
+const rdbRedisVersion = "6.0.0"
+
+// SaveRDB 将db中的数据写入rdb文件，先写临时文件再rename，保证文件完整
+func SaveRDB(filename string, db database.DBEngine) error {
+	file, err := ioutil.TempFile(filepath.Dir(filename), "*.rdb")
+	if err != nil {
+		return err
+	}
+	err = WriteRDB(file, db)
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		_ = file.Close()
+		_ = os.Remove(file.Name())
+		return err
+	}
+	_ = file.Close()
+	if err = os.Rename(file.Name(), filename); err != nil {
+		_ = os.Remove(file.Name())
+		return err
+	}
+	return nil
+}
+
+// WriteRDB 将db中的所有数据按照rdb格式写入writer，已经过期的key会被跳过
+func WriteRDB(writer io.Writer, db database.DBEngine) error {
+	return writeRDB(writer, db, false)
+}
+
+// writeRDB preamble为true时代表写入的是aof文件的rdb前言
+func writeRDB(writer io.Writer, db database.DBEngine, preamble bool) error {
+	enc := encoder.NewEncoder(writer).EnableCompress()
+	if err := enc.WriteHeader(); err != nil {
+		return err
+	}
+	auxMap := map[string]string{
+		"redis-ver":    rdbRedisVersion,
+		"redis-bits":   "64",
+		"ctime":        strconv.FormatInt(time.Now().Unix(), 10),
+		"aof-preamble": "0",
+	}
+	if preamble {
+		auxMap["aof-preamble"] = "1"
+	}
+	for k, v := range auxMap {
+		if err := enc.WriteAux(k, v); err != nil {
+			return err
+		}
+	}
+	now := time.Now()
+	for i := 0; i < config.Properties.Databases; i++ {
+		keyCount, ttlCount := db.GetDBSize(i)
+		if keyCount == 0 {
+			continue
+		}
+		// rdb不允许空的数据库，写入第一个key之前再写入数据库头
+		headerWritten := false
+		var err error
+		db.ForEach(i, func(key string, entity *database.DataEntity, expiration *time.Time) bool {
+			if expiration != nil && expiration.Before(now) {
+				return true
+			}
+			if isEmptyEntity(entity) {
+				return true
+			}
+			if !headerWritten {
+				err = enc.WriteDBHeader(uint(i), uint64(keyCount), uint64(ttlCount))
+				if err != nil {
+					return false
+				}
+				headerWritten = true
+			}
+			var opts []interface{}
+			if expiration != nil {
+				opts = append(opts, encoder.WithTTL(uint64(expiration.UnixNano()/1e6)))
+			}
+			err = writeRDBObject(enc, key, entity, opts)
+			return err == nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return enc.WriteEnd()
+}
+
+func writeRDBObject(enc *encoder.Encoder, key string, entity *database.DataEntity, opts []interface{}) error {
+	switch val := entity.Data.(type) {
+	case []byte:
+		return enc.WriteStringObject(key, val, opts...)
+	case *List.LinkedList:
+		values := make([][]byte, 0, val.Len())
+		val.ForEach(func(i int, v interface{}) bool {
+			bytes, _ := v.([]byte)
+			values = append(values, bytes)
+			return true
+		})
+		return enc.WriteListObject(key, values, opts...)
+	case *set.Set:
+		members := make([][]byte, 0, val.Len())
+		val.ForEach(func(member string) bool {
+			members = append(members, []byte(member))
+			return true
+		})
+		return enc.WriteSetObject(key, members, opts...)
+	case dict.Dict:
+		hash := make(map[string][]byte, val.Len())
+		val.ForEach(func(field string, v interface{}) bool {
+			bytes, _ := v.([]byte)
+			hash[field] = bytes
+			return true
+		})
+		return enc.WriteHashMapObject(key, hash, opts...)
+	case *SortedSet.SortedSet:
+		entries := make([]*model.ZSetEntry, 0, val.Len())
+		val.ForEach(int64(0), val.Len(), false, func(element *SortedSet.Element) bool {
+			entries = append(entries, &model.ZSetEntry{
+				Member: element.Member,
+				Score:  element.Score,
+			})
+			return true
+		})
+		return enc.WriteZSetObject(key, entries, opts...)
+	}
+	return nil
+}
+
+// isEmptyEntity 空的容器以及无法识别的类型不写入rdb
+func isEmptyEntity(entity *database.DataEntity) bool {
+	if entity == nil {
+		return true
+	}
+	switch val := entity.Data.(type) {
+	case []byte:
+		return false
+	case *List.LinkedList:
+		return val.Len() == 0
+	case *set.Set:
+		return val.Len() == 0
+	case dict.Dict:
+		return val.Len() == 0
+	case *SortedSet.SortedSet:
+		return val.Len() == 0
+	}
+	return true
+}
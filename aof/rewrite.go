@@ -0,0 +1,356 @@
+package aof
+
+import (
+	"errors"
+	"gedis/config"
+	"gedis/interface/database"
+	"gedis/lib/logger"
+	"gedis/lib/utils"
+	"gedis/redis/protocol"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// ErrRewriteInProgress 已经有一个重写任务在执行
+var ErrRewriteInProgress = errors.New("ERR Background append only file rewriting already in progress")
+
+// RewriteCtx 记录开始重写时aof文件的状态
+type RewriteCtx struct {
+	tmpFile *os.File
+	// 开始重写时aof文件的大小，只有这部分数据会被加载到临时数据库中
+	fileSize int64
+	// 临时文件中最后一次select的数据库
+	lastDB int
+
+	// 分段aof需要压缩的文件，为空时代表使用单文件aof
+	files []string
+	// 开始重写时新建的增量段，新的快照段插入到它之前
+	incrSeq int64
+	// 开始重写的时间，unix毫秒
+	startMs int64
+	// 不为空时直接写入其中的数据，不再重放重写开始时的aof
+	snapshot database.DBEngine
+}
+
+// Rewrite 压缩aof文件，重写期间可以正常写入
+func (persister *Persister) Rewrite() error {
+	if !persister.rewriting.CompareAndSet(false, true) {
+		return ErrRewriteInProgress
+	}
+	defer persister.rewriting.Set(false)
+
+	ctx, err := persister.StartRewrite()
+	if err != nil {
+		return err
+	}
+	err = persister.DoRewrite(ctx)
+	if err != nil {
+		persister.abortRewrite(ctx)
+		return err
+	}
+	return persister.FinishRewrite(ctx)
+}
+
+// RewriteFrom 以db中当前的数据替换aof，例如从节点全量同步之后
+// 调用方需要保证期间db中的数据不会被修改，正在进行的重写完成之后才会开始
+func (persister *Persister) RewriteFrom(db database.DBEngine) error {
+	for !persister.rewriting.CompareAndSet(false, true) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	defer persister.rewriting.Set(false)
+
+	// 之前的命令不能出现在快照之后
+	persister.waitWritten()
+	ctx, err := persister.StartRewrite()
+	if err != nil {
+		return err
+	}
+	ctx.snapshot = db
+	err = persister.DoRewrite(ctx)
+	if err != nil {
+		persister.abortRewrite(ctx)
+		return err
+	}
+	return persister.FinishRewrite(ctx)
+}
+
+// IsRewriting 返回是否正在重写
+func (persister *Persister) IsRewriting() bool {
+	return persister.rewriting.Get()
+}
+
+// StartRewrite 暂停aof写入，记录当前aof文件的大小，并开始缓存之后的写命令
+func (persister *Persister) StartRewrite() (*RewriteCtx, error) {
+	persister.pausingAof.Lock()
+	defer persister.pausingAof.Unlock()
+
+	err := persister.aofFile.Sync()
+	if err != nil {
+		logger.Warn("fsync failed")
+		return nil, err
+	}
+	if persister.manifest != nil {
+		return persister.startSegmentRewrite()
+	}
+	fileInfo, err := os.Stat(persister.aofFilename)
+	if err != nil {
+		return nil, err
+	}
+	// 临时文件与aof文件位于同一目录，保证之后可以原子地rename
+	file, err := ioutil.TempFile(filepath.Dir(persister.aofFilename), "*.aof")
+	if err != nil {
+		logger.Warn("tmp file create failed")
+		return nil, err
+	}
+	persister.rewriteBuffer = make([]*payload, 0)
+	// 重写开始之后的第一条命令之前重新写入标记，新文件中缓存的命令都在标记之后
+	persister.lastMarkMs = 0
+	return &RewriteCtx{
+		tmpFile:  file,
+		fileSize: fileInfo.Size(),
+	}, nil
+}
+
+// DoRewrite 将重写开始时的aof加载到临时数据库中，再将临时数据库中的数据转换为命令写入临时文件
+// ctx中有快照时直接写入快照中的数据
+// 开启aof-use-rdb-preamble时以rdb格式写入临时文件
+func (persister *Persister) DoRewrite(ctx *RewriteCtx) error {
+	tmpFile := ctx.tmpFile
+	tmpDB := ctx.snapshot
+	if tmpDB == nil {
+		tmpDB = persister.tmpDBMaker()
+		if err := persister.loadRewriteFiles(ctx, tmpDB); err != nil {
+			return err
+		}
+	}
+
+	if config.Properties.AofUseRdbPreamble {
+		// 加载rdb前言之后处于0号数据库，之后追加的命令从0号数据库开始
+		ctx.lastDB = 0
+		return writeRDB(tmpFile, tmpDB, true)
+	}
+	for i := 0; i < config.Properties.Databases; i++ {
+		selected := false
+		var err error
+		tmpDB.ForEach(i, func(key string, entity *database.DataEntity, expiration *time.Time) bool {
+			cmd := EntityToCmd(key, entity)
+			if cmd == nil {
+				return true
+			}
+			// 只为非空的数据库写入select
+			if !selected {
+				selectCmd := utils.ToCmdLine("SELECT", strconv.Itoa(i))
+				if _, err = tmpFile.Write(protocol.MakeMultiBulkReply(selectCmd).ToBytes()); err != nil {
+					return false
+				}
+				selected = true
+			}
+			if _, err = tmpFile.Write(cmd.ToBytes()); err != nil {
+				return false
+			}
+			if expiration != nil {
+				if _, err = tmpFile.Write(MakeExpireCmd(key, *expiration).ToBytes()); err != nil {
+					return false
+				}
+			}
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		if selected {
+			ctx.lastDB = i
+		}
+	}
+	return nil
+}
+
+// loadRewriteFiles 将重写开始时的aof重放到tmpDB中
+func (persister *Persister) loadRewriteFiles(ctx *RewriteCtx, tmpDB database.DBEngine) error {
+	if ctx.files != nil {
+		for _, filename := range ctx.files {
+			if _, _, err := ReplayFile(tmpDB, filename, 0, 0); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		return nil
+	}
+	if ctx.fileSize > 0 {
+		if _, _, err := ReplayFile(tmpDB, persister.aofFilename, int(ctx.fileSize), 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FinishRewrite 将重写期间缓存的命令写入临时文件，然后用临时文件替换aof文件
+func (persister *Persister) FinishRewrite(ctx *RewriteCtx) error {
+	persister.pausingAof.Lock()
+	defer persister.pausingAof.Unlock()
+	defer func() {
+		persister.rewriteBuffer = nil
+	}()
+	if persister.manifest != nil {
+		return persister.finishSegmentRewrite(ctx)
+	}
+
+	tmpFile := ctx.tmpFile
+	currentDB := ctx.lastDB
+	for _, p := range persister.rewriteBuffer {
+		if !p.mark && p.dbIndex != currentDB {
+			selectCmd := utils.ToCmdLine("SELECT", strconv.Itoa(p.dbIndex))
+			if _, err := tmpFile.Write(protocol.MakeMultiBulkReply(selectCmd).ToBytes()); err != nil {
+				persister.removeTmpFile(ctx)
+				return err
+			}
+			currentDB = p.dbIndex
+		}
+		if _, err := tmpFile.Write(protocol.MakeMultiBulkReply(p.cmdLine).ToBytes()); err != nil {
+			persister.removeTmpFile(ctx)
+			return err
+		}
+	}
+	if err := tmpFile.Sync(); err != nil {
+		persister.removeTmpFile(ctx)
+		return err
+	}
+	_ = tmpFile.Close()
+
+	// rename是原子操作，替换之后重新打开aof文件继续追加
+	_ = persister.aofFile.Close()
+	renameErr := os.Rename(tmpFile.Name(), persister.aofFilename)
+	if renameErr != nil {
+		// 重写期间的命令已经写入了原aof文件，继续使用原文件即可
+		_ = os.Remove(tmpFile.Name())
+	}
+	aofFile, err := os.OpenFile(persister.aofFilename, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		panic(err)
+	}
+	persister.aofFile = aofFile
+	if renameErr != nil {
+		return renameErr
+	}
+	persister.currentDB = currentDB
+	// 新文件中的下一条命令之前重新写入时间戳标记
+	persister.lastMarkMs = 0
+	if info, err := aofFile.Stat(); err == nil {
+		persister.baseSize = info.Size()
+		persister.aofSize = info.Size()
+	}
+	return nil
+}
+
+// abortRewrite 放弃本次重写，停止缓存写命令
+func (persister *Persister) abortRewrite(ctx *RewriteCtx) {
+	persister.pausingAof.Lock()
+	persister.rewriteBuffer = nil
+	persister.pausingAof.Unlock()
+	persister.removeTmpFile(ctx)
+}
+
+func (persister *Persister) removeTmpFile(ctx *RewriteCtx) {
+	_ = ctx.tmpFile.Close()
+	_ = os.Remove(ctx.tmpFile.Name())
+}
+
+// EnableAutoRewrite 当aof文件大于minSize，且相比上次重写之后增长超过percentage%时自动重写
+func (persister *Persister) EnableAutoRewrite(percentage int, minSize int64) {
+	if percentage <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Second)
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				if persister.needRewrite(percentage, minSize) {
+					logger.Info("starting automatic rewriting of AOF")
+					if err := persister.Rewrite(); err != nil && err != ErrRewriteInProgress {
+						logger.Error("aof rewrite failed: " + err.Error())
+					}
+				}
+			case <-persister.ctx.Done():
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+func (persister *Persister) needRewrite(percentage int, minSize int64) bool {
+	if persister.rewriting.Get() {
+		return false
+	}
+	persister.pausingAof.Lock()
+	size := persister.aofTotalSize()
+	base := persister.baseSize
+	persister.pausingAof.Unlock()
+	if size < minSize {
+		return false
+	}
+	if base <= 0 {
+		base = 1
+	}
+	growth := (size - base) * 100 / base
+	return growth >= int64(percentage)
+}
+
+// startSegmentRewrite 切换到新的增量段，之前的快照段和增量段将被压缩为新的快照段
+// 重写期间的写命令进入新的增量段，不需要缓存，调用方需要持有pausingAof
+func (persister *Persister) startSegmentRewrite() (*RewriteCtx, error) {
+	manifest := persister.manifest
+	var files []string
+	for _, seg := range manifest.loadSegments() {
+		files = append(files, manifest.Path(seg))
+	}
+	seg, err := persister.rotate()
+	if err != nil {
+		return nil, err
+	}
+	file, err := ioutil.TempFile(manifest.dir, "*.aof.tmp")
+	if err != nil {
+		logger.Warn("tmp file create failed")
+		return nil, err
+	}
+	return &RewriteCtx{
+		tmpFile: file,
+		files:   files,
+		incrSeq: seg.Seq,
+		startMs: seg.Start,
+	}, nil
+}
+
+// finishSegmentRewrite 将临时文件作为新的快照段加入manifest，并清理超出保留代数的历史
+func (persister *Persister) finishSegmentRewrite(ctx *RewriteCtx) error {
+	manifest := persister.manifest
+	tmpFile := ctx.tmpFile
+	if err := tmpFile.Sync(); err != nil {
+		persister.removeTmpFile(ctx)
+		return err
+	}
+	_ = tmpFile.Close()
+	base := manifest.newSegment(segmentTypeBase, ctx.startMs)
+	if err := os.Rename(tmpFile.Name(), manifest.Path(base)); err != nil {
+		_ = os.Remove(tmpFile.Name())
+		return err
+	}
+	segments := manifest.segments
+	manifest.insertBefore(base, ctx.incrSeq)
+	removed := manifest.purgeHistory(config.Properties.AofPitrHistory)
+	if err := manifest.save(); err != nil {
+		manifest.segments = segments
+		_ = os.Remove(manifest.Path(base))
+		return err
+	}
+	for _, seg := range removed {
+		if err := os.Remove(manifest.Path(seg)); err != nil && !os.IsNotExist(err) {
+			logger.Warn(err)
+		}
+	}
+	persister.baseSize = persister.aofTotalSize()
+	return nil
+}
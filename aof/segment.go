@@ -0,0 +1,145 @@
+package aof
+
+import (
+	"gedis/lib/logger"
+	"gedis/lib/utils"
+	"gedis/redis/protocol"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// TimestampCmd 时间戳标记命令，参数为unix毫秒，重放时不会执行
+	TimestampCmd = "TSMARK"
+	// timestampInterval 两次时间戳标记之间的最小间隔，按时间点恢复的精度与之相同
+	timestampInterval = 1000
+)
+
+func nowMs() int64 {
+	return time.Now().UnixNano() / 1e6
+}
+
+// writeTimestamp 距离上一次标记超过timestampInterval时，在命令之前写入一条时间戳标记
+// 两个标记之间的命令都在前一个标记之后的timestampInterval毫秒内执行
+func (persister *Persister) writeTimestamp() {
+	if !persister.timestamp {
+		return
+	}
+	now := nowMs()
+	if now-persister.lastMarkMs < timestampInterval {
+		return
+	}
+	cmdLine := utils.ToCmdLine(TimestampCmd, strconv.FormatInt(now, 10))
+	if err := persister.write(protocol.MakeMultiBulkReply(cmdLine).ToBytes()); err != nil {
+		logger.Warn(err)
+		return
+	}
+	persister.lastMarkMs = now
+	// 与命令一起缓存，重写之后的文件中命令之前同样有标记
+	if persister.rewriteBuffer != nil {
+		persister.rewriteBuffer = append(persister.rewriteBuffer, &payload{cmdLine: cmdLine, mark: true})
+	}
+}
+
+// parseTimestamp 判断命令是否为时间戳标记，并返回标记的时间
+func parseTimestamp(cmdLine CmdLine) (int64, bool) {
+	if len(cmdLine) != 2 || !strings.EqualFold(string(cmdLine[0]), TimestampCmd) {
+		return 0, false
+	}
+	ts, err := strconv.ParseInt(string(cmdLine[1]), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return ts, true
+}
+
+// openManifest 打开分段aof目录，之前使用单文件aof时将其作为第一个快照段
+// 完成之后aofFilename指向正在追加的增量段
+func (persister *Persister) openManifest(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	filename := filepath.Base(persister.aofFilename)
+	path := ManifestPath(dir, filename)
+	manifest, err := LoadManifest(path)
+	if os.IsNotExist(err) {
+		manifest = &Manifest{
+			dir:      dir,
+			filename: filename,
+			nextSeq:  1,
+		}
+		if info, statErr := os.Stat(persister.aofFilename); statErr == nil && info.Size() > 0 {
+			base := manifest.newSegment(segmentTypeBase, info.ModTime().UnixNano()/1e6)
+			if err := os.Rename(persister.aofFilename, manifest.Path(base)); err != nil {
+				return err
+			}
+			manifest.segments = append(manifest.segments, base)
+			if err := manifest.save(); err != nil {
+				_ = os.Rename(manifest.Path(base), persister.aofFilename)
+				return err
+			}
+			logger.Info("moved " + persister.aofFilename + " into " + manifest.Path(base))
+		}
+	} else if err != nil {
+		return err
+	}
+	// 始终以一个增量段结尾，新的写命令追加到增量段中
+	if active := manifest.active(); active == nil || active.IsBase() {
+		manifest.segments = append(manifest.segments, manifest.newSegment(segmentTypeIncr, nowMs()))
+		if err := manifest.save(); err != nil {
+			return err
+		}
+	}
+	persister.manifest = manifest
+	persister.aofFilename = manifest.Path(manifest.active())
+	return nil
+}
+
+// rotate 结束当前的增量段并切换到新的增量段，调用方需要持有pausingAof
+func (persister *Persister) rotate() (*Segment, error) {
+	manifest := persister.manifest
+	seg := manifest.newSegment(segmentTypeIncr, nowMs())
+	file, err := os.OpenFile(manifest.Path(seg), os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	manifest.segments = append(manifest.segments, seg)
+	if err := manifest.save(); err != nil {
+		manifest.segments = manifest.segments[:len(manifest.segments)-1]
+		_ = file.Close()
+		_ = os.Remove(file.Name())
+		return nil, err
+	}
+	if err := persister.aofFile.Sync(); err != nil {
+		logger.Warn(err)
+	}
+	_ = persister.aofFile.Close()
+	persister.aofFile = file
+	persister.aofFilename = file.Name()
+	persister.aofSize = 0
+	// 每个段都从0号数据库开始重放，并且以时间戳标记开头
+	persister.currentDB = 0
+	persister.lastMarkMs = 0
+	return seg, nil
+}
+
+// aofTotalSize 返回启动时需要加载的aof文件的总大小，调用方需要持有pausingAof或者尚未开始写入
+func (persister *Persister) aofTotalSize() int64 {
+	if persister.manifest == nil {
+		info, err := os.Stat(persister.aofFilename)
+		if err != nil {
+			return 0
+		}
+		return info.Size()
+	}
+	var size int64
+	for _, seg := range persister.manifest.loadSegments() {
+		if info, err := os.Stat(persister.manifest.Path(seg)); err == nil {
+			size += info.Size()
+		}
+	}
+	return size
+}
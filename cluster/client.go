@@ -0,0 +1,93 @@
+package cluster
+
+import (
+	"gedis/config"
+	"gedis/interface/redis"
+	"gedis/lib/utils"
+	"gedis/redis/client"
+	"gedis/redis/protocol"
+	"net"
+	"time"
+)
+
+const (
+	// peerDialTimeout 连接其他节点的超时时间
+	peerDialTimeout = 3 * time.Second
+	// peerRequestTimeout 等待其他节点回复的超时时间
+	peerRequestTimeout = 3 * time.Second
+)
+
+// peerCmd 内部命令，其他节点的客户端建立连接之后发送 _peer node 标记该连接
+const peerCmd = "_peer"
+
+// makePeerClient 创建与其他节点之间的客户端，集群中的节点使用相同的密码，连接建立之后以self握手
+func makePeerClient(self string, addr string) *client.Client {
+	return client.New(client.Config{
+		Addr:         addr,
+		Password:     config.Properties.RequirePass,
+		InitCmdLines: []CmdLine{utils.ToCmdLine(peerCmd, self)},
+		DialTimeout:  peerDialTimeout,
+		ReadTimeout:  peerRequestTimeout,
+		MaxIdle:      8,
+		MaxActive:    64,
+	})
+}
+
+// execPeer _peer node，将连接标记为来自集群中的节点node
+// 只接受从node所在主机建立的连接，普通客户端无法借此发送Prepare等事务命令
+func execPeer(cluster *Cluster, c redis.Connection, cmdLine CmdLine) redis.Reply {
+	if len(cmdLine) != 2 {
+		return protocol.MakeArgNumErrReply(peerCmd)
+	}
+	node := string(cmdLine[1])
+	known := false
+	for _, n := range cluster.nodes {
+		if n == node && n != cluster.self {
+			known = true
+		}
+	}
+	if !known {
+		return protocol.MakeErrReply("ERR unknown cluster node " + node)
+	}
+	if !isFromHost(c, node) {
+		return protocol.MakeErrReply("ERR connection is not from cluster node " + node)
+	}
+	c.SetPeer()
+	return protocol.MakeOkReply()
+}
+
+// isFromHost 连接的远端地址是否属于节点addr所在的主机
+func isFromHost(c redis.Connection, addr string) bool {
+	conn, ok := c.(interface{ RemoteAddr() net.Addr })
+	if !ok {
+		return false
+	}
+	remote, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return false
+	}
+	for _, ip := range ips {
+		if ip.Equal(remote.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// peerOnly 只允许其他节点的连接执行的命令，普通客户端收到与未知命令相同的错误
+func peerOnly(cmdFunc CmdFunc) CmdFunc {
+	return func(cluster *Cluster, c redis.Connection, cmdLine CmdLine) redis.Reply {
+		if !c.IsPeer() {
+			return protocol.MakeErrReply("ERR unknown command '" + string(cmdLine[0]) + "'")
+		}
+		return cmdFunc(cluster, c, cmdLine)
+	}
+}
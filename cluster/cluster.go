@@ -0,0 +1,164 @@
+package cluster
+
+import (
+	"fmt"
+	"gedis/config"
+	"gedis/database"
+	"gedis/datastruct/dict"
+	database2 "gedis/interface/database"
+	"gedis/interface/redis"
+	"gedis/lib/consistenthash"
+	"gedis/lib/logger"
+	"gedis/lib/utils"
+	"gedis/redis/client"
+	"gedis/redis/protocol"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CmdLine 是[][]byte的别名
+type CmdLine = [][]byte
+
+// replicas 每个节点在一致性哈希环上的虚拟节点数量
+const replicas = 16
+
+// Cluster 集群模式下的数据库，key属于当前节点时在本地的MultiDB执行，否则转发给负责该key的节点
+type Cluster struct {
+	self  string
+	nodes []string
+	// 一致性哈希环，包括当前节点以及所有的peers
+	peerPicker *consistenthash.Map
+	// 节点地址->客户端
+	peerClients map[string]*client.Client
+	db          database2.DBEngine
+	// 需要特殊处理的命令，例如需要拆分到多个节点执行的命令
+	router map[string]CmdFunc
+
+	// 作为参与者的分布式事务，txID->*Transaction
+	transactions dict.Dict
+	// 生成作为协调者的事务id
+	txSeq    uint64
+	bootTime int64
+}
+
+// MakeCluster 创建集群节点，所有节点的self与peers组成的集合需要相同
+func MakeCluster() *Cluster {
+	self := config.Properties.Self
+	if self == "" {
+		self = fmt.Sprintf("%s:%d", config.Properties.Bind, config.Properties.Port)
+	}
+	return makeCluster(self, config.Properties.Peers)
+}
+
+// makeCluster 以self与peers创建集群节点
+func makeCluster(self string, peers []string) *Cluster {
+	cluster := &Cluster{
+		self:         self,
+		peerPicker:   consistenthash.New(replicas, nil),
+		peerClients:  make(map[string]*client.Client),
+		db:           database.NewStandaloneServer(),
+		router:       makeRouter(),
+		transactions: dict.MakeConcurrent(64),
+		bootTime:     time.Now().UnixNano(),
+	}
+	nodes := make([]string, 0, len(peers)+1)
+	nodes = append(nodes, self)
+	for _, peer := range peers {
+		if peer == self {
+			continue
+		}
+		nodes = append(nodes, peer)
+		cluster.peerClients[peer] = makePeerClient(self, peer)
+	}
+	cluster.nodes = nodes
+	cluster.peerPicker.AddNode(nodes...)
+	logger.Info(fmt.Sprintf("cluster mode, self %s, nodes %v", self, nodes))
+	return cluster
+}
+
+// Exec 根据命令涉及的key选择执行的节点，没有key的命令在本地执行，跨节点的多key命令拆分到各个节点执行
+func (cluster *Cluster) Exec(c redis.Connection, cmdLine [][]byte) (result redis.Reply) {
+	defer func() {
+		if err := recover(); err != nil {
+			logger.Warn(fmt.Sprintf("error occurs: %v\n%s", err, string(debug.Stack())))
+			result = &protocol.UnknownErrReply{}
+		}
+	}()
+	cmdName := strings.ToLower(string(cmdLine[0]))
+	// 事务中的命令只需要入队，EXEC时再按节点分组执行
+	if c.InMultiState() && !multiControlCommands[cmdName] {
+		return cluster.db.Exec(c, cmdLine)
+	}
+	if cmdFunc, ok := cluster.router[cmdName]; ok {
+		// 路由中的命令不经过本地数据库的鉴权
+		if !isAuthenticated(c) {
+			return protocol.MakeErrReply("NOAUTH Authentication required")
+		}
+		return cmdFunc(cluster, c, cmdLine)
+	}
+	return cluster.defaultExec(c, cmdLine)
+}
+
+// defaultExec 所有key属于同一个节点时在该节点执行，否则返回错误
+func (cluster *Cluster) defaultExec(c redis.Connection, cmdLine CmdLine) redis.Reply {
+	keys, ok := database.GetRelatedKeys(cmdLine)
+	if !ok || len(keys) == 0 {
+		return cluster.db.Exec(c, cmdLine)
+	}
+	peer := cluster.peerPicker.PickNode(keys[0])
+	for _, key := range keys[1:] {
+		if cluster.peerPicker.PickNode(key) != peer {
+			return protocol.MakeErrReply("CROSSSLOT Keys in request don't hash to the same node")
+		}
+	}
+	if peer == cluster.self {
+		return cluster.db.Exec(c, cmdLine)
+	}
+	// 鉴权之后才能转发，节点之间的连接已经通过鉴权
+	if !isAuthenticated(c) {
+		return protocol.MakeErrReply("NOAUTH Authentication required")
+	}
+	return convertRelayed(c, cmdLine, cluster.relay(peer, c, cmdLine))
+}
+
+// relay 将命令转发给节点peer，先选择与客户端相同的数据库
+func (cluster *Cluster) relay(peer string, c redis.Connection, cmdLine CmdLine) redis.Reply {
+	peerClient, ok := cluster.peerClients[peer]
+	if !ok {
+		return protocol.MakeErrReply("ERR unknown peer " + peer)
+	}
+	// SELECT与命令在同一个连接上一次发送
+	replies, err := peerClient.Pipeline().
+		Do(utils.ToCmdLine("SELECT", strconv.Itoa(c.GetDBIndex()))).
+		Do(cmdLine).
+		Exec()
+	if err != nil {
+		return protocol.MakeErrReply("ERR relay to " + peer + " failed: " + err.Error())
+	}
+	if protocol.IsErrorReply(replies[0]) {
+		return replies[0]
+	}
+	return replies[1]
+}
+
+// AfterClientClose 客户端断开连接之后清理本地数据库中的状态
+func (cluster *Cluster) AfterClientClose(c redis.Connection) {
+	cluster.db.AfterClientClose(c)
+}
+
+// Close 关闭本地数据库以及与其他节点之间的连接
+func (cluster *Cluster) Close() {
+	cluster.db.Close()
+	for _, peerClient := range cluster.peerClients {
+		peerClient.Close()
+	}
+}
+
+func isAuthenticated(c redis.Connection) bool {
+	if config.Properties.RequirePass == "" {
+		return true
+	}
+	return c.GetPassword() == config.Properties.RequirePass
+}
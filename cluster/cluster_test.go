@@ -0,0 +1,93 @@
+package cluster
+
+import (
+	"gedis/config"
+	"gedis/lib/utils"
+	"gedis/redis/connection"
+	"gedis/redis/parser"
+	"gedis/redis/protocol"
+	"net"
+	"strconv"
+	"testing"
+)
+
+// serveCluster 在listener上处理客户端的命令，只用于测试
+func serveCluster(listener net.Listener, cluster *Cluster) {
+	for {
+		netConn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			conn := connection.NewConn(netConn)
+			defer func() {
+				cluster.AfterClientClose(conn)
+				_ = conn.Close()
+			}()
+			for payload := range parser.ParseStream(netConn) {
+				if payload.Err != nil {
+					return
+				}
+				args, ok := payload.Data.(*protocol.MultiBulkReply)
+				if !ok {
+					return
+				}
+				if err := conn.Write(cluster.Exec(conn, args.Args).ToBytes()); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// startTestCluster 在随机端口上启动n个不持久化的节点
+func startTestCluster(t *testing.T, n int) []*Cluster {
+	config.Properties.Save = nil
+	config.Properties.AppendOnly = false
+	config.Properties.RDBFilename = ""
+	config.Properties.RequirePass = ""
+	listeners := make([]net.Listener, n)
+	addrs := make([]string, n)
+	for i := range listeners {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners[i] = listener
+		addrs[i] = listener.Addr().String()
+	}
+	nodes := make([]*Cluster, n)
+	for i, listener := range listeners {
+		nodes[i] = makeCluster(addrs[i], addrs)
+		go serveCluster(listener, nodes[i])
+	}
+	t.Cleanup(func() {
+		for i, listener := range listeners {
+			_ = listener.Close()
+			nodes[i].Close()
+		}
+	})
+	return nodes
+}
+
+// keyOn 返回一个属于节点node的key
+func keyOn(cluster *Cluster, node string, prefix string) string {
+	for i := 0; ; i++ {
+		key := prefix + strconv.Itoa(i)
+		if cluster.peerPicker.PickNode(key) == node {
+			return key
+		}
+	}
+}
+
+// exec 在cluster上执行命令并返回回复的原始字节
+func exec(cluster *Cluster, c *connection.FakeConn, args ...string) string {
+	return string(cluster.Exec(c, utils.ToCmdLine(args...)).ToBytes())
+}
+
+func assertReply(t *testing.T, actual string, expect string) {
+	t.Helper()
+	if actual != expect {
+		t.Errorf("expect %q actually %q", expect, actual)
+	}
+}
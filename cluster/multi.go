@@ -0,0 +1,118 @@
+package cluster
+
+import (
+	"gedis/database"
+	"gedis/interface/redis"
+	"gedis/lib/utils"
+	"gedis/redis/protocol"
+)
+
+// execWatch WATCH key [key ...]，从key所属的节点获取版本号保存在连接上，EXEC时由各个节点检查
+func execWatch(cluster *Cluster, c redis.Connection, cmdLine CmdLine) redis.Reply {
+	if len(cmdLine) < 2 {
+		return protocol.MakeArgNumErrReply(string(cmdLine[0]))
+	}
+	if c.InMultiState() {
+		return protocol.MakeErrReply("ERR WATCH inside MULTI is not allowed")
+	}
+	watching := c.GetWatching()
+	for _, arg := range cmdLine[1:] {
+		key := string(arg)
+		peer := cluster.peerPicker.PickNode(key)
+		reply := cluster.execOnPeer(peer, c, utils.ToCmdLine("GetVer", key))
+		intReply, ok := reply.(*protocol.IntReply)
+		if !ok {
+			if protocol.IsErrorReply(reply) {
+				return reply
+			}
+			return protocol.MakeErrReply("ERR unexpected reply of GetVer from " + peer)
+		}
+		watching[key] = uint32(intReply.Code)
+	}
+	return protocol.MakeOkReply()
+}
+
+// execMulti EXEC，所有key都属于当前节点时在本地执行，否则按节点分组以分布式事务执行
+// 同一条命令的key需要属于同一个节点，结果按照命令入队的顺序排列
+func execMulti(cluster *Cluster, c redis.Connection, cmdLine CmdLine) redis.Reply {
+	if len(cmdLine) != 1 {
+		return protocol.MakeArgNumErrReply(string(cmdLine[0]))
+	}
+	if !c.InMultiState() {
+		return protocol.MakeErrReply("ERR EXEC without MULTI")
+	}
+	cmdLines := c.GetQueuedCmdLine()
+	requests := make(map[string]*txRequest)
+	getRequest := func(peer string) *txRequest {
+		req, ok := requests[peer]
+		if !ok {
+			req = makeTxRequest()
+			requests[peer] = req
+		}
+		return req
+	}
+	// 每个节点上的命令在原来的事务中的位置
+	indexes := make(map[string][]int)
+	for i, cmdLine := range cmdLines {
+		keys, _ := database.GetRelatedKeys(cmdLine)
+		peer := cluster.self
+		if len(keys) > 0 {
+			peer = cluster.peerPicker.PickNode(keys[0])
+			for _, key := range keys[1:] {
+				if cluster.peerPicker.PickNode(key) != peer {
+					c.SetMultiState(false)
+					return protocol.MakeErrReply("CROSSSLOT Keys in request don't hash to the same node")
+				}
+			}
+		}
+		req := getRequest(peer)
+		req.cmdLines = append(req.cmdLines, cmdLine)
+		indexes[peer] = append(indexes[peer], i)
+	}
+	for key, version := range c.GetWatching() {
+		getRequest(cluster.peerPicker.PickNode(key)).watching[key] = version
+	}
+	if _, ok := requests[cluster.self]; len(requests) == 0 || (len(requests) == 1 && ok) {
+		return cluster.db.Exec(c, cmdLine)
+	}
+	// 清除事务状态之后，Prepare等命令才不会被入队
+	c.SetMultiState(false)
+
+	coord := cluster.newCoordinator(c)
+	if _, errReply := coord.prepare(requests); errReply != nil {
+		if isWatchChanged(errReply) {
+			return protocol.MakeEmptyMultiBulkReply()
+		}
+		return errReply
+	}
+	peers := make([]string, 0, len(requests))
+	for peer := range requests {
+		peers = append(peers, peer)
+	}
+	replies, errReply := coord.commit(peers...)
+	if errReply != nil {
+		return errReply
+	}
+	// 与单机的事务一致，任意命令执行出错时撤销所有参与者上的修改
+	for _, reply := range replies {
+		if commandError(reply) != nil {
+			coord.rollback()
+			return protocol.MakeErrReply("EXECABORT Transaction discarded because of previous errors.")
+		}
+	}
+	results := make([]redis.Reply, len(cmdLines))
+	for peer, reply := range replies {
+		// 只包含watch的key的节点没有需要返回的结果
+		if len(indexes[peer]) == 0 {
+			continue
+		}
+		multiBulk, ok := reply.(*protocol.MultiBulkReply)
+		if !ok || len(multiBulk.Args) != len(indexes[peer]) {
+			return protocol.MakeErrReply("ERR unexpected reply of Commit from " + peer)
+		}
+		for i, index := range indexes[peer] {
+			results[index] = rawReply(multiBulk.Args[i])
+		}
+	}
+	return protocol.MakeMultiRawReply(results)
+}
@@ -0,0 +1,229 @@
+package cluster
+
+import (
+	"gedis/database"
+	"gedis/interface/redis"
+	"gedis/redis/protocol"
+	"strings"
+	"sync"
+)
+
+// 跨节点的多key命令：按key所属的节点拆分命令，并行地在各个节点执行，再按原来的顺序合并结果
+// 任意一个节点执行失败时返回错误，并列出失败的节点，不会忽略部分失败
+
+// keyGroup 属于同一个节点的key在原命令中的位置以及拆分后的命令
+type keyGroup struct {
+	indexes []int
+	cmdLine CmdLine
+}
+
+// groupByPeer 按节点对key分组，stride为每个key在命令中占用的参数个数，例如MSET为2
+func (cluster *Cluster) groupByPeer(cmdName string, args [][]byte, stride int) map[string]*keyGroup {
+	groups := make(map[string]*keyGroup)
+	for i := 0; i+stride <= len(args); i += stride {
+		peer := cluster.peerPicker.PickNode(string(args[i]))
+		group, ok := groups[peer]
+		if !ok {
+			group = &keyGroup{cmdLine: CmdLine{[]byte(cmdName)}}
+			groups[peer] = group
+		}
+		group.indexes = append(group.indexes, i/stride)
+		group.cmdLine = append(group.cmdLine, args[i:i+stride]...)
+	}
+	return groups
+}
+
+// execOnPeer 在节点peer上执行命令，当前节点直接在本地执行
+func (cluster *Cluster) execOnPeer(peer string, c redis.Connection, cmdLine CmdLine) redis.Reply {
+	if peer == cluster.self {
+		return cluster.db.Exec(c, cmdLine)
+	}
+	return cluster.relay(peer, c, cmdLine)
+}
+
+// scatter 并行地在各个节点上执行对应的命令，返回节点->回复
+func (cluster *Cluster) scatter(c redis.Connection, cmdLines map[string]CmdLine) map[string]redis.Reply {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	replies := make(map[string]redis.Reply, len(cmdLines))
+	for peer, cmdLine := range cmdLines {
+		wg.Add(1)
+		go func(peer string, cmdLine CmdLine) {
+			defer wg.Done()
+			reply := cluster.execOnPeer(peer, c, cmdLine)
+			mu.Lock()
+			replies[peer] = reply
+			mu.Unlock()
+		}(peer, cmdLine)
+	}
+	wg.Wait()
+	return replies
+}
+
+// scatterGroups 并行执行分组后的命令
+func (cluster *Cluster) scatterGroups(c redis.Connection, groups map[string]*keyGroup) map[string]redis.Reply {
+	cmdLines := make(map[string]CmdLine, len(groups))
+	for peer, group := range groups {
+		cmdLines[peer] = group.cmdLine
+	}
+	return cluster.scatter(c, cmdLines)
+}
+
+// broadcast 在所有节点上执行命令，其他节点通过 _local 前缀在本地执行，不会再次广播
+func (cluster *Cluster) broadcast(c redis.Connection, cmdLine CmdLine) map[string]redis.Reply {
+	cmdLines := make(map[string]CmdLine, len(cluster.nodes))
+	for _, node := range cluster.nodes {
+		if node == cluster.self {
+			cmdLines[node] = cmdLine
+		} else {
+			cmdLines[node] = append(CmdLine{[]byte(localCmd)}, cmdLine...)
+		}
+	}
+	return cluster.scatter(c, cmdLines)
+}
+
+// mergeErrors 汇总各个节点返回的错误，没有错误时返回nil
+// 只有一个节点出错时原样返回它的错误，否则按节点顺序拼接错误信息
+func (cluster *Cluster) mergeErrors(replies map[string]redis.Reply) redis.Reply {
+	var failed []string
+	var first redis.Reply
+	for _, node := range cluster.nodes {
+		reply, ok := replies[node]
+		if !ok || !protocol.IsErrorReply(reply) {
+			continue
+		}
+		if first == nil {
+			first = reply
+		}
+		msg := strings.TrimSuffix(string(reply.ToBytes()[1:]), protocol.CRLF)
+		failed = append(failed, node+": "+msg)
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	if len(failed) == 1 && len(replies) == 1 {
+		return first
+	}
+	return protocol.MakeErrReply("ERR partial failure on " + strings.Join(failed, "; "))
+}
+
+// prepareScatter 检查命令能否拆分执行，参数错误的命令交给本地数据库返回错误
+func (cluster *Cluster) prepareScatter(c redis.Connection, cmdLine CmdLine) (redis.Reply, bool) {
+	if _, ok := database.GetRelatedKeys(cmdLine); !ok {
+		return cluster.db.Exec(c, cmdLine), false
+	}
+	return nil, true
+}
+
+// execMSet MSET key value [key value ...]
+func execMSet(cluster *Cluster, c redis.Connection, cmdLine CmdLine) redis.Reply {
+	if reply, ok := cluster.prepareScatter(c, cmdLine); !ok {
+		return reply
+	}
+	if len(cmdLine)%2 != 1 {
+		return protocol.MakeArgNumErrReply(string(cmdLine[0]))
+	}
+	groups := cluster.groupByPeer("MSET", cmdLine[1:], 2)
+	if len(groups) == 1 {
+		return cluster.defaultExec(c, cmdLine)
+	}
+	replies := cluster.scatterGroups(c, groups)
+	if errReply := cluster.mergeErrors(replies); errReply != nil {
+		return errReply
+	}
+	return protocol.MakeOkReply()
+}
+
+// execMGet MGET key [key ...]，结果按照key原来的顺序排列
+func execMGet(cluster *Cluster, c redis.Connection, cmdLine CmdLine) redis.Reply {
+	if reply, ok := cluster.prepareScatter(c, cmdLine); !ok {
+		return reply
+	}
+	groups := cluster.groupByPeer("MGET", cmdLine[1:], 1)
+	if len(groups) == 1 {
+		return cluster.defaultExec(c, cmdLine)
+	}
+	replies := cluster.scatterGroups(c, groups)
+	if errReply := cluster.mergeErrors(replies); errReply != nil {
+		return errReply
+	}
+	result := make([][]byte, len(cmdLine)-1)
+	for peer, group := range groups {
+		reply, ok := replies[peer].(*protocol.MultiBulkReply)
+		if !ok || len(reply.Args) != len(group.indexes) {
+			return protocol.MakeErrReply("ERR unexpected reply of MGET from " + peer)
+		}
+		for i, index := range group.indexes {
+			result[index] = reply.Args[i]
+		}
+	}
+	return protocol.MakeMultiBulkReply(result)
+}
+
+// sumIntReplies 合并DEL与EXISTS等命令在各个节点的整数结果
+func (cluster *Cluster) sumIntReplies(c redis.Connection, cmdLine CmdLine) redis.Reply {
+	if reply, ok := cluster.prepareScatter(c, cmdLine); !ok {
+		return reply
+	}
+	groups := cluster.groupByPeer(strings.ToUpper(string(cmdLine[0])), cmdLine[1:], 1)
+	if len(groups) == 1 {
+		return cluster.defaultExec(c, cmdLine)
+	}
+	replies := cluster.scatterGroups(c, groups)
+	if errReply := cluster.mergeErrors(replies); errReply != nil {
+		return errReply
+	}
+	var sum int64
+	for peer, reply := range replies {
+		intReply, ok := reply.(*protocol.IntReply)
+		if !ok {
+			return protocol.MakeErrReply("ERR unexpected reply of " + string(cmdLine[0]) + " from " + peer)
+		}
+		sum += intReply.Code
+	}
+	return protocol.MakeIntReply(sum)
+}
+
+// execDel DEL key [key ...]
+func execDel(cluster *Cluster, c redis.Connection, cmdLine CmdLine) redis.Reply {
+	return cluster.sumIntReplies(c, cmdLine)
+}
+
+// execExists EXISTS key [key ...]
+func execExists(cluster *Cluster, c redis.Connection, cmdLine CmdLine) redis.Reply {
+	return cluster.sumIntReplies(c, cmdLine)
+}
+
+// execKeys KEYS pattern，拼接所有节点上匹配的key
+func execKeys(cluster *Cluster, c redis.Connection, cmdLine CmdLine) redis.Reply {
+	if len(cmdLine) != 2 {
+		return cluster.db.Exec(c, cmdLine)
+	}
+	replies := cluster.broadcast(c, cmdLine)
+	if errReply := cluster.mergeErrors(replies); errReply != nil {
+		return errReply
+	}
+	result := make([][]byte, 0)
+	for _, node := range cluster.nodes {
+		switch reply := replies[node].(type) {
+		case *protocol.MultiBulkReply:
+			result = append(result, reply.Args...)
+		case *protocol.EmptyMultiBulkReply:
+		default:
+			return protocol.MakeErrReply("ERR unexpected reply of KEYS from " + node)
+		}
+	}
+	return protocol.MakeMultiBulkReply(result)
+}
+
+// execFlush FLUSHALL与FLUSHDB，清空所有节点上的数据
+func execFlush(cluster *Cluster, c redis.Connection, cmdLine CmdLine) redis.Reply {
+	if len(cmdLine) != 1 {
+		return cluster.db.Exec(c, cmdLine)
+	}
+	replies := cluster.broadcast(c, cmdLine)
+	if errReply := cluster.mergeErrors(replies); errReply != nil {
+		return errReply
+	}
+	return protocol.MakeOkReply()
+}
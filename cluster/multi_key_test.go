@@ -0,0 +1,75 @@
+package cluster
+
+import (
+	"gedis/redis/connection"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestScatterGatherKeepOrder(t *testing.T) {
+	nodes := startTestCluster(t, 3)
+	c := connection.NewFakeConn()
+	// 依次属于节点0、1、2、0，拆分之后结果仍然按照原来的顺序排列
+	a := keyOn(nodes[0], nodes[0].self, "a")
+	b := keyOn(nodes[0], nodes[1].self, "b")
+	d := keyOn(nodes[0], nodes[2].self, "d")
+	e := keyOn(nodes[0], nodes[0].self, "e")
+	assertReply(t, exec(nodes[1], c, "MSET", a, "1", b, "2", d, "3", e, "4"), "+OK\r\n")
+	assertReply(t, exec(nodes[2], c, "MGET", e, "missing", d, b, a),
+		"*5\r\n$1\r\n4\r\n$-1\r\n$1\r\n3\r\n$1\r\n2\r\n$1\r\n1\r\n")
+	// 每个key写入负责它的节点
+	assertReply(t, exec(nodes[1], c, localCmd, "GET", b), "$1\r\n2\r\n")
+	assertReply(t, exec(nodes[2], c, localCmd, "GET", d), "$1\r\n3\r\n")
+	assertReply(t, exec(nodes[0], c, "EXISTS", a, b, d, e, "missing"), ":4\r\n")
+	assertReply(t, exec(nodes[0], c, "DEL", a, d, "missing"), ":2\r\n")
+	assertReply(t, exec(nodes[1], c, "MGET", a, b), "*2\r\n$-1\r\n$1\r\n2\r\n")
+
+	keys := exec(nodes[0], c, "KEYS", "*")
+	if !strings.HasPrefix(keys, "*2\r\n") || !strings.Contains(keys, b) || !strings.Contains(keys, e) {
+		t.Errorf("expect keys of all nodes actually %q", keys)
+	}
+	assertReply(t, exec(nodes[2], c, "FLUSHALL"), "+OK\r\n")
+	assertReply(t, exec(nodes[0], c, "EXISTS", b, e), ":0\r\n")
+	// 参数个数错误时不拆分
+	assertReply(t, exec(nodes[0], c, "MSET", a, "1", b), "-ERR wrong number of arguments for 'MSET' command\r\n")
+}
+
+func TestScatterGatherPartialFailure(t *testing.T) {
+	nodes := startTestCluster(t, 2)
+	// 节点down的地址上没有服务，转发到它的命令都会失败
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := listener.Addr().String()
+	_ = listener.Close()
+	node := makeCluster(nodes[0].self, []string{nodes[1].self, down})
+	defer node.Close()
+
+	c := connection.NewFakeConn()
+	a := keyOn(node, node.self, "a")
+	b := keyOn(node, nodes[1].self, "b")
+	d := keyOn(node, down, "d")
+	reply := exec(node, c, "MSET", a, "1", b, "2", d, "3")
+	if !strings.HasPrefix(reply, "-ERR partial failure on "+down+": ") {
+		t.Errorf("expect failure of %s actually %q", down, reply)
+	}
+	// 其他节点上的部分仍然执行，错误不会被忽略
+	assertReply(t, exec(nodes[1], c, "GET", b), "$1\r\n2\r\n")
+	for _, cmd := range [][]string{
+		{"MGET", a, b, d},
+		{"DEL", a, b, d},
+		{"EXISTS", a, d},
+		{"KEYS", "*"},
+		{"FLUSHALL"},
+	} {
+		reply = exec(node, c, cmd...)
+		if !strings.HasPrefix(reply, "-ERR partial failure on "+down+": ") {
+			t.Errorf("%s: expect failure of %s actually %q", cmd[0], down, reply)
+		}
+		if strings.Contains(reply, nodes[1].self) {
+			t.Errorf("%s: expect only failed node reported actually %q", cmd[0], reply)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package cluster
+
+import (
+	"errors"
+	"gedis/interface/redis"
+	"gedis/lib/utils"
+	"gedis/redis/protocol"
+)
+
+var errInvalidDump = errors.New("invalid dump reply")
+
+// execRename RENAME src dest，src与dest属于不同节点时以分布式事务搬运数据
+func execRename(cluster *Cluster, c redis.Connection, cmdLine CmdLine) redis.Reply {
+	return cluster.renameAcrossNodes(c, cmdLine, false)
+}
+
+// execRenameNx RENAMENX src dest
+func execRenameNx(cluster *Cluster, c redis.Connection, cmdLine CmdLine) redis.Reply {
+	return cluster.renameAcrossNodes(c, cmdLine, true)
+}
+
+// renameAcrossNodes 先在src所属的节点Prepare并取得src的值，再在dest所属的节点Prepare写入dest的命令，最后一起提交
+func (cluster *Cluster) renameAcrossNodes(c redis.Connection, cmdLine CmdLine, nx bool) redis.Reply {
+	if len(cmdLine) != 3 {
+		return cluster.db.Exec(c, cmdLine)
+	}
+	src := string(cmdLine[1])
+	dest := string(cmdLine[2])
+	srcPeer := cluster.peerPicker.PickNode(src)
+	destPeer := cluster.peerPicker.PickNode(dest)
+	if srcPeer == destPeer {
+		return cluster.defaultExec(c, cmdLine)
+	}
+
+	coord := cluster.newCoordinator(c)
+	srcReq := makeTxRequest()
+	srcReq.cmdLines = []CmdLine{utils.ToCmdLine("DEL", src)}
+	srcReq.dumpKeys = []string{src}
+	replies, errReply := coord.prepare(map[string]*txRequest{srcPeer: srcReq})
+	if errReply != nil {
+		return errReply
+	}
+	dumps, err := decodeDumps(replies[srcPeer], 1)
+	if err != nil {
+		coord.rollback()
+		return protocol.MakeErrReply("ERR unexpected reply of Prepare from " + srcPeer + ": " + err.Error())
+	}
+	if len(dumps[0]) == 0 {
+		coord.rollback()
+		return protocol.MakeErrReply("no such key")
+	}
+
+	destReq := makeTxRequest()
+	destReq.cmdLines = []CmdLine{utils.ToCmdLine("DEL", dest)}
+	for _, dumpCmd := range dumps[0] {
+		// 重建src的命令的第一个参数都是key，替换为dest
+		renamed := make(CmdLine, len(dumpCmd))
+		copy(renamed, dumpCmd)
+		renamed[1] = []byte(dest)
+		destReq.cmdLines = append(destReq.cmdLines, renamed)
+	}
+	if nx {
+		destReq.dumpKeys = []string{dest}
+	}
+	replies, errReply = coord.prepare(map[string]*txRequest{destPeer: destReq})
+	if errReply != nil {
+		return errReply
+	}
+	if nx {
+		destDumps, err := decodeDumps(replies[destPeer], 1)
+		if err != nil {
+			coord.rollback()
+			return protocol.MakeErrReply("ERR unexpected reply of Prepare from " + destPeer + ": " + err.Error())
+		}
+		if len(destDumps[0]) > 0 {
+			coord.rollback()
+			return protocol.MakeIntReply(0)
+		}
+	}
+	replies, errReply = coord.commit(srcPeer, destPeer)
+	if errReply != nil {
+		return errReply
+	}
+	// 重建dest的命令出错时src与dest都需要恢复
+	for _, peer := range []string{srcPeer, destPeer} {
+		if errReply = commandError(replies[peer]); errReply != nil {
+			coord.rollback()
+			return errReply
+		}
+	}
+	if nx {
+		return protocol.MakeIntReply(1)
+	}
+	return protocol.MakeOkReply()
+}
+
+// execSMove SMOVE src dest member，先提交src上的SREM，确实移除了member之后再提交dest上的SADD
+func execSMove(cluster *Cluster, c redis.Connection, cmdLine CmdLine) redis.Reply {
+	if len(cmdLine) != 4 {
+		return cluster.db.Exec(c, cmdLine)
+	}
+	src := string(cmdLine[1])
+	dest := string(cmdLine[2])
+	member := cmdLine[3]
+	srcPeer := cluster.peerPicker.PickNode(src)
+	destPeer := cluster.peerPicker.PickNode(dest)
+	if srcPeer == destPeer {
+		return cluster.defaultExec(c, cmdLine)
+	}
+
+	coord := cluster.newCoordinator(c)
+	srcReq := makeTxRequest()
+	srcReq.cmdLines = []CmdLine{utils.ToCmdLine3("SREM", []byte(src), member)}
+	destReq := makeTxRequest()
+	destReq.cmdLines = []CmdLine{utils.ToCmdLine3("SADD", []byte(dest), member)}
+	_, errReply := coord.prepare(map[string]*txRequest{srcPeer: srcReq, destPeer: destReq})
+	if errReply != nil {
+		return errReply
+	}
+	replies, errReply := coord.commit(srcPeer)
+	if errReply != nil {
+		return errReply
+	}
+	// src不是集合，SREM没有修改数据，回滚以释放dest上的锁
+	if errReply = commandError(replies[srcPeer]); errReply != nil {
+		coord.rollback()
+		return errReply
+	}
+	removed, ok := replies[srcPeer].(*protocol.MultiBulkReply)
+	if !ok || len(removed.Args) != 1 {
+		coord.rollback()
+		return protocol.MakeErrReply("ERR unexpected reply of Commit from " + srcPeer)
+	}
+	if string(removed.Args[0]) != string(protocol.MakeIntReply(1).ToBytes()) {
+		// member不在src中，dest不需要修改
+		coord.rollback()
+		return protocol.MakeIntReply(0)
+	}
+	replies, errReply = coord.commit(destPeer)
+	if errReply != nil {
+		return errReply
+	}
+	// dest不是集合时回滚src上已经提交的SREM
+	if errReply = commandError(replies[destPeer]); errReply != nil {
+		coord.rollback()
+		return errReply
+	}
+	return protocol.MakeIntReply(1)
+}
+
+// decodeDumps 解析Prepare返回的dumpKeys的值，每个key对应一组重建它的命令
+func decodeDumps(reply redis.Reply, count int) ([][]CmdLine, error) {
+	multiBulk, ok := reply.(*protocol.MultiBulkReply)
+	if !ok {
+		return nil, errInvalidDump
+	}
+	args := multiBulk.Args
+	dumps := make([][]CmdLine, 0, count)
+	for i := 0; i < count; i++ {
+		var cmdLines []CmdLine
+		var err error
+		cmdLines, args, err = decodeCmdLines(args)
+		if err != nil {
+			return nil, err
+		}
+		dumps = append(dumps, cmdLines)
+	}
+	return dumps, nil
+}
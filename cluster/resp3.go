@@ -0,0 +1,112 @@
+package cluster
+
+import (
+	"gedis/interface/redis"
+	"gedis/redis/protocol"
+	"strconv"
+	"strings"
+)
+
+/*
+节点之间通过RESP2转发命令，HGETALL等命令的结果在转发之后变成了数组或者字符串
+客户端协商了RESP3时，按照命令将转发的结果转换为与单机一致的类型
+*/
+
+type resp3Converter func(cmdLine CmdLine, reply redis.Reply) redis.Reply
+
+var resp3Converters = map[string]resp3Converter{
+	"hgetall":          toMapReply,
+	"smembers":         toSetReply,
+	"sinter":           toSetReply,
+	"sunion":           toSetReply,
+	"sdiff":            toSetReply,
+	"zscore":           toDoubleReply,
+	"zincrby":          toDoubleReply,
+	"zrange":           toScoredMembersReply,
+	"zrevrange":        toScoredMembersReply,
+	"zrangebyscore":    toScoredMembersReply,
+	"zrevrangebyscore": toScoredMembersReply,
+}
+
+// convertRelayed 客户端使用RESP3时转换其他节点返回的结果，错误以及无法转换的结果原样返回
+func convertRelayed(c redis.Connection, cmdLine CmdLine, reply redis.Reply) redis.Reply {
+	if c.GetProtocol() != protocol.RESP3 {
+		return reply
+	}
+	converter, ok := resp3Converters[strings.ToLower(string(cmdLine[0]))]
+	if !ok {
+		return reply
+	}
+	return converter(cmdLine, reply)
+}
+
+// toMapReply 键值交替出现的数组转换为键值对
+func toMapReply(cmdLine CmdLine, reply redis.Reply) redis.Reply {
+	switch r := reply.(type) {
+	case *protocol.EmptyMultiBulkReply:
+		return protocol.MakeMapReply(nil)
+	case *protocol.MultiBulkReply:
+		if len(r.Args)%2 != 0 {
+			return reply
+		}
+		return protocol.MakeBulkMapReply(r.Args)
+	}
+	return reply
+}
+
+// toSetReply 数组转换为集合
+func toSetReply(cmdLine CmdLine, reply redis.Reply) redis.Reply {
+	switch r := reply.(type) {
+	case *protocol.EmptyMultiBulkReply:
+		return protocol.MakeSetReply(nil)
+	case *protocol.MultiBulkReply:
+		return protocol.MakeSetReply(r.Args)
+	}
+	return reply
+}
+
+// toDoubleReply 字符串形式的分数转换为浮点数，成员不存在时的空值不需要转换
+func toDoubleReply(cmdLine CmdLine, reply redis.Reply) redis.Reply {
+	bulk, ok := reply.(*protocol.BulkReply)
+	if !ok {
+		return reply
+	}
+	value, err := strconv.ParseFloat(string(bulk.Arg), 64)
+	if err != nil {
+		return reply
+	}
+	return protocol.MakeDoubleReply(value)
+}
+
+// toScoredMembersReply WITHSCORES时成员与分数交替出现的数组转换为带有分数的成员列表
+func toScoredMembersReply(cmdLine CmdLine, reply redis.Reply) redis.Reply {
+	withScores := false
+	for _, arg := range cmdLine[1:] {
+		if strings.ToUpper(string(arg)) == "WITHSCORES" {
+			withScores = true
+		}
+	}
+	if !withScores {
+		return reply
+	}
+	switch r := reply.(type) {
+	case *protocol.EmptyMultiBulkReply:
+		return protocol.MakeScoredMembersReply(nil, nil)
+	case *protocol.MultiBulkReply:
+		if len(r.Args)%2 != 0 {
+			return reply
+		}
+		members := make([][]byte, 0, len(r.Args)/2)
+		scores := make([]float64, 0, len(r.Args)/2)
+		for i := 0; i < len(r.Args); i += 2 {
+			score, err := strconv.ParseFloat(string(r.Args[i+1]), 64)
+			if err != nil {
+				return reply
+			}
+			members = append(members, r.Args[i])
+			scores = append(scores, score)
+		}
+		return protocol.MakeScoredMembersReply(members, scores)
+	}
+	return reply
+}
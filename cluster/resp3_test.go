@@ -0,0 +1,60 @@
+package cluster
+
+import (
+	"gedis/lib/utils"
+	"gedis/redis/connection"
+	"gedis/redis/protocol"
+	"testing"
+)
+
+// execEncoded 在cluster上执行命令并按照连接协商的协议版本编码回复
+func execEncoded(cluster *Cluster, c *connection.FakeConn, args ...string) string {
+	return string(protocol.Encode(cluster.Exec(c, utils.ToCmdLine(args...)), c.GetProtocol()))
+}
+
+func TestRelayResp3(t *testing.T) {
+	nodes := startTestCluster(t, 2)
+	h := keyOn(nodes[0], nodes[1].self, "h")
+	s := keyOn(nodes[0], nodes[1].self, "s")
+	z := keyOn(nodes[0], nodes[1].self, "z")
+	c := connection.NewFakeConn()
+	if reply := execEncoded(nodes[0], c, "HELLO", "3"); reply[0] != '%' {
+		t.Fatalf("expect map reply actually %q", reply)
+	}
+
+	// 转发到其他节点的命令与单机的编码一致
+	assertReply(t, execEncoded(nodes[0], c, "HSET", h, "f", "v"), ":1\r\n")
+	assertReply(t, execEncoded(nodes[0], c, "HGETALL", h), "%1\r\n$1\r\nf\r\n$1\r\nv\r\n")
+	assertReply(t, execEncoded(nodes[0], c, "HGETALL", keyOn(nodes[0], nodes[1].self, "none")), "%0\r\n")
+	assertReply(t, execEncoded(nodes[0], c, "SADD", s, "m"), ":1\r\n")
+	assertReply(t, execEncoded(nodes[0], c, "SMEMBERS", s), "~1\r\n$1\r\nm\r\n")
+	assertReply(t, execEncoded(nodes[0], c, "ZADD", z, "1.5", "a"), ":1\r\n")
+	assertReply(t, execEncoded(nodes[0], c, "ZSCORE", z, "a"), ",1.5\r\n")
+	assertReply(t, execEncoded(nodes[0], c, "ZSCORE", z, "none"), "_\r\n")
+	assertReply(t, execEncoded(nodes[0], c, "ZINCRBY", z, "1", "a"), ",2.5\r\n")
+	assertReply(t, execEncoded(nodes[0], c, "ZRANGE", z, "0", "-1", "withscores"), "*1\r\n*2\r\n$1\r\na\r\n,2.5\r\n")
+	assertReply(t, execEncoded(nodes[0], c, "ZRANGE", z, "0", "-1"), "*1\r\n$1\r\na\r\n")
+	assertReply(t, execEncoded(nodes[0], c, "HGET", h, "none"), "_\r\n")
+	assertReply(t, execEncoded(nodes[0], c, "SMEMBERS", h), "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n")
+
+	// RESP2客户端不受影响
+	c2 := connection.NewFakeConn()
+	assertReply(t, execEncoded(nodes[0], c2, "HGETALL", h), "*2\r\n$1\r\nf\r\n$1\r\nv\r\n")
+	assertReply(t, execEncoded(nodes[0], c2, "ZSCORE", z, "a"), "$3\r\n2.5\r\n")
+}
+
+func TestExecAcrossNodesResp3(t *testing.T) {
+	nodes := startTestCluster(t, 2)
+	a := keyOn(nodes[0], nodes[0].self, "a")
+	h := keyOn(nodes[0], nodes[1].self, "h")
+	c := connection.NewFakeConn()
+	c.SetProtocol(protocol.RESP3)
+
+	assertReply(t, execEncoded(nodes[0], c, "MULTI"), "+OK\r\n")
+	assertReply(t, execEncoded(nodes[0], c, "ZINCRBY", a, "1.5", "m"), "+QUEUED\r\n")
+	assertReply(t, execEncoded(nodes[0], c, "HSET", h, "f", "v"), "+QUEUED\r\n")
+	assertReply(t, execEncoded(nodes[0], c, "HGETALL", h), "+QUEUED\r\n")
+	assertReply(t, execEncoded(nodes[0], c, "GET", a+"x"), "+QUEUED\r\n")
+	// 每个参与者按照客户端的协议版本编码结果
+	assertReply(t, execEncoded(nodes[0], c, "EXEC"), "*4\r\n,1.5\r\n:1\r\n%1\r\n$1\r\nf\r\n$1\r\nv\r\n_\r\n")
+}
@@ -0,0 +1,67 @@
+package cluster
+
+import (
+	"gedis/database"
+	"gedis/interface/redis"
+	"gedis/redis/protocol"
+)
+
+// CmdFunc 集群模式下需要特殊处理的命令的执行函数
+type CmdFunc func(cluster *Cluster, c redis.Connection, cmdLine CmdLine) redis.Reply
+
+// localCmd 内部命令，让节点直接在本地执行后面的命令，避免广播类命令被再次分发
+const localCmd = "_local"
+
+// multiControlCommands 事务状态下不入队的命令
+var multiControlCommands = map[string]bool{
+	"multi":   true,
+	"exec":    true,
+	"discard": true,
+	"watch":   true,
+}
+
+func makeRouter() map[string]CmdFunc {
+	routerMap := make(map[string]CmdFunc)
+	routerMap["mset"] = execMSet
+	routerMap["mget"] = execMGet
+	routerMap["del"] = execDel
+	routerMap["exists"] = execExists
+	routerMap["keys"] = execKeys
+	routerMap["flushall"] = execFlush
+	routerMap["flushdb"] = execFlush
+
+	routerMap["watch"] = execWatch
+	routerMap["exec"] = execMulti
+	routerMap["rename"] = execRename
+	routerMap["renamenx"] = execRenameNx
+	routerMap["smove"] = execSMove
+
+	routerMap[localCmd] = execLocal
+	routerMap[peerCmd] = execPeer
+	for name, cmdFunc := range txCommands {
+		routerMap[name] = peerOnly(cmdFunc)
+	}
+	return routerMap
+}
+
+// txCommands 分布式事务中协调者发送给参与者的命令，只接受其他节点的连接，协调者自身直接调用
+var txCommands = map[string]CmdFunc{
+	"prepare":  execPrepare,
+	"commit":   execCommit,
+	"rollback": execRollback,
+}
+
+// execLocal 执行 _local cmd [args...]
+// 只有广播的无key命令会带上 _local 前缀，命令涉及的key必须属于本节点，避免客户端借此绕过路由写入其他节点的数据
+func execLocal(cluster *Cluster, c redis.Connection, cmdLine CmdLine) redis.Reply {
+	if len(cmdLine) < 2 {
+		return protocol.MakeArgNumErrReply(localCmd)
+	}
+	keys, _ := database.GetRelatedKeys(cmdLine[1:])
+	for _, key := range keys {
+		if cluster.peerPicker.PickNode(key) != cluster.self {
+			return protocol.MakeErrReply("ERR key " + key + " of " + localCmd + " command does not belong to this node")
+		}
+	}
+	return cluster.db.Exec(c, cmdLine[1:])
+}
@@ -0,0 +1,32 @@
+package cluster
+
+import (
+	"gedis/redis/connection"
+	"strconv"
+	"testing"
+)
+
+func TestLocalRejectsForeignKeys(t *testing.T) {
+	nodes := startTestCluster(t, 2)
+	c := connection.NewFakeConn()
+	own := keyOn(nodes[0], nodes[0].self, "own")
+	foreign := keyOn(nodes[0], nodes[1].self, "foreign")
+
+	assertReply(t, exec(nodes[0], c, localCmd, "SET", own, "v"), "+OK\r\n")
+	// 属于其他节点的key不能通过 _local 写入本节点
+	reply := exec(nodes[0], c, localCmd, "SET", foreign, "v")
+	if reply[0] != '-' {
+		t.Fatalf("expect error actually %q", reply)
+	}
+	reply = exec(nodes[0], c, localCmd, "MSET", own, "v", foreign, "v")
+	if reply[0] != '-' {
+		t.Fatalf("expect error actually %q", reply)
+	}
+	assertReply(t, exec(nodes[1], c, "EXISTS", foreign), ":0\r\n")
+	assertReply(t, string(nodes[0].db.Exec(c, [][]byte{[]byte("EXISTS"), []byte(foreign)}).ToBytes()), ":0\r\n")
+
+	// 广播的无key命令仍然可以执行
+	assertReply(t, exec(nodes[0], c, "KEYS", own), "*1\r\n$"+strconv.Itoa(len(own))+"\r\n"+own+"\r\n")
+	assertReply(t, exec(nodes[0], c, "FLUSHALL"), "+OK\r\n")
+	assertReply(t, exec(nodes[0], c, "EXISTS", own), ":0\r\n")
+}
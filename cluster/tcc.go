@@ -0,0 +1,529 @@
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"gedis/aof"
+	"gedis/database"
+	"gedis/interface/redis"
+	"gedis/lib/logger"
+	"gedis/lib/timewheel"
+	"gedis/lib/utils"
+	"gedis/redis/connection"
+	"gedis/redis/protocol"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+跨节点的事务使用TCC(try-confirm-cancel)的方式执行，收到命令的节点作为协调者：
+1.协调者向所有参与的节点发送Prepare，参与者为key加锁、检查watch的版本并记录undo日志
+2.全部Prepare成功之后发送Commit，参与者执行命令并释放锁，任意Prepare失败时向所有参与者发送Rollback
+3.Commit请求失败时，例如连接中断，或者任意参与者的命令执行出错时，协调者向所有参与者发送Rollback，
+  已经提交的参与者重新加锁并重放undo日志。与单机的事务一致，一条命令出错整个事务都会被撤销
+参与者Prepare之后超过maxLockTime没有收到Commit时自动回滚，避免协调者崩溃之后key一直被锁住
+*/
+
+var (
+	// maxLockTime Prepare之后持有锁的最长时间
+	maxLockTime = 5 * time.Second
+	// undoLogTTL Commit之后保留undo日志的时间，在此期间协调者仍然可以回滚事务
+	undoLogTTL = 10 * time.Second
+)
+
+// errWatchChanged 参与者检查到watch的key已经被修改
+const errWatchChanged = "EXECABORT watched keys have been modified"
+
+type txStatus = int8
+
+const (
+	txPreparing txStatus = iota
+	txPrepared
+	txCommitted
+	txRolledBack
+)
+
+// txRequest 一个参与者在事务中需要执行的内容
+type txRequest struct {
+	cmdLines []CmdLine
+	// key->watch时的版本号，Prepare时版本号不一致则事务失败
+	watching map[string]uint32
+	// 需要在Prepare时返回其当前值的key，用于RENAME等需要跨节点搬运数据的命令
+	dumpKeys []string
+}
+
+func makeTxRequest() *txRequest {
+	return &txRequest{watching: make(map[string]uint32)}
+}
+
+// Transaction 参与者上的一个事务
+type Transaction struct {
+	id      string
+	cluster *Cluster
+	// 执行命令使用的连接，超时回滚时没有客户端连接，因此使用绑定了数据库的FakeConn
+	conn      *connection.FakeConn
+	dbIndex   int
+	req       *txRequest
+	writeKeys []string
+	readKeys  []string
+	undoLog   []CmdLine
+	status    txStatus
+	locked    bool
+	mu        sync.Mutex
+}
+
+func genTxTaskKey(txID string) string {
+	return "tcc:" + txID
+}
+
+func newTransaction(cluster *Cluster, id string, dbIndex int, req *txRequest) (*Transaction, error) {
+	writeKeys := make([]string, 0)
+	readKeys := make([]string, 0)
+	for _, cmdLine := range req.cmdLines {
+		write, read, ok := database.GetWriteReadKeys(cmdLine)
+		if !ok {
+			return nil, errors.New("ERR invalid command in transaction '" + string(cmdLine[0]) + "'")
+		}
+		writeKeys = append(writeKeys, write...)
+		readKeys = append(readKeys, read...)
+	}
+	for key := range req.watching {
+		readKeys = append(readKeys, key)
+	}
+	readKeys = append(readKeys, req.dumpKeys...)
+	conn := connection.NewFakeConn()
+	conn.SelectDB(dbIndex)
+	return &Transaction{
+		id:        id,
+		cluster:   cluster,
+		conn:      conn,
+		dbIndex:   dbIndex,
+		req:       req,
+		writeKeys: writeKeys,
+		readKeys:  readKeys,
+	}, nil
+}
+
+func (tx *Transaction) lockKeys() {
+	if !tx.locked {
+		tx.cluster.db.RWLocks(tx.dbIndex, tx.writeKeys, tx.readKeys)
+		tx.locked = true
+	}
+}
+
+// waitLockKeys 在不持有tx.mu时等待key的锁，等待期间Rollback以及协调者的超时仍然可以撤销事务
+// 加锁之后事务已经被回滚时释放锁并返回false，返回true时调用方持有tx.mu
+func (tx *Transaction) waitLockKeys() bool {
+	tx.cluster.db.RWLocks(tx.dbIndex, tx.writeKeys, tx.readKeys)
+	tx.mu.Lock()
+	if tx.status != txPreparing {
+		tx.mu.Unlock()
+		tx.cluster.db.RWUnLocks(tx.dbIndex, tx.writeKeys, tx.readKeys)
+		return false
+	}
+	tx.locked = true
+	return true
+}
+
+func (tx *Transaction) unLockKeys() {
+	if tx.locked {
+		tx.cluster.db.RWUnLocks(tx.dbIndex, tx.writeKeys, tx.readKeys)
+		tx.locked = false
+	}
+}
+
+// prepare 加锁，检查watch的版本，记录undo日志并返回dumpKeys的当前值
+func (tx *Transaction) prepare() redis.Reply {
+	// 等待加锁期间已经被回滚，例如协调者等待超时，或者与其他节点上的事务互相等待
+	if !tx.waitLockKeys() {
+		return protocol.MakeErrReply("ERR transaction " + tx.id + " has been rolled back")
+	}
+	defer tx.mu.Unlock()
+	tx.status = txPrepared
+	for key, version := range tx.req.watching {
+		reply := tx.cluster.db.ExecWithLock(tx.conn, utils.ToCmdLine("GetVer", key))
+		if intReply, ok := reply.(*protocol.IntReply); !ok || uint32(intReply.Code) != version {
+			tx.rollbackWithLock()
+			return protocol.MakeErrReply(errWatchChanged)
+		}
+	}
+	tx.undoLog = tx.cluster.db.GetUndoLogs(tx.dbIndex, tx.req.cmdLines)
+	dumps := make([][]byte, 0)
+	for _, key := range tx.req.dumpKeys {
+		dumps = append(dumps, encodeCmdLines(tx.dumpKey(key))...)
+	}
+	// 协调者崩溃或者失联时自动回滚
+	timewheel.Delay(maxLockTime, genTxTaskKey(tx.id), func() {
+		tx.mu.Lock()
+		defer tx.mu.Unlock()
+		if tx.status == txPrepared {
+			logger.Warn("transaction " + tx.id + " timeout, rollback")
+			tx.rollbackWithLock()
+		}
+	})
+	if len(tx.req.dumpKeys) == 0 {
+		return protocol.MakeOkReply()
+	}
+	return protocol.MakeMultiBulkReply(dumps)
+}
+
+// dumpKey 返回重建key所需的命令，key不存在时返回空
+func (tx *Transaction) dumpKey(key string) []CmdLine {
+	entity, ok := tx.cluster.db.GetEntity(tx.dbIndex, key)
+	if !ok {
+		return nil
+	}
+	cmd := aof.EntityToCmd(key, entity)
+	if cmd == nil {
+		return nil
+	}
+	cmdLines := []CmdLine{cmd.Args}
+	if expiration := tx.cluster.db.GetExpiration(tx.dbIndex, key); expiration != nil {
+		timestamp := strconv.FormatInt(expiration.UnixNano()/int64(time.Millisecond), 10)
+		cmdLines = append(cmdLines, utils.ToCmdLine("PEXPIREAT", key, timestamp))
+	}
+	return cmdLines
+}
+
+// commit 依次执行命令并释放锁，返回每条命令的回复按照客户端的协议版本编码之后的原始字节，执行出错的命令返回其错误
+func (tx *Transaction) commit(version int) redis.Reply {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.status != txPrepared {
+		return protocol.MakeErrReply("ERR transaction " + tx.id + " is not prepared")
+	}
+	timewheel.Cancel(genTxTaskKey(tx.id))
+	replies := make([][]byte, 0, len(tx.req.cmdLines))
+	for _, cmdLine := range tx.req.cmdLines {
+		result := tx.cluster.db.ExecWithLock(tx.conn, cmdLine)
+		replies = append(replies, protocol.Encode(result, version))
+	}
+	tx.status = txCommitted
+	tx.unLockKeys()
+	// 保留undo日志一段时间，其他参与者提交失败时仍然可以回滚
+	timewheel.Delay(undoLogTTL, genTxTaskKey(tx.id), func() {
+		tx.cluster.transactions.Remove(tx.id)
+	})
+	return protocol.MakeMultiBulkReply(replies)
+}
+
+// rollbackWithLock 撤销事务，调用方需要持有tx.mu
+func (tx *Transaction) rollbackWithLock() {
+	switch tx.status {
+	case txPrepared:
+		tx.unLockKeys()
+	case txCommitted:
+		// 提交之后锁已经释放，需要重新加锁再重放undo日志
+		tx.lockKeys()
+		for _, cmdLine := range tx.undoLog {
+			tx.cluster.db.ExecWithLock(tx.conn, cmdLine)
+		}
+		tx.unLockKeys()
+	}
+	tx.status = txRolledBack
+	timewheel.Cancel(genTxTaskKey(tx.id))
+	tx.cluster.transactions.Remove(tx.id)
+}
+
+func (tx *Transaction) rollback() redis.Reply {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	tx.rollbackWithLock()
+	return protocol.MakeOkReply()
+}
+
+/*---参与者处理的命令---*/
+
+// execPrepare Prepare txID <请求>
+func execPrepare(cluster *Cluster, c redis.Connection, cmdLine CmdLine) redis.Reply {
+	if len(cmdLine) < 3 {
+		return protocol.MakeArgNumErrReply(string(cmdLine[0]))
+	}
+	txID := string(cmdLine[1])
+	req, err := decodeTxRequest(cmdLine[2:])
+	if err != nil {
+		return protocol.MakeErrReply("ERR invalid prepare request: " + err.Error())
+	}
+	tx, err := newTransaction(cluster, txID, c.GetDBIndex(), req)
+	if err != nil {
+		return protocol.MakeErrReply(err.Error())
+	}
+	if cluster.transactions.PutIfAbsent(txID, tx) == 0 {
+		return protocol.MakeErrReply("ERR transaction " + txID + " already exists")
+	}
+	return tx.prepare()
+}
+
+// execCommit Commit txID [protover]，protover为客户端的协议版本，默认为RESP2
+func execCommit(cluster *Cluster, c redis.Connection, cmdLine CmdLine) redis.Reply {
+	if len(cmdLine) != 2 && len(cmdLine) != 3 {
+		return protocol.MakeArgNumErrReply(string(cmdLine[0]))
+	}
+	version := protocol.RESP2
+	if len(cmdLine) == 3 {
+		v, err := strconv.Atoi(string(cmdLine[2]))
+		if err != nil || (v != protocol.RESP2 && v != protocol.RESP3) {
+			return protocol.MakeErrReply("ERR invalid protocol version")
+		}
+		version = v
+	}
+	raw, ok := cluster.transactions.Get(string(cmdLine[1]))
+	if !ok {
+		return protocol.MakeErrReply("ERR transaction " + string(cmdLine[1]) + " not found")
+	}
+	return raw.(*Transaction).commit(version)
+}
+
+// execRollback Rollback txID，事务不存在时认为已经回滚
+func execRollback(cluster *Cluster, c redis.Connection, cmdLine CmdLine) redis.Reply {
+	if len(cmdLine) != 2 {
+		return protocol.MakeArgNumErrReply(string(cmdLine[0]))
+	}
+	raw, ok := cluster.transactions.Get(string(cmdLine[1]))
+	if !ok {
+		return protocol.MakeOkReply()
+	}
+	return raw.(*Transaction).rollback()
+}
+
+/*---协调者---*/
+
+// coordinator 协调者上的一个事务，记录所有收到过Prepare的参与者
+type coordinator struct {
+	cluster      *Cluster
+	conn         redis.Connection
+	id           string
+	mu           sync.Mutex
+	participants []string
+}
+
+func (cluster *Cluster) newCoordinator(c redis.Connection) *coordinator {
+	seq := atomic.AddUint64(&cluster.txSeq, 1)
+	return &coordinator{
+		cluster: cluster,
+		conn:    c,
+		id:      fmt.Sprintf("%s-%d-%d", cluster.self, cluster.bootTime, seq),
+	}
+}
+
+// execOnNode 当前节点直接调用事务命令的处理函数，其他节点通过连接池转发
+func (coord *coordinator) execOnNode(peer string, cmdLine CmdLine) redis.Reply {
+	if peer == coord.cluster.self {
+		return txCommands[strings.ToLower(string(cmdLine[0]))](coord.cluster, coord.conn, cmdLine)
+	}
+	return coord.cluster.relay(peer, coord.conn, cmdLine)
+}
+
+// each 并行地在多个节点上执行事务命令
+func (coord *coordinator) each(peers []string, makeCmd func(peer string) CmdLine) map[string]redis.Reply {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	replies := make(map[string]redis.Reply, len(peers))
+	for _, peer := range peers {
+		wg.Add(1)
+		go func(peer string) {
+			defer wg.Done()
+			reply := coord.execOnNode(peer, makeCmd(peer))
+			mu.Lock()
+			replies[peer] = reply
+			mu.Unlock()
+		}(peer)
+	}
+	wg.Wait()
+	return replies
+}
+
+// prepare 向参与者发送Prepare，任意参与者失败时回滚整个事务并返回它的错误
+func (coord *coordinator) prepare(requests map[string]*txRequest) (map[string]redis.Reply, redis.Reply) {
+	peers := make([]string, 0, len(requests))
+	coord.mu.Lock()
+	for peer := range requests {
+		peers = append(peers, peer)
+		// 请求超时时参与者可能已经完成了Prepare，同样需要回滚
+		coord.participants = append(coord.participants, peer)
+	}
+	coord.mu.Unlock()
+	replies := coord.each(peers, func(peer string) CmdLine {
+		return append(utils.ToCmdLine("Prepare", coord.id), encodeTxRequest(requests[peer])...)
+	})
+	if errReply := coord.firstError(replies); errReply != nil {
+		coord.rollback()
+		return nil, errReply
+	}
+	return replies, nil
+}
+
+// commit 向参与者发送Commit，Commit请求失败时回滚整个事务并返回它的错误
+// 参与者执行命令出错时错误包含在参与者返回的结果中，由调用方决定是否回滚
+// 参与者按照客户端的协议版本编码结果，RESP3客户端收到的HGETALL等命令的结果与单机一致
+func (coord *coordinator) commit(peers ...string) (map[string]redis.Reply, redis.Reply) {
+	version := strconv.Itoa(coord.conn.GetProtocol())
+	replies := coord.each(peers, func(peer string) CmdLine {
+		return utils.ToCmdLine("Commit", coord.id, version)
+	})
+	if errReply := coord.firstError(replies); errReply != nil {
+		coord.rollback()
+		return nil, errReply
+	}
+	return replies, nil
+}
+
+// rollback 向所有收到过Prepare的参与者发送Rollback
+func (coord *coordinator) rollback() {
+	coord.mu.Lock()
+	peers := coord.participants
+	coord.participants = nil
+	coord.mu.Unlock()
+	replies := coord.each(peers, func(peer string) CmdLine {
+		return utils.ToCmdLine("Rollback", coord.id)
+	})
+	for peer, reply := range replies {
+		if protocol.IsErrorReply(reply) {
+			logger.Warn(fmt.Sprintf("rollback transaction %s on %s failed: %s", coord.id, peer, string(reply.ToBytes())))
+		}
+	}
+}
+
+// firstError 按节点顺序返回第一个错误，watch的key被修改优先返回
+func (coord *coordinator) firstError(replies map[string]redis.Reply) redis.Reply {
+	var first redis.Reply
+	for _, node := range coord.cluster.nodes {
+		reply, ok := replies[node]
+		if !ok || !protocol.IsErrorReply(reply) {
+			continue
+		}
+		if isWatchChanged(reply) {
+			return reply
+		}
+		if first == nil {
+			first = reply
+		}
+	}
+	return first
+}
+
+func isWatchChanged(reply redis.Reply) bool {
+	errReply, ok := reply.(protocol.ErrorReply)
+	return ok && errReply.Error() == errWatchChanged
+}
+
+/*---Prepare请求的编码---*/
+
+// encodeCmdLines 将多条命令编码为一组参数：命令数量，然后是每条命令的参数个数以及参数
+func encodeCmdLines(cmdLines []CmdLine) [][]byte {
+	args := [][]byte{[]byte(strconv.Itoa(len(cmdLines)))}
+	for _, cmdLine := range cmdLines {
+		args = append(args, []byte(strconv.Itoa(len(cmdLine))))
+		args = append(args, cmdLine...)
+	}
+	return args
+}
+
+// decodeCmdLines 解析encodeCmdLines编码的命令，返回剩余的参数
+func decodeCmdLines(args [][]byte) ([]CmdLine, [][]byte, error) {
+	count, args, err := decodeCount(args)
+	if err != nil {
+		return nil, nil, err
+	}
+	cmdLines := make([]CmdLine, 0, count)
+	for i := 0; i < count; i++ {
+		var argc int
+		argc, args, err = decodeCount(args)
+		if err != nil {
+			return nil, nil, err
+		}
+		if argc == 0 || argc > len(args) {
+			return nil, nil, errors.New("malformed command")
+		}
+		cmdLines = append(cmdLines, args[:argc])
+		args = args[argc:]
+	}
+	return cmdLines, args, nil
+}
+
+func decodeCount(args [][]byte) (int, [][]byte, error) {
+	if len(args) == 0 {
+		return 0, nil, errors.New("unexpected end of arguments")
+	}
+	count, err := strconv.Atoi(string(args[0]))
+	if err != nil || count < 0 {
+		return 0, nil, errors.New("invalid count " + string(args[0]))
+	}
+	return count, args[1:], nil
+}
+
+// encodeTxRequest 编码格式：dumpKey数量 dumpKeys... watch数量 [key version]... 命令
+func encodeTxRequest(req *txRequest) [][]byte {
+	args := [][]byte{[]byte(strconv.Itoa(len(req.dumpKeys)))}
+	for _, key := range req.dumpKeys {
+		args = append(args, []byte(key))
+	}
+	args = append(args, []byte(strconv.Itoa(len(req.watching))))
+	for key, version := range req.watching {
+		args = append(args, []byte(key), []byte(strconv.FormatUint(uint64(version), 10)))
+	}
+	return append(args, encodeCmdLines(req.cmdLines)...)
+}
+
+func decodeTxRequest(args [][]byte) (*txRequest, error) {
+	req := makeTxRequest()
+	count, args, err := decodeCount(args)
+	if err != nil {
+		return nil, err
+	}
+	if count > len(args) {
+		return nil, errors.New("malformed dump keys")
+	}
+	for _, key := range args[:count] {
+		req.dumpKeys = append(req.dumpKeys, string(key))
+	}
+	args = args[count:]
+	count, args, err = decodeCount(args)
+	if err != nil {
+		return nil, err
+	}
+	if count*2 > len(args) {
+		return nil, errors.New("malformed watching keys")
+	}
+	for i := 0; i < count; i++ {
+		version, err := strconv.ParseUint(string(args[2*i+1]), 10, 32)
+		if err != nil {
+			return nil, errors.New("invalid version " + string(args[2*i+1]))
+		}
+		req.watching[string(args[2*i])] = uint32(version)
+	}
+	args = args[count*2:]
+	req.cmdLines, args, err = decodeCmdLines(args)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) > 0 {
+		return nil, errors.New("unexpected trailing arguments")
+	}
+	return req, nil
+}
+
+// commandError 返回Commit结果中第一条执行出错的命令的错误
+// 用于SMOVE等需要所有命令都成功的内部事务，出错时由调用方回滚
+func commandError(reply redis.Reply) redis.Reply {
+	multiBulk, ok := reply.(*protocol.MultiBulkReply)
+	if !ok {
+		return nil
+	}
+	for _, arg := range multiBulk.Args {
+		if len(arg) > 0 && arg[0] == '-' {
+			return protocol.MakeErrReply(strings.TrimSuffix(string(arg[1:]), protocol.CRLF))
+		}
+	}
+	return nil
+}
+
+// rawReply 参与者在Commit时以原始字节返回每条命令的回复，已经按照客户端的协议版本编码，协调者原样返回给客户端
+type rawReply []byte
+
+func (r rawReply) ToBytes() []byte {
+	return r
+}
@@ -0,0 +1,233 @@
+package cluster
+
+import (
+	"gedis/lib/utils"
+	"gedis/redis/client"
+	"gedis/redis/connection"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// execAsync 在后台执行命令，用于检查命令是否被事务的锁阻塞
+func execAsync(cluster *Cluster, args ...string) <-chan string {
+	ch := make(chan string, 1)
+	go func() {
+		ch <- exec(cluster, connection.NewFakeConn(), args...)
+	}()
+	return ch
+}
+
+func assertBlocked(t *testing.T, ch <-chan string) {
+	t.Helper()
+	select {
+	case reply := <-ch:
+		t.Fatalf("expect blocked actually %q", reply)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func waitReply(t *testing.T, ch <-chan string, timeout time.Duration) string {
+	t.Helper()
+	select {
+	case reply := <-ch:
+		return reply
+	case <-time.After(timeout):
+		t.Fatal("command blocked")
+		return ""
+	}
+}
+
+// peerConn 返回被标记为其他节点的连接，用于直接向参与者发送事务命令
+func peerConn() *connection.FakeConn {
+	c := connection.NewFakeConn()
+	c.SetPeer()
+	return c
+}
+
+// prepareOn 直接向参与者发送Prepare
+func prepareOn(t *testing.T, cluster *Cluster, txID string, cmdLines ...CmdLine) {
+	t.Helper()
+	req := makeTxRequest()
+	req.cmdLines = cmdLines
+	cmdLine := append(utils.ToCmdLine("Prepare", txID), encodeTxRequest(req)...)
+	assertReply(t, string(cluster.Exec(peerConn(), cmdLine).ToBytes()), "+OK\r\n")
+}
+
+func TestExecAcrossNodes(t *testing.T) {
+	nodes := startTestCluster(t, 2)
+	a := keyOn(nodes[0], nodes[0].self, "a")
+	b := keyOn(nodes[0], nodes[1].self, "b")
+	c := connection.NewFakeConn()
+
+	assertReply(t, exec(nodes[0], c, "MULTI"), "+OK\r\n")
+	assertReply(t, exec(nodes[0], c, "SET", a, "1"), "+QUEUED\r\n")
+	assertReply(t, exec(nodes[0], c, "SET", b, "x"), "+QUEUED\r\n")
+	assertReply(t, exec(nodes[0], c, "INCR", a), "+QUEUED\r\n")
+	assertReply(t, exec(nodes[0], c, "EXEC"), "*3\r\n+OK\r\n+OK\r\n:2\r\n")
+	assertReply(t, exec(nodes[0], c, "GET", a), "$1\r\n2\r\n")
+	assertReply(t, exec(nodes[0], c, "GET", b), "$1\r\nx\r\n")
+	// 事务结束之后锁都已经释放
+	assertReply(t, waitReply(t, execAsync(nodes[1], "SET", b, "y"), time.Second), "+OK\r\n")
+}
+
+func TestExecAcrossNodesAbort(t *testing.T) {
+	nodes := startTestCluster(t, 2)
+	a := keyOn(nodes[0], nodes[0].self, "a")
+	b := keyOn(nodes[0], nodes[1].self, "b")
+	c := connection.NewFakeConn()
+	assertReply(t, exec(nodes[0], c, "SET", a, "1"), "+OK\r\n")
+
+	assertReply(t, exec(nodes[0], c, "MULTI"), "+OK\r\n")
+	assertReply(t, exec(nodes[0], c, "INCR", a), "+QUEUED\r\n")
+	assertReply(t, exec(nodes[0], c, "SET", b, "x"), "+QUEUED\r\n")
+	assertReply(t, exec(nodes[0], c, "INCR", b), "+QUEUED\r\n")
+	assertReply(t, exec(nodes[0], c, "SET", a, "y"), "+QUEUED\r\n")
+	// 与单机的事务一致，INCR出错时撤销所有节点上已经执行的命令
+	assertReply(t, exec(nodes[0], c, "EXEC"), "-EXECABORT Transaction discarded because of previous errors.\r\n")
+	assertReply(t, exec(nodes[0], c, "GET", a), "$1\r\n1\r\n")
+	assertReply(t, exec(nodes[0], c, "GET", b), "$-1\r\n")
+	assertReply(t, waitReply(t, execAsync(nodes[1], "SET", b, "y"), time.Second), "+OK\r\n")
+	assertReply(t, waitReply(t, execAsync(nodes[0], "SET", a, "2"), time.Second), "+OK\r\n")
+}
+
+func TestExecWatchAcrossNodes(t *testing.T) {
+	nodes := startTestCluster(t, 2)
+	a := keyOn(nodes[0], nodes[0].self, "a")
+	b := keyOn(nodes[0], nodes[1].self, "b")
+	c := connection.NewFakeConn()
+
+	assertReply(t, exec(nodes[0], c, "WATCH", b), "+OK\r\n")
+	assertReply(t, exec(nodes[0], connection.NewFakeConn(), "SET", b, "changed"), "+OK\r\n")
+	assertReply(t, exec(nodes[0], c, "MULTI"), "+OK\r\n")
+	assertReply(t, exec(nodes[0], c, "SET", a, "1"), "+QUEUED\r\n")
+	assertReply(t, exec(nodes[0], c, "SET", b, "1"), "+QUEUED\r\n")
+	assertReply(t, exec(nodes[0], c, "EXEC"), "*0\r\n")
+	assertReply(t, exec(nodes[0], c, "GET", a), "$-1\r\n")
+	assertReply(t, exec(nodes[0], c, "GET", b), "$7\r\nchanged\r\n")
+}
+
+func TestPrepareRollback(t *testing.T) {
+	nodes := startTestCluster(t, 1)
+	c := peerConn()
+	assertReply(t, exec(nodes[0], c, "SET", "k", "old"), "+OK\r\n")
+
+	prepareOn(t, nodes[0], "tx1", utils.ToCmdLine("SET", "k", "new"))
+	// Prepare之后key被锁住，直到回滚
+	blocked := execAsync(nodes[0], "GET", "k")
+	assertBlocked(t, blocked)
+	assertReply(t, exec(nodes[0], c, "Rollback", "tx1"), "+OK\r\n")
+	assertReply(t, waitReply(t, blocked, time.Second), "$3\r\nold\r\n")
+	// 回滚之后事务不存在
+	assertReply(t, exec(nodes[0], c, "Commit", "tx1"), "-ERR transaction tx1 not found\r\n")
+}
+
+func TestCommitRollback(t *testing.T) {
+	nodes := startTestCluster(t, 1)
+	c := peerConn()
+	assertReply(t, exec(nodes[0], c, "SADD", "set", "a", "b"), ":2\r\n")
+	assertReply(t, exec(nodes[0], c, "EXPIRE", "set", "100"), ":1\r\n")
+
+	prepareOn(t, nodes[0], "tx1", utils.ToCmdLine("DEL", "set"), utils.ToCmdLine("SET", "set", "v"))
+	assertReply(t, exec(nodes[0], c, "Commit", "tx1"), "*2\r\n$4\r\n:1\r\n\r\n$5\r\n+OK\r\n\r\n")
+	assertReply(t, exec(nodes[0], c, "GET", "set"), "$1\r\nv\r\n")
+	// 其他参与者提交失败时，已经提交的参与者重放undo日志
+	assertReply(t, exec(nodes[0], c, "Rollback", "tx1"), "+OK\r\n")
+	assertReply(t, exec(nodes[0], c, "SCARD", "set"), ":2\r\n")
+	assertReply(t, exec(nodes[0], c, "SISMEMBER", "set", "b"), ":1\r\n")
+	if ttl, err := strconv.Atoi(strings.Trim(exec(nodes[0], c, "TTL", "set"), ":\r\n")); err != nil || ttl < 90 || ttl > 100 {
+		t.Errorf("expect ttl restored actually %d %v", ttl, err)
+	}
+}
+
+func TestRollbackWhilePrepareBlocked(t *testing.T) {
+	nodes := startTestCluster(t, 1)
+	c := peerConn()
+	prepareOn(t, nodes[0], "tx1", utils.ToCmdLine("SET", "k", "v1"))
+
+	// tx2等待tx1持有的锁，等待期间可以被回滚
+	req := makeTxRequest()
+	req.cmdLines = []CmdLine{utils.ToCmdLine("SET", "k", "v2")}
+	prepared := make(chan string, 1)
+	go func() {
+		cmdLine := append(utils.ToCmdLine("Prepare", "tx2"), encodeTxRequest(req)...)
+		prepared <- string(nodes[0].Exec(peerConn(), cmdLine).ToBytes())
+	}()
+	assertBlocked(t, prepared)
+	rollback := make(chan string, 1)
+	go func() {
+		rollback <- exec(nodes[0], peerConn(), "Rollback", "tx2")
+	}()
+	assertReply(t, waitReply(t, rollback, time.Second), "+OK\r\n")
+
+	// tx1释放锁之后tx2得知已经被回滚，不再持有锁
+	assertReply(t, exec(nodes[0], c, "Commit", "tx1"), "*1\r\n$5\r\n+OK\r\n\r\n")
+	assertReply(t, waitReply(t, prepared, time.Second), "-ERR transaction tx2 has been rolled back\r\n")
+	assertReply(t, waitReply(t, execAsync(nodes[0], "SET", "k", "v3"), time.Second), "+OK\r\n")
+	assertReply(t, exec(nodes[0], c, "Commit", "tx2"), "-ERR transaction tx2 not found\r\n")
+}
+
+func TestTxCommandsPeerOnly(t *testing.T) {
+	nodes := startTestCluster(t, 2)
+	c := connection.NewFakeConn()
+	// 普通客户端不能发送事务命令
+	for _, cmd := range []string{"Prepare", "Commit", "Rollback"} {
+		assertReply(t, exec(nodes[0], c, cmd, "tx1", "x"), "-ERR unknown command '"+cmd+"'\r\n")
+	}
+	assertReply(t, exec(nodes[0], c, "_peer", nodes[1].self), "-ERR connection is not from cluster node "+nodes[1].self+"\r\n")
+	assertReply(t, exec(nodes[0], c, "_peer", "127.0.0.1:1"), "-ERR unknown cluster node 127.0.0.1:1\r\n")
+	assertReply(t, exec(nodes[0], c, "Rollback", "tx1"), "-ERR unknown command 'Rollback'\r\n")
+
+	// 从其他节点所在的主机建立的连接握手之后可以发送事务命令
+	conn, err := client.Dial(client.Config{
+		Addr:         nodes[0].self,
+		InitCmdLines: []CmdLine{utils.ToCmdLine("_peer", nodes[1].self)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reply, err := conn.Do(utils.ToCmdLine("Rollback", "tx1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertReply(t, string(reply.ToBytes()), "+OK\r\n")
+}
+
+func TestPrepareTimeout(t *testing.T) {
+	nodes := startTestCluster(t, 1)
+	defaultLockTime := maxLockTime
+	maxLockTime = time.Second
+	defer func() {
+		maxLockTime = defaultLockTime
+	}()
+	c := peerConn()
+
+	prepareOn(t, nodes[0], "tx1", utils.ToCmdLine("SET", "k", "v"))
+	blocked := execAsync(nodes[0], "SET", "k", "other")
+	assertBlocked(t, blocked)
+	// 协调者没有发送Commit，超时之后自动回滚并释放锁
+	assertReply(t, waitReply(t, blocked, 5*time.Second), "+OK\r\n")
+	assertReply(t, exec(nodes[0], c, "Commit", "tx1"), "-ERR transaction tx1 not found\r\n")
+	assertReply(t, exec(nodes[0], c, "GET", "k"), "$5\r\nother\r\n")
+}
+
+func TestSMoveAcrossNodes(t *testing.T) {
+	nodes := startTestCluster(t, 2)
+	src := keyOn(nodes[0], nodes[0].self, "src")
+	dest := keyOn(nodes[0], nodes[1].self, "dest")
+	c := connection.NewFakeConn()
+
+	assertReply(t, exec(nodes[0], c, "SADD", src, "m"), ":1\r\n")
+	assertReply(t, exec(nodes[0], c, "SET", dest, "v"), "+OK\r\n")
+	// dest不是集合，src上已经提交的SREM被回滚
+	assertReply(t, exec(nodes[0], c, "SMOVE", src, dest, "m"),
+		"-WRONGTYPE Operation against a key holding the wrong kind of value\r\n")
+	assertReply(t, exec(nodes[0], c, "SISMEMBER", src, "m"), ":1\r\n")
+
+	assertReply(t, exec(nodes[0], c, "DEL", dest), ":1\r\n")
+	assertReply(t, exec(nodes[0], c, "SMOVE", src, dest, "m"), ":1\r\n")
+	assertReply(t, exec(nodes[0], c, "SISMEMBER", src, "m"), ":0\r\n")
+	assertReply(t, exec(nodes[0], c, "SISMEMBER", dest, "m"), ":1\r\n")
+}
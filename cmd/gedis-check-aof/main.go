@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"gedis/aof"
+	"os"
+	"strings"
+)
+
+// confirm 与redis-check-aof一致，修复会丢弃大量数据时需要用户确认
+func confirm() bool {
+	fmt.Print("Continue? [y/N]: ")
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	return strings.ToLower(strings.TrimSpace(answer)) == "y"
+}
+
+// gedis-check-aof 离线校验aof文件，使用--fix截断最后一条完整命令之后的内容
+// 文件中间的命令损坏时需要确认，rdb前言损坏时拒绝修复
+func main() {
+	fix := flag.Bool("fix", false, "truncate the file after the last valid command")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [--fix] <file.aof>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	filename := flag.Arg(0)
+	info, err := os.Stat(filename)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot open file: %v\n", err)
+		os.Exit(1)
+	}
+	size := info.Size()
+
+	validSize, err := aof.CheckAof(filename)
+	formatErr, isFormatErr := err.(*aof.FormatError)
+	if err != nil && !isFormatErr {
+		fmt.Fprintf(os.Stderr, "Cannot read file: %v\n", err)
+		os.Exit(1)
+	}
+	if isFormatErr {
+		fmt.Printf("0x%08x: %s\n", formatErr.Offset, formatErr.Reason)
+	}
+	fmt.Printf("AOF analyzed: size=%d, ok_up_to=%d, diff=%d\n", size, validSize, size-validSize)
+	if err == nil {
+		fmt.Println("AOF is valid")
+		return
+	}
+	if !*fix {
+		fmt.Println("AOF is not valid. Use the --fix option to try fixing it.")
+		os.Exit(1)
+	}
+	if formatErr.Preamble {
+		fmt.Println("RDB preamble of AOF file is not sane, aborting.")
+		os.Exit(1)
+	}
+	if !formatErr.Truncated {
+		fmt.Printf("!!! Corruption found in the middle of the file, all data after offset %d will be discarded\n", validSize)
+		if !confirm() {
+			fmt.Println("Aborting...")
+			os.Exit(1)
+		}
+	}
+	fmt.Printf("This will shrink the AOF from %d bytes, with %d bytes, to %d bytes\n", size, size-validSize, validSize)
+	if err := os.Truncate(filename, validSize); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to truncate AOF: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println("Successfully truncated AOF")
+}
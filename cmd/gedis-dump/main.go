@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"gedis/aof"
+	"gedis/config"
+	"gedis/database"
+	"gedis/redis/client"
+	"gedis/redis/protocol"
+	"io"
+	"net"
+	"os"
+	"strconv"
+
+	rdb "github.com/hdt3213/rdb/parser"
+)
+
+// importBatchSize 导入时每条jsonrestore命令携带的行数
+const importBatchSize = 100
+
+// gedis-dump 以JSON Lines格式导出或导入数据，每行一个key
+// export 通过jsondump从运行中的gedis导出，指定-rdb时离线读取rdb文件导出
+// import 通过jsonrestore将文件中的记录写入运行中的gedis
+func main() {
+	host := flag.String("h", "127.0.0.1", "server host")
+	port := flag.Int("p", 6379, "server port")
+	password := flag.String("a", "", "password")
+	dbIndex := flag.Int("n", -1, "only export this database, -1 for all databases")
+	filename := flag.String("file", "", "file to write or read, default stdout or stdin")
+	rdbFile := flag.String("rdb", "", "export from a rdb file instead of a running server")
+	databases := flag.Int("databases", 16, "number of databases, used with -rdb")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] export|import\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	addr := net.JoinHostPort(*host, strconv.Itoa(*port))
+
+	switch flag.Arg(0) {
+	case "export":
+		out := os.Stdout
+		if *filename != "" {
+			file, err := os.Create(*filename)
+			if err != nil {
+				fatal(err)
+			}
+			defer file.Close()
+			out = file
+		}
+		var err error
+		if *rdbFile != "" {
+			config.Properties.Databases = *databases
+			err = exportRDB(out, *rdbFile, *dbIndex)
+		} else {
+			err = exportServer(out, addr, *password, *dbIndex)
+		}
+		if err != nil {
+			fatal(err)
+		}
+	case "import":
+		in := os.Stdin
+		if *filename != "" {
+			file, err := os.Open(*filename)
+			if err != nil {
+				fatal(err)
+			}
+			defer file.Close()
+			in = file
+		}
+		count, err := importServer(in, addr, *password)
+		fmt.Fprintf(os.Stderr, "imported %d keys\n", count)
+		if err != nil {
+			fatal(err)
+		}
+	default:
+		flag.Usage()
+		os.Exit(1)
+	}
+}
+
+// exportRDB 将rdb文件加载到内存中再导出
+func exportRDB(out io.Writer, filename string, dbIndex int) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	db := database.MakeBasicMultiDB()
+	if err := db.LoadRDB(rdb.NewDecoder(file)); err != nil {
+		return err
+	}
+	return aof.ExportJSONL(out, db, dbIndex)
+}
+
+func exportServer(out io.Writer, addr string, password string, dbIndex int) error {
+	conn, err := dial(addr, password)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	cmdLine := [][]byte{[]byte("JSONDUMP")}
+	if dbIndex >= 0 {
+		cmdLine = append(cmdLine, []byte(strconv.Itoa(dbIndex)))
+	}
+	reply, err := conn.Do(cmdLine)
+	if err != nil {
+		return err
+	}
+	switch r := reply.(type) {
+	case *protocol.BulkReply:
+		_, err = out.Write(r.Arg)
+		return err
+	case *protocol.NullBulkReply:
+		// 没有任何数据
+		return nil
+	}
+	return fmt.Errorf("unexpected reply: %q", string(reply.ToBytes()))
+}
+
+// importServer 分批发送jsonrestore，返回导入的key的数量
+func importServer(in io.Reader, addr string, password string) (int, error) {
+	conn, err := dial(addr, password)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 0, 64*1024), 512*1024*1024)
+	count := 0
+	batch := [][]byte{[]byte("JSONRESTORE")}
+	flush := func() error {
+		if len(batch) == 1 {
+			return nil
+		}
+		reply, err := conn.Do(batch)
+		if err != nil {
+			return err
+		}
+		n, ok := reply.(*protocol.IntReply)
+		if !ok {
+			return fmt.Errorf("import failed after %d keys: %s", count, string(reply.ToBytes()))
+		}
+		count += int(n.Code)
+		batch = batch[:1]
+		return nil
+	}
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		batch = append(batch, append([]byte(nil), line...))
+		if len(batch) > importBatchSize {
+			if err := flush(); err != nil {
+				return count, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return count, err
+	}
+	return count, flush()
+}
+
+// dial 连接服务端，导入导出大量数据时不限制等待回复的时间
+func dial(addr string, password string) (*client.Conn, error) {
+	return client.Dial(client.Config{
+		Addr:        addr,
+		Password:    password,
+		ReadTimeout: -1,
+	})
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, err.Error())
+	os.Exit(1)
+}
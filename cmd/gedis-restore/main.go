@@ -0,0 +1,112 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"gedis/aof"
+	"gedis/config"
+	"gedis/database"
+	"os"
+	"strconv"
+	"time"
+)
+
+// gedis-restore 将aof重放到指定的时间点，并将结果保存为rdb文件
+// 使用生成的rdb文件启动gedis即可得到该时间点的数据
+func main() {
+	until := flag.String("until", "", "restore point, unix ms, RFC3339 or \"2006-01-02 15:04:05\" in local time")
+	manifestPath := flag.String("manifest", "", "manifest of a segmented aof, e.g. appendonlydir/appendonly.aof.manifest")
+	aofPath := flag.String("aof", "", "a single aof file written with aof-timestamp-enabled")
+	output := flag.String("output", "restore.rdb", "rdb file to write")
+	databases := flag.Int("databases", 16, "number of databases")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s -until <time> (-manifest <file> | -aof <file>) [-output restore.rdb]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *until == "" || (*manifestPath == "") == (*aofPath == "") {
+		flag.Usage()
+		os.Exit(1)
+	}
+	untilMs, err := parseTime(*until)
+	if err != nil {
+		fatal(err)
+	}
+	config.Properties.Databases = *databases
+
+	files := []string{*aofPath}
+	if *manifestPath != "" {
+		if files, err = restoreFiles(*manifestPath, untilMs); err != nil {
+			fatal(err)
+		}
+	}
+
+	db := database.MakeBasicMultiDB()
+	if err := replay(db, files, untilMs); err != nil {
+		fatal(err)
+	}
+	if err := aof.SaveRDB(*output, db); err != nil {
+		fatal(err)
+	}
+	for i := 0; i < *databases; i++ {
+		keys, expires := db.GetDBSize(i)
+		if keys > 0 {
+			fmt.Printf("db%d: keys=%d, expires=%d\n", i, keys, expires)
+		}
+	}
+	fmt.Printf("restored to %s, saved to %s\n", time.Unix(0, untilMs*int64(time.Millisecond)).Format(time.RFC3339Nano), *output)
+}
+
+// restoreFiles 返回恢复到untilMs时需要按顺序重放的段文件
+func restoreFiles(manifestPath string, untilMs int64) ([]string, error) {
+	manifest, err := aof.LoadManifest(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+	chain, err := manifest.RestoreChain(untilMs)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, seg := range chain {
+		// 增量段的创建时间晚于恢复点时，其中的命令都不需要重放
+		if !seg.IsBase() && seg.Start > untilMs {
+			break
+		}
+		files = append(files, manifest.Path(seg))
+	}
+	return files, nil
+}
+
+// replay 依次重放files，遇到晚于untilMs的时间戳标记时停止
+func replay(db *database.MultiDB, files []string, untilMs int64) error {
+	for _, filename := range files {
+		fmt.Printf("replaying %s\n", filename)
+		_, stopped, err := aof.ReplayFile(db, filename, 0, untilMs)
+		if err != nil {
+			return err
+		}
+		if stopped {
+			break
+		}
+	}
+	return nil
+}
+
+func parseTime(s string) (int64, error) {
+	if ms, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return ms, nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t.UnixNano() / 1e6, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02 15:04:05", s, time.Local); err == nil {
+		return t.UnixNano() / 1e6, nil
+	}
+	return 0, fmt.Errorf("invalid time: %s", s)
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, err.Error())
+	os.Exit(1)
+}
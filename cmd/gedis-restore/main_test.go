@@ -0,0 +1,107 @@
+package main
+
+import (
+	"gedis/aof"
+	"gedis/database"
+	"gedis/lib/utils"
+	"gedis/redis/connection"
+	"gedis/redis/protocol"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeSegment 将命令以aof格式写入dir中的文件
+func writeSegment(t *testing.T, dir string, name string, cmdLines ...[]string) {
+	var builder strings.Builder
+	for _, args := range cmdLines {
+		builder.Write(protocol.MakeMultiBulkReply(utils.ToCmdLine(args...)).ToBytes())
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(builder.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	dir := t.TempDir()
+	writeSegment(t, dir, "appendonly.aof.1.base.aof",
+		[]string{"SET", "a", "1"},
+	)
+	writeSegment(t, dir, "appendonly.aof.2.incr.aof",
+		[]string{aof.TimestampCmd, "2000"},
+		[]string{"SET", "a", "2"},
+		[]string{aof.TimestampCmd, "3000"},
+		[]string{"SET", "a", "3"},
+		[]string{"SELECT", "1"},
+		[]string{"SET", "c", "1"},
+	)
+	writeSegment(t, dir, "appendonly.aof.3.base.aof",
+		[]string{"SET", "a", "3"},
+		[]string{"SET", "b", "1"},
+	)
+	writeSegment(t, dir, "appendonly.aof.4.incr.aof",
+		[]string{aof.TimestampCmd, "4000"},
+		[]string{"SET", "b", "2"},
+		[]string{aof.TimestampCmd, "5000"},
+		[]string{"DEL", "a"},
+	)
+	manifestPath := aof.ManifestPath(dir, "appendonly.aof")
+	manifest := "file appendonly.aof.1.base.aof seq 1 type b start 1000\n" +
+		"file appendonly.aof.2.incr.aof seq 2 type i start 2000\n" +
+		"file appendonly.aof.3.base.aof seq 3 type b start 3500\n" +
+		"file appendonly.aof.4.incr.aof seq 4 type i start 4000\n"
+	if err := ioutil.WriteFile(manifestPath, []byte(manifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		untilMs int64
+		files   []string
+		// db0中a与b的值，以及db1中c的值，空字符串代表key不存在
+		a, b, c string
+	}{
+		// 增量段在恢复点之后创建，不需要重放
+		{untilMs: 1500, files: []string{"1.base"}, a: "1"},
+		// 在晚于恢复点的时间戳标记处停止
+		{untilMs: 2500, files: []string{"1.base", "2.incr"}, a: "2"},
+		{untilMs: 3000, files: []string{"1.base", "2.incr"}, a: "3", c: "1"},
+		{untilMs: 3800, files: []string{"3.base"}, a: "3", b: "1"},
+		{untilMs: 4500, files: []string{"3.base", "4.incr"}, a: "3", b: "2"},
+		{untilMs: 6000, files: []string{"3.base", "4.incr"}, b: "2"},
+	}
+	get := func(db *database.MultiDB, dbIndex int, key string) string {
+		conn := connection.NewFakeConn()
+		conn.SelectDB(dbIndex)
+		reply, ok := db.Exec(conn, utils.ToCmdLine("GET", key)).(*protocol.BulkReply)
+		if !ok {
+			return ""
+		}
+		return string(reply.Arg)
+	}
+	for _, c := range cases {
+		files, err := restoreFiles(manifestPath, c.untilMs)
+		if err != nil {
+			t.Fatalf("until %d: %v", c.untilMs, err)
+		}
+		expectFiles := make([]string, len(c.files))
+		for i, name := range c.files {
+			expectFiles[i] = filepath.Join(dir, "appendonly.aof."+name+".aof")
+		}
+		if strings.Join(files, ",") != strings.Join(expectFiles, ",") {
+			t.Fatalf("until %d: expect %v actually %v", c.untilMs, expectFiles, files)
+		}
+		db := database.MakeBasicMultiDB()
+		if err := replay(db, files, c.untilMs); err != nil {
+			t.Fatalf("until %d: %v", c.untilMs, err)
+		}
+		if a, b, cc := get(db, 0, "a"), get(db, 0, "b"), get(db, 1, "c"); a != c.a || b != c.b || cc != c.c {
+			t.Errorf("until %d: expect a=%q b=%q c=%q actually a=%q b=%q c=%q", c.untilMs, c.a, c.b, c.c, a, b, cc)
+		}
+	}
+
+	// 恢复点早于最早的快照段时无法恢复
+	if _, err := restoreFiles(manifestPath, 500); err == nil {
+		t.Error("expect error when restoring before the first snapshot")
+	}
+}
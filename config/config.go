@@ -1,8 +1,11 @@
 package config
 
 import (
+	"errors"
 	"gopkg.in/yaml.v3"
 	"io/ioutil"
+	"strconv"
+	"strings"
 )
 
 var Banner = `
@@ -14,26 +17,151 @@ var Banner = `
  ╚═════╝ ╚══════╝╚═════╝ ╚═╝╚══════╝
 `
 var DefaultProperties = &ServerProperties{
-	Bind:       "0.0.0.0",
-	Port:       6399,
-	MaxClients: 1000,
+	Bind:             "0.0.0.0",
+	Port:             6399,
+	MaxClients:       1000,
+	AppendFilename:   "appendonly.aof",
+	AppendFsync:      "everysec",
+	RDBFilename:      "dump.rdb",
+	AofLoadTruncated: true,
+	AppendDirname:    "appendonlydir",
+	AofPitrHistory:   2,
+	Save:             []string{"3600 1", "300 100", "60 10000"},
+	ReplBacklogSize:  "1mb",
+
+	ProtoMaxBulkLen:      "512mb",
+	ProtoMaxMultiBulkLen: 1024 * 1024,
+	TLSAuthClients:       "yes",
+
+	ClusterConfigFile:  "nodes.conf",
+	ClusterNodeTimeout: 15000,
+
+	RaftDir:               "raft",
+	RaftElectionTimeout:   1000,
+	RaftSnapshotThreshold: 10000,
+
+	AutoAofRewritePercentage: 100,
+	AutoAofRewriteMinSize:    "64mb",
 }
 
 type ServerProperties struct {
-	Bind        string   `yaml:"bind"`
-	Port        int      `yaml:"port"`
-	MaxClients  int      `yaml:"maxclients"`
-	RequirePass string   `yaml:"requirepass"`
-	Databases   int      `yaml:"databases"`
-	Peers       []string `yaml:"peers"`
+	Bind        string `yaml:"bind"`
+	Port        int    `yaml:"port"`
+	MaxClients  int    `yaml:"maxclients"`
+	RequirePass string `yaml:"requirepass"`
+	Databases   int    `yaml:"databases"`
+	// 集群中其他节点的地址，不为空时以集群模式运行
+	Peers []string `yaml:"peers"`
+	// 当前节点在集群中的地址，为空时使用bind:port
+	Self string `yaml:"self"`
+
+	// 客户端请求中单个参数的最大长度，例如512mb，超过时回复协议错误并关闭连接
+	ProtoMaxBulkLen string `yaml:"proto-max-bulk-len"`
+	// 客户端请求中一条命令的最大参数数量
+	ProtoMaxMultiBulkLen int64 `yaml:"proto-max-multibulk-len"`
+
+	// TLS
+	// 大于0时在该端口上监听TLS连接，port为0时只监听TLS，主从复制与集群之间的连接仍然使用port
+	TLSPort     int    `yaml:"tls-port"`
+	TLSCertFile string `yaml:"tls-cert-file"`
+	TLSKeyFile  string `yaml:"tls-key-file"`
+	// 校验客户端证书使用的CA证书
+	TLSCACertFile string `yaml:"tls-ca-cert-file"`
+	// 是否要求客户端提供证书，yes|optional|no
+	TLSAuthClients string `yaml:"tls-auth-clients"`
+
+	// aof持久化
+	AppendOnly     bool   `yaml:"appendonly"`
+	AppendFilename string `yaml:"appendfilename"`
+	// always|everysec|no
+	AppendFsync string `yaml:"appendfsync"`
+	// aof文件相比上次重写增长的百分比超过该值时自动重写，0代表关闭自动重写
+	AutoAofRewritePercentage int `yaml:"auto-aof-rewrite-percentage"`
+	// 自动重写时aof文件的最小体积，例如64mb
+	AutoAofRewriteMinSize string `yaml:"auto-aof-rewrite-min-size"`
+	// 重写aof时以rdb格式写入数据，之后的命令以resp格式追加
+	AofUseRdbPreamble bool `yaml:"aof-use-rdb-preamble"`
+	// aof文件结尾的命令不完整时是否截断之后继续启动
+	AofLoadTruncated bool `yaml:"aof-load-truncated"`
+	// 每秒在aof中写入一次时间戳标记，用于按时间点恢复
+	AofTimestampEnabled bool `yaml:"aof-timestamp-enabled"`
+	// 大于0时开启分段aof，增量段超过该大小时切换到新的段，例如64mb
+	AofSegmentSize string `yaml:"aof-segment-size"`
+	// 分段aof以及manifest所在的目录
+	AppendDirname string `yaml:"appenddirname"`
+	// 重写之后保留的历史代数，用于恢复到更早的时间点
+	AofPitrHistory int `yaml:"aof-pitr-history"`
+
+	// rdb持久化
+	RDBFilename string `yaml:"dbfilename"`
+	// 自动bgsave的规则，每一项为 "<seconds> <changes>"，为空时关闭自动保存
+	Save []string `yaml:"save"`
+
+	// 主从复制
+	// 启动时作为从节点复制的主节点，格式为 "<host> <port>"
+	ReplicaOf string `yaml:"replicaof"`
+	// 连接主节点时使用的密码
+	MasterAuth string `yaml:"masterauth"`
+	// 复制积压缓冲区的大小，从节点断线重连时在其中查找缺失的命令，例如1mb
+	ReplBacklogSize string `yaml:"repl-backlog-size"`
+
+	// redis cluster兼容的slot集群
+	// 开启之后key不属于当前节点时返回MOVED/ASK，由客户端重定向，不能与peers同时使用
+	ClusterEnabled bool `yaml:"cluster-enabled"`
+	// 每个节点负责的slot，每一项为 "<host:port> <slot或start-end> ..."，nodes.conf存在时以它为准
+	ClusterSlots []string `yaml:"cluster-slots"`
+	// 保存集群拓扑的文件
+	ClusterConfigFile string `yaml:"cluster-config-file"`
+	// 节点之间交换心跳的集群总线端口，为0时使用port+10000
+	ClusterPort int `yaml:"cluster-port"`
+	// 超过该毫秒数没有回复心跳的节点被标记为疑似下线
+	ClusterNodeTimeout int `yaml:"cluster-node-timeout"`
+
+	// raft强一致模式
+	// 开启之后self与peers组成raft集群，写命令提交到多数节点之后才会执行，节点之间通过port+10000端口通信
+	RaftEnabled bool `yaml:"raft-enabled"`
+	// 保存raft日志、任期以及快照的目录
+	RaftDir string `yaml:"raft-dir"`
+	// 超过该毫秒数没有收到leader的心跳时发起选举
+	RaftElectionTimeout int `yaml:"raft-election-timeout"`
+	// 快照之后执行的日志超过该条数时生成新的快照并删除之前的日志，0代表不生成快照
+	RaftSnapshotThreshold int `yaml:"raft-snapshot-threshold"`
+}
+
+// SavePoint 在Seconds秒之内至少有Changes次修改时触发bgsave
+type SavePoint struct {
+	Seconds int64
+	Changes int64
 }
 
 var Properties *ServerProperties
 
 func init() {
 	Properties = &ServerProperties{
-		Bind: "127.0.0.1",
-		Port: 6379,
+		Bind:             "127.0.0.1",
+		Port:             6379,
+		AppendFilename:   "appendonly.aof",
+		AppendFsync:      "everysec",
+		RDBFilename:      "dump.rdb",
+		AofLoadTruncated: true,
+		AppendDirname:    "appendonlydir",
+		AofPitrHistory:   2,
+		Save:             []string{"3600 1", "300 100", "60 10000"},
+		ReplBacklogSize:  "1mb",
+
+		ProtoMaxBulkLen:      "512mb",
+		ProtoMaxMultiBulkLen: 1024 * 1024,
+		TLSAuthClients:       "yes",
+
+		ClusterConfigFile:  "nodes.conf",
+		ClusterNodeTimeout: 15000,
+
+		RaftDir:               "raft",
+		RaftElectionTimeout:   1000,
+		RaftSnapshotThreshold: 10000,
+
+		AutoAofRewritePercentage: 100,
+		AutoAofRewriteMinSize:    "64mb",
 	}
 }
 
@@ -48,3 +176,55 @@ func SetupConfig(configFileName string) {
 	}
 
 }
+
+// ParseSize 解析带单位的体积配置，例如 64mb、1gb、512
+func ParseSize(size string) (int64, error) {
+	size = strings.ToLower(strings.TrimSpace(size))
+	if size == "" {
+		return 0, nil
+	}
+	units := []struct {
+		suffix string
+		scale  int64
+	}{
+		{"gb", 1 << 30}, {"mb", 1 << 20}, {"kb", 1 << 10},
+		{"g", 1000 * 1000 * 1000}, {"m", 1000 * 1000}, {"k", 1000}, {"b", 1},
+	}
+	scale := int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(size, unit.suffix) {
+			size = strings.TrimSuffix(size, unit.suffix)
+			scale = unit.scale
+			break
+		}
+	}
+	n, err := strconv.ParseInt(size, 10, 64)
+	if err != nil || n < 0 {
+		return 0, errors.New("invalid size: " + size)
+	}
+	return n * scale, nil
+}
+
+// ParseSavePoints 解析save配置，例如 "900 1" 代表900秒内至少有1次修改
+func ParseSavePoints(rules []string) ([]SavePoint, error) {
+	points := make([]SavePoint, 0, len(rules))
+	for _, rule := range rules {
+		fields := strings.Fields(rule)
+		if len(fields) != 2 {
+			return nil, errors.New("invalid save point: " + rule)
+		}
+		seconds, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil || seconds <= 0 {
+			return nil, errors.New("invalid save point: " + rule)
+		}
+		changes, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil || changes <= 0 {
+			return nil, errors.New("invalid save point: " + rule)
+		}
+		points = append(points, SavePoint{
+			Seconds: seconds,
+			Changes: changes,
+		})
+	}
+	return points, nil
+}
@@ -0,0 +1,545 @@
+package database
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"gedis/config"
+	"gedis/interface/redis"
+	"gedis/lib/crc16"
+	"gedis/redis/protocol"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+与redis cluster兼容的集群模式：key通过CRC16映射到16384个slot，每个slot由一个节点负责
+key不属于当前节点时不转发命令，而是返回MOVED或ASK，由支持集群的客户端重定向
+节点之间通过集群总线交换心跳，拓扑保存在nodes.conf中
+*/
+
+// slotCount slot的数量
+const slotCount = 16384
+
+// clusterNode 集群中的一个节点，除id外的字段由clusterState.mu保护
+type clusterNode struct {
+	// 40位十六进制的节点id
+	id      string
+	host    string
+	port    int
+	busPort int
+	// 从节点复制的主节点id，主节点为空
+	masterID string
+	// 节点负责的slot的配置版本，发生冲突时版本大的节点获胜
+	configEpoch uint64
+	// 节点最近公布的复制偏移量，选举时偏移量大的从节点优先
+	offset int64
+
+	// 最早一次没有收到回复的ping的发送时间，收到pong之后清空
+	pingSent     time.Time
+	pongReceived time.Time
+	// 最近一次发送ping的时间，以及是否正在发送，同一时间只发送一个
+	lastPing time.Time
+	pinging  bool
+	// pfail为当前节点认为疑似下线，fail为多数主节点确认下线
+	pfail    bool
+	fail     bool
+	failTime time.Time
+	// 其他主节点报告该节点疑似下线的时间，报告者id->时间
+	failReports map[string]time.Time
+	// 最近一次为该主节点的从节点投票的时间
+	votedTime time.Time
+	// 发往该节点的总线连接
+	link *busLink
+}
+
+func (node *clusterNode) addr() string {
+	return net.JoinHostPort(node.host, strconv.Itoa(node.port))
+}
+
+func (node *clusterNode) busAddr() string {
+	return net.JoinHostPort(node.host, strconv.Itoa(node.busPort))
+}
+
+func (node *clusterNode) isMaster() bool {
+	return node.masterID == ""
+}
+
+// clusterState 当前节点看到的集群状态
+type clusterState struct {
+	mu     sync.RWMutex
+	mdb    *MultiDB
+	myself *clusterNode
+	// 节点id->节点
+	nodes map[string]*clusterNode
+	// slot->负责该slot的节点，nil代表没有节点负责
+	slots [slotCount]*clusterNode
+	// 正在迁出的slot->目标节点，以及正在迁入的slot->源节点
+	migrating map[int]*clusterNode
+	importing map[int]*clusterNode
+
+	// 集群中见过的最大的epoch，以及最近一次投票的epoch
+	currentEpoch  uint64
+	lastVoteEpoch uint64
+	// 被CLUSTER FORGET的节点id->解除屏蔽的时间，期间不会通过心跳重新加入
+	blacklist map[string]time.Time
+
+	// 从节点发起故障转移的时间、是否已经发送投票请求以及选举的epoch
+	failoverAuthTime  time.Time
+	failoverAuthSent  bool
+	failoverAuthEpoch uint64
+
+	configFile  string
+	nodeTimeout time.Duration
+	listener    net.Listener
+	closed      bool
+}
+
+// genNodeID 根据节点地址生成固定的id，配置中的所有节点计算出的id相同
+func genNodeID(addr string) string {
+	sum := sha1.Sum([]byte(addr))
+	return hex.EncodeToString(sum[:])
+}
+
+func parseNodeAddr(addr string) (*clusterNode, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		return nil, errors.New("invalid port in " + addr)
+	}
+	return &clusterNode{
+		id:           genNodeID(addr),
+		host:         host,
+		port:         port,
+		busPort:      port + 10000,
+		pongReceived: time.Now(),
+		failReports:  make(map[string]time.Time),
+	}, nil
+}
+
+// parseSlotRange 解析 "slot" 或者 "start-end"
+func parseSlotRange(s string) (int, int, error) {
+	startStr, endStr := s, s
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		startStr, endStr = s[:i], s[i+1:]
+	}
+	start, err1 := strconv.Atoi(startStr)
+	end, err2 := strconv.Atoi(endStr)
+	if err1 != nil || err2 != nil || start < 0 || end >= slotCount || start > end {
+		return 0, 0, errors.New("invalid slot range " + s)
+	}
+	return start, end, nil
+}
+
+func newClusterState(myself *clusterNode) *clusterState {
+	return &clusterState{
+		myself:      myself,
+		nodes:       map[string]*clusterNode{myself.id: myself},
+		migrating:   make(map[int]*clusterNode),
+		importing:   make(map[int]*clusterNode),
+		blacklist:   make(map[string]time.Time),
+		nodeTimeout: 15 * time.Second,
+	}
+}
+
+// makeClusterState 根据cluster-slots配置创建集群状态，self为当前节点的地址
+func makeClusterState(self string, slotsConfig []string) (*clusterState, error) {
+	myself, err := parseNodeAddr(self)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cluster node address %s: %v", self, err)
+	}
+	state := newClusterState(myself)
+	for _, line := range slotsConfig {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		node, err := parseNodeAddr(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid cluster-slots %q: %v", line, err)
+		}
+		if existed, ok := state.nodes[node.id]; ok {
+			node = existed
+		} else {
+			state.nodes[node.id] = node
+		}
+		for _, field := range fields[1:] {
+			start, end, err := parseSlotRange(field)
+			if err != nil {
+				return nil, fmt.Errorf("invalid cluster-slots %q: %v", line, err)
+			}
+			for slot := start; slot <= end; slot++ {
+				if state.slots[slot] != nil && state.slots[slot] != node {
+					return nil, fmt.Errorf("slot %d is assigned to more than one node", slot)
+				}
+				state.slots[slot] = node
+			}
+		}
+	}
+	return state, nil
+}
+
+// clusterSelfAddr 当前节点对客户端公布的地址
+func clusterSelfAddr() string {
+	if config.Properties.Self != "" {
+		return config.Properties.Self
+	}
+	return net.JoinHostPort(config.Properties.Bind, strconv.Itoa(config.Properties.Port))
+}
+
+// initCluster 优先从nodes.conf恢复集群拓扑，不存在时使用cluster-slots配置，然后启动集群总线
+func (mdb *MultiDB) initCluster() error {
+	state, err := loadClusterConfig(config.Properties.ClusterConfigFile)
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		state, err = makeClusterState(clusterSelfAddr(), config.Properties.ClusterSlots)
+		if err != nil {
+			return err
+		}
+	}
+	state.mdb = mdb
+	state.configFile = config.Properties.ClusterConfigFile
+	if config.Properties.ClusterNodeTimeout > 0 {
+		state.nodeTimeout = time.Duration(config.Properties.ClusterNodeTimeout) * time.Millisecond
+	}
+	busPort := config.Properties.ClusterPort
+	if busPort == 0 {
+		busPort = config.Properties.Port + 10000
+	}
+	state.myself.busPort = busPort
+	state.mu.Lock()
+	state.saveConfig()
+	state.mu.Unlock()
+	if err := state.startBus(net.JoinHostPort(config.Properties.Bind, strconv.Itoa(busPort))); err != nil {
+		return err
+	}
+	mdb.cluster = state
+	// 重启之前是从节点时继续复制原来的主节点
+	if master := state.nodes[state.myself.masterID]; master != nil {
+		mdb.startReplication(master.host, master.port)
+	}
+	return nil
+}
+
+// keyHashSlot 计算key所属的slot，key中包含非空的{tag}时只使用第一个tag计算
+func keyHashSlot(key string) int {
+	if beg := strings.IndexByte(key, '{'); beg >= 0 {
+		if end := strings.IndexByte(key[beg+1:], '}'); end > 0 {
+			key = key[beg+1 : beg+1+end]
+		}
+	}
+	return int(crc16.Checksum([]byte(key)) & (slotCount - 1))
+}
+
+// redirect 检查命令中的key是否由当前节点负责，需要客户端重定向时返回错误，否则返回nil
+func (state *clusterState) redirect(mdb *MultiDB, c redis.Connection, cmdLine CmdLine) redis.Reply {
+	// ASKING只对之后的一条命令有效，MIGRATE发送的RESTORE-ASKING自带ASKING
+	asking := c.IsAsking() || strings.ToLower(string(cmdLine[0])) == "restore-asking"
+	c.SetAsking(false)
+	// 主节点发送的复制流总是在本地执行
+	if c.IsMaster() {
+		return nil
+	}
+	keys, ok := GetRelatedKeys(cmdLine)
+	if !ok || len(keys) == 0 {
+		return nil
+	}
+	slot := keyHashSlot(keys[0])
+	for _, key := range keys[1:] {
+		if keyHashSlot(key) != slot {
+			return protocol.MakeErrReply("CROSSSLOT Keys in request don't hash to the same slot")
+		}
+	}
+	state.mu.RLock()
+	defer state.mu.RUnlock()
+	node := state.slots[slot]
+	if node == nil {
+		return protocol.MakeErrReply("CLUSTERDOWN Hash slot not served")
+	}
+	if node == state.myself {
+		target, migrating := state.migrating[slot]
+		if !migrating {
+			return nil
+		}
+		// 正在迁出的slot中不存在的key可能已经迁移到目标节点，让客户端去目标节点询问
+		missing := mdb.countMissingKeys(c.GetDBIndex(), keys)
+		if missing == 0 {
+			return nil
+		}
+		if missing < len(keys) {
+			return protocol.MakeErrReply("TRYAGAIN Multiple keys request during rehashing of slot")
+		}
+		return protocol.MakeErrReply(fmt.Sprintf("ASK %d %s", slot, target.addr()))
+	}
+	if _, importing := state.importing[slot]; importing && asking {
+		// 正在迁入的slot只接受ASKING之后的命令，多个key时需要全部迁移完成
+		if len(keys) > 1 && mdb.countMissingKeys(c.GetDBIndex(), keys) > 0 {
+			return protocol.MakeErrReply("TRYAGAIN Multiple keys request during rehashing of slot")
+		}
+		return nil
+	}
+	if node.fail {
+		return protocol.MakeErrReply("CLUSTERDOWN The cluster is down")
+	}
+	return protocol.MakeErrReply(fmt.Sprintf("MOVED %d %s", slot, node.addr()))
+}
+
+func (mdb *MultiDB) countMissingKeys(dbIndex int, keys []string) int {
+	db := mdb.selectDB(dbIndex)
+	missing := 0
+	for _, key := range keys {
+		if _, ok := db.GetEntity(key); !ok {
+			missing++
+		}
+	}
+	return missing
+}
+
+/*---CLUSTER命令---*/
+
+var errClusterDisabled = protocol.MakeErrReply("ERR This instance has cluster support disabled")
+
+// execAsking ASKING，允许下一条命令访问正在迁入的slot
+func execAsking(mdb *MultiDB, c redis.Connection) redis.Reply {
+	if mdb.cluster == nil {
+		return errClusterDisabled
+	}
+	c.SetAsking(true)
+	return protocol.MakeOkReply()
+}
+
+// execCluster CLUSTER subcommand [args...]
+func execCluster(mdb *MultiDB, args [][]byte) redis.Reply {
+	if mdb.cluster == nil {
+		return errClusterDisabled
+	}
+	state := mdb.cluster
+	subCmd := strings.ToLower(string(args[0]))
+	switch subCmd {
+	case "info":
+		return state.info()
+	case "myid":
+		return protocol.MakeBulkReply([]byte(state.myself.id))
+	case "nodes":
+		return state.nodesReply()
+	case "slots":
+		return state.slotsReply()
+	case "shards":
+		return state.shardsReply()
+	case "setslot":
+		return execSetSlot(mdb, args[1:])
+	case "countkeysinslot":
+		return execCountKeysInSlot(mdb, args[1:])
+	case "getkeysinslot":
+		return execGetKeysInSlot(mdb, args[1:])
+	case "meet":
+		return execMeet(state, args[1:])
+	case "forget":
+		return execForget(state, args[1:])
+	case "replicate":
+		return execReplicate(state, args[1:])
+	case "keyslot":
+		if len(args) != 2 {
+			return protocol.MakeErrReply("ERR wrong number of arguments for 'cluster|keyslot' command")
+		}
+		return protocol.MakeIntReply(int64(keyHashSlot(string(args[1]))))
+	}
+	return protocol.MakeErrReply("ERR unknown subcommand '" + string(args[0]) + "'. Try CLUSTER HELP.")
+}
+
+// slotRange 一段连续的slot
+type slotRange struct {
+	start int
+	end   int
+	node  *clusterNode
+}
+
+// slotRanges 返回所有连续的slot区间，调用方需要持有读锁
+func (state *clusterState) slotRanges() []slotRange {
+	ranges := make([]slotRange, 0)
+	for slot := 0; slot < slotCount; slot++ {
+		node := state.slots[slot]
+		if node == nil {
+			continue
+		}
+		if n := len(ranges); n > 0 && ranges[n-1].node == node && ranges[n-1].end == slot-1 {
+			ranges[n-1].end = slot
+			continue
+		}
+		ranges = append(ranges, slotRange{start: slot, end: slot, node: node})
+	}
+	return ranges
+}
+
+// countSlots 节点负责的slot数量，调用方需要持有锁
+func (state *clusterState) countSlots(node *clusterNode) int {
+	count := 0
+	for _, owner := range state.slots {
+		if owner == node {
+			count++
+		}
+	}
+	return count
+}
+
+// sortedNodes 按地址排序的节点，保证输出稳定
+func (state *clusterState) sortedNodes() []*clusterNode {
+	nodes := make([]*clusterNode, 0, len(state.nodes))
+	for _, node := range state.nodes {
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].addr() < nodes[j].addr()
+	})
+	return nodes
+}
+
+// replicasOf 返回主节点的所有从节点，调用方需要持有锁
+func (state *clusterState) replicasOf(master *clusterNode) []*clusterNode {
+	replicas := make([]*clusterNode, 0)
+	for _, node := range state.sortedNodes() {
+		if node.masterID == master.id {
+			replicas = append(replicas, node)
+		}
+	}
+	return replicas
+}
+
+func (state *clusterState) info() redis.Reply {
+	state.mu.RLock()
+	defer state.mu.RUnlock()
+	assigned, pfail, fail := 0, 0, 0
+	sizes := make(map[*clusterNode]struct{})
+	for _, node := range state.slots {
+		if node == nil {
+			continue
+		}
+		assigned++
+		sizes[node] = struct{}{}
+		if node.fail {
+			fail++
+		} else if node.pfail {
+			pfail++
+		}
+	}
+	clusterStatus := "ok"
+	if assigned < slotCount || fail > 0 {
+		clusterStatus = "fail"
+	}
+	info := fmt.Sprintf("cluster_state:%s\r\n"+
+		"cluster_slots_assigned:%d\r\n"+
+		"cluster_slots_ok:%d\r\n"+
+		"cluster_slots_pfail:%d\r\n"+
+		"cluster_slots_fail:%d\r\n"+
+		"cluster_known_nodes:%d\r\n"+
+		"cluster_size:%d\r\n"+
+		"cluster_current_epoch:%d\r\n"+
+		"cluster_my_epoch:%d\r\n",
+		clusterStatus, assigned, assigned-pfail-fail, pfail, fail, len(state.nodes), len(sizes),
+		state.currentEpoch, state.myEpoch())
+	return protocol.MakeBulkReply([]byte(info))
+}
+
+// myEpoch 主节点为自己的configEpoch，从节点为主节点的configEpoch
+func (state *clusterState) myEpoch() uint64 {
+	if master := state.nodes[state.myself.masterID]; master != nil {
+		return master.configEpoch
+	}
+	return state.myself.configEpoch
+}
+
+// nodesReply CLUSTER NODES，格式与nodes.conf相同
+func (state *clusterState) nodesReply() redis.Reply {
+	state.mu.RLock()
+	defer state.mu.RUnlock()
+	return protocol.MakeBulkReply([]byte(state.nodesDescription()))
+}
+
+func nodeInfoReply(node *clusterNode) redis.Reply {
+	return protocol.MakeMultiRawReply([]redis.Reply{
+		protocol.MakeBulkReply([]byte(node.host)),
+		protocol.MakeIntReply(int64(node.port)),
+		protocol.MakeBulkReply([]byte(node.id)),
+	})
+}
+
+// slotsReply CLUSTER SLOTS，每一项为 [start, end, [host, port, id], [从节点host, port, id] ...]
+func (state *clusterState) slotsReply() redis.Reply {
+	state.mu.RLock()
+	defer state.mu.RUnlock()
+	ranges := state.slotRanges()
+	replies := make([]redis.Reply, 0, len(ranges))
+	for _, r := range ranges {
+		item := []redis.Reply{
+			protocol.MakeIntReply(int64(r.start)),
+			protocol.MakeIntReply(int64(r.end)),
+			nodeInfoReply(r.node),
+		}
+		for _, replica := range state.replicasOf(r.node) {
+			if !replica.fail {
+				item = append(item, nodeInfoReply(replica))
+			}
+		}
+		replies = append(replies, protocol.MakeMultiRawReply(item))
+	}
+	return protocol.MakeMultiRawReply(replies)
+}
+
+func (state *clusterState) shardNodeReply(node *clusterNode) redis.Reply {
+	role, health := "master", "online"
+	if !node.isMaster() {
+		role = "replica"
+	}
+	if node.fail || node.pfail {
+		health = "fail"
+	}
+	offset := node.offset
+	if node == state.myself {
+		offset = state.mdb.replOffset()
+	}
+	return protocol.MakeMultiRawReply([]redis.Reply{
+		protocol.MakeBulkReply([]byte("id")), protocol.MakeBulkReply([]byte(node.id)),
+		protocol.MakeBulkReply([]byte("port")), protocol.MakeIntReply(int64(node.port)),
+		protocol.MakeBulkReply([]byte("ip")), protocol.MakeBulkReply([]byte(node.host)),
+		protocol.MakeBulkReply([]byte("endpoint")), protocol.MakeBulkReply([]byte(node.host)),
+		protocol.MakeBulkReply([]byte("role")), protocol.MakeBulkReply([]byte(role)),
+		protocol.MakeBulkReply([]byte("replication-offset")), protocol.MakeIntReply(offset),
+		protocol.MakeBulkReply([]byte("health")), protocol.MakeBulkReply([]byte(health)),
+	})
+}
+
+// shardsReply CLUSTER SHARDS，每个主节点与它的从节点组成一个分片，包含slots以及nodes两个字段
+func (state *clusterState) shardsReply() redis.Reply {
+	state.mu.RLock()
+	defer state.mu.RUnlock()
+	nodeSlots := make(map[*clusterNode][]redis.Reply)
+	for _, r := range state.slotRanges() {
+		nodeSlots[r.node] = append(nodeSlots[r.node],
+			protocol.MakeIntReply(int64(r.start)), protocol.MakeIntReply(int64(r.end)))
+	}
+	shards := make([]redis.Reply, 0, len(state.nodes))
+	for _, node := range state.sortedNodes() {
+		if !node.isMaster() && state.nodes[node.masterID] != nil {
+			continue
+		}
+		nodes := []redis.Reply{state.shardNodeReply(node)}
+		for _, replica := range state.replicasOf(node) {
+			nodes = append(nodes, state.shardNodeReply(replica))
+		}
+		shards = append(shards, protocol.MakeMultiRawReply([]redis.Reply{
+			protocol.MakeBulkReply([]byte("slots")), protocol.MakeMultiRawReply(nodeSlots[node]),
+			protocol.MakeBulkReply([]byte("nodes")), protocol.MakeMultiRawReply(nodes),
+		}))
+	}
+	return protocol.MakeMultiRawReply(shards)
+}
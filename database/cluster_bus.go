@@ -0,0 +1,663 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"gedis/interface/redis"
+	"gedis/lib/logger"
+	"gedis/redis/protocol"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+集群总线：节点之间在port+10000端口上交换以换行分隔的json消息，每条消息都会收到一条回复
+消息头包含发送者的地址、角色、epoch以及负责的slot，并附带发送者已知的其他节点的状态(gossip)
+1. 每个节点定时向其他节点发送ping，超过cluster-node-timeout没有回复的节点标记为疑似下线(PFAIL)
+2. 收到多数主节点的疑似下线报告之后标记为下线(FAIL)，并广播给所有节点
+3. 下线主节点的从节点发起选举，获得多数主节点的投票之后接管它的slot
+*/
+
+// 总线消息的类型
+const (
+	msgPing        = "ping"
+	msgPong        = "pong"
+	msgMeet        = "meet"
+	msgFail        = "fail"
+	msgAuthRequest = "auth-request"
+	msgAuthAck     = "auth-ack"
+)
+
+const (
+	// clusterCronPeriod 检查节点状态的间隔
+	clusterCronPeriod = 100 * time.Millisecond
+	// forgetTTL 被CLUSTER FORGET的节点在该时间内不会通过gossip重新加入
+	forgetTTL = time.Minute
+)
+
+// gossipEntry 消息中携带的其他节点的状态
+type gossipEntry struct {
+	ID       string `json:"id"`
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	BusPort  int    `json:"bus_port"`
+	MasterID string `json:"master_id,omitempty"`
+	PFail    bool   `json:"pfail,omitempty"`
+	Fail     bool   `json:"fail,omitempty"`
+}
+
+// clusterMsg 总线消息
+type clusterMsg struct {
+	Type         string `json:"type"`
+	Sender       string `json:"sender"`
+	Host         string `json:"host"`
+	Port         int    `json:"port"`
+	BusPort      int    `json:"bus_port"`
+	MasterID     string `json:"master_id,omitempty"`
+	ConfigEpoch  uint64 `json:"config_epoch"`
+	CurrentEpoch uint64 `json:"current_epoch"`
+	Offset       int64  `json:"offset"`
+	// 发送者负责的slot区间，依次为start, end
+	Slots  []int         `json:"slots,omitempty"`
+	Gossip []gossipEntry `json:"gossip,omitempty"`
+	// fail消息中下线的节点
+	FailNode string `json:"fail_node,omitempty"`
+	// auth-ack消息中是否同意
+	Ack bool `json:"ack,omitempty"`
+}
+
+// busLink 发往一个节点的总线连接，同一时间只有一个请求
+type busLink struct {
+	mu   sync.Mutex
+	conn net.Conn
+	enc  *json.Encoder
+	dec  *json.Decoder
+}
+
+// request 发送一条消息并等待回复，出错时关闭连接，下次请求重新连接
+func (link *busLink) request(addr string, msg *clusterMsg, timeout time.Duration) (*clusterMsg, error) {
+	link.mu.Lock()
+	defer link.mu.Unlock()
+	if link.conn == nil {
+		conn, err := net.DialTimeout("tcp", addr, timeout)
+		if err != nil {
+			return nil, err
+		}
+		link.conn = conn
+		link.enc = json.NewEncoder(conn)
+		link.dec = json.NewDecoder(conn)
+	}
+	_ = link.conn.SetDeadline(time.Now().Add(timeout))
+	reply := &clusterMsg{}
+	err := link.enc.Encode(msg)
+	if err == nil {
+		err = link.dec.Decode(reply)
+	}
+	if err != nil {
+		_ = link.conn.Close()
+		link.conn = nil
+		return nil, err
+	}
+	return reply, nil
+}
+
+func (link *busLink) close() {
+	link.mu.Lock()
+	defer link.mu.Unlock()
+	if link.conn != nil {
+		_ = link.conn.Close()
+		link.conn = nil
+	}
+}
+
+// requestTimeout 等待总线消息回复的时间
+func (state *clusterState) requestTimeout() time.Duration {
+	timeout := state.nodeTimeout / 2
+	if timeout < 500*time.Millisecond {
+		timeout = 500 * time.Millisecond
+	}
+	return timeout
+}
+
+// sendMsg 通过节点的总线连接发送消息，不能持有锁调用
+func (state *clusterState) sendMsg(node *clusterNode, msg *clusterMsg) (*clusterMsg, error) {
+	state.mu.Lock()
+	link := node.link
+	if link == nil {
+		link = &busLink{}
+		node.link = link
+	}
+	addr := node.busAddr()
+	state.mu.Unlock()
+	return link.request(addr, msg, state.requestTimeout())
+}
+
+// broadcastLocked 在后台向其他所有节点发送消息，调用方需要持有锁
+func (state *clusterState) broadcastLocked(msg *clusterMsg) {
+	for _, node := range state.nodes {
+		if node == state.myself {
+			continue
+		}
+		go func(node *clusterNode) {
+			reply, err := state.sendMsg(node, msg)
+			if err != nil || reply.Type != msgPong {
+				return
+			}
+			state.mu.Lock()
+			defer state.mu.Unlock()
+			if state.nodes[node.id] == node && reply.Sender == node.id {
+				state.processHeader(reply, true)
+			}
+		}(node)
+	}
+}
+
+// makeMsg 生成带有当前节点信息的消息，调用方需要持有锁
+func (state *clusterState) makeMsg(msgType string) *clusterMsg {
+	myself := state.myself
+	msg := &clusterMsg{
+		Type:         msgType,
+		Sender:       myself.id,
+		Host:         myself.host,
+		Port:         myself.port,
+		BusPort:      myself.busPort,
+		MasterID:     myself.masterID,
+		ConfigEpoch:  myself.configEpoch,
+		CurrentEpoch: state.currentEpoch,
+		Offset:       state.mdb.replOffset(),
+	}
+	if myself.isMaster() {
+		for _, r := range state.slotRanges() {
+			if r.node == myself {
+				msg.Slots = append(msg.Slots, r.start, r.end)
+			}
+		}
+	}
+	for _, node := range state.nodes {
+		if node == myself {
+			continue
+		}
+		msg.Gossip = append(msg.Gossip, gossipEntry{
+			ID:       node.id,
+			Host:     node.host,
+			Port:     node.port,
+			BusPort:  node.busPort,
+			MasterID: node.masterID,
+			PFail:    node.pfail,
+			Fail:     node.fail,
+		})
+	}
+	return msg
+}
+
+/*---总线服务端---*/
+
+// startBus 监听集群总线端口并开始定时发送心跳
+func (state *clusterState) startBus(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	state.listener = listener
+	logger.Info("cluster bus listening on " + addr)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go state.serveBusConn(conn)
+		}
+	}()
+	go state.cron()
+	return nil
+}
+
+func (state *clusterState) serveBusConn(conn net.Conn) {
+	defer conn.Close()
+	dec := json.NewDecoder(conn)
+	enc := json.NewEncoder(conn)
+	for {
+		msg := &clusterMsg{}
+		if err := dec.Decode(msg); err != nil {
+			return
+		}
+		reply := state.handleMsg(msg)
+		if reply == nil {
+			return
+		}
+		if err := enc.Encode(reply); err != nil {
+			return
+		}
+	}
+}
+
+// handleMsg 处理其他节点发来的消息并生成回复
+func (state *clusterState) handleMsg(msg *clusterMsg) *clusterMsg {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if state.closed {
+		return nil
+	}
+	sender := state.processHeader(msg, false)
+	switch msg.Type {
+	case msgFail:
+		if node := state.nodes[msg.FailNode]; node != nil && node != state.myself && !node.fail {
+			node.fail = true
+			node.failTime = time.Now()
+			logger.Warn(fmt.Sprintf("node %s (%s) is marked as failed by %s", node.id, node.addr(), msg.Sender))
+			state.saveConfig()
+		}
+	case msgAuthRequest:
+		return state.voteFor(sender, msg)
+	}
+	return state.makeMsg(msgPong)
+}
+
+// addNode 加入一个新的节点，调用方需要持有锁
+func (state *clusterState) addNode(id string, host string, port int, busPort int) *clusterNode {
+	node := &clusterNode{
+		id:           id,
+		host:         host,
+		port:         port,
+		busPort:      busPort,
+		pongReceived: time.Now(),
+		failReports:  make(map[string]time.Time),
+	}
+	state.nodes[id] = node
+	logger.Info(fmt.Sprintf("node %s (%s) joined the cluster", id, node.addr()))
+	return node
+}
+
+// delNode 移除一个节点以及它负责的slot，调用方需要持有锁
+func (state *clusterState) delNode(node *clusterNode) {
+	delete(state.nodes, node.id)
+	state.delSlots(node)
+	for slot, target := range state.migrating {
+		if target == node {
+			delete(state.migrating, slot)
+		}
+	}
+	for slot, source := range state.importing {
+		if source == node {
+			delete(state.importing, slot)
+		}
+	}
+	for _, other := range state.nodes {
+		delete(other.failReports, node.id)
+	}
+	if node.link != nil {
+		go node.link.close()
+	}
+}
+
+func (state *clusterState) delSlots(node *clusterNode) {
+	for slot, owner := range state.slots {
+		if owner == node {
+			state.slots[slot] = nil
+		}
+	}
+}
+
+// processHeader 根据消息头更新发送者以及gossip中节点的状态，返回发送者，未知的发送者返回nil
+// isPong为true时消息是当前节点发送的请求的回复，说明发送者仍然在线
+func (state *clusterState) processHeader(msg *clusterMsg, isPong bool) *clusterNode {
+	if msg.CurrentEpoch > state.currentEpoch {
+		state.currentEpoch = msg.CurrentEpoch
+		state.saveConfig()
+	}
+	sender := state.nodes[msg.Sender]
+	if sender == nil {
+		// 只有MEET可以让未知的节点加入集群
+		if msg.Type != msgMeet || msg.Sender == state.myself.id {
+			return nil
+		}
+		delete(state.blacklist, msg.Sender)
+		sender = state.addNode(msg.Sender, msg.Host, msg.Port, msg.BusPort)
+		state.saveConfig()
+	}
+	if sender == state.myself {
+		return nil
+	}
+	if msg.Host != "" && (sender.host != msg.Host || sender.port != msg.Port || sender.busPort != msg.BusPort) {
+		sender.host, sender.port, sender.busPort = msg.Host, msg.Port, msg.BusPort
+		if sender.link != nil {
+			go sender.link.close()
+			sender.link = nil
+		}
+		state.saveConfig()
+	}
+	sender.offset = msg.Offset
+	if isPong {
+		sender.pongReceived = time.Now()
+		sender.pingSent = time.Time{}
+		if sender.pfail {
+			sender.pfail = false
+			logger.Info(fmt.Sprintf("node %s (%s) is reachable again", sender.id, sender.addr()))
+		}
+		state.clearFailIfNeeded(sender)
+	}
+	if msg.MasterID != sender.masterID {
+		// 成为从节点之后不再负责任何slot
+		sender.masterID = msg.MasterID
+		if msg.MasterID != "" {
+			state.delSlots(sender)
+		}
+		state.saveConfig()
+	}
+	if sender.isMaster() {
+		if sender.configEpoch != msg.ConfigEpoch {
+			sender.configEpoch = msg.ConfigEpoch
+			state.saveConfig()
+		}
+		state.updateSlots(sender, msg.Slots)
+		state.handleEpochCollision(sender)
+	}
+	state.processGossip(sender, msg.Gossip)
+	return sender
+}
+
+// updateSlots 发送者声明的slot由configEpoch更大的一方负责
+// 当前节点或者当前节点的主节点失去所有slot时，成为新的负责节点的从节点
+func (state *clusterState) updateSlots(sender *clusterNode, ranges []int) {
+	myself := state.myself
+	myMaster := state.nodes[myself.masterID]
+	changed, lostByMe := false, false
+	for i := 0; i+1 < len(ranges); i += 2 {
+		for slot := ranges[i]; slot <= ranges[i+1] && slot < slotCount; slot++ {
+			if slot < 0 {
+				continue
+			}
+			owner := state.slots[slot]
+			if owner == sender {
+				continue
+			}
+			if _, importing := state.importing[slot]; importing {
+				continue
+			}
+			if owner != nil && owner.configEpoch >= sender.configEpoch {
+				continue
+			}
+			state.slots[slot] = sender
+			delete(state.migrating, slot)
+			changed = true
+			if owner != nil && (owner == myself || owner == myMaster) {
+				lostByMe = true
+			}
+		}
+	}
+	if !changed {
+		return
+	}
+	state.saveConfig()
+	if !lostByMe {
+		return
+	}
+	if myself.isMaster() && state.countSlots(myself) == 0 {
+		logger.Info(fmt.Sprintf("all slots are taken over by %s, becoming its replica", sender.addr()))
+		state.setMyMaster(sender)
+	} else if myMaster != nil && state.countSlots(myMaster) == 0 {
+		logger.Info(fmt.Sprintf("master %s lost all slots, replicating %s", myMaster.addr(), sender.addr()))
+		state.setMyMaster(sender)
+	}
+}
+
+// handleEpochCollision 两个主节点的configEpoch相同时，id较小的一方递增自己的configEpoch
+func (state *clusterState) handleEpochCollision(sender *clusterNode) {
+	myself := state.myself
+	if !myself.isMaster() || sender.configEpoch != myself.configEpoch || sender.id <= myself.id {
+		return
+	}
+	state.currentEpoch++
+	myself.configEpoch = state.currentEpoch
+	state.saveConfig()
+}
+
+// processGossip 记录其他主节点对节点的疑似下线报告，并加入未知的节点
+func (state *clusterState) processGossip(sender *clusterNode, entries []gossipEntry) {
+	now := time.Now()
+	for _, entry := range entries {
+		if entry.ID == state.myself.id {
+			continue
+		}
+		node := state.nodes[entry.ID]
+		if node == nil {
+			if _, forgotten := state.blacklist[entry.ID]; forgotten || entry.Fail || entry.Host == "" {
+				continue
+			}
+			node = state.addNode(entry.ID, entry.Host, entry.Port, entry.BusPort)
+			node.masterID = entry.MasterID
+			state.saveConfig()
+			continue
+		}
+		if !sender.isMaster() {
+			continue
+		}
+		if entry.PFail || entry.Fail {
+			node.failReports[sender.id] = now
+		} else {
+			delete(node.failReports, sender.id)
+		}
+		state.markFailIfNeeded(node)
+	}
+}
+
+// slotOwners 负责slot的主节点
+func (state *clusterState) slotOwners() map[*clusterNode]struct{} {
+	owners := make(map[*clusterNode]struct{})
+	for _, node := range state.slots {
+		if node != nil {
+			owners[node] = struct{}{}
+		}
+	}
+	return owners
+}
+
+// quorum 标记下线或者当选需要的主节点数量，为负责slot的主节点的多数
+func (state *clusterState) quorum() int {
+	return len(state.slotOwners())/2 + 1
+}
+
+// markFailIfNeeded 疑似下线的节点收到多数主节点的报告之后标记为下线并广播
+func (state *clusterState) markFailIfNeeded(node *clusterNode) {
+	if node == state.myself || !node.pfail || node.fail {
+		return
+	}
+	now := time.Now()
+	owners := state.slotOwners()
+	reports := 0
+	for reporterID, reportTime := range node.failReports {
+		if now.Sub(reportTime) > 2*state.nodeTimeout {
+			delete(node.failReports, reporterID)
+			continue
+		}
+		if _, ok := owners[state.nodes[reporterID]]; ok {
+			reports++
+		}
+	}
+	if _, ok := owners[state.myself]; ok {
+		reports++
+	}
+	if reports < len(owners)/2+1 {
+		return
+	}
+	node.fail = true
+	node.failTime = now
+	logger.Warn(fmt.Sprintf("node %s (%s) is marked as failed", node.id, node.addr()))
+	state.saveConfig()
+	msg := state.makeMsg(msgFail)
+	msg.FailNode = node.id
+	state.broadcastLocked(msg)
+}
+
+// clearFailIfNeeded 下线的节点恢复之后，从节点以及不负责slot的主节点立即清除下线标记
+// 负责slot的主节点在一段时间内没有被故障转移时也清除
+func (state *clusterState) clearFailIfNeeded(node *clusterNode) {
+	if !node.fail {
+		return
+	}
+	if node.isMaster() && state.countSlots(node) > 0 && time.Since(node.failTime) < 2*state.nodeTimeout {
+		return
+	}
+	node.fail = false
+	node.failReports = make(map[string]time.Time)
+	logger.Info(fmt.Sprintf("clear FAIL state for node %s (%s)", node.id, node.addr()))
+	state.saveConfig()
+}
+
+/*---MEET与FORGET---*/
+
+// execMeet CLUSTER MEET ip port [cluster-bus-port]，在后台与目标节点握手
+func execMeet(state *clusterState, args [][]byte) redis.Reply {
+	if len(args) != 2 && len(args) != 3 {
+		return protocol.MakeErrReply("ERR wrong number of arguments for 'cluster|meet' command")
+	}
+	host := string(args[0])
+	port, err := strconv.Atoi(string(args[1]))
+	busPort := port + 10000
+	if err == nil && len(args) == 3 {
+		busPort, err = strconv.Atoi(string(args[2]))
+	}
+	if err != nil || host == "" || port <= 0 || port > 65535 || busPort <= 0 || busPort > 65535 {
+		return protocol.MakeErrReply("ERR Invalid node address specified: " + host + ":" + string(args[1]))
+	}
+	go state.meet(host, port, busPort)
+	return protocol.MakeOkReply()
+}
+
+func (state *clusterState) meet(host string, port int, busPort int) {
+	state.mu.Lock()
+	msg := state.makeMsg(msgMeet)
+	state.mu.Unlock()
+	link := &busLink{}
+	defer link.close()
+	addr := net.JoinHostPort(host, strconv.Itoa(busPort))
+	reply, err := link.request(addr, msg, state.requestTimeout())
+	if err != nil {
+		logger.Warn(fmt.Sprintf("cluster meet %s failed: %v", addr, err))
+		return
+	}
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if reply.Sender == state.myself.id {
+		return
+	}
+	delete(state.blacklist, reply.Sender)
+	if state.nodes[reply.Sender] == nil {
+		state.addNode(reply.Sender, host, port, busPort)
+		state.saveConfig()
+	}
+	state.processHeader(reply, true)
+}
+
+// execForget CLUSTER FORGET node-id，需要在forgetTTL之内对所有节点执行，否则会通过gossip重新加入
+func execForget(state *clusterState, args [][]byte) redis.Reply {
+	if len(args) != 1 {
+		return protocol.MakeErrReply("ERR wrong number of arguments for 'cluster|forget' command")
+	}
+	id := string(args[0])
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	node := state.nodes[id]
+	if node == nil {
+		return protocol.MakeErrReply("ERR Unknown node " + id)
+	}
+	if node == state.myself {
+		return protocol.MakeErrReply("ERR I tried hard but I can't forget myself...")
+	}
+	if node.id == state.myself.masterID {
+		return protocol.MakeErrReply("ERR Can't forget my master!")
+	}
+	state.delNode(node)
+	state.blacklist[id] = time.Now().Add(forgetTTL)
+	state.saveConfig()
+	return protocol.MakeOkReply()
+}
+
+/*---定时任务---*/
+
+func (state *clusterState) cron() {
+	ticker := time.NewTicker(clusterCronPeriod)
+	defer ticker.Stop()
+	for range ticker.C {
+		state.mu.Lock()
+		if state.closed {
+			state.mu.Unlock()
+			return
+		}
+		state.clusterCron()
+		state.mu.Unlock()
+	}
+}
+
+// pingPeriod 向每个节点发送ping的间隔
+func (state *clusterState) pingPeriod() time.Duration {
+	period := state.nodeTimeout / 4
+	if period > time.Second {
+		period = time.Second
+	}
+	if period < clusterCronPeriod {
+		period = clusterCronPeriod
+	}
+	return period
+}
+
+func (state *clusterState) clusterCron() {
+	now := time.Now()
+	for id, expireAt := range state.blacklist {
+		if now.After(expireAt) {
+			delete(state.blacklist, id)
+		}
+	}
+	for _, node := range state.nodes {
+		if node == state.myself {
+			continue
+		}
+		if !node.pfail && !node.pingSent.IsZero() && now.Sub(node.pingSent) > state.nodeTimeout {
+			node.pfail = true
+			logger.Warn(fmt.Sprintf("node %s (%s) is possibly failing", node.id, node.addr()))
+		}
+		state.markFailIfNeeded(node)
+		if !node.pinging && now.Sub(node.lastPing) >= state.pingPeriod() {
+			node.pinging = true
+			node.lastPing = now
+			// 记录最早一次没有回复的ping
+			if node.pingSent.IsZero() {
+				node.pingSent = now
+			}
+			go state.ping(node, state.makeMsg(msgPing))
+		}
+	}
+	state.failoverCron()
+}
+
+func (state *clusterState) ping(node *clusterNode, msg *clusterMsg) {
+	reply, err := state.sendMsg(node, msg)
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	node.pinging = false
+	if err != nil || state.nodes[node.id] != node || reply.Sender != node.id {
+		return
+	}
+	state.processHeader(reply, true)
+}
+
+// close 关闭集群总线
+func (state *clusterState) close() {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if state.closed {
+		return
+	}
+	state.closed = true
+	if state.listener != nil {
+		_ = state.listener.Close()
+	}
+	for _, node := range state.nodes {
+		if node.link != nil {
+			go node.link.close()
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package database
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// freePort 返回一个当前没有被监听的端口
+func freePort(t *testing.T) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// startTestClusterNode 启动只有集群总线的节点，slots为空时节点不负责任何slot
+func startTestClusterNode(t *testing.T, slots string) *clusterState {
+	mdb := makeTestServer(t)
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(freePort(t)))
+	var slotsConfig []string
+	if slots != "" {
+		slotsConfig = []string{addr + " " + slots}
+	}
+	state, err := makeClusterState(addr, slotsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.mdb = mdb
+	state.nodeTimeout = 500 * time.Millisecond
+	state.myself.busPort = freePort(t)
+	if err := state.startBus(state.myself.busAddr()); err != nil {
+		t.Fatal(err)
+	}
+	mdb.cluster = state
+	return state
+}
+
+// waitCluster 持有锁检查所有节点的状态，直到cond返回true
+func waitCluster(t *testing.T, timeout time.Duration, desc string, nodes []*clusterState, cond func(state *clusterState) bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for {
+		ok := true
+		for _, state := range nodes {
+			state.mu.RLock()
+			ok = cond(state)
+			state.mu.RUnlock()
+			if !ok {
+				break
+			}
+		}
+		if ok {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for " + desc)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestClusterGossipAndFailover(t *testing.T) {
+	a := startTestClusterNode(t, "0-5460")
+	b := startTestClusterNode(t, "5461-10922")
+	c := startTestClusterNode(t, "10923-16383")
+	d := startTestClusterNode(t, "")
+	all := []*clusterState{a, b, c, d}
+
+	// a与其他节点握手之后，b、c、d通过gossip得知彼此
+	for _, other := range all[1:] {
+		a.meet(other.myself.host, other.myself.port, other.myself.busPort)
+	}
+	waitCluster(t, 5*time.Second, "gossip", all, func(state *clusterState) bool {
+		if len(state.nodes) != len(all) {
+			return false
+		}
+		// 每个主节点负责的第一个slot
+		for slot, owner := range map[int]*clusterState{0: a, 5461: b, 10923: c} {
+			if state.slots[slot] == nil || state.slots[slot].id != owner.myself.id {
+				return false
+			}
+		}
+		return true
+	})
+
+	assertReply(t, string(execReplicate(d, [][]byte{[]byte(a.myself.id)}).ToBytes()), "+OK\r\n")
+	waitCluster(t, 5*time.Second, "replicate", all, func(state *clusterState) bool {
+		node := state.nodes[d.myself.id]
+		return node != nil && node.masterID == a.myself.id
+	})
+
+	// a下线之后，b、c将其标记为下线，d当选并接管a的slot
+	a.close()
+	survivors := []*clusterState{b, c, d}
+	waitCluster(t, 15*time.Second, "failover", survivors, func(state *clusterState) bool {
+		owner := state.slots[0]
+		return owner != nil && owner.id == d.myself.id && state.nodes[d.myself.id].isMaster()
+	})
+	waitCluster(t, 5*time.Second, "fail flag", []*clusterState{b, c}, func(state *clusterState) bool {
+		return state.nodes[a.myself.id].fail
+	})
+	// 新的主节点以更大的configEpoch接管slot
+	waitCluster(t, time.Second, "config epoch", []*clusterState{b, c}, func(state *clusterState) bool {
+		return state.nodes[d.myself.id].configEpoch > state.myself.configEpoch
+	})
+}
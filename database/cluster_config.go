@@ -0,0 +1,233 @@
+package database
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"gedis/lib/logger"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+nodes.conf与redis的格式相同，每个节点一行：
+<id> <ip:port@cport> <flags> <master> <ping-sent> <pong-recv> <config-epoch> <link-state> <slot> ...
+最后一行为 vars currentEpoch <epoch> lastVoteEpoch <epoch>
+*/
+
+func unixMilli(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// nodesDescription 生成CLUSTER NODES的内容，调用方需要持有锁
+func (state *clusterState) nodesDescription() string {
+	nodeSlots := make(map[*clusterNode][]string)
+	for _, r := range state.slotRanges() {
+		s := strconv.Itoa(r.start)
+		if r.end != r.start {
+			s += "-" + strconv.Itoa(r.end)
+		}
+		nodeSlots[r.node] = append(nodeSlots[r.node], s)
+	}
+	// 迁移中的slot只在当前节点的行中输出
+	for slot, target := range state.migrating {
+		nodeSlots[state.myself] = append(nodeSlots[state.myself], fmt.Sprintf("[%d->-%s]", slot, target.id))
+	}
+	for slot, source := range state.importing {
+		nodeSlots[state.myself] = append(nodeSlots[state.myself], fmt.Sprintf("[%d-<-%s]", slot, source.id))
+	}
+	buf := &strings.Builder{}
+	for _, node := range state.sortedNodes() {
+		flags := make([]string, 0, 3)
+		if node == state.myself {
+			flags = append(flags, "myself")
+		}
+		master := "-"
+		if node.isMaster() {
+			flags = append(flags, "master")
+		} else {
+			flags = append(flags, "slave")
+			master = node.masterID
+		}
+		if node.fail {
+			flags = append(flags, "fail")
+		} else if node.pfail {
+			flags = append(flags, "fail?")
+		}
+		linkState := "connected"
+		if node != state.myself && (node.pfail || node.fail) {
+			linkState = "disconnected"
+		}
+		var pongReceived int64
+		if node != state.myself {
+			pongReceived = unixMilli(node.pongReceived)
+		}
+		fields := []string{
+			node.id,
+			fmt.Sprintf("%s@%d", node.addr(), node.busPort),
+			strings.Join(flags, ","),
+			master,
+			strconv.FormatInt(unixMilli(node.pingSent), 10),
+			strconv.FormatInt(pongReceived, 10),
+			strconv.FormatUint(node.configEpoch, 10),
+			linkState,
+		}
+		fields = append(fields, nodeSlots[node]...)
+		buf.WriteString(strings.Join(fields, " "))
+		buf.WriteString("\n")
+	}
+	return buf.String()
+}
+
+// saveConfig 将集群拓扑写入nodes.conf，调用方需要持有写锁
+func (state *clusterState) saveConfig() {
+	if state.configFile == "" {
+		return
+	}
+	content := state.nodesDescription() +
+		fmt.Sprintf("vars currentEpoch %d lastVoteEpoch %d\n", state.currentEpoch, state.lastVoteEpoch)
+	// 先写入临时文件再重命名，避免进程崩溃时留下不完整的配置
+	tmpFile := state.configFile + ".tmp"
+	if err := ioutil.WriteFile(tmpFile, []byte(content), 0644); err != nil {
+		logger.Warn("save cluster config failed: " + err.Error())
+		return
+	}
+	if err := os.Rename(tmpFile, state.configFile); err != nil {
+		logger.Warn("save cluster config failed: " + err.Error())
+	}
+}
+
+// loadClusterConfig 从nodes.conf恢复集群拓扑，文件不存在时返回nil
+func loadClusterConfig(filename string) (*clusterState, error) {
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	type nodeLine struct {
+		node  *clusterNode
+		slots []string
+	}
+	var myself *clusterNode
+	lines := make([]nodeLine, 0)
+	var currentEpoch, lastVoteEpoch uint64
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "vars" {
+			for i := 1; i+1 < len(fields); i += 2 {
+				value, err := strconv.ParseUint(fields[i+1], 10, 64)
+				if err != nil {
+					return nil, fmt.Errorf("invalid %s in %s", fields[i], filename)
+				}
+				switch fields[i] {
+				case "currentEpoch":
+					currentEpoch = value
+				case "lastVoteEpoch":
+					lastVoteEpoch = value
+				}
+			}
+			continue
+		}
+		if len(fields) < 8 {
+			return nil, fmt.Errorf("invalid line in %s: %s", filename, scanner.Text())
+		}
+		addr, busPortStr := fields[1], ""
+		if i := strings.IndexByte(addr, '@'); i >= 0 {
+			addr, busPortStr = addr[:i], addr[i+1:]
+		}
+		node, err := parseNodeAddr(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid node address in %s: %v", filename, err)
+		}
+		node.id = fields[0]
+		if busPortStr != "" {
+			if node.busPort, err = strconv.Atoi(busPortStr); err != nil {
+				return nil, fmt.Errorf("invalid bus port in %s: %s", filename, fields[1])
+			}
+		}
+		if fields[3] != "-" {
+			node.masterID = fields[3]
+		}
+		if node.configEpoch, err = strconv.ParseUint(fields[6], 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid config epoch in %s: %s", filename, fields[6])
+		}
+		for _, flag := range strings.Split(fields[2], ",") {
+			if flag == "myself" {
+				myself = node
+			}
+		}
+		lines = append(lines, nodeLine{node: node, slots: fields[8:]})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if myself == nil {
+		return nil, errors.New("myself node not found in " + filename)
+	}
+	state := newClusterState(myself)
+	state.currentEpoch = currentEpoch
+	state.lastVoteEpoch = lastVoteEpoch
+	for _, line := range lines {
+		state.nodes[line.node.id] = line.node
+	}
+	for _, line := range lines {
+		for _, field := range line.slots {
+			// 迁移中的slot，重启之后继续迁移，否则迁出的slot中已经迁走的key无法再通过ASK访问
+			if strings.HasPrefix(field, "[") {
+				if err := state.loadMigratingSlot(field); err != nil {
+					return nil, fmt.Errorf("invalid slot in %s: %v", filename, err)
+				}
+				continue
+			}
+			start, end, err := parseSlotRange(field)
+			if err != nil {
+				return nil, fmt.Errorf("invalid slot in %s: %v", filename, err)
+			}
+			for slot := start; slot <= end; slot++ {
+				state.slots[slot] = line.node
+			}
+		}
+	}
+	return state, nil
+}
+
+// loadMigratingSlot 解析 [slot->-目标节点id] 或者 [slot-<-源节点id]
+func (state *clusterState) loadMigratingSlot(field string) error {
+	if !strings.HasSuffix(field, "]") {
+		return errors.New("invalid migrating slot " + field)
+	}
+	field = field[1 : len(field)-1]
+	states := state.migrating
+	i := strings.Index(field, "->-")
+	if i < 0 {
+		states = state.importing
+		i = strings.Index(field, "-<-")
+	}
+	if i < 0 {
+		return errors.New("invalid migrating slot [" + field + "]")
+	}
+	slot, ok := parseSlot([]byte(field[:i]))
+	if !ok {
+		return errors.New("invalid migrating slot [" + field + "]")
+	}
+	node, ok := state.nodes[field[i+3:]]
+	if !ok {
+		return errors.New("unknown node " + field[i+3:])
+	}
+	states[slot] = node
+	return nil
+}
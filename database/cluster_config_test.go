@@ -0,0 +1,86 @@
+package database
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestClusterConfigRoundTrip(t *testing.T) {
+	state, err := makeClusterState("127.0.0.1:7000", []string{
+		"127.0.0.1:7000 0-100 200",
+		"127.0.0.1:7001 101-199 201-16383",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := state.slots[101]
+	replica := state.addNode(genNodeID("127.0.0.1:7002"), "127.0.0.1", 7002, 17102)
+	replica.masterID = other.id
+	state.myself.configEpoch = 2
+	other.configEpoch = 3
+	state.currentEpoch = 5
+	state.lastVoteEpoch = 4
+	// 正在迁出与迁入的slot
+	state.migrating[5] = other
+	state.importing[150] = other
+	state.configFile = filepath.Join(t.TempDir(), "nodes.conf")
+	state.saveConfig()
+
+	loaded, err := loadClusterConfig(state.configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.myself.id != state.myself.id || loaded.currentEpoch != 5 || loaded.lastVoteEpoch != 4 {
+		t.Fatalf("expect myself %s epoch 5/4 actually %s %d/%d",
+			state.myself.id, loaded.myself.id, loaded.currentEpoch, loaded.lastVoteEpoch)
+	}
+	if len(loaded.nodes) != len(state.nodes) {
+		t.Fatalf("expect %d nodes actually %d", len(state.nodes), len(loaded.nodes))
+	}
+	for id, node := range state.nodes {
+		actual := loaded.nodes[id]
+		if actual == nil || actual.addr() != node.addr() || actual.busPort != node.busPort ||
+			actual.masterID != node.masterID || actual.configEpoch != node.configEpoch {
+			t.Errorf("node %s: expect %+v actually %+v", id, node, actual)
+		}
+	}
+	for slot := range state.slots {
+		if loaded.slots[slot].id != state.slots[slot].id {
+			t.Fatalf("slot %d: expect %s actually %s", slot, state.slots[slot].id, loaded.slots[slot].id)
+		}
+	}
+	if len(loaded.migrating) != 1 || loaded.migrating[5] != loaded.nodes[other.id] {
+		t.Errorf("expect slot 5 migrating to %s actually %v", other.id, loaded.migrating)
+	}
+	if len(loaded.importing) != 1 || loaded.importing[150] != loaded.nodes[other.id] {
+		t.Errorf("expect slot 150 importing from %s actually %v", other.id, loaded.importing)
+	}
+}
+
+func TestLoadInvalidClusterConfig(t *testing.T) {
+	dir := t.TempDir()
+	if state, err := loadClusterConfig(filepath.Join(dir, "missing.conf")); state != nil || err != nil {
+		t.Errorf("expect nil for missing file actually %v %v", state, err)
+	}
+	self := genNodeID("127.0.0.1:7000")
+	prefix := self + " 127.0.0.1:7000@17000 myself,master - 0 0 1 connected 0-16383"
+	invalid := []string{
+		// 没有myself
+		genNodeID("127.0.0.1:7001") + " 127.0.0.1:7001@17001 master - 0 0 1 connected 0-16383\n",
+		prefix + " 16384\n",
+		prefix + " [5->-" + genNodeID("127.0.0.1:7001") + "]\n",
+		prefix + " [5=>-" + self + "]\n",
+		prefix + " [x-<-" + self + "\n",
+		prefix + "\nvars currentEpoch x\n",
+	}
+	for i, content := range invalid {
+		filename := filepath.Join(dir, "nodes.conf")
+		if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadClusterConfig(filename); err == nil {
+			t.Errorf("case %d: expect error", i)
+		}
+	}
+}
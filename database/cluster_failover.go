@@ -0,0 +1,193 @@
+package database
+
+import (
+	"fmt"
+	"gedis/interface/redis"
+	"gedis/lib/logger"
+	"gedis/redis/protocol"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+/*
+自动故障转移，与redis cluster的流程一致：
+1. 从节点发现主节点被标记为下线之后，按照复制偏移量排名等待一段时间，偏移量越大等待越短
+2. 递增currentEpoch，向所有节点请求投票，每个负责slot的主节点在一个epoch中只投一票
+3. 获得多数主节点的投票之后停止复制，以新的configEpoch接管原主节点的slot，并通知所有节点
+4. 原主节点恢复之后发现自己的slot被epoch更大的节点接管，成为它的从节点
+*/
+
+// failoverTimeout 一次选举的超时时间，超过两倍该时间之后重新发起选举
+func (state *clusterState) failoverTimeout() time.Duration {
+	timeout := 2 * state.nodeTimeout
+	if timeout < 2*time.Second {
+		timeout = 2 * time.Second
+	}
+	return timeout
+}
+
+// replicaRank 当前节点在同一个主节点的从节点中按照复制偏移量的排名，0为数据最新
+func (state *clusterState) replicaRank(master *clusterNode) int {
+	myOffset := state.mdb.replOffset()
+	rank := 0
+	for _, replica := range state.replicasOf(master) {
+		if replica != state.myself && !replica.fail && replica.offset > myOffset {
+			rank++
+		}
+	}
+	return rank
+}
+
+// failoverCron 主节点下线时由从节点发起选举，调用方需要持有锁
+func (state *clusterState) failoverCron() {
+	myself := state.myself
+	master := state.nodes[myself.masterID]
+	if myself.isMaster() || master == nil || !master.fail || state.countSlots(master) == 0 {
+		state.failoverAuthTime = time.Time{}
+		return
+	}
+	now := time.Now()
+	if state.failoverAuthTime.IsZero() || now.Sub(state.failoverAuthTime) > 2*state.failoverTimeout() {
+		rank := state.replicaRank(master)
+		delay := 500*time.Millisecond + time.Duration(rand.Intn(500))*time.Millisecond + time.Duration(rank)*time.Second
+		state.failoverAuthTime = now.Add(delay)
+		state.failoverAuthSent = false
+		logger.Info(fmt.Sprintf("master %s failed, start election in %v (rank %d)", master.addr(), delay, rank))
+		return
+	}
+	if state.failoverAuthSent || now.Before(state.failoverAuthTime) {
+		return
+	}
+	state.currentEpoch++
+	state.failoverAuthEpoch = state.currentEpoch
+	state.failoverAuthSent = true
+	state.saveConfig()
+	msg := state.makeMsg(msgAuthRequest)
+	voters := make([]*clusterNode, 0, len(state.nodes))
+	for _, node := range state.nodes {
+		if node != state.myself {
+			voters = append(voters, node)
+		}
+	}
+	logger.Info(fmt.Sprintf("requesting failover votes for epoch %d", state.failoverAuthEpoch))
+	go state.requestVotes(msg, voters, state.quorum(), master)
+}
+
+// requestVotes 并行地向其他节点请求投票，获得多数票之后接管主节点
+func (state *clusterState) requestVotes(msg *clusterMsg, voters []*clusterNode, needed int, master *clusterNode) {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	votes := 0
+	for _, voter := range voters {
+		wg.Add(1)
+		go func(voter *clusterNode) {
+			defer wg.Done()
+			reply, err := state.sendMsg(voter, msg)
+			if err != nil || reply.Type != msgAuthAck || !reply.Ack {
+				return
+			}
+			mu.Lock()
+			votes++
+			mu.Unlock()
+		}(voter)
+	}
+	wg.Wait()
+
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if votes < needed {
+		logger.Warn(fmt.Sprintf("failover election for epoch %d got %d of %d votes", msg.CurrentEpoch, votes, needed))
+		return
+	}
+	// 等待投票期间可能已经有其他从节点当选，或者发起了新一轮选举
+	if state.closed || state.myself.masterID != master.id || state.failoverAuthEpoch != msg.CurrentEpoch {
+		return
+	}
+	state.promote(master)
+}
+
+// promote 当前节点成为主节点，接管原主节点的slot，调用方需要持有锁
+func (state *clusterState) promote(oldMaster *clusterNode) {
+	myself := state.myself
+	myself.masterID = ""
+	myself.configEpoch = state.failoverAuthEpoch
+	for slot, owner := range state.slots {
+		if owner == oldMaster {
+			state.slots[slot] = myself
+		}
+	}
+	state.failoverAuthTime = time.Time{}
+	state.saveConfig()
+	state.mdb.stopReplication()
+	logger.Info(fmt.Sprintf("failover succeeded, took over slots of %s with config epoch %d", oldMaster.addr(), myself.configEpoch))
+	state.broadcastLocked(state.makeMsg(msgPong))
+}
+
+// voteFor 处理从节点的投票请求，调用方需要持有锁
+func (state *clusterState) voteFor(sender *clusterNode, msg *clusterMsg) *clusterMsg {
+	reply := state.makeMsg(msgAuthAck)
+	myself := state.myself
+	// 只有负责slot的主节点可以投票
+	if !myself.isMaster() || state.countSlots(myself) == 0 {
+		return reply
+	}
+	if sender == nil || sender.isMaster() {
+		return reply
+	}
+	master := state.nodes[sender.masterID]
+	if master == nil || !master.fail {
+		return reply
+	}
+	// 每个epoch只投一票，同一个主节点的从节点在一段时间内只能获得一次投票
+	if msg.CurrentEpoch < state.currentEpoch || state.lastVoteEpoch == state.currentEpoch {
+		return reply
+	}
+	if time.Since(master.votedTime) < 2*state.nodeTimeout {
+		return reply
+	}
+	state.lastVoteEpoch = state.currentEpoch
+	master.votedTime = time.Now()
+	state.saveConfig()
+	logger.Info(fmt.Sprintf("voted for %s to replace %s in epoch %d", sender.addr(), master.addr(), state.currentEpoch))
+	reply.Ack = true
+	return reply
+}
+
+// setMyMaster 成为master的从节点，调用方需要持有锁
+func (state *clusterState) setMyMaster(master *clusterNode) {
+	myself := state.myself
+	myself.masterID = master.id
+	state.delSlots(myself)
+	state.migrating = make(map[int]*clusterNode)
+	state.importing = make(map[int]*clusterNode)
+	state.failoverAuthTime = time.Time{}
+	state.saveConfig()
+	state.mdb.startReplication(master.host, master.port)
+}
+
+// execReplicate CLUSTER REPLICATE node-id，成为指定主节点的从节点
+func execReplicate(state *clusterState, args [][]byte) redis.Reply {
+	if len(args) != 1 {
+		return protocol.MakeErrReply("ERR wrong number of arguments for 'cluster|replicate' command")
+	}
+	id := string(args[0])
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	node := state.nodes[id]
+	if node == nil {
+		return protocol.MakeErrReply("ERR Unknown node " + id)
+	}
+	if node == state.myself {
+		return protocol.MakeErrReply("ERR Can't replicate myself")
+	}
+	if !node.isMaster() {
+		return protocol.MakeErrReply("ERR I can only replicate a master, not a replica.")
+	}
+	if state.myself.isMaster() && state.countSlots(state.myself) > 0 {
+		return protocol.MakeErrReply("ERR To set a master the node must be empty and without assigned slots.")
+	}
+	state.setMyMaster(node)
+	state.broadcastLocked(state.makeMsg(msgPing))
+	return protocol.MakeOkReply()
+}
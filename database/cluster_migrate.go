@@ -0,0 +1,317 @@
+package database
+
+import (
+	"fmt"
+	"gedis/aof"
+	"gedis/interface/database"
+	"gedis/interface/redis"
+	"gedis/lib/utils"
+	"gedis/redis/client"
+	"gedis/redis/protocol"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+slot迁移，与redis cluster的流程一致：
+1. 目标节点 CLUSTER SETSLOT <slot> IMPORTING <源节点id>
+2. 源节点 CLUSTER SETSLOT <slot> MIGRATING <目标节点id>
+3. 在源节点循环 CLUSTER GETKEYSINSLOT 与 MIGRATE，直到slot中没有key
+4. 在所有节点执行 CLUSTER SETSLOT <slot> NODE <目标节点id>
+迁移期间源节点上不存在的key会返回ASK，让客户端到目标节点访问
+*/
+
+func parseSlot(arg []byte) (int, bool) {
+	slot, err := strconv.Atoi(string(arg))
+	if err != nil || slot < 0 || slot >= slotCount {
+		return 0, false
+	}
+	return slot, true
+}
+
+var errInvalidSlot = protocol.MakeErrReply("ERR Invalid or out of range slot")
+
+// keysInSlot 返回0号数据库中属于slot的key，limit小于0时不限制数量
+func (mdb *MultiDB) keysInSlot(slot int, limit int) []string {
+	keys := make([]string, 0)
+	if limit == 0 {
+		return keys
+	}
+	mdb.selectDB(0).ForEach(func(key string, _ *database.DataEntity, expiration *time.Time) bool {
+		if expiration != nil && expiration.Before(time.Now()) {
+			return true
+		}
+		if keyHashSlot(key) == slot {
+			keys = append(keys, key)
+		}
+		return limit < 0 || len(keys) < limit
+	})
+	return keys
+}
+
+// execSetSlot CLUSTER SETSLOT slot IMPORTING|MIGRATING|NODE node-id 或 CLUSTER SETSLOT slot STABLE
+func execSetSlot(mdb *MultiDB, args [][]byte) redis.Reply {
+	if len(args) < 2 {
+		return protocol.MakeErrReply("ERR wrong number of arguments for 'cluster|setslot' command")
+	}
+	slot, ok := parseSlot(args[0])
+	if !ok {
+		return errInvalidSlot
+	}
+	action := strings.ToLower(string(args[1]))
+	state := mdb.cluster
+	if action == "stable" {
+		if len(args) != 2 {
+			return protocol.MakeSyntaxErrReply()
+		}
+		state.mu.Lock()
+		delete(state.migrating, slot)
+		delete(state.importing, slot)
+		state.saveConfig()
+		state.mu.Unlock()
+		return protocol.MakeOkReply()
+	}
+	if len(args) != 3 {
+		return protocol.MakeSyntaxErrReply()
+	}
+	nodeID := string(args[2])
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	node, ok := state.nodes[nodeID]
+	if !ok {
+		return protocol.MakeErrReply("ERR I don't know about node " + nodeID)
+	}
+	switch action {
+	case "migrating":
+		if state.slots[slot] != state.myself {
+			return protocol.MakeErrReply(fmt.Sprintf("ERR I'm not the owner of hash slot %d", slot))
+		}
+		if node == state.myself {
+			return protocol.MakeErrReply("ERR I can't migrate a slot to myself")
+		}
+		state.migrating[slot] = node
+	case "importing":
+		if state.slots[slot] == state.myself {
+			return protocol.MakeErrReply(fmt.Sprintf("ERR I'm already the owner of hash slot %d", slot))
+		}
+		if node == state.myself {
+			return protocol.MakeErrReply("ERR I can't import a slot from myself")
+		}
+		state.importing[slot] = node
+	case "node":
+		// 迁出的slot中还有key时不能交给其他节点，否则这些key无法再被访问
+		if state.slots[slot] == state.myself && node != state.myself && len(mdb.keysInSlot(slot, 1)) > 0 {
+			return protocol.MakeErrReply(fmt.Sprintf("ERR Can't assign hashslot %d to a different node while I still hold keys for this hash slot.", slot))
+		}
+		// 迁入的slot交给自己时递增configEpoch，其他节点通过心跳得知slot的新归属
+		if node == state.myself && state.slots[slot] != state.myself {
+			state.currentEpoch++
+			state.myself.configEpoch = state.currentEpoch
+		}
+		state.slots[slot] = node
+		delete(state.migrating, slot)
+		delete(state.importing, slot)
+	default:
+		return protocol.MakeErrReply("ERR Invalid CLUSTER SETSLOT action or number of arguments. Try CLUSTER HELP")
+	}
+	state.saveConfig()
+	return protocol.MakeOkReply()
+}
+
+// execCountKeysInSlot CLUSTER COUNTKEYSINSLOT slot
+func execCountKeysInSlot(mdb *MultiDB, args [][]byte) redis.Reply {
+	if len(args) != 1 {
+		return protocol.MakeErrReply("ERR wrong number of arguments for 'cluster|countkeysinslot' command")
+	}
+	slot, ok := parseSlot(args[0])
+	if !ok {
+		return errInvalidSlot
+	}
+	return protocol.MakeIntReply(int64(len(mdb.keysInSlot(slot, -1))))
+}
+
+// execGetKeysInSlot CLUSTER GETKEYSINSLOT slot count
+func execGetKeysInSlot(mdb *MultiDB, args [][]byte) redis.Reply {
+	if len(args) != 2 {
+		return protocol.MakeErrReply("ERR wrong number of arguments for 'cluster|getkeysinslot' command")
+	}
+	slot, ok := parseSlot(args[0])
+	if !ok {
+		return errInvalidSlot
+	}
+	count, err := strconv.Atoi(string(args[1]))
+	if err != nil || count < 0 {
+		return protocol.MakeErrReply("ERR Invalid number of keys")
+	}
+	keys := mdb.keysInSlot(slot, count)
+	result := make([][]byte, len(keys))
+	for i, key := range keys {
+		result[i] = []byte(key)
+	}
+	return protocol.MakeMultiBulkReply(result)
+}
+
+/*---MIGRATE---*/
+
+// migrateArgs MIGRATE命令的参数
+type migrateArgs struct {
+	addr     string
+	destDB   int
+	timeout  time.Duration
+	copy     bool
+	replace  bool
+	authArgs []string
+	keys     []string
+}
+
+// parseMigrateArgs 解析 MIGRATE host port key|"" destination-db timeout [COPY] [REPLACE] [AUTH password] [AUTH2 username password] [KEYS key ...]
+func parseMigrateArgs(args [][]byte) (*migrateArgs, redis.Reply) {
+	port, err := strconv.Atoi(string(args[1]))
+	if err != nil {
+		return nil, protocol.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	destDB, err := strconv.Atoi(string(args[3]))
+	if err != nil {
+		return nil, protocol.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	timeout, err := strconv.ParseInt(string(args[4]), 10, 64)
+	if err != nil {
+		return nil, protocol.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	if timeout <= 0 {
+		timeout = 1000
+	}
+	migrate := &migrateArgs{
+		addr:    net.JoinHostPort(string(args[0]), strconv.Itoa(port)),
+		destDB:  destDB,
+		timeout: time.Duration(timeout) * time.Millisecond,
+	}
+	for i := 5; i < len(args); i++ {
+		switch strings.ToLower(string(args[i])) {
+		case "copy":
+			migrate.copy = true
+		case "replace":
+			migrate.replace = true
+		case "auth":
+			if i+1 >= len(args) {
+				return nil, protocol.MakeSyntaxErrReply()
+			}
+			migrate.authArgs = []string{string(args[i+1])}
+			i++
+		case "auth2":
+			if i+2 >= len(args) {
+				return nil, protocol.MakeSyntaxErrReply()
+			}
+			migrate.authArgs = []string{string(args[i+1]), string(args[i+2])}
+			i += 2
+		case "keys":
+			if len(args[2]) != 0 {
+				return nil, protocol.MakeErrReply("ERR When using MIGRATE KEYS option, the key argument must be set to the empty string")
+			}
+			for _, key := range args[i+1:] {
+				migrate.keys = append(migrate.keys, string(key))
+			}
+			i = len(args)
+		default:
+			return nil, protocol.MakeSyntaxErrReply()
+		}
+	}
+	if len(args[2]) != 0 {
+		migrate.keys = []string{string(args[2])}
+	}
+	return migrate, nil
+}
+
+// execMigrate 将key序列化之后通过RESTORE-ASKING发送到目标节点，目标节点全部写入成功的key会在本地删除
+// 迁移期间持有key的写锁，其他客户端对这些key的访问会等待迁移结束
+func execMigrate(mdb *MultiDB, c redis.Connection, args [][]byte) redis.Reply {
+	migrate, errReply := parseMigrateArgs(args)
+	if errReply != nil {
+		return errReply
+	}
+	if len(migrate.keys) == 0 {
+		return protocol.MakeStatusReply("NOKEY")
+	}
+	db := mdb.selectDB(c.GetDBIndex())
+	db.RWLocks(migrate.keys, nil)
+	defer db.RWUnLocks(migrate.keys, nil)
+
+	// 序列化key的值以及剩余的过期时间，已经不存在的key跳过
+	keys := make([]string, 0, len(migrate.keys))
+	cmds := make([]CmdLine, 0, len(migrate.keys))
+	for _, key := range migrate.keys {
+		entity, ok := db.GetEntity(key)
+		if !ok {
+			continue
+		}
+		var ttl int64
+		if raw, ok := db.ttlMap.Get(key); ok {
+			expireTime, _ := raw.(time.Time)
+			ttl = time.Until(expireTime).Milliseconds()
+			if ttl <= 0 {
+				continue
+			}
+		}
+		cmd := aof.EntityToCmd(key, entity)
+		if cmd == nil {
+			continue
+		}
+		restore := utils.ToCmdLine3("RESTORE-ASKING", []byte(key), []byte(strconv.FormatInt(ttl, 10)), cmd.ToBytes())
+		if migrate.replace {
+			restore = append(restore, []byte("REPLACE"))
+		}
+		keys = append(keys, key)
+		cmds = append(cmds, restore)
+	}
+	if len(keys) == 0 {
+		return protocol.MakeStatusReply("NOKEY")
+	}
+
+	cfg := client.Config{
+		Addr:        migrate.addr,
+		DB:          migrate.destDB,
+		DialTimeout: migrate.timeout,
+		ReadTimeout: migrate.timeout,
+	}
+	if len(migrate.authArgs) == 1 {
+		cfg.Password = migrate.authArgs[0]
+	} else if len(migrate.authArgs) == 2 {
+		cfg.Username, cfg.Password = migrate.authArgs[0], migrate.authArgs[1]
+	}
+	conn, err := client.Dial(cfg)
+	if err != nil {
+		if replyErr, ok := err.(client.Error); ok {
+			return protocol.MakeErrReply("ERR Target instance replied with error: " + replyErr.Error())
+		}
+		return protocol.MakeErrReply("IOERR error or timeout connecting to the client")
+	}
+	defer conn.Close()
+	// 一次性发送所有的RESTORE，再按顺序读取回复
+	replies, err := conn.Pipeline(cmds)
+	if err != nil {
+		return protocol.MakeErrReply("IOERR error or timeout reading to target instance")
+	}
+	var firstErr string
+	for i, key := range keys {
+		if errReply, ok := replies[i].(protocol.ErrorReply); ok {
+			if firstErr == "" {
+				firstErr = errReply.Error()
+			}
+			continue
+		}
+		if migrate.copy {
+			continue
+		}
+		// 目标节点写入成功之后删除本地的key，仍然持有写锁，期间不会有其他命令修改它
+		db.AddVersion(key)
+		db.Remove(key)
+		db.addDirty(1)
+		db.propagate(utils.ToCmdLine("DEL", key))
+	}
+	if firstErr != "" {
+		return protocol.MakeErrReply("ERR Target instance replied with error: " + firstErr)
+	}
+	return protocol.MakeOkReply()
+}
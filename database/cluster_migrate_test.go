@@ -0,0 +1,136 @@
+package database
+
+import (
+	"fmt"
+	"gedis/lib/utils"
+	"gedis/redis/connection"
+	"gedis/redis/protocol"
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+// dump 返回DUMP的序列化值
+func dump(t *testing.T, mdb *MultiDB, key string) string {
+	t.Helper()
+	reply, ok := mdb.Exec(connection.NewFakeConn(), utils.ToCmdLine("DUMP", key)).(*protocol.BulkReply)
+	if !ok {
+		t.Fatalf("dump %s failed", key)
+	}
+	return string(reply.Arg)
+}
+
+func TestDumpRestore(t *testing.T) {
+	mdb := makeTestServer(t)
+	c := connection.NewFakeConn()
+	execString(mdb, c, "SET", "str", "v")
+	execString(mdb, c, "RPUSH", "list", "a", "b")
+	execString(mdb, c, "HSET", "hash", "f", "v")
+	execString(mdb, c, "SADD", "set", "a", "b")
+	execString(mdb, c, "ZADD", "zset", "1.5", "m")
+	for _, key := range []string{"str", "list", "hash", "set", "zset"} {
+		assertReply(t, execString(mdb, c, "RESTORE", key+":copy", "0", dump(t, mdb, key)), "+OK\r\n")
+	}
+	assertReply(t, execString(mdb, c, "GET", "str:copy"), "$1\r\nv\r\n")
+	assertReply(t, execString(mdb, c, "LLEN", "list:copy"), ":2\r\n")
+	assertReply(t, execString(mdb, c, "HGET", "hash:copy", "f"), "$1\r\nv\r\n")
+	assertReply(t, execString(mdb, c, "SCARD", "set:copy"), ":2\r\n")
+	assertReply(t, execString(mdb, c, "ZSCORE", "zset:copy", "m"), "$3\r\n1.5\r\n")
+	assertReply(t, execString(mdb, c, "TTL", "str:copy"), ":-1\r\n")
+
+	payload := dump(t, mdb, "str")
+	assertReply(t, execString(mdb, c, "RESTORE", "str:copy", "0", payload),
+		"-BUSYKEY Target key name already exists.\r\n")
+	assertReply(t, execString(mdb, c, "RESTORE", "str:copy", "100000", payload, "REPLACE"), "+OK\r\n")
+	if ttl := execString(mdb, c, "TTL", "str:copy"); ttl != ":100\r\n" && ttl != ":99\r\n" {
+		t.Errorf("expect ttl 100 actually %q", ttl)
+	}
+	assertReply(t, execString(mdb, c, "RESTORE", "bad", "0", "garbage"),
+		"-ERR DUMP payload version or checksum are wrong\r\n")
+	// 只接受重建数据结构的命令
+	assertReply(t, execString(mdb, c, "RESTORE", "bad", "0",
+		string(protocol.MakeMultiBulkReply(utils.ToCmdLine("FLUSHALL", "x")).ToBytes())),
+		"-ERR DUMP payload version or checksum are wrong\r\n")
+	assertReply(t, execString(mdb, c, "DUMP", "missing"), "$-1\r\n")
+}
+
+func TestMigrate(t *testing.T) {
+	src := makeTestServer(t)
+	dest := makeTestServer(t)
+	host, port, _ := net.SplitHostPort(serveTestServer(t, dest))
+	c := connection.NewFakeConn()
+	destConn := connection.NewFakeConn()
+
+	execString(src, c, "SET", "k1", "v1")
+	execString(src, c, "PEXPIRE", "k1", "100000")
+	assertReply(t, execString(src, c, "MIGRATE", host, port, "k1", "0", "1000"), "+OK\r\n")
+	assertReply(t, execString(src, c, "EXISTS", "k1"), ":0\r\n")
+	assertReply(t, execString(dest, destConn, "GET", "k1"), "$2\r\nv1\r\n")
+	if ttl := execString(dest, destConn, "TTL", "k1"); ttl != ":100\r\n" && ttl != ":99\r\n" {
+		t.Errorf("expect ttl 100 actually %q", ttl)
+	}
+
+	// COPY保留本地的key，不存在的key被跳过
+	execString(src, c, "SADD", "k2", "a")
+	assertReply(t, execString(src, c, "MIGRATE", host, port, "", "1", "1000", "COPY", "KEYS", "k2", "missing"), "+OK\r\n")
+	assertReply(t, execString(src, c, "SISMEMBER", "k2", "a"), ":1\r\n")
+	destConn.SelectDB(1)
+	assertReply(t, execString(dest, destConn, "SISMEMBER", "k2", "a"), ":1\r\n")
+	destConn.SelectDB(0)
+	assertReply(t, execString(src, c, "MIGRATE", host, port, "missing", "0", "1000"), "+NOKEY\r\n")
+
+	// 目标节点已经存在的key需要REPLACE，失败时本地的key保留
+	execString(src, c, "SET", "k3", "src")
+	execString(dest, destConn, "SET", "k3", "dest")
+	assertReply(t, execString(src, c, "MIGRATE", host, port, "k3", "0", "1000"),
+		"-ERR Target instance replied with error: BUSYKEY Target key name already exists.\r\n")
+	assertReply(t, execString(src, c, "GET", "k3"), "$3\r\nsrc\r\n")
+	assertReply(t, execString(src, c, "MIGRATE", host, port, "k3", "0", "1000", "REPLACE"), "+OK\r\n")
+	assertReply(t, execString(dest, destConn, "GET", "k3"), "$3\r\nsrc\r\n")
+
+	// 目标节点不可用
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, closedPort, _ := net.SplitHostPort(listener.Addr().String())
+	_ = listener.Close()
+	execString(src, c, "SET", "k4", "v")
+	assertReply(t, execString(src, c, "MIGRATE", "127.0.0.1", closedPort, "k4", "0", "200"),
+		"-IOERR error or timeout connecting to the client\r\n")
+	assertReply(t, execString(src, c, "EXISTS", "k4"), ":1\r\n")
+}
+
+func TestReplicaRejectsMigrate(t *testing.T) {
+	mdb := makeTestServer(t)
+	c := connection.NewFakeConn()
+	execString(mdb, c, "SET", "k", "v")
+	payload := dump(t, mdb, "k")
+	atomic.StoreInt32(&mdb.role, roleSlave)
+	defer atomic.StoreInt32(&mdb.role, roleMaster)
+	readonly := "-READONLY You can't write against a read only replica\r\n"
+	assertReply(t, execString(mdb, c, "MIGRATE", "127.0.0.1", "1", "k", "0", "1000"), readonly)
+	assertReply(t, execString(mdb, c, "RESTORE-ASKING", "k2", "0", payload), readonly)
+	assertReply(t, execString(mdb, c, "EXISTS", "k"), ":1\r\n")
+}
+
+func TestRestoreAskingImporting(t *testing.T) {
+	// 当前节点负责0-8191，{a}所在的slot正在从7001迁入
+	mdb := makeClusterServer(t, "127.0.0.1:7000", "127.0.0.1:7000 0-8191", "127.0.0.1:7001 8192-16383")
+	c := connection.NewFakeConn()
+	slot := keyHashSlot("{a}")
+	other := mdb.cluster.slots[slotCount-1]
+	mdb.cluster.slots[slot] = other
+	mdb.cluster.importing[slot] = other
+	source := makeTestServer(t)
+	execString(source, c, "SET", "{a}1", "v")
+	payload := dump(t, source, "{a}1")
+
+	// MIGRATE发送的RESTORE-ASKING不需要ASKING
+	moved := fmt.Sprintf("-MOVED %d 127.0.0.1:7001\r\n", slot)
+	assertReply(t, execString(mdb, c, "RESTORE", "{a}1", "0", payload), moved)
+	assertReply(t, execString(mdb, c, "RESTORE-ASKING", "{a}1", "0", payload), "+OK\r\n")
+	assertReply(t, execString(mdb, c, "GET", "{a}1"), moved)
+	assertReply(t, execString(mdb, c, "ASKING"), "+OK\r\n")
+	assertReply(t, execString(mdb, c, "GET", "{a}1"), "$1\r\nv\r\n")
+}
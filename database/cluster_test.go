@@ -0,0 +1,134 @@
+package database
+
+import (
+	"fmt"
+	"gedis/config"
+	"gedis/redis/connection"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// makeClusterServer 创建开启集群模式的服务端，slots为cluster-slots配置
+func makeClusterServer(t *testing.T, self string, slots ...string) *MultiDB {
+	config.Properties.ClusterEnabled = true
+	config.Properties.Self = self
+	config.Properties.ClusterSlots = slots
+	// 节点配置写入临时目录，集群总线使用空闲端口
+	config.Properties.ClusterConfigFile = filepath.Join(t.TempDir(), "nodes.conf")
+	config.Properties.ClusterPort = freePort(t)
+	defer func() {
+		config.Properties.ClusterEnabled = false
+		config.Properties.Self = ""
+		config.Properties.ClusterSlots = nil
+		config.Properties.ClusterConfigFile = "nodes.conf"
+		config.Properties.ClusterPort = 0
+	}()
+	return makeTestServer(t)
+}
+
+func TestKeyHashSlot(t *testing.T) {
+	cases := map[string]string{
+		// 只使用第一个非空的{tag}计算slot
+		"{user1000}.following": "user1000",
+		"{user1000}.followers": "user1000",
+		"foo{bar}{zap}":        "bar",
+		"foo{{bar}}zap":        "{bar",
+		// 空的tag或者没有闭合的tag使用整个key
+		"foo{}{bar}": "foo{}{bar}",
+		"foo{bar":    "foo{bar",
+		"}foo{":      "}foo{",
+	}
+	for key, hashed := range cases {
+		if keyHashSlot(key) != keyHashSlot(hashed) {
+			t.Errorf("key %q: expect slot of %q", key, hashed)
+		}
+	}
+	assertReply(t, fmt.Sprint(keyHashSlot("foo")), "12182")
+	assertReply(t, fmt.Sprint(keyHashSlot("{foo}bar")), "12182")
+}
+
+func TestClusterRedirect(t *testing.T) {
+	// 当前节点负责0-8191，7001负责8192-16382，16383没有节点负责
+	mdb := makeClusterServer(t, "127.0.0.1:7000", "127.0.0.1:7000 0-8191", "127.0.0.1:7001 8192-16382")
+	c := connection.NewFakeConn()
+	// foo在12182，bar在5061
+	assertReply(t, execString(mdb, c, "SET", "bar", "v"), "+OK\r\n")
+	assertReply(t, execString(mdb, c, "GET", "bar"), "$1\r\nv\r\n")
+	assertReply(t, execString(mdb, c, "GET", "foo"), "-MOVED 12182 127.0.0.1:7001\r\n")
+	assertReply(t, execString(mdb, c, "SET", "{foo}bar", "v"), "-MOVED 12182 127.0.0.1:7001\r\n")
+	assertReply(t, execString(mdb, c, "MSET", "bar", "1", "{bar}1", "2"), "+OK\r\n")
+	assertReply(t, execString(mdb, c, "MGET", "bar", "foo"), "-CROSSSLOT Keys in request don't hash to the same slot\r\n")
+	unserved := "k0"
+	for i := 1; keyHashSlot(unserved) != slotCount-1; i++ {
+		unserved = fmt.Sprintf("k%d", i)
+	}
+	assertReply(t, execString(mdb, c, "GET", unserved), "-CLUSTERDOWN Hash slot not served\r\n")
+	// 没有key的命令在本地执行，集群模式下只能使用0号数据库
+	assertReply(t, execString(mdb, c, "PING"), "+PONG\r\n")
+	assertReply(t, execString(mdb, c, "SELECT", "1"), "-ERR SELECT is not allowed in cluster mode\r\n")
+
+	// 迁出的slot中存在的key在本地执行，不存在的key返回ASK
+	other := mdb.cluster.slots[keyHashSlot("foo")]
+	barSlot := keyHashSlot("bar")
+	mdb.cluster.migrating[barSlot] = other
+	assertReply(t, execString(mdb, c, "GET", "bar"), "$1\r\n1\r\n")
+	assertReply(t, execString(mdb, c, "GET", "{bar}missing"), fmt.Sprintf("-ASK %d 127.0.0.1:7001\r\n", barSlot))
+	assertReply(t, execString(mdb, c, "MGET", "{bar}1", "{bar}missing"),
+		"-TRYAGAIN Multiple keys request during rehashing of slot\r\n")
+
+	// 迁入的slot只接受ASKING之后的命令，ASKING只对之后的一条命令有效
+	delete(mdb.cluster.migrating, barSlot)
+	mdb.cluster.slots[barSlot] = other
+	mdb.cluster.importing[barSlot] = other
+	moved := fmt.Sprintf("-MOVED %d 127.0.0.1:7001\r\n", barSlot)
+	assertReply(t, execString(mdb, c, "GET", "bar"), moved)
+	assertReply(t, execString(mdb, c, "ASKING"), "+OK\r\n")
+	assertReply(t, execString(mdb, c, "GET", "bar"), "$1\r\n1\r\n")
+	assertReply(t, execString(mdb, c, "GET", "bar"), moved)
+	assertReply(t, execString(mdb, c, "ASKING"), "+OK\r\n")
+	assertReply(t, execString(mdb, c, "MGET", "{bar}1", "{bar}missing"),
+		"-TRYAGAIN Multiple keys request during rehashing of slot\r\n")
+	assertReply(t, execString(mdb, c, "ASKING"), "+OK\r\n")
+	assertReply(t, execString(mdb, c, "MGET", "bar", "{bar}1"), "*2\r\n$1\r\n1\r\n$1\r\n2\r\n")
+	delete(mdb.cluster.importing, barSlot)
+	assertReply(t, execString(mdb, c, "ASKING"), "+OK\r\n")
+	assertReply(t, execString(mdb, c, "GET", "bar"), moved)
+}
+
+func TestClusterCommand(t *testing.T) {
+	mdb := makeClusterServer(t, "127.0.0.1:7000", "127.0.0.1:7000 0-100 200", "127.0.0.1:7001 101-199 201-16383")
+	c := connection.NewFakeConn()
+	self, other := genNodeID("127.0.0.1:7000"), genNodeID("127.0.0.1:7001")
+	assertReply(t, execString(mdb, c, "CLUSTER", "KEYSLOT", "{foo}bar"), ":12182\r\n")
+	assertReply(t, execString(mdb, c, "CLUSTER", "MYID"), "$40\r\n"+self+"\r\n")
+	assertReply(t, execString(mdb, c, "CLUSTER", "SLOTS"), "*4\r\n"+
+		"*3\r\n:0\r\n:100\r\n*3\r\n$9\r\n127.0.0.1\r\n:7000\r\n$40\r\n"+self+"\r\n"+
+		"*3\r\n:101\r\n:199\r\n*3\r\n$9\r\n127.0.0.1\r\n:7001\r\n$40\r\n"+other+"\r\n"+
+		"*3\r\n:200\r\n:200\r\n*3\r\n$9\r\n127.0.0.1\r\n:7000\r\n$40\r\n"+self+"\r\n"+
+		"*3\r\n:201\r\n:16383\r\n*3\r\n$9\r\n127.0.0.1\r\n:7001\r\n$40\r\n"+other+"\r\n")
+	nodes := execString(mdb, c, "CLUSTER", "NODES")
+	selfLine := fmt.Sprintf("%s 127.0.0.1:7000@%d myself,master - 0 0 0 connected 0-100 200\n", self, mdb.cluster.myself.busPort)
+	if !strings.Contains(nodes, selfLine) {
+		t.Errorf("expect %q in CLUSTER NODES actually %q", selfLine, nodes)
+	}
+	// 其他节点的行中包含发送ping的时间
+	otherLine := regexp.MustCompile(other + ` 127\.0\.0\.1:7001@17001 master - 0 \d+ 0 connected 101-199 201-16383\n`)
+	if !otherLine.MatchString(nodes) {
+		t.Errorf("expect %s in CLUSTER NODES actually %q", otherLine, nodes)
+	}
+	shards := execString(mdb, c, "CLUSTER", "SHARDS")
+	if !strings.HasPrefix(shards, "*2\r\n*4\r\n$5\r\nslots\r\n*4\r\n:0\r\n:100\r\n:200\r\n:200\r\n$5\r\nnodes\r\n") {
+		t.Errorf("unexpected CLUSTER SHARDS %q", shards)
+	}
+	info := execString(mdb, c, "CLUSTER", "INFO")
+	if !strings.Contains(info, "cluster_state:ok\r\n") || !strings.Contains(info, "cluster_known_nodes:2\r\n") {
+		t.Errorf("unexpected CLUSTER INFO %q", info)
+	}
+	assertReply(t, execString(mdb, c, "CLUSTER", "KEYSLOT"), "-ERR wrong number of arguments for 'cluster|keyslot' command\r\n")
+
+	standalone := makeTestServer(t)
+	assertReply(t, execString(standalone, c, "CLUSTER", "INFO"), "-ERR This instance has cluster support disabled\r\n")
+	assertReply(t, execString(standalone, c, "ASKING"), "-ERR This instance has cluster support disabled\r\n")
+}
@@ -2,24 +2,65 @@ package database
 
 import (
 	"fmt"
+	"gedis/aof"
 	"gedis/config"
 	"gedis/interface/database"
 	"gedis/interface/redis"
 	"gedis/lib/logger"
+	"gedis/lib/raft"
+	"gedis/lib/sync/atomic"
+	"gedis/lib/timewheel"
 	"gedis/redis/protocol"
 	"runtime/debug"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 // MultiDB 是一个组合类，包括多个DB
 type MultiDB struct {
 	dbSet []*DB
+	// aof持久化，未开启时为nil
+	persister *aof.Persister
+	// 普通命令执行时持有读锁，save等需要一致性快照的操作持有写锁
+	pausing sync.RWMutex
+	// 分布式事务的参与者从Prepare到Commit或Rollback期间持有读锁，需要快照的操作通过pause先获取写锁
+	pausingTx sync.RWMutex
+	// 是否有bgsave正在执行
+	bgSaving atomic.Boolean
+	// 最近一次成功保存rdb的unix时间戳
+	lastSave int64
+	// 自上次保存rdb以来的修改次数
+	dirty int64
+	// 最近一次bgsave是否失败，以及最近一次尝试bgsave的unix时间戳
+	lastBgSaveFailed atomic.Boolean
+	lastBgSaveTry    int64
+	// 自动bgsave的规则
+	savePoints []config.SavePoint
+	closed     atomic.Boolean
+	startTime  time.Time
+
+	// 主从复制，role为roleMaster或roleSlave
+	role   int32
+	master *masterStatus
+	slave  *slaveStatus
+	// 发送ping的定时任务，每个实例使用不同的key，关闭时取消
+	pingTaskKey string
+
+	// 集群模式下的slot分配，未开启时为nil
+	cluster *clusterState
+	// raft强一致模式的节点，未开启时为nil
+	raft *raft.Node
 }
 
 func NewStandaloneServer() *MultiDB {
-	mdb := &MultiDB{}
+	mdb := &MultiDB{
+		lastSave:  time.Now().Unix(),
+		startTime: time.Now(),
+		master:    makeMasterStatus(),
+		slave:     &slaveStatus{},
+	}
 	if config.Properties.Databases == 0 {
 		config.Properties.Databases = 16
 	}
@@ -27,17 +68,93 @@ func NewStandaloneServer() *MultiDB {
 	for i := range mdb.dbSet {
 		singleDB := MakeDB()
 		singleDB.index = i
+		singleDB.addDirty = mdb.addDirty
+		singleDB.addBacklog = func(line CmdLine) {
+			mdb.master.feed(singleDB.index, line)
+		}
 		mdb.dbSet[i] = singleDB
 	}
+	if config.Properties.RaftEnabled {
+		if config.Properties.ClusterEnabled {
+			panic("raft-enabled cannot be used together with cluster-enabled")
+		}
+		if config.Properties.AppendOnly {
+			panic("raft-enabled cannot be used together with appendonly, data is persisted in raft-dir")
+		}
+		if config.Properties.ReplicaOf != "" {
+			panic("raft-enabled cannot be used together with replicaof")
+		}
+	}
+	// 与redis一致，开启aof时以aof文件为准，否则从rdb文件恢复数据
+	// raft模式下数据从raft的快照与日志恢复
+	if !config.Properties.AppendOnly && !config.Properties.RaftEnabled && config.Properties.RDBFilename != "" {
+		if err := mdb.loadRDBFile(); err != nil {
+			logger.Error(err.Error())
+		}
+	}
+	// 开启aof时先重放aof文件，再将之后的写命令追加到aof
+	if config.Properties.AppendOnly {
+		persister, err := aof.NewPersister(mdb,
+			config.Properties.AppendFilename, true, config.Properties.AppendFsync,
+			func() database.DBEngine {
+				return MakeBasicMultiDB()
+			})
+		if err != nil {
+			panic(err)
+		}
+		mdb.bindPersister(persister)
+		minSize, err := config.ParseSize(config.Properties.AutoAofRewriteMinSize)
+		if err != nil {
+			panic(err)
+		}
+		persister.EnableAutoRewrite(config.Properties.AutoAofRewritePercentage, minSize)
+	}
+	// 加载数据产生的修改不需要再次保存
+	mdb.dirty = 0
+	savePoints, err := config.ParseSavePoints(config.Properties.Save)
+	if err != nil {
+		panic(err)
+	}
+	mdb.startSaveScheduler(savePoints)
+	mdb.startReplPing()
+	if config.Properties.ClusterEnabled {
+		if len(config.Properties.Peers) > 0 {
+			panic("cluster-enabled cannot be used together with peers")
+		}
+		if err := mdb.initCluster(); err != nil {
+			panic(err)
+		}
+	}
+	if config.Properties.RaftEnabled {
+		if err := mdb.initRaft(); err != nil {
+			panic(err)
+		}
+	}
+	if config.Properties.ReplicaOf != "" {
+		fields := strings.Fields(config.Properties.ReplicaOf)
+		if len(fields) != 2 {
+			panic("invalid replicaof: " + config.Properties.ReplicaOf)
+		}
+		port, err := strconv.Atoi(fields[1])
+		if err != nil {
+			panic("invalid replicaof: " + config.Properties.ReplicaOf)
+		}
+		mdb.startReplication(fields[0], port)
+	}
 	return mdb
 }
 
 // MakeBasicMultiDB 创建一个非线程安全基本的数据库
 func MakeBasicMultiDB() *MultiDB {
 	mdb := &MultiDB{}
+	if config.Properties.Databases == 0 {
+		config.Properties.Databases = 16
+	}
 	mdb.dbSet = make([]*DB, config.Properties.Databases)
 	for i := range mdb.dbSet {
-		mdb.dbSet[i] = makeBasicDB()
+		basicDB := makeBasicDB()
+		basicDB.index = i
+		mdb.dbSet[i] = basicDB
 	}
 	return mdb
 }
@@ -60,6 +177,10 @@ func (mdb *MultiDB) Exec(c redis.Connection, cmdLine [][]byte) (result redis.Rep
 	if cmdName == "auth" {
 		return Auth(c, cmdLine[1:])
 	}
+	// HELLO可以同时鉴权，在鉴权检查之前处理
+	if cmdName == "hello" {
+		return Hello(mdb, c, cmdLine[1:])
+	}
 	if cmdName == "command" {
 		return protocol.MakeOkReply()
 	}
@@ -67,9 +188,109 @@ func (mdb *MultiDB) Exec(c redis.Connection, cmdLine [][]byte) (result redis.Rep
 	if !isAuthenticated(c) {
 		return protocol.MakeErrReply("NOAUTH Authentication required")
 	}
+	// 集群模式下key不属于当前节点时让客户端重定向，从节点将所有key重定向到主节点
+	if mdb.cluster != nil && cmdName != "asking" {
+		if errReply := mdb.cluster.redirect(mdb, c, cmdLine); errReply != nil {
+			return errReply
+		}
+	}
+	// raft模式下写命令提交之后才执行，follower将命令重定向到leader
+	if mdb.raft != nil {
+		if reply, ok := mdb.execRaft(c, cmdLine); ok {
+			return reply
+		}
+	}
+	if mdb.isReadOnlyRejected(c, cmdLine) {
+		return protocol.MakeErrReply("READONLY You can't write against a read only replica")
+	}
+	defer mdb.recordWriteOffset(c, cmdLine)
+
+	// save、bgsave、psync与replicaof需要获取pausing的写锁，jsonrestore会重新进入Exec，必须在获取读锁之前处理
+	if cmdName == "save" {
+		if len(cmdLine) != 1 {
+			return protocol.MakeArgNumErrReply(cmdName)
+		}
+		return SaveRDB(mdb)
+	} else if cmdName == "bgsave" {
+		if len(cmdLine) != 1 {
+			return protocol.MakeArgNumErrReply(cmdName)
+		}
+		return BGSaveRDB(mdb)
+	} else if cmdName == "lastsave" {
+		if len(cmdLine) != 1 {
+			return protocol.MakeArgNumErrReply(cmdName)
+		}
+		return LastSave(mdb)
+	} else if cmdName == "info" {
+		if len(cmdLine) > 2 {
+			return protocol.MakeArgNumErrReply(cmdName)
+		}
+		return Info(mdb, cmdLine[1:])
+	} else if cmdName == "jsondump" {
+		if len(cmdLine) > 2 {
+			return protocol.MakeArgNumErrReply(cmdName)
+		}
+		return JSONDump(mdb, cmdLine[1:])
+	} else if cmdName == "jsonrestore" {
+		if len(cmdLine) < 2 {
+			return protocol.MakeArgNumErrReply(cmdName)
+		}
+		return JSONRestore(mdb, cmdLine[1:])
+	} else if cmdName == "psync" {
+		if len(cmdLine) != 3 {
+			return protocol.MakeArgNumErrReply(cmdName)
+		}
+		return execPSync(mdb, c, cmdLine[1:])
+	} else if cmdName == "replicaof" || cmdName == "slaveof" {
+		if len(cmdLine) != 3 {
+			return protocol.MakeArgNumErrReply(cmdName)
+		}
+		if mdb.cluster != nil {
+			return protocol.MakeErrReply("ERR REPLICAOF not allowed in cluster mode.")
+		}
+		return execReplicaOf(mdb, cmdLine[1:])
+	} else if cmdName == "replconf" {
+		return execReplConf(mdb, c, cmdLine[1:])
+	} else if cmdName == "wait" {
+		// 事务中的命令在EXEC时一起执行，不能阻塞
+		if c.InMultiState() {
+			return protocol.MakeErrReply("ERR command 'Wait' cannot be used in MULTI")
+		}
+		if len(cmdLine) != 3 {
+			return protocol.MakeArgNumErrReply(cmdName)
+		}
+		return execWait(mdb, c, cmdLine[1:])
+	} else if cmdName == "role" {
+		if len(cmdLine) != 1 {
+			return protocol.MakeArgNumErrReply(cmdName)
+		}
+		return execRole(mdb)
+	} else if cmdName == "cluster" {
+		if len(cmdLine) < 2 {
+			return protocol.MakeArgNumErrReply(cmdName)
+		}
+		return execCluster(mdb, cmdLine[1:])
+	} else if cmdName == "asking" {
+		if len(cmdLine) != 1 {
+			return protocol.MakeArgNumErrReply(cmdName)
+		}
+		return execAsking(mdb, c)
+	}
+	mdb.pausing.RLock()
+	defer mdb.pausing.RUnlock()
 
 	if cmdName == "flushall" {
-		return mdb.flushAll()
+		if c.InMultiState() {
+			return protocol.MakeErrReply("ERR command 'FlushAll' cannot be used in MULTI")
+		}
+		result := mdb.flushAll()
+		if mdb.persister != nil {
+			mdb.persister.SaveCmdLine(dbIndex, cmdLine)
+		}
+		if mdb.master != nil {
+			mdb.master.feed(-1, cmdLine)
+		}
+		return result
 	} else if cmdName == "select" {
 		if c != nil && c.InMultiState() {
 			return protocol.MakeErrReply("cannot select database within multi")
@@ -78,22 +299,86 @@ func (mdb *MultiDB) Exec(c redis.Connection, cmdLine [][]byte) (result redis.Rep
 			return protocol.MakeArgNumErrReply("select")
 		}
 		return execSelect(c, mdb, cmdLine[1:])
+	} else if cmdName == "migrate" {
+		if c.InMultiState() {
+			return protocol.MakeErrReply("ERR command 'Migrate' cannot be used in MULTI")
+		}
+		if len(cmdLine) < 6 {
+			return protocol.MakeArgNumErrReply(cmdName)
+		}
+		return execMigrate(mdb, c, cmdLine[1:])
+	} else if cmdName == "bgrewriteaof" {
+		if len(cmdLine) != 1 {
+			return protocol.MakeArgNumErrReply(cmdName)
+		}
+		return BGRewriteAOF(mdb)
 	}
 
 	selectedDB := mdb.dbSet[dbIndex]
 	return selectedDB.Exec(c, cmdLine)
 }
 
+// Close 关闭数据库，配置了save规则时保存一次rdb，并将aof缓冲区中的命令写入磁盘
+func (mdb *MultiDB) Close() {
+	if !mdb.closed.CompareAndSet(false, true) {
+		return
+	}
+	if mdb.slave != nil {
+		mdb.slave.mu.Lock()
+		mdb.slave.configVersion++
+		if mdb.slave.masterConn != nil {
+			_ = mdb.slave.masterConn.Close()
+		}
+		mdb.slave.mu.Unlock()
+	}
+	if mdb.cluster != nil {
+		mdb.cluster.close()
+	}
+	if mdb.raft != nil {
+		mdb.raft.Stop()
+	}
+	if len(mdb.savePoints) > 0 {
+		SaveRDB(mdb)
+	}
+	if mdb.persister != nil {
+		mdb.persister.Close()
+	}
+	// 取消定时任务，关闭之后时间轮不再持有数据库
+	timewheel.Cancel(mdb.pingTaskKey)
+	for _, db := range mdb.dbSet {
+		db.cancelExpireTasks()
+	}
+}
+
+// AfterClientClose 客户端断开连接之后清理相关的状态
+func (mdb *MultiDB) AfterClientClose(c redis.Connection) {
+	if mdb.master == nil {
+		return
+	}
+	mdb.master.mu.Lock()
+	slave, ok := mdb.master.slaves[c]
+	delete(mdb.master.listeningPorts, c)
+	mdb.master.mu.Unlock()
+	if ok {
+		mdb.master.removeSlave(slave)
+	}
+}
+
 func execSelect(c redis.Connection, mdb *MultiDB, args [][]byte) redis.Reply {
 	dbIndex, err := strconv.Atoi(string(args[0]))
 	if err != nil {
 		return protocol.MakeErrReply("ERR invalid DB index")
 	}
+	// 与redis cluster一致，集群模式下只能使用0号数据库
+	if mdb.cluster != nil && dbIndex != 0 {
+		return protocol.MakeErrReply("ERR SELECT is not allowed in cluster mode")
+	}
 	c.SelectDB(dbIndex)
 	return protocol.MakeOkReply()
 }
 func (mdb *MultiDB) flushAll() redis.Reply {
 	for _, db := range mdb.dbSet {
+		mdb.addDirty(db.data.Len())
 		db.Flush()
 	}
 	return protocol.MakeOkReply()
@@ -113,3 +398,96 @@ func (mdb *MultiDB) GetDBSize(dbIndex int) (int, int) {
 	db := mdb.selectDB(dbIndex)
 	return db.data.Len(), db.ttlMap.Len()
 }
+
+/*---集群的分布式事务在调用方持有key的锁时执行命令---*/
+
+// pause 暂停所有命令，先等待已经Prepare的分布式事务结束，再获取pausing的写锁
+// 事务持有key的锁时不会有快照操作等待pausing的写锁，提交时执行命令需要的pausing读锁不会被阻塞
+func (mdb *MultiDB) pause() {
+	mdb.pausingTx.Lock()
+	mdb.pausing.Lock()
+}
+
+// resume 恢复被pause暂停的命令
+func (mdb *MultiDB) resume() {
+	mdb.pausing.Unlock()
+	mdb.pausingTx.Unlock()
+}
+
+// RWLocks 为dbIndex中的key加锁，同时获取pausingTx的读锁，快照操作在事务结束之前不会开始
+// 不持有pausing的读锁，等待事务提交期间其他命令不会被排队的save阻塞
+func (mdb *MultiDB) RWLocks(dbIndex int, writeKeys []string, readKeys []string) {
+	mdb.pausingTx.RLock()
+	mdb.selectDB(dbIndex).RWLocks(writeKeys, readKeys)
+}
+
+// RWUnLocks 释放dbIndex中key的锁以及RWLocks获取的pausingTx读锁
+func (mdb *MultiDB) RWUnLocks(dbIndex int, writeKeys []string, readKeys []string) {
+	mdb.selectDB(dbIndex).RWUnLocks(writeKeys, readKeys)
+	mdb.pausingTx.RUnlock()
+}
+
+// GetUndoLogs 返回撤销一组命令所需的命令，调用方需要持有写key的锁
+// 只有一条命令时使用命令自身的UndoFunc，多条命令时后面命令的undo依赖前面命令的结果，
+// 因此直接保存所有写key当前的值
+func (mdb *MultiDB) GetUndoLogs(dbIndex int, cmdLines []CmdLine) []CmdLine {
+	db := mdb.selectDB(dbIndex)
+	if len(cmdLines) == 1 {
+		return db.GetUndoLogs(cmdLines[0])
+	}
+	keySet := make(map[string]struct{})
+	keys := make([]string, 0)
+	for _, cmdLine := range cmdLines {
+		cmd, ok := cmdTable[strings.ToLower(string(cmdLine[0]))]
+		if !ok || cmd.prepare == nil || !validateArity(cmd.arity, cmdLine) {
+			continue
+		}
+		write, _ := cmd.prepare(cmdLine[1:])
+		for _, key := range write {
+			if _, ok := keySet[key]; !ok {
+				keySet[key] = struct{}{}
+				keys = append(keys, key)
+			}
+		}
+	}
+	return rollbackGivenKeys(db, keys...)
+}
+
+// ExecWithLock 在调用方已经通过RWLocks持有key的锁时执行命令，执行成功的写命令同样会写入aof以及复制积压缓冲区
+func (mdb *MultiDB) ExecWithLock(c redis.Connection, cmdLine CmdLine) redis.Reply {
+	mdb.pausing.RLock()
+	defer mdb.pausing.RUnlock()
+	db := mdb.selectDB(c.GetDBIndex())
+	cmd, ok := cmdTable[strings.ToLower(string(cmdLine[0]))]
+	if !ok || cmd.prepare == nil {
+		return protocol.MakeErrReply("ERR unknown command '" + string(cmdLine[0]) + "'")
+	}
+	if !validateArity(cmd.arity, cmdLine) {
+		return protocol.MakeArgNumErrReply(string(cmdLine[0]))
+	}
+	write, _ := cmd.prepare(cmdLine[1:])
+	db.AddVersion(write...)
+	result := cmd.executor(db, cmdLine[1:])
+	if len(write) > 0 && !protocol.IsErrorReply(result) {
+		db.addDirty(len(write))
+		for _, line := range toAofCmdLines(db, cmdLine, result) {
+			db.propagate(line)
+		}
+	}
+	return result
+}
+
+// GetEntity 返回dbIndex中未过期的key
+func (mdb *MultiDB) GetEntity(dbIndex int, key string) (*database.DataEntity, bool) {
+	return mdb.selectDB(dbIndex).GetEntity(key)
+}
+
+// GetExpiration 返回key的过期时间，没有设置过期时间时返回nil
+func (mdb *MultiDB) GetExpiration(dbIndex int, key string) *time.Time {
+	raw, ok := mdb.selectDB(dbIndex).ttlMap.Get(key)
+	if !ok {
+		return nil
+	}
+	expireTime, _ := raw.(time.Time)
+	return &expireTime
+}
@@ -0,0 +1,151 @@
+package database
+
+import (
+	"gedis/config"
+	"gedis/lib/utils"
+	"gedis/redis/connection"
+	"gedis/redis/parser"
+	"gedis/redis/protocol"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// makeTestServer 创建不加载也不自动保存数据的服务端，rdb文件写入临时目录
+func makeTestServer(t *testing.T) *MultiDB {
+	config.Properties.Save = nil
+	config.Properties.AppendOnly = false
+	config.Properties.RDBFilename = ""
+	mdb := NewStandaloneServer()
+	config.Properties.RDBFilename = filepath.Join(t.TempDir(), "dump.rdb")
+	t.Cleanup(mdb.Close)
+	return mdb
+}
+
+// serveTestServer 在随机端口上处理客户端的命令，返回监听的地址
+func serveTestServer(t *testing.T, mdb *MultiDB) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	go func() {
+		for {
+			netConn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn := connection.NewConn(netConn)
+				defer func() {
+					mdb.AfterClientClose(conn)
+					_ = conn.Close()
+				}()
+				for payload := range parser.ParseStream(netConn) {
+					args, ok := payload.Data.(*protocol.MultiBulkReply)
+					if payload.Err != nil || !ok {
+						return
+					}
+					if err := conn.Write(mdb.Exec(conn, args.Args).ToBytes()); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// execString 执行命令并返回回复的原始字节
+func execString(mdb *MultiDB, c *connection.FakeConn, args ...string) string {
+	return string(mdb.Exec(c, utils.ToCmdLine(args...)).ToBytes())
+}
+
+func assertReply(t *testing.T, actual string, expect string) {
+	t.Helper()
+	if actual != expect {
+		t.Errorf("expect %q actually %q", expect, actual)
+	}
+}
+
+// waitReply 等待异步执行的命令返回，超时说明发生了死锁
+func waitReply(t *testing.T, name string, ch <-chan string) string {
+	select {
+	case reply := <-ch:
+		return reply
+	case <-time.After(3 * time.Second):
+		t.Fatalf("%s blocked", name)
+		return ""
+	}
+}
+
+func TestRWLocksWithPendingSave(t *testing.T) {
+	mdb := makeTestServer(t)
+	// 分布式事务的参与者在Prepare时加锁，Commit时执行命令并释放锁
+	mdb.RWLocks(0, []string{"k"}, nil)
+
+	setDone := make(chan string, 1)
+	go func() {
+		setDone <- string(mdb.Exec(connection.NewFakeConn(), utils.ToCmdLine("SET", "k", "1")).ToBytes())
+	}()
+	// SET先获取pausing的读锁，然后等待key的锁
+	time.Sleep(100 * time.Millisecond)
+	saveDone := make(chan string, 1)
+	go func() {
+		saveDone <- string(mdb.Exec(connection.NewFakeConn(), utils.ToCmdLine("SAVE")).ToBytes())
+	}()
+	// SAVE等待事务结束
+	time.Sleep(100 * time.Millisecond)
+	// 事务提交之前，与事务无关的命令不会被排队的SAVE阻塞
+	getDone := make(chan string, 1)
+	go func() {
+		getDone <- string(mdb.Exec(connection.NewFakeConn(), utils.ToCmdLine("GET", "other")).ToBytes())
+	}()
+	if reply := waitReply(t, "get", getDone); reply != string(protocol.MakeNullBulkReply().ToBytes()) {
+		t.Errorf("get: expect nil actually %q", reply)
+	}
+	select {
+	case reply := <-saveDone:
+		t.Fatalf("save finished before commit: %q", reply)
+	default:
+	}
+
+	commitDone := make(chan string, 1)
+	go func() {
+		reply := mdb.ExecWithLock(connection.NewFakeConn(), utils.ToCmdLine("SET", "k", "2"))
+		mdb.RWUnLocks(0, []string{"k"}, nil)
+		commitDone <- string(reply.ToBytes())
+	}()
+	ok := string(protocol.MakeOkReply().ToBytes())
+	for name, ch := range map[string]chan string{"commit": commitDone, "set": setDone, "save": saveDone} {
+		if reply := waitReply(t, name, ch); reply != ok {
+			t.Errorf("%s: expect OK actually %q", name, reply)
+		}
+	}
+	reply := mdb.Exec(connection.NewFakeConn(), utils.ToCmdLine("GET", "k"))
+	if bulk, ok := reply.(*protocol.BulkReply); !ok || string(bulk.Arg) != "1" {
+		t.Errorf("expect 1 actually %q", reply.ToBytes())
+	}
+}
+
+func TestBasicDBExpire(t *testing.T) {
+	makeTestServer(t)
+	basic := MakeBasicMultiDB()
+	c := connection.NewFakeConn()
+	basic.Exec(c, utils.ToCmdLine("SET", "k", "v", "PX", "100"))
+	if _, ok := basic.dbSet[0].ttlMap.Get("k"); !ok {
+		t.Fatal("expect ttl recorded in basic db")
+	}
+	// aof重写时临时的DB不注册过期任务，定时任务会持有临时的数据并覆盖正在运行的DB中同名key的任务
+	time.Sleep(2500 * time.Millisecond)
+	if _, ok := basic.dbSet[0].data.Get("k"); !ok {
+		t.Error("expect no expire task in basic db")
+	}
+	// 读取时仍然惰性删除
+	if reply := basic.Exec(c, utils.ToCmdLine("GET", "k")); string(reply.ToBytes()) != "$-1\r\n" {
+		t.Errorf("expect nil actually %q", reply.ToBytes())
+	}
+}
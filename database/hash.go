@@ -302,7 +302,7 @@ func execHGetAll(db *DB, args [][]byte) redis.Reply {
 		return errReply
 	}
 	if dict == nil {
-		return &protocol.EmptyMultiBulkReply{}
+		return protocol.MakeMapReply(nil)
 	}
 
 	size := dict.Len()
@@ -315,7 +315,7 @@ func execHGetAll(db *DB, args [][]byte) redis.Reply {
 		i++
 		return true
 	})
-	return protocol.MakeMultiBulkReply(result[:i])
+	return protocol.MakeBulkMapReply(result[:i])
 }
 
 // execHIncrBy increments the integer value of a hash field by the given number
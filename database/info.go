@@ -0,0 +1,122 @@
+package database
+
+import (
+	"bytes"
+	"fmt"
+	"gedis/config"
+	"gedis/interface/redis"
+	"gedis/redis/protocol"
+	"os"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// infoSection 生成INFO中的一个部分
+type infoSection struct {
+	name      string
+	generator func(mdb *MultiDB) string
+}
+
+// infoSections 按顺序输出的INFO部分
+var infoSections = []infoSection{
+	{"server", genServerInfo},
+	{"persistence", genPersistenceInfo},
+	{"replication", genReplicationInfo},
+	{"cluster", genClusterInfo},
+	{"raft", genRaftInfo},
+	{"keyspace", genKeyspaceInfo},
+}
+
+// Info 返回服务器的状态信息，可以通过参数指定部分
+func Info(mdb *MultiDB, args [][]byte) redis.Reply {
+	section := "default"
+	if len(args) == 1 {
+		section = strings.ToLower(string(args[0]))
+	}
+	all := section == "default" || section == "all" || section == "everything"
+	buf := &bytes.Buffer{}
+	for _, s := range infoSections {
+		if !all && s.name != section {
+			continue
+		}
+		if buf.Len() > 0 {
+			buf.WriteString("\r\n")
+		}
+		buf.WriteString("# " + strings.Title(s.name) + "\r\n")
+		buf.WriteString(s.generator(mdb))
+	}
+	return protocol.MakeVerbatimStringReply("txt", buf.Bytes())
+}
+
+func genServerInfo(mdb *MultiDB) string {
+	uptime := int64(time.Since(mdb.startTime).Seconds())
+	mode := "standalone"
+	if mdb.cluster != nil {
+		mode = "cluster"
+	}
+	return fmt.Sprintf("redis_version:%s\r\n"+
+		"redis_mode:%s\r\n"+
+		"os:%s %s\r\n"+
+		"go_version:%s\r\n"+
+		"process_id:%d\r\n"+
+		"tcp_port:%d\r\n"+
+		"uptime_in_seconds:%d\r\n"+
+		"uptime_in_days:%d\r\n",
+		redisVersion, mode, runtime.GOOS, runtime.GOARCH, runtime.Version(), os.Getpid(),
+		config.Properties.Port, uptime, uptime/(3600*24))
+}
+
+func genPersistenceInfo(mdb *MultiDB) string {
+	bgSaveStatus := "ok"
+	if mdb.lastBgSaveFailed.Get() {
+		bgSaveStatus = "err"
+	}
+	aofEnabled, aofRewriting := 0, 0
+	if mdb.persister != nil {
+		aofEnabled = 1
+		if mdb.persister.IsRewriting() {
+			aofRewriting = 1
+		}
+	}
+	return fmt.Sprintf("loading:0\r\n"+
+		"rdb_changes_since_last_save:%d\r\n"+
+		"rdb_bgsave_in_progress:%d\r\n"+
+		"rdb_last_save_time:%d\r\n"+
+		"rdb_last_bgsave_status:%s\r\n"+
+		"aof_enabled:%d\r\n"+
+		"aof_rewrite_in_progress:%d\r\n",
+		atomic.LoadInt64(&mdb.dirty), boolToInt(mdb.bgSaving.Get()), atomic.LoadInt64(&mdb.lastSave),
+		bgSaveStatus, aofEnabled, aofRewriting)
+}
+
+func genClusterInfo(mdb *MultiDB) string {
+	enabled := 0
+	if mdb.cluster != nil {
+		enabled = 1
+	}
+	return fmt.Sprintf("cluster_enabled:%d\r\n", enabled)
+}
+
+func genKeyspaceInfo(mdb *MultiDB) string {
+	buf := &bytes.Buffer{}
+	for i := range mdb.dbSet {
+		keys, expires := mdb.GetDBSize(i)
+		if keys == 0 {
+			continue
+		}
+		buf.WriteString(fmt.Sprintf("db%d:keys=%d,expires=%d,avg_ttl=0\r\n", i, keys, expires))
+	}
+	return buf.String()
+}
+
+// redisVersion INFO中展示的兼容redis版本
+const redisVersion = "6.0.0"
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
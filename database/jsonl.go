@@ -0,0 +1,50 @@
+package database
+
+import (
+	"bytes"
+	"gedis/aof"
+	"gedis/config"
+	"gedis/interface/redis"
+	"gedis/redis/protocol"
+	"strconv"
+)
+
+// JSONDump 以JSON Lines格式导出数据，每行一个key，不指定db时导出所有数据库
+// 与bgsave相同，先在暂停命令期间复制快照，再在快照上序列化，指定db时只复制该数据库
+func JSONDump(mdb *MultiDB, args [][]byte) redis.Reply {
+	dbIndex := -1
+	if len(args) == 1 {
+		index, err := strconv.Atoi(string(args[0]))
+		if err != nil {
+			return protocol.MakeErrReply("ERR value is not an integer or out of range")
+		}
+		if index < 0 || index >= config.Properties.Databases {
+			return protocol.MakeErrReply("ERR DB index is out of range")
+		}
+		dbIndex = index
+	}
+	mdb.pause()
+	var snapshot *MultiDB
+	if dbIndex >= 0 {
+		snapshot = mdb.snapshotDB(dbIndex)
+	} else {
+		snapshot = mdb.snapshot()
+	}
+	mdb.resume()
+	buf := &bytes.Buffer{}
+	if err := aof.ExportJSONL(buf, snapshot, dbIndex); err != nil {
+		return protocol.MakeErrReply("ERR " + err.Error())
+	}
+	return protocol.MakeBulkReply(buf.Bytes())
+}
+
+// JSONRestore 导入JSON Lines格式的记录，每个参数为一行，返回导入的key的数量
+// 记录通过Exec重建，会正常写入aof，调用时不能持有pausing的读锁
+func JSONRestore(mdb *MultiDB, args [][]byte) redis.Reply {
+	for i, line := range args {
+		if err := aof.ImportJSONRecord(mdb, line); err != nil {
+			return protocol.MakeErrReply("ERR line " + strconv.Itoa(i+1) + ": " + err.Error())
+		}
+	}
+	return protocol.MakeIntReply(int64(len(args)))
+}
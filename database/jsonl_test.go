@@ -0,0 +1,113 @@
+package database
+
+import (
+	"bytes"
+	"encoding/json"
+	"gedis/aof"
+	"gedis/lib/utils"
+	"gedis/redis/connection"
+	"gedis/redis/protocol"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// jsonDump 执行JSONDUMP，返回按行拆分的记录
+func jsonDump(t *testing.T, mdb *MultiDB, args ...string) [][]byte {
+	reply, ok := mdb.Exec(connection.NewFakeConn(), utils.ToCmdLine(append([]string{"JSONDUMP"}, args...)...)).(*protocol.BulkReply)
+	if !ok {
+		t.Fatal("expect bulk reply of JSONDUMP")
+	}
+	return bytes.Split(bytes.TrimSuffix(reply.Arg, []byte("\n")), []byte("\n"))
+}
+
+// parseRecords 按照 db/key 索引记录，set与hash的元素顺序不固定，排序之后再比较
+func parseRecords(t *testing.T, lines [][]byte) map[string]*aof.JSONRecord {
+	records := make(map[string]*aof.JSONRecord)
+	for _, line := range lines {
+		record := &aof.JSONRecord{}
+		if err := json.Unmarshal(line, record); err != nil {
+			t.Fatal(err)
+		}
+		if record.Type == "set" || record.Type == "hash" {
+			var elements []json.RawMessage
+			if err := json.Unmarshal(record.Value, &elements); err != nil {
+				t.Fatal(err)
+			}
+			values := make([]string, len(elements))
+			for i, element := range elements {
+				values[i] = string(element)
+			}
+			sort.Strings(values)
+			record.Value = json.RawMessage("[" + strings.Join(values, ",") + "]")
+		}
+		records[strconv.Itoa(record.DB)+"/"+string(record.Key)] = record
+	}
+	return records
+}
+
+func TestJSONRoundTrip(t *testing.T) {
+	src := makeTestServer(t)
+	c := connection.NewFakeConn()
+	assertReply(t, execString(src, c, "SET", "str", "a\x00\xff\r\nb"), "+OK\r\n")
+	assertReply(t, execString(src, c, "RPUSH", "list", "a", "", "c"), ":3\r\n")
+	assertReply(t, execString(src, c, "SADD", "set", "a", "b", "c"), ":3\r\n")
+	assertReply(t, execString(src, c, "HSET", "hash", "f1", "v1"), ":1\r\n")
+	assertReply(t, execString(src, c, "HSET", "hash", "f2", ""), ":1\r\n")
+	assertReply(t, execString(src, c, "ZADD", "zset", "1.5", "a", "-inf", "b", "+inf", "c"), ":3\r\n")
+	assertReply(t, execString(src, c, "SET", "ttl", "v"), "+OK\r\n")
+	assertReply(t, execString(src, c, "PEXPIRE", "ttl", "100000"), ":1\r\n")
+	assertReply(t, execString(src, c, "SELECT", "3"), "+OK\r\n")
+	assertReply(t, execString(src, c, "SADD", "set3", "x"), ":1\r\n")
+	assertReply(t, execString(src, c, "PEXPIRE", "set3", "200000"), ":1\r\n")
+
+	lines := jsonDump(t, src)
+	if len(lines) != 7 {
+		t.Fatalf("expect 7 records actually %d: %q", len(lines), lines)
+	}
+	dst := makeTestServer(t)
+	args := make([]string, len(lines))
+	for i, line := range lines {
+		args[i] = string(line)
+	}
+	assertReply(t, execString(dst, c, append([]string{"JSONRESTORE"}, args...)...), ":7\r\n")
+
+	expect := parseRecords(t, lines)
+	actual := parseRecords(t, jsonDump(t, dst))
+	if len(actual) != len(expect) {
+		t.Fatalf("expect %d records actually %d", len(expect), len(actual))
+	}
+	for id, record := range expect {
+		restored := actual[id]
+		if restored == nil {
+			t.Errorf("%s: missing after restore", id)
+			continue
+		}
+		if restored.Type != record.Type || !bytes.Equal(restored.Value, record.Value) {
+			t.Errorf("%s: expect %s %s actually %s %s", id, record.Type, record.Value, restored.Type, restored.Value)
+		}
+		// 恢复时的剩余时间只会比导出时更短
+		if (record.TTL < 0 && restored.TTL != -1) || (record.TTL >= 0 && (restored.TTL > record.TTL || restored.TTL < record.TTL-5000)) {
+			t.Errorf("%s: expect ttl %d actually %d", id, record.TTL, restored.TTL)
+		}
+	}
+	if expect["0/ttl"].TTL < 0 || expect["3/set3"].TTL < 100000 {
+		t.Error("expect ttl exported")
+	}
+}
+
+func TestJSONDumpSingleDB(t *testing.T) {
+	mdb := makeTestServer(t)
+	c := connection.NewFakeConn()
+	assertReply(t, execString(mdb, c, "SET", "a", "1"), "+OK\r\n")
+	assertReply(t, execString(mdb, c, "SELECT", "2"), "+OK\r\n")
+	assertReply(t, execString(mdb, c, "SET", "b", "2"), "+OK\r\n")
+
+	records := parseRecords(t, jsonDump(t, mdb, "2"))
+	if len(records) != 1 || records["2/b"] == nil {
+		t.Errorf("expect only b in db 2 actually %v", records)
+	}
+	assertReply(t, execString(mdb, c, "JSONDUMP", "16"), "-ERR DB index is out of range\r\n")
+	assertReply(t, execString(mdb, c, "JSONDUMP", "x"), "-ERR value is not an integer or out of range\r\n")
+}
@@ -1,6 +1,8 @@
 package database
 
 import (
+	"bytes"
+	"gedis/aof"
 	"gedis/datastruct/dict"
 	"gedis/datastruct/list"
 	"gedis/datastruct/set"
@@ -8,8 +10,11 @@ import (
 	"gedis/interface/redis"
 	"gedis/lib/utils"
 	"gedis/lib/wildcard"
+	"gedis/redis/parser"
 	"gedis/redis/protocol"
+	"io"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -76,7 +81,8 @@ func execType(db *DB, args [][]byte) redis.Reply {
 func prepareRename(args [][]byte) ([]string, []string) {
 	src := string(args[0])
 	dest := string(args[1])
-	return []string{dest}, []string{src}
+	// src会被删除，同样需要写锁
+	return []string{src, dest}, nil
 }
 
 // execRename a key
@@ -289,6 +295,86 @@ func toTTLCmd(db *DB, key string) *protocol.MultiBulkReply {
 	return protocol.MakeMultiBulkReply(utils.ToCmdLine("PEXPIREAT", key, timestamp))
 }
 
+// execDump DUMP key，返回可以由RESTORE重建该key的序列化值，不包含过期时间
+func execDump(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	entity, ok := db.GetEntity(key)
+	if !ok {
+		return protocol.MakeNullBulkReply()
+	}
+	cmd := aof.EntityToCmd(key, entity)
+	if cmd == nil {
+		return protocol.MakeNullBulkReply()
+	}
+	return protocol.MakeBulkReply(cmd.ToBytes())
+}
+
+// decodeDump 解析DUMP的序列化值，得到重建key的命令
+func decodeDump(payload []byte) (CmdLine, bool) {
+	var cmdLine CmdLine
+	valid := true
+	// 读取到结尾时parser会关闭channel
+	for p := range parser.ParseStream(bytes.NewReader(payload)) {
+		if p.Err != nil {
+			if p.Err != io.EOF {
+				valid = false
+			}
+			continue
+		}
+		reply, ok := p.Data.(*protocol.MultiBulkReply)
+		if !ok || cmdLine != nil || len(reply.Args) < 2 {
+			valid = false
+			continue
+		}
+		cmdLine = reply.Args
+	}
+	if !valid || cmdLine == nil {
+		return nil, false
+	}
+	// 只接受重建数据结构的命令
+	switch strings.ToLower(string(cmdLine[0])) {
+	case "set", "rpush", "hmset", "sadd", "zadd":
+		return cmdLine, true
+	}
+	return nil, false
+}
+
+// execRestore RESTORE key ttl serialized-value [REPLACE]，ttl为毫秒，0表示不过期
+func execRestore(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	ttl, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return protocol.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	if ttl < 0 {
+		return protocol.MakeErrReply("ERR Invalid TTL value, must be >= 0")
+	}
+	replace := false
+	for _, arg := range args[3:] {
+		if strings.ToLower(string(arg)) != "replace" {
+			return protocol.MakeSyntaxErrReply()
+		}
+		replace = true
+	}
+	cmdLine, ok := decodeDump(args[2])
+	if !ok {
+		return protocol.MakeErrReply("ERR DUMP payload version or checksum are wrong")
+	}
+	if _, exists := db.GetEntity(key); exists && !replace {
+		return protocol.MakeErrReply("BUSYKEY Target key name already exists.")
+	}
+	db.Remove(key)
+	// 重建命令的第一个参数是key，替换为目标key
+	cmdLine[1] = []byte(key)
+	if result := db.execWithLock(cmdLine); protocol.IsErrorReply(result) {
+		return result
+	}
+	if ttl > 0 {
+		db.Expire(key, time.Now().Add(time.Duration(ttl)*time.Millisecond))
+	}
+	return protocol.MakeOkReply()
+}
+
 func undoExpire(db *DB, args [][]byte) []CmdLine {
 	key := string(args[0])
 	return []CmdLine{
@@ -310,4 +396,8 @@ func init() {
 	RegisterCommand("Rename", execRename, prepareRename, undoRename, 3)
 	RegisterCommand("RenameNx", execRenameNx, prepareRename, undoRename, 3)
 	RegisterCommand("Keys", execKeys, noPrepare, nil, 2)
+	RegisterCommand("Dump", execDump, readFirstKey, nil, 2)
+	RegisterCommand("Restore", execRestore, writeFirstKey, rollbackFirstKey, -4)
+	// MIGRATE发送的RESTORE，允许在ASKING之前写入正在迁入的slot
+	RegisterCommand("Restore-Asking", execRestore, writeFirstKey, rollbackFirstKey, -4)
 }
@@ -0,0 +1,354 @@
+package database
+
+import (
+	"fmt"
+	"gedis/aof"
+	"gedis/config"
+	"gedis/datastruct/dict"
+	List "gedis/datastruct/list"
+	"gedis/datastruct/set"
+	SortedSet "gedis/datastruct/sortedset"
+	"gedis/interface/database"
+	"gedis/interface/redis"
+	"gedis/lib/logger"
+	"gedis/lib/timewheel"
+	"gedis/lib/utils"
+	"gedis/redis/protocol"
+	"github.com/hdt3213/rdb/core"
+	rdb "github.com/hdt3213/rdb/parser"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// relativeTTLCommands 使用相对时间设置过期的命令，重放时需要换算为绝对时间
+var relativeTTLCommands = map[string]struct{}{
+	"set":            {},
+	"setex":          {},
+	"psetex":         {},
+	"expire":         {},
+	"pexpire":        {},
+	"restore":        {},
+	"restore-asking": {},
+}
+
+// isWriteCommand 根据prepare函数是否返回写key判断是否为写命令
+func isWriteCommand(cmdLine CmdLine) bool {
+	cmdName := strings.ToLower(string(cmdLine[0]))
+	cmd, ok := cmdTable[cmdName]
+	if !ok || cmd.prepare == nil || !validateArity(cmd.arity, cmdLine) {
+		return false
+	}
+	write, _ := cmd.prepare(cmdLine[1:])
+	return len(write) > 0
+}
+
+// toAofCmdLines 将一条执行成功的写命令转换为写入aof的命令
+// 重放结果与执行时间有关的命令需要改写，保证重放之后数据一致
+func toAofCmdLines(db *DB, cmdLine CmdLine, result redis.Reply) []CmdLine {
+	cmdName := strings.ToLower(string(cmdLine[0]))
+	if cmdName == "spop" {
+		// spop随机弹出元素，记录实际被删除的元素
+		return spopToSRem(cmdLine, result)
+	}
+	cmdLines := []CmdLine{cmdLine}
+	if _, ok := relativeTTLCommands[cmdName]; ok {
+		key := string(cmdLine[1])
+		if _, hasTTL := db.ttlMap.Get(key); hasTTL {
+			cmdLines = append(cmdLines, toTTLCmd(db, key).Args)
+		}
+	}
+	return cmdLines
+}
+
+func spopToSRem(cmdLine CmdLine, result redis.Reply) []CmdLine {
+	reply, ok := result.(*protocol.MultiBulkReply)
+	if !ok || len(reply.Args) == 0 {
+		return nil
+	}
+	return []CmdLine{utils.ToCmdLine3("SREM", append([][]byte{cmdLine[1]}, reply.Args...)...)}
+}
+
+// bindPersister 将aof持久化绑定到每一个DB上
+func (mdb *MultiDB) bindPersister(persister *aof.Persister) {
+	mdb.persister = persister
+	for _, db := range mdb.dbSet {
+		singleDB := db
+		singleDB.addAof = func(line CmdLine) {
+			persister.SaveCmdLine(singleDB.index, line)
+		}
+	}
+}
+
+// BGRewriteAOF 在后台压缩aof文件
+func BGRewriteAOF(mdb *MultiDB) redis.Reply {
+	if mdb.persister == nil {
+		return protocol.MakeErrReply("ERR append only file is disabled")
+	}
+	if mdb.persister.IsRewriting() {
+		return protocol.MakeErrReply(aof.ErrRewriteInProgress.Error())
+	}
+	go func() {
+		if err := mdb.persister.Rewrite(); err != nil {
+			logger.Error("background aof rewrite failed: " + err.Error())
+		}
+	}()
+	return protocol.MakeStatusReply("Background append only file rewriting started")
+}
+
+// SaveRDB 暂停所有命令，同步地将数据写入rdb文件
+func SaveRDB(mdb *MultiDB) redis.Reply {
+	if mdb.bgSaving.Get() {
+		return protocol.MakeErrReply("ERR Background save already in progress")
+	}
+	mdb.pause()
+	defer mdb.resume()
+	if err := aof.SaveRDB(config.Properties.RDBFilename, mdb); err != nil {
+		logger.Error("save rdb failed: " + err.Error())
+		return protocol.MakeErrReply("ERR " + err.Error())
+	}
+	atomic.StoreInt64(&mdb.dirty, 0)
+	atomic.StoreInt64(&mdb.lastSave, time.Now().Unix())
+	return protocol.MakeOkReply()
+}
+
+// BGSaveRDB 暂停命令复制一份数据快照，然后在后台将快照写入rdb文件
+func BGSaveRDB(mdb *MultiDB) redis.Reply {
+	if !mdb.bgSaving.CompareAndSet(false, true) {
+		return protocol.MakeErrReply("ERR Background save already in progress")
+	}
+	mdb.pause()
+	snapshot := mdb.snapshot()
+	// 快照之后产生的修改保留在dirty中
+	dirtyBefore := atomic.LoadInt64(&mdb.dirty)
+	mdb.resume()
+	atomic.StoreInt64(&mdb.lastBgSaveTry, time.Now().Unix())
+	go func() {
+		defer mdb.bgSaving.Set(false)
+		if err := aof.SaveRDB(config.Properties.RDBFilename, snapshot); err != nil {
+			logger.Error("background save rdb failed: " + err.Error())
+			mdb.lastBgSaveFailed.Set(true)
+			return
+		}
+		mdb.lastBgSaveFailed.Set(false)
+		atomic.AddInt64(&mdb.dirty, -dirtyBefore)
+		atomic.StoreInt64(&mdb.lastSave, time.Now().Unix())
+		logger.Info("background saving terminated with success")
+	}()
+	return protocol.MakeStatusReply("Background saving started")
+}
+
+// bgSaveRetryDelay bgsave失败之后，至少间隔该时间才会再次自动触发
+const bgSaveRetryDelay = 5
+
+// savePointTaskKey 检查save规则的定时任务
+const savePointTaskKey = "rdb:save-point"
+
+func (mdb *MultiDB) addDirty(n int) {
+	atomic.AddInt64(&mdb.dirty, int64(n))
+}
+
+// startSaveScheduler 每秒检查一次save规则，满足任意一条时触发bgsave
+func (mdb *MultiDB) startSaveScheduler(points []config.SavePoint) {
+	mdb.savePoints = points
+	if len(points) == 0 {
+		return
+	}
+	var check func()
+	check = func() {
+		if mdb.closed.Get() {
+			return
+		}
+		if mdb.needBGSave() {
+			logger.Info("save point reached, starting background saving")
+			BGSaveRDB(mdb)
+		}
+		timewheel.Delay(time.Second, savePointTaskKey, check)
+	}
+	timewheel.Delay(time.Second, savePointTaskKey, check)
+}
+
+func (mdb *MultiDB) needBGSave() bool {
+	if mdb.bgSaving.Get() {
+		return false
+	}
+	now := time.Now().Unix()
+	// 上次bgsave失败时不立刻重试，避免持续失败占用资源
+	if mdb.lastBgSaveFailed.Get() && now-atomic.LoadInt64(&mdb.lastBgSaveTry) < bgSaveRetryDelay {
+		return false
+	}
+	dirty := atomic.LoadInt64(&mdb.dirty)
+	elapsed := now - atomic.LoadInt64(&mdb.lastSave)
+	for _, point := range mdb.savePoints {
+		if dirty >= point.Changes && elapsed >= point.Seconds {
+			return true
+		}
+	}
+	return false
+}
+
+// LastSave 返回最近一次成功保存rdb的unix时间戳
+func LastSave(mdb *MultiDB) redis.Reply {
+	return protocol.MakeIntReply(atomic.LoadInt64(&mdb.lastSave))
+}
+
+// snapshot 深拷贝所有数据库中未过期的数据，调用方需要持有pausing的写锁
+func (mdb *MultiDB) snapshot() *MultiDB {
+	snapshot := MakeBasicMultiDB()
+	now := time.Now()
+	for i, db := range mdb.dbSet {
+		copyDB(snapshot.dbSet[i], db, now)
+	}
+	return snapshot
+}
+
+// snapshotDB 只深拷贝dbIndex号数据库，快照中的其他数据库为空，调用方需要持有pausing的写锁
+func (mdb *MultiDB) snapshotDB(dbIndex int) *MultiDB {
+	snapshot := MakeBasicMultiDB()
+	copyDB(snapshot.dbSet[dbIndex], mdb.dbSet[dbIndex], time.Now())
+	return snapshot
+}
+
+// copyDB 将db中在now时未过期的数据深拷贝到target中
+func copyDB(target *DB, db *DB, now time.Time) {
+	db.ForEach(func(key string, entity *database.DataEntity, expiration *time.Time) bool {
+		if entity == nil || (expiration != nil && expiration.Before(now)) {
+			return true
+		}
+		target.data.Put(key, &database.DataEntity{Data: copyData(entity.Data)})
+		// 快照不需要过期任务，只记录过期时间
+		if expiration != nil {
+			target.ttlMap.Put(key, *expiration)
+		}
+		return true
+	})
+}
+
+// copyData 深拷贝各种数据结构，快照之后原数据的修改不会影响快照
+func copyData(data interface{}) interface{} {
+	switch val := data.(type) {
+	case []byte:
+		return copyBytes(val)
+	case *List.LinkedList:
+		list := List.Make()
+		val.ForEach(func(i int, v interface{}) bool {
+			bytes, _ := v.([]byte)
+			list.Add(copyBytes(bytes))
+			return true
+		})
+		return list
+	case *set.Set:
+		s := set.Make()
+		val.ForEach(func(member string) bool {
+			s.Add(member)
+			return true
+		})
+		return s
+	case dict.Dict:
+		hash := dict.MakeSimple()
+		val.ForEach(func(field string, v interface{}) bool {
+			bytes, _ := v.([]byte)
+			hash.Put(field, copyBytes(bytes))
+			return true
+		})
+		return hash
+	case *SortedSet.SortedSet:
+		zset := SortedSet.Make()
+		if val.Len() > 0 {
+			val.ForEach(int64(0), val.Len(), false, func(element *SortedSet.Element) bool {
+				zset.Add(element.Member, element.Score)
+				return true
+			})
+		}
+		return zset
+	}
+	return data
+}
+
+func copyBytes(src []byte) []byte {
+	if src == nil {
+		return nil
+	}
+	dst := make([]byte, len(src))
+	copy(dst, src)
+	return dst
+}
+
+// loadRDBFile 启动时从配置的rdb文件中恢复数据，文件不存在时直接返回
+func (mdb *MultiDB) loadRDBFile() error {
+	file, err := os.Open(config.Properties.RDBFilename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+	err = mdb.LoadRDB(rdb.NewDecoder(file))
+	if err != nil {
+		return fmt.Errorf("load rdb file %s failed: %v", config.Properties.RDBFilename, err)
+	}
+	return nil
+}
+
+// LoadRDB 将rdb中的对象转换为对应的数据结构放入数据库，已经过期的key会被丢弃
+func (mdb *MultiDB) LoadRDB(dec *core.Decoder) error {
+	now := time.Now()
+	err := dec.Parse(func(o rdb.RedisObject) bool {
+		var entity *database.DataEntity
+		switch obj := o.(type) {
+		case *rdb.StringObject:
+			entity = &database.DataEntity{Data: obj.Value}
+		case *rdb.ListObject:
+			list := List.Make()
+			for _, v := range obj.Values {
+				list.Add(v)
+			}
+			entity = &database.DataEntity{Data: list}
+		case *rdb.HashObject:
+			hash := dict.MakeSimple()
+			for field, v := range obj.Hash {
+				hash.Put(field, v)
+			}
+			entity = &database.DataEntity{Data: hash}
+		case *rdb.SetObject:
+			s := set.Make()
+			for _, member := range obj.Members {
+				s.Add(string(member))
+			}
+			entity = &database.DataEntity{Data: s}
+		case *rdb.ZSetObject:
+			zset := SortedSet.Make()
+			for _, e := range obj.Entries {
+				zset.Add(e.Member, e.Score)
+			}
+			entity = &database.DataEntity{Data: zset}
+		case *rdb.AuxObject, *rdb.DBSizeObject:
+			return true
+		default:
+			logger.Warn(fmt.Sprintf("unsupported rdb object type %s of key %s, skipped", o.GetType(), o.GetKey()))
+			return true
+		}
+		dbIndex := o.GetDBIndex()
+		if dbIndex < 0 || dbIndex >= len(mdb.dbSet) {
+			logger.Warn(fmt.Sprintf("rdb db index %d is out of range, key %s skipped", dbIndex, o.GetKey()))
+			return true
+		}
+		expiration := o.GetExpiration()
+		if expiration != nil && expiration.Before(now) {
+			return true
+		}
+		db := mdb.dbSet[dbIndex]
+		db.PutEntity(o.GetKey(), entity)
+		if expiration != nil {
+			db.Expire(o.GetKey(), *expiration)
+		}
+		return true
+	})
+	if err != nil && strings.HasPrefix(err.Error(), "unknown type flag") {
+		// 解码器无法跳过未知类型的对象，例如stream和module
+		return fmt.Errorf("unsupported rdb object type (%v), streams and module types are not supported", err)
+	}
+	return err
+}
@@ -0,0 +1,581 @@
+package database
+
+import (
+	"bytes"
+	"gedis/aof"
+	"gedis/config"
+	"gedis/lib/utils"
+	"gedis/redis/connection"
+	"gedis/redis/parser"
+	"gedis/redis/protocol"
+	"github.com/hdt3213/rdb/core"
+	"github.com/hdt3213/rdb/encoder"
+	"github.com/hdt3213/rdb/model"
+	rdb "github.com/hdt3213/rdb/parser"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// makeAofServer 创建开启aof的服务端，启动时重放filename中已有的命令
+func makeAofServer(t *testing.T, filename string, fsync string) *MultiDB {
+	config.Properties.Save = nil
+	config.Properties.AppendOnly = true
+	config.Properties.AppendFilename = filename
+	config.Properties.AppendFsync = fsync
+	t.Cleanup(func() {
+		config.Properties.AppendOnly = false
+	})
+	return NewStandaloneServer()
+}
+
+func TestAofReplay(t *testing.T) {
+	for _, fsync := range []string{aof.FsyncAlways, aof.FsyncEverySec, aof.FsyncNo} {
+		t.Run(fsync, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "appendonly.aof")
+			mdb := makeAofServer(t, filename, fsync)
+			c := connection.NewFakeConn()
+			assertReply(t, execString(mdb, c, "SET", "str", "v"), "+OK\r\n")
+			assertReply(t, execString(mdb, c, "RPUSH", "list", "a", "b"), ":2\r\n")
+			assertReply(t, execString(mdb, c, "SET", "ttl", "v", "EX", "1000"), "+OK\r\n")
+			assertReply(t, execString(mdb, c, "SADD", "set", "a", "b", "c"), ":3\r\n")
+			popped := mdb.Exec(c, utils.ToCmdLine("SPOP", "set")).(*protocol.MultiBulkReply).Args[0]
+			// 执行失败的命令与只读命令不写入aof
+			assertReply(t, execString(mdb, c, "LPUSH", "str", "x"), "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n")
+			assertReply(t, execString(mdb, c, "GET", "str"), "$1\r\nv\r\n")
+			assertReply(t, execString(mdb, c, "SELECT", "2"), "+OK\r\n")
+			assertReply(t, execString(mdb, c, "SET", "str", "db2"), "+OK\r\n")
+			assertReply(t, execString(mdb, c, "MULTI"), "+OK\r\n")
+			assertReply(t, execString(mdb, c, "INCR", "counter"), "+QUEUED\r\n")
+			assertReply(t, execString(mdb, c, "INCR", "counter"), "+QUEUED\r\n")
+			assertReply(t, execString(mdb, c, "EXEC"), "*2\r\n:1\r\n:2\r\n")
+			mdb.Close()
+
+			data, err := ioutil.ReadFile(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			content := string(data)
+			// 切换数据库之后写入select，相对过期时间改写为绝对时间，spop改写为srem
+			for _, expect := range []string{"SELECT\r\n$1\r\n2\r\n", "PEXPIREAT\r\n", "SREM\r\n"} {
+				if !strings.Contains(content, expect) {
+					t.Errorf("expect %q in aof", expect)
+				}
+			}
+			for _, unexpect := range []string{"GET", "LPUSH", "SPOP", "MULTI", "EXEC"} {
+				if strings.Contains(content, unexpect) {
+					t.Errorf("expect no %q in aof", unexpect)
+				}
+			}
+
+			reloaded := makeAofServer(t, filename, fsync)
+			defer reloaded.Close()
+			c = connection.NewFakeConn()
+			assertReply(t, execString(reloaded, c, "GET", "str"), "$1\r\nv\r\n")
+			assertReply(t, execString(reloaded, c, "LPOP", "list"), "$1\r\na\r\n")
+			assertReply(t, execString(reloaded, c, "LLEN", "list"), ":1\r\n")
+			assertReply(t, execString(reloaded, c, "SCARD", "set"), ":2\r\n")
+			assertReply(t, execString(reloaded, c, "SISMEMBER", "set", string(popped)), ":0\r\n")
+			assertTTL(t, reloaded, c, "ttl", 990, 1000)
+			assertReply(t, execString(reloaded, c, "SELECT", "2"), "+OK\r\n")
+			assertReply(t, execString(reloaded, c, "GET", "str"), "$3\r\ndb2\r\n")
+			assertReply(t, execString(reloaded, c, "GET", "counter"), "$1\r\n2\r\n")
+		})
+	}
+}
+
+func TestAofFsyncAlways(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "appendonly.aof")
+	mdb := makeAofServer(t, filename, aof.FsyncAlways)
+	defer mdb.Close()
+	c := connection.NewFakeConn()
+	assertReply(t, execString(mdb, c, "SET", "k", "v"), "+OK\r\n")
+	// always策略下命令返回之前已经写入文件
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertReply(t, string(data), "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$1\r\nv\r\n")
+}
+
+func TestAofWriteAfterClose(t *testing.T) {
+	for _, fsync := range []string{aof.FsyncAlways, aof.FsyncEverySec, aof.FsyncNo} {
+		t.Run(fsync, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "appendonly.aof")
+			mdb := makeAofServer(t, filename, fsync)
+			// 关闭时仍有客户端在写入，关闭之后到达的命令被丢弃
+			var wg sync.WaitGroup
+			for i := 0; i < 4; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					c := connection.NewFakeConn()
+					for j := 0; j < 200; j++ {
+						execString(mdb, c, "SET", "k"+strconv.Itoa(i), strconv.Itoa(j))
+					}
+				}(i)
+			}
+			time.Sleep(10 * time.Millisecond)
+			mdb.Close()
+			wg.Wait()
+			mdb.persister.SaveCmdLine(0, utils.ToCmdLine("DEL", "k0"))
+
+			reloaded := makeAofServer(t, filename, fsync)
+			defer reloaded.Close()
+			reply := execString(reloaded, connection.NewFakeConn(), "GET", "k0")
+			if !strings.HasPrefix(reply, "$") {
+				t.Errorf("unexpected reply %q", reply)
+			}
+		})
+	}
+}
+
+func TestAofFlush(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "appendonly.aof")
+	mdb := makeAofServer(t, filename, aof.FsyncEverySec)
+	c := connection.NewFakeConn()
+	assertReply(t, execString(mdb, c, "SET", "a", "1"), "+OK\r\n")
+	assertReply(t, execString(mdb, c, "SELECT", "1"), "+OK\r\n")
+	assertReply(t, execString(mdb, c, "SET", "b", "1"), "+OK\r\n")
+	assertReply(t, execString(mdb, c, "FLUSHDB"), "+OK\r\n")
+	assertReply(t, execString(mdb, c, "SET", "c", "1"), "+OK\r\n")
+	assertReply(t, execString(mdb, c, "SELECT", "0"), "+OK\r\n")
+	assertReply(t, execString(mdb, c, "SET", "d", "1"), "+OK\r\n")
+	mdb.Close()
+
+	reloaded := makeAofServer(t, filename, aof.FsyncEverySec)
+	defer reloaded.Close()
+	c = connection.NewFakeConn()
+	assertReply(t, execString(reloaded, c, "EXISTS", "a", "d"), ":2\r\n")
+	assertReply(t, execString(reloaded, c, "SELECT", "1"), "+OK\r\n")
+	assertReply(t, execString(reloaded, c, "EXISTS", "b", "c"), ":1\r\n")
+	assertReply(t, execString(reloaded, c, "FLUSHALL"), "+OK\r\n")
+	reloaded.Close()
+
+	flushed := makeAofServer(t, filename, aof.FsyncEverySec)
+	defer flushed.Close()
+	assertReply(t, execString(flushed, c, "EXISTS", "c"), ":0\r\n")
+	assertReply(t, execString(flushed, connection.NewFakeConn(), "EXISTS", "a", "d"), ":0\r\n")
+}
+
+func TestAofRewrite(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "appendonly.aof")
+	mdb := makeAofServer(t, filename, aof.FsyncAlways)
+	c := connection.NewFakeConn()
+	for i := 0; i < 100; i++ {
+		execString(mdb, c, "INCR", "counter")
+	}
+	assertReply(t, execString(mdb, c, "SET", "ttl", "v", "EX", "1000"), "+OK\r\n")
+	assertReply(t, execString(mdb, c, "SELECT", "3"), "+OK\r\n")
+	assertReply(t, execString(mdb, c, "HSET", "hash", "f", "v"), ":1\r\n")
+	before, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mdb.persister.Rewrite(); err != nil {
+		t.Fatal(err)
+	}
+	after, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Size() >= before.Size() {
+		t.Errorf("expect aof compacted, before %d after %d", before.Size(), after.Size())
+	}
+	// 重写之后的命令追加到新的aof文件中
+	assertReply(t, execString(mdb, c, "SET", "after", "1"), "+OK\r\n")
+	mdb.Close()
+
+	reloaded := makeAofServer(t, filename, aof.FsyncAlways)
+	defer reloaded.Close()
+	c = connection.NewFakeConn()
+	assertReply(t, execString(reloaded, c, "GET", "counter"), "$3\r\n100\r\n")
+	assertTTL(t, reloaded, c, "ttl", 990, 1000)
+	assertReply(t, execString(reloaded, c, "SELECT", "3"), "+OK\r\n")
+	assertReply(t, execString(reloaded, c, "HGET", "hash", "f"), "$1\r\nv\r\n")
+	assertReply(t, execString(reloaded, c, "GET", "after"), "$1\r\n1\r\n")
+}
+
+// readRDB 解析rdb文件，按照 db/key 索引其中的数据
+func readRDB(t *testing.T, filename string) map[string]model.RedisObject {
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	objects := make(map[string]model.RedisObject)
+	err = rdb.NewDecoder(file).Parse(func(o model.RedisObject) bool {
+		objects[strconv.Itoa(o.GetDBIndex())+"/"+o.GetKey()] = o
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return objects
+}
+
+// fillAllTypes 写入每一种数据类型，以及带有过期时间和已经过期的key
+func fillAllTypes(t *testing.T, mdb *MultiDB) {
+	c := connection.NewFakeConn()
+	assertReply(t, execString(mdb, c, "SET", "str", "a\x00\xff\r\nb"), "+OK\r\n")
+	assertReply(t, execString(mdb, c, "RPUSH", "list", "a", "b", "c"), ":3\r\n")
+	assertReply(t, execString(mdb, c, "SADD", "set", "x", "y"), ":2\r\n")
+	assertReply(t, execString(mdb, c, "HSET", "hash", "f", "v"), ":1\r\n")
+	assertReply(t, execString(mdb, c, "ZADD", "zset", "1.5", "a", "-2", "b"), ":2\r\n")
+	assertReply(t, execString(mdb, c, "SET", "ttl", "v", "EX", "1000"), "+OK\r\n")
+	assertReply(t, execString(mdb, c, "SET", "expired", "v", "PX", "1"), "+OK\r\n")
+	assertReply(t, execString(mdb, c, "SELECT", "5"), "+OK\r\n")
+	assertReply(t, execString(mdb, c, "SET", "str5", "v"), "+OK\r\n")
+	time.Sleep(10 * time.Millisecond)
+}
+
+// assertAllTypes 检查rdb文件中的数据与fillAllTypes写入的一致
+func assertAllTypes(t *testing.T, objects map[string]model.RedisObject) {
+	t.Helper()
+	if len(objects) != 7 {
+		t.Errorf("expect 7 keys actually %d", len(objects))
+	}
+	if o, ok := objects["0/str"].(*model.StringObject); !ok || string(o.Value) != "a\x00\xff\r\nb" {
+		t.Errorf("unexpected str %v", objects["0/str"])
+	}
+	if o, ok := objects["0/list"].(*model.ListObject); !ok || len(o.Values) != 3 || string(o.Values[2]) != "c" {
+		t.Errorf("unexpected list %v", objects["0/list"])
+	}
+	if o, ok := objects["0/set"].(*model.SetObject); !ok || len(o.Members) != 2 {
+		t.Errorf("unexpected set %v", objects["0/set"])
+	}
+	if o, ok := objects["0/hash"].(*model.HashObject); !ok || string(o.Hash["f"]) != "v" {
+		t.Errorf("unexpected hash %v", objects["0/hash"])
+	}
+	if o, ok := objects["0/zset"].(*model.ZSetObject); !ok || len(o.Entries) != 2 ||
+		o.Entries[0].Member != "b" || o.Entries[0].Score != -2 || o.Entries[1].Score != 1.5 {
+		t.Errorf("unexpected zset %v", objects["0/zset"])
+	}
+	if o := objects["0/ttl"]; o == nil || o.GetExpiration() == nil || time.Until(*o.GetExpiration()) < 900*time.Second {
+		t.Errorf("expect ttl saved %v", o)
+	}
+	if o := objects["0/expired"]; o != nil {
+		t.Error("expect expired key skipped")
+	}
+	if o := objects["5/str5"]; o == nil {
+		t.Error("expect key in db 5 saved")
+	}
+}
+
+func TestSaveRDB(t *testing.T) {
+	mdb := makeTestServer(t)
+	fillAllTypes(t, mdb)
+	c := connection.NewFakeConn()
+	start := time.Now().Unix()
+	assertReply(t, execString(mdb, c, "SAVE"), "+OK\r\n")
+	assertAllTypes(t, readRDB(t, config.Properties.RDBFilename))
+	lastSave, ok := mdb.Exec(c, utils.ToCmdLine("LASTSAVE")).(*protocol.IntReply)
+	if !ok || lastSave.Code < start {
+		t.Errorf("expect lastsave updated actually %v", lastSave)
+	}
+}
+
+func TestBGSaveRDB(t *testing.T) {
+	mdb := makeTestServer(t)
+	fillAllTypes(t, mdb)
+	c := connection.NewFakeConn()
+	assertReply(t, execString(mdb, c, "BGSAVE"), "+Background saving started\r\n")
+	// 快照之后的修改不影响正在保存的数据
+	assertReply(t, execString(mdb, c, "SET", "str", "changed"), "+OK\r\n")
+	assertReply(t, execString(mdb, c, "SET", "later", "v"), "+OK\r\n")
+	for i := 0; mdb.bgSaving.Get(); i++ {
+		if i > 100 {
+			t.Fatal("background save blocked")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assertAllTypes(t, readRDB(t, config.Properties.RDBFilename))
+}
+
+// makeRDBServer 创建启动时从filename加载rdb的服务端
+func makeRDBServer(t *testing.T, filename string) *MultiDB {
+	config.Properties.Save = nil
+	config.Properties.AppendOnly = false
+	config.Properties.RDBFilename = filename
+	mdb := NewStandaloneServer()
+	t.Cleanup(mdb.Close)
+	return mdb
+}
+
+func TestLoadRDB(t *testing.T) {
+	src := makeTestServer(t)
+	fillAllTypes(t, src)
+	c := connection.NewFakeConn()
+	assertReply(t, execString(src, c, "SAVE"), "+OK\r\n")
+
+	dst := makeRDBServer(t, config.Properties.RDBFilename)
+	// 重新保存之后与原文件的内容一致
+	assertReply(t, execString(dst, c, "SAVE"), "+OK\r\n")
+	assertAllTypes(t, readRDB(t, config.Properties.RDBFilename))
+	assertReply(t, execString(dst, c, "GET", "str"), "$6\r\na\x00\xff\r\nb\r\n")
+	assertReply(t, execString(dst, c, "LPOP", "list"), "$1\r\na\r\n")
+	assertReply(t, execString(dst, c, "LLEN", "list"), ":2\r\n")
+	assertReply(t, execString(dst, c, "SISMEMBER", "set", "y"), ":1\r\n")
+	assertReply(t, execString(dst, c, "HGET", "hash", "f"), "$1\r\nv\r\n")
+	assertReply(t, execString(dst, c, "ZSCORE", "zset", "b"), "$2\r\n-2\r\n")
+	assertReply(t, execString(dst, c, "EXISTS", "expired"), ":0\r\n")
+	assertTTL(t, dst, c, "ttl", 990, 1000)
+	assertReply(t, execString(dst, c, "SELECT", "5"), "+OK\r\n")
+	assertReply(t, execString(dst, c, "GET", "str5"), "$1\r\nv\r\n")
+}
+
+func TestLoadRDBSkipExpired(t *testing.T) {
+	buf := &bytes.Buffer{}
+	enc := encoder.NewEncoder(buf)
+	now := time.Now()
+	if err := enc.WriteHeader(); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.WriteDBHeader(0, 2, 2); err != nil {
+		t.Fatal(err)
+	}
+	past := uint64(now.Add(-time.Minute).UnixNano() / 1e6)
+	if err := enc.WriteStringObject("old", []byte("v"), encoder.WithTTL(past)); err != nil {
+		t.Fatal(err)
+	}
+	future := uint64(now.Add(time.Minute).UnixNano() / 1e6)
+	if err := enc.WriteStringObject("new", []byte("v"), encoder.WithTTL(future)); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.WriteEnd(); err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(t.TempDir(), "dump.rdb")
+	if err := ioutil.WriteFile(filename, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	mdb := makeRDBServer(t, filename)
+	c := connection.NewFakeConn()
+	assertReply(t, execString(mdb, c, "EXISTS", "old"), ":0\r\n")
+	assertReply(t, execString(mdb, c, "GET", "new"), "$1\r\nv\r\n")
+	if ttl := execString(mdb, c, "TTL", "new"); ttl != ":60\r\n" && ttl != ":59\r\n" {
+		t.Errorf("expect ttl restored actually %q", ttl)
+	}
+}
+
+func TestLoadRDBUnsupportedType(t *testing.T) {
+	buf := &bytes.Buffer{}
+	enc := encoder.NewEncoder(buf)
+	if err := enc.WriteHeader(); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.WriteDBHeader(0, 2, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.WriteStringObject("k", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	// 15代表stream类型，解码器无法解析
+	buf.Write([]byte{15, 1, 's'})
+
+	mdb := makeTestServer(t)
+	err := mdb.LoadRDB(core.NewDecoder(buf))
+	if err == nil || !strings.Contains(err.Error(), "unsupported rdb object type") {
+		t.Errorf("expect unsupported type error actually %v", err)
+	}
+}
+
+// infoField 返回INFO中指定字段的值
+// assertTTL 检查key的剩余秒数在[min, max]之内，测试运行较慢时TTL会比设置的值小
+func assertTTL(t *testing.T, mdb *MultiDB, c *connection.FakeConn, key string, min int64, max int64) {
+	t.Helper()
+	reply := execString(mdb, c, "TTL", key)
+	ttl, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(reply, ":"), "\r\n"), 10, 64)
+	if err != nil || ttl < min || ttl > max {
+		t.Errorf("expect ttl of %s in [%d, %d] actually %q", key, min, max, reply)
+	}
+}
+
+func infoField(t *testing.T, mdb *MultiDB, section string, field string) string {
+	t.Helper()
+	// RESP2客户端收到的INFO是bulk字符串
+	reply := execString(mdb, connection.NewFakeConn(), "INFO", section)
+	if !strings.HasPrefix(reply, "$") {
+		t.Fatalf("expect bulk reply of INFO actually %q", reply)
+	}
+	for _, line := range strings.Split(reply, "\r\n") {
+		if strings.HasPrefix(line, field+":") {
+			return strings.TrimPrefix(line, field+":")
+		}
+	}
+	t.Fatalf("no %s in INFO %s", field, section)
+	return ""
+}
+
+func TestDirtyCounter(t *testing.T) {
+	mdb := makeTestServer(t)
+	c := connection.NewFakeConn()
+	assertReply(t, execString(mdb, c, "SET", "a", "1"), "+OK\r\n")
+	assertReply(t, execString(mdb, c, "MSET", "b", "1", "c", "1"), "+OK\r\n")
+	// 只读命令与执行失败的命令不计入修改次数
+	assertReply(t, execString(mdb, c, "GET", "a"), "$1\r\n1\r\n")
+	assertReply(t, execString(mdb, c, "LPUSH", "a", "x"), "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n")
+	assertReply(t, infoField(t, mdb, "persistence", "rdb_changes_since_last_save"), "3")
+	assertReply(t, execString(mdb, c, "SAVE"), "+OK\r\n")
+	assertReply(t, infoField(t, mdb, "persistence", "rdb_changes_since_last_save"), "0")
+	assertReply(t, infoField(t, mdb, "keyspace", "db0"), "keys=3,expires=0,avg_ttl=0")
+}
+
+func TestSavePoint(t *testing.T) {
+	config.Properties.AppendOnly = false
+	config.Properties.RDBFilename = filepath.Join(t.TempDir(), "dump.rdb")
+	config.Properties.Save = []string{"1 2"}
+	mdb := NewStandaloneServer()
+	config.Properties.Save = nil
+	defer mdb.Close()
+	c := connection.NewFakeConn()
+	assertReply(t, execString(mdb, c, "SET", "a", "1"), "+OK\r\n")
+	// 修改次数不足时不触发保存
+	time.Sleep(2500 * time.Millisecond)
+	if _, err := os.Stat(config.Properties.RDBFilename); !os.IsNotExist(err) {
+		t.Fatal("expect no rdb file before save point reached")
+	}
+	assertReply(t, execString(mdb, c, "SET", "b", "1"), "+OK\r\n")
+	for i := 0; ; i++ {
+		if _, err := os.Stat(config.Properties.RDBFilename); err == nil && !mdb.bgSaving.Get() {
+			break
+		}
+		if i > 300 {
+			t.Fatal("expect bgsave triggered by save point")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	objects := readRDB(t, config.Properties.RDBFilename)
+	if len(objects) != 2 {
+		t.Errorf("expect 2 keys saved actually %d", len(objects))
+	}
+	assertReply(t, infoField(t, mdb, "persistence", "rdb_changes_since_last_save"), "0")
+	assertReply(t, infoField(t, mdb, "persistence", "rdb_last_bgsave_status"), "ok")
+}
+
+func TestAofRDBPreamble(t *testing.T) {
+	config.Properties.AofUseRdbPreamble = true
+	defer func() {
+		config.Properties.AofUseRdbPreamble = false
+	}()
+	filename := filepath.Join(t.TempDir(), "appendonly.aof")
+	mdb := makeAofServer(t, filename, aof.FsyncAlways)
+	fillAllTypes(t, mdb)
+	if err := mdb.persister.Rewrite(); err != nil {
+		t.Fatal(err)
+	}
+	// 重写之后的命令以resp格式追加在rdb前言之后
+	c := connection.NewFakeConn()
+	assertReply(t, execString(mdb, c, "SELECT", "5"), "+OK\r\n")
+	assertReply(t, execString(mdb, c, "SET", "after", "1"), "+OK\r\n")
+	mdb.Close()
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, []byte("REDIS")) {
+		t.Fatal("expect aof begins with rdb preamble")
+	}
+	if !bytes.HasSuffix(data, []byte("*2\r\n$6\r\nSELECT\r\n$1\r\n5\r\n*3\r\n$3\r\nSET\r\n$5\r\nafter\r\n$1\r\n1\r\n")) {
+		t.Errorf("expect commands appended after preamble")
+	}
+
+	reloaded := makeAofServer(t, filename, aof.FsyncAlways)
+	defer reloaded.Close()
+	config.Properties.AofUseRdbPreamble = false
+	assertReply(t, execString(reloaded, c, "GET", "after"), "$1\r\n1\r\n")
+	assertReply(t, execString(reloaded, c, "DEL", "after"), ":1\r\n")
+	rdbFilename := filepath.Join(t.TempDir(), "dump.rdb")
+	if err := aof.SaveRDB(rdbFilename, reloaded); err != nil {
+		t.Fatal(err)
+	}
+	assertAllTypes(t, readRDB(t, rdbFilename))
+}
+
+func TestAofTimestamp(t *testing.T) {
+	config.Properties.AofTimestampEnabled = true
+	t.Cleanup(func() {
+		config.Properties.AofTimestampEnabled = false
+	})
+	filename := filepath.Join(t.TempDir(), "appendonly.aof")
+	mdb := makeAofServer(t, filename, aof.FsyncAlways)
+	c := connection.NewFakeConn()
+	assertReply(t, execString(mdb, c, "SET", "a", "1"), "+OK\r\n")
+	// 时间戳标记只在重放aof时被跳过，客户端发送时与未知命令一样
+	assertReply(t, execString(mdb, c, "TSMARK", "1"), "-ERR unknown command 'tsmark'\r\n")
+	mdb.Close()
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), "*2\r\n$6\r\nTSMARK\r\n") {
+		t.Errorf("expect timestamp mark before the first command actually %q", data)
+	}
+	reloaded := makeAofServer(t, filename, aof.FsyncAlways)
+	defer reloaded.Close()
+	assertReply(t, execString(reloaded, connection.NewFakeConn(), "GET", "a"), "$1\r\n1\r\n")
+}
+
+func TestAofRewriteKeepsTimestamps(t *testing.T) {
+	config.Properties.AofTimestampEnabled = true
+	t.Cleanup(func() {
+		config.Properties.AofTimestampEnabled = false
+	})
+	filename := filepath.Join(t.TempDir(), "appendonly.aof")
+	mdb := makeAofServer(t, filename, aof.FsyncAlways)
+	defer mdb.Close()
+	c := connection.NewFakeConn()
+	assertReply(t, execString(mdb, c, "SET", "a", "1"), "+OK\r\n")
+
+	ctx, err := mdb.persister.StartRewrite()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 重写期间的命令被缓存，与它之前的时间戳标记一起追加到新文件
+	assertReply(t, execString(mdb, c, "SELECT", "1"), "+OK\r\n")
+	assertReply(t, execString(mdb, c, "SET", "b", "2"), "+OK\r\n")
+	if err := mdb.persister.DoRewrite(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := mdb.persister.FinishRewrite(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmds := make([]string, 0)
+	for payload := range parser.ParseStream(bytes.NewReader(data)) {
+		if payload.Err != nil {
+			break
+		}
+		args := make([]string, 0)
+		for _, arg := range payload.Data.(*protocol.MultiBulkReply).Args {
+			args = append(args, string(arg))
+		}
+		cmds = append(cmds, strings.Join(args, " "))
+	}
+	n := len(cmds)
+	if n < 3 || !strings.HasPrefix(cmds[n-3], aof.TimestampCmd+" ") || cmds[n-2] != "SELECT 1" || cmds[n-1] != "SET b 2" {
+		t.Fatalf("expect timestamp mark before buffered commands actually %q", cmds)
+	}
+
+	// 按照标记恢复到重写期间的命令之前
+	markMs, _ := strconv.ParseInt(strings.TrimPrefix(cmds[n-3], aof.TimestampCmd+" "), 10, 64)
+	restored := MakeBasicMultiDB()
+	if _, stopped, err := aof.ReplayFile(restored, filename, 0, markMs-1); err != nil || !stopped {
+		t.Fatalf("expect replay stopped at mark actually %v %v", stopped, err)
+	}
+	assertReply(t, execString(restored, connection.NewFakeConn(), "GET", "a"), "$1\r\n1\r\n")
+	c = connection.NewFakeConn()
+	c.SelectDB(1)
+	assertReply(t, execString(restored, c, "GET", "b"), "$-1\r\n")
+}
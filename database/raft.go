@@ -0,0 +1,333 @@
+package database
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"gedis/aof"
+	"gedis/config"
+	"gedis/interface/redis"
+	"gedis/lib/logger"
+	"gedis/lib/raft"
+	"gedis/redis/protocol"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+raft强一致模式：
+1. self与peers组成raft集群，写命令由leader追加到raft日志，复制到多数节点之后提交
+2. 每个节点按照日志顺序在本地DB执行已提交的命令，leader执行之后将结果返回给客户端
+3. follower不接受读写命令，返回 REDIRECT <leader地址>，让客户端到leader执行
+4. 执行的日志超过阈值时将数据库编码为rdb作为快照，落后太多的follower直接安装快照
+*/
+
+// raftProposeTimeout 写命令等待提交的最长时间
+const raftProposeTimeout = 5 * time.Second
+
+// raftCommand 一条raft日志，在DB中执行一条命令或者一个事务
+type raftCommand struct {
+	DB    int       `json:"db"`
+	Cmds  []CmdLine `json:"cmds"`
+	Multi bool      `json:"multi,omitempty"`
+	// leader接受命令时的unix毫秒时间戳，执行时据此换算相对过期时间
+	Time int64 `json:"time"`
+}
+
+// raftMachine 将MultiDB作为raft的状态机
+type raftMachine struct {
+	mdb *MultiDB
+}
+
+// raftAddr 节点之间raft通信的地址，端口为服务端口+10000
+func raftAddr(addr string) string {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return addr
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port+10000))
+}
+
+// initRaft 以当前节点的地址作为id，与peers组成raft集群
+func (mdb *MultiDB) initRaft() error {
+	self := clusterSelfAddr()
+	peers := []string{self}
+	for _, peer := range config.Properties.Peers {
+		if peer != self {
+			peers = append(peers, peer)
+		}
+	}
+	electionTimeout := time.Duration(config.Properties.RaftElectionTimeout) * time.Millisecond
+	if electionTimeout <= 0 {
+		return fmt.Errorf("invalid raft-election-timeout: %d", config.Properties.RaftElectionTimeout)
+	}
+	if config.Properties.RaftSnapshotThreshold < 0 {
+		return fmt.Errorf("invalid raft-snapshot-threshold: %d", config.Properties.RaftSnapshotThreshold)
+	}
+	transport := raft.NewTCPTransport(raftAddr, electionTimeout)
+	node, err := raft.NewNode(raft.Config{
+		ID:                self,
+		Peers:             peers,
+		Dir:               config.Properties.RaftDir,
+		ElectionTimeout:   electionTimeout,
+		HeartbeatInterval: electionTimeout / 10,
+		SnapshotThreshold: uint64(config.Properties.RaftSnapshotThreshold),
+	}, &raftMachine{mdb: mdb}, transport)
+	if err != nil {
+		return err
+	}
+	listener, err := net.Listen("tcp", raftAddr(net.JoinHostPort(config.Properties.Bind, strconv.Itoa(config.Properties.Port))))
+	if err != nil {
+		return err
+	}
+	go func() {
+		if err := node.Serve(listener); err != nil && !mdb.closed.Get() {
+			logger.Error("raft listener stopped: " + err.Error())
+		}
+	}()
+	node.Start()
+	mdb.raft = node
+	logger.Info(fmt.Sprintf("raft mode, self %s, peers %v", self, peers))
+	return nil
+}
+
+// hasRelativeTTL 命令是否以相对时间设置了过期时间
+func hasRelativeTTL(cmdLine CmdLine) bool {
+	cmdName := strings.ToLower(string(cmdLine[0]))
+	if _, ok := relativeTTLCommands[cmdName]; !ok {
+		return false
+	}
+	if cmdName != "set" {
+		return true
+	}
+	for _, arg := range cmdLine[3:] {
+		option := strings.ToLower(string(arg))
+		if option == "ex" || option == "px" {
+			return true
+		}
+	}
+	return false
+}
+
+// ttlOverrideCommands 以绝对时间设置或者清除过期时间的命令，之后的过期时间不需要换算
+var ttlOverrideCommands = map[string]struct{}{
+	"set":       {},
+	"getset":    {},
+	"expireat":  {},
+	"pexpireat": {},
+	"persist":   {},
+}
+
+// isTTLApplied 命令是否执行成功并修改了key，失败、NX/XX条件不满足以及key不存在时返回false
+func isTTLApplied(result redis.Reply) bool {
+	if result == nil || protocol.IsErrorReply(result) {
+		return false
+	}
+	switch reply := result.(type) {
+	case *protocol.NullBulkReply:
+		return false
+	case *protocol.IntReply:
+		return reply.Code != 0
+	}
+	return true
+}
+
+// adjustTTL 过期时间从leader接受命令时开始计算，重启之后重放旧的日志也能得到相同的过期时间
+// 只换算以相对时间成功设置了过期时间的key，每个key只换算一次
+func adjustTTL(db *DB, cmdLines []CmdLine, results []redis.Reply, acceptedAt int64) {
+	elapsed := time.Duration(unixMilli(time.Now())-acceptedAt) * time.Millisecond
+	if elapsed <= 0 {
+		return
+	}
+	keys := make(map[string]struct{})
+	for i, cmdLine := range cmdLines {
+		if len(cmdLine) < 2 || i >= len(results) || !isTTLApplied(results[i]) {
+			continue
+		}
+		key := string(cmdLine[1])
+		if hasRelativeTTL(cmdLine) {
+			keys[key] = struct{}{}
+		} else if _, ok := ttlOverrideCommands[strings.ToLower(string(cmdLine[0]))]; ok {
+			delete(keys, key)
+		}
+	}
+	for key := range keys {
+		raw, ok := db.ttlMap.Get(key)
+		if !ok {
+			continue
+		}
+		expireTime, _ := raw.(time.Time)
+		db.Expire(key, expireTime.Add(-elapsed))
+	}
+}
+
+// Apply 执行已提交的日志，返回值为命令的回复
+func (m *raftMachine) Apply(index uint64, data []byte) interface{} {
+	cmd := &raftCommand{}
+	if err := json.Unmarshal(data, cmd); err != nil || len(cmd.Cmds) == 0 || cmd.DB < 0 || cmd.DB >= len(m.mdb.dbSet) {
+		logger.Error(fmt.Sprintf("invalid raft entry %d", index))
+		return protocol.MakeErrReply("ERR invalid raft entry")
+	}
+	mdb := m.mdb
+	mdb.pausing.RLock()
+	defer mdb.pausing.RUnlock()
+	db := mdb.dbSet[cmd.DB]
+	var result redis.Reply
+	if cmd.Multi {
+		result = db.ExecMulti(map[string]uint32{}, cmd.Cmds)
+	} else {
+		cmdLine := cmd.Cmds[0]
+		switch strings.ToLower(string(cmdLine[0])) {
+		case "flushall":
+			result = mdb.flushAll()
+			mdb.master.feed(-1, cmdLine)
+		case "flushdb":
+			db.addDirty(db.data.Len())
+			result = execFlushDB(db, cmdLine[1:])
+			db.propagate(cmdLine)
+		default:
+			result = db.execNormalCommand(cmdLine)
+		}
+	}
+	adjustTTL(db, cmd.Cmds, raftResults(cmd, result), cmd.Time)
+	return result
+}
+
+// raftResults 日志中每条命令的回复，事务回滚时没有命令生效
+func raftResults(cmd *raftCommand, result redis.Reply) []redis.Reply {
+	if !cmd.Multi {
+		return []redis.Reply{result}
+	}
+	if reply, ok := result.(*protocol.MultiRawReply); ok {
+		return reply.Replies
+	}
+	return nil
+}
+
+// Snapshot 将所有数据库编码为rdb
+func (m *raftMachine) Snapshot() ([]byte, error) {
+	m.mdb.pause()
+	snapshot := m.mdb.snapshot()
+	m.mdb.resume()
+	buf := &bytes.Buffer{}
+	if err := aof.WriteRDB(buf, snapshot); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Restore 清空所有数据库并加载快照
+func (m *raftMachine) Restore(data []byte) error {
+	return m.mdb.loadMasterRDB(data)
+}
+
+// execRaft raft模式下处理数据相关的命令，返回false时按照普通命令执行
+// 写命令提交到raft日志，执行之后返回结果，follower将读写命令重定向到leader
+func (mdb *MultiDB) execRaft(c redis.Connection, cmdLine CmdLine) (redis.Reply, bool) {
+	cmdName := strings.ToLower(string(cmdLine[0]))
+	switch cmdName {
+	case "watch":
+		// 快照不包含key的版本号，各个节点的版本号不一致
+		return protocol.MakeErrReply("ERR WATCH is not supported in raft mode"), true
+	case "spop":
+		// 随机弹出的元素在各个节点上不同
+		return protocol.MakeErrReply("ERR SPOP is not supported in raft mode, use SREM instead"), true
+	case "replicaof", "slaveof":
+		return protocol.MakeErrReply("ERR REPLICAOF not allowed in raft mode."), true
+	case "migrate":
+		return protocol.MakeErrReply("ERR MIGRATE not allowed in raft mode."), true
+	}
+	if c.InMultiState() {
+		if cmdName != "exec" {
+			return nil, false
+		}
+		// 事务中的命令作为一条日志提交，在所有节点上原子地执行
+		defer c.SetMultiState(false)
+		cmdLines := c.GetQueuedCmdLine()
+		for _, line := range cmdLines {
+			if isWriteCommand(line) {
+				return mdb.proposeRaft(c, cmdLines, true), true
+			}
+		}
+		if errReply := mdb.raftRedirect(); errReply != nil {
+			return errReply, true
+		}
+		// 只读事务在leader本地执行
+		return mdb.selectDB(c.GetDBIndex()).ExecMulti(map[string]uint32{}, cmdLines), true
+	}
+	if cmdName == "flushall" || cmdName == "flushdb" || isWriteCommand(cmdLine) {
+		return mdb.proposeRaft(c, []CmdLine{cmdLine}, false), true
+	}
+	// ping之外命令表中的命令都会访问数据，follower的数据可能落后，需要到leader读取
+	if _, ok := cmdTable[cmdName]; ok && cmdName != "ping" {
+		if errReply := mdb.raftRedirect(); errReply != nil {
+			return errReply, true
+		}
+	}
+	return nil, false
+}
+
+// raftRedirect 当前节点不是leader时返回重定向错误
+func (mdb *MultiDB) raftRedirect() redis.Reply {
+	isLeader, leader := mdb.raft.Leader()
+	if isLeader {
+		return nil
+	}
+	return makeRaftRedirect(leader)
+}
+
+func makeRaftRedirect(leader string) redis.Reply {
+	if leader == "" {
+		return protocol.MakeErrReply("TRYAGAIN No raft leader elected yet")
+	}
+	return protocol.MakeErrReply("REDIRECT " + leader)
+}
+
+// proposeRaft 将命令追加到raft日志，等待提交并在本地执行之后返回执行结果
+func (mdb *MultiDB) proposeRaft(c redis.Connection, cmdLines []CmdLine, multi bool) redis.Reply {
+	data, err := json.Marshal(&raftCommand{
+		DB:    c.GetDBIndex(),
+		Cmds:  cmdLines,
+		Multi: multi,
+		Time:  unixMilli(time.Now()),
+	})
+	if err != nil {
+		return protocol.MakeErrReply("ERR " + err.Error())
+	}
+	result, err := mdb.raft.Propose(data, raftProposeTimeout)
+	if err != nil {
+		if notLeader, ok := err.(*raft.NotLeaderError); ok {
+			return makeRaftRedirect(notLeader.Leader)
+		}
+		return protocol.MakeErrReply("ERR " + err.Error())
+	}
+	reply, _ := result.(redis.Reply)
+	if reply == nil {
+		return protocol.MakeErrReply("ERR unexpected raft result")
+	}
+	return reply
+}
+
+func genRaftInfo(mdb *MultiDB) string {
+	if mdb.raft == nil {
+		return "raft_enabled:0\r\n"
+	}
+	status := mdb.raft.Status()
+	return fmt.Sprintf("raft_enabled:1\r\n"+
+		"raft_id:%s\r\n"+
+		"raft_state:%s\r\n"+
+		"raft_term:%d\r\n"+
+		"raft_leader:%s\r\n"+
+		"raft_commit_index:%d\r\n"+
+		"raft_last_applied:%d\r\n"+
+		"raft_last_index:%d\r\n"+
+		"raft_snapshot_index:%d\r\n",
+		status.ID, status.State, status.Term, status.Leader, status.CommitIndex,
+		status.LastApplied, status.LastIndex, status.SnapshotIndex)
+}
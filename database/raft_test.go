@@ -0,0 +1,50 @@
+package database
+
+import (
+	"encoding/json"
+	"gedis/lib/utils"
+	"gedis/redis/connection"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// applyRaft 在状态机上执行一条在acceptedAt被leader接受的日志
+func applyRaft(t *testing.T, mdb *MultiDB, acceptedAt time.Time, multi bool, cmdLines ...CmdLine) {
+	t.Helper()
+	data, err := json.Marshal(&raftCommand{Cmds: cmdLines, Multi: multi, Time: unixMilli(acceptedAt)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	(&raftMachine{mdb: mdb}).Apply(1, data)
+}
+
+func TestRaftAdjustTTL(t *testing.T) {
+	mdb := makeTestServer(t)
+	c := connection.NewFakeConn()
+	acceptedAt := time.Now().Add(-100 * time.Second)
+
+	// 过期时间从leader接受命令时开始计算
+	applyRaft(t, mdb, acceptedAt, false, utils.ToCmdLine("SET", "a", "1", "EX", "1000"))
+	assertTTL(t, mdb, c, "a", 890, 900)
+
+	// 条件不满足的SET没有修改过期时间，不需要换算
+	execString(mdb, c, "SET", "b", "1", "EX", "1000")
+	applyRaft(t, mdb, acceptedAt, false, utils.ToCmdLine("SET", "b", "2", "EX", "10", "NX"))
+	assertTTL(t, mdb, c, "b", 990, 1000)
+	applyRaft(t, mdb, acceptedAt, false, utils.ToCmdLine("EXPIRE", "none", "1000"))
+	assertReply(t, execString(mdb, c, "TTL", "none"), ":-2\r\n")
+
+	// 事务中多次设置同一个key的过期时间只换算一次
+	applyRaft(t, mdb, acceptedAt, true,
+		utils.ToCmdLine("SET", "c", "1", "EX", "1000"),
+		utils.ToCmdLine("EXPIRE", "c", "1000"))
+	assertTTL(t, mdb, c, "c", 890, 900)
+
+	// 之后以绝对时间设置的过期时间保持不变
+	expireAt := time.Now().Add(1000 * time.Second).Unix()
+	applyRaft(t, mdb, acceptedAt, true,
+		utils.ToCmdLine("SET", "d", "1", "EX", "10"),
+		utils.ToCmdLine("EXPIREAT", "d", strconv.FormatInt(expireAt, 10)))
+	assertTTL(t, mdb, c, "d", 990, 1000)
+}
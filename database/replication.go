@@ -0,0 +1,213 @@
+package database
+
+import (
+	"bytes"
+	"fmt"
+	"gedis/interface/redis"
+	"gedis/redis/protocol"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// replicaWriteCommands 不在命令表中或者需要显式标记，但是会修改数据的命令
+// migrate会删除迁移成功的本地key，restore-asking只能由源节点的MIGRATE发往主节点
+var replicaWriteCommands = map[string]struct{}{
+	"flushall":       {},
+	"flushdb":        {},
+	"jsonrestore":    {},
+	"migrate":        {},
+	"restore-asking": {},
+}
+
+// isWriteRequest 与aof相同，根据prepare函数是否返回写key判断是否为写命令
+func isWriteRequest(cmdLine CmdLine) bool {
+	cmdName := strings.ToLower(string(cmdLine[0]))
+	if _, ok := replicaWriteCommands[cmdName]; ok {
+		return true
+	}
+	return isWriteCommand(cmdLine)
+}
+
+// isReadOnlyRejected 从节点只读，拒绝客户端的写命令，主节点复制连接发送的命令除外
+func (mdb *MultiDB) isReadOnlyRejected(c redis.Connection, cmdLine CmdLine) bool {
+	if !mdb.isSlave() || (c != nil && c.IsMaster()) {
+		return false
+	}
+	return isWriteRequest(cmdLine)
+}
+
+// recordWriteOffset 主节点上客户端执行写命令或事务之后，记录此时的复制偏移量供wait使用
+func (mdb *MultiDB) recordWriteOffset(c redis.Connection, cmdLine CmdLine) {
+	if c == nil || mdb.master == nil || mdb.isSlave() {
+		return
+	}
+	if strings.ToLower(string(cmdLine[0])) == "exec" || isWriteRequest(cmdLine) {
+		c.SetWriteOffset(mdb.master.currentOffset())
+	}
+}
+
+// replOffset 当前节点的复制偏移量，从节点为已经处理的主节点复制流的字节数
+func (mdb *MultiDB) replOffset() int64 {
+	if mdb.isSlave() {
+		mdb.slave.mu.Lock()
+		defer mdb.slave.mu.Unlock()
+		return mdb.slave.offset
+	}
+	return mdb.master.currentOffset()
+}
+
+// replicaInfo 主节点上一个从节点的状态快照
+type replicaInfo struct {
+	ip     string
+	port   int
+	state  string
+	offset int64
+	lag    int64
+}
+
+// masterInfo 主节点复制状态的快照
+type masterInfo struct {
+	replId         string
+	offset         int64
+	backlogActive  bool
+	backlogSize    int
+	backlogBegin   int64
+	backlogHistLen int
+	replicas       []replicaInfo
+}
+
+func (master *masterStatus) info() *masterInfo {
+	master.mu.Lock()
+	defer master.mu.Unlock()
+	info := &masterInfo{
+		replId: master.replId,
+	}
+	if master.backlog != nil {
+		info.offset = master.backlog.endOffset()
+		info.backlogActive = true
+		info.backlogSize = master.backlog.size
+		// 与redis一致，复制流的第一个字节的偏移量为1
+		info.backlogBegin = master.backlog.beginOffset + 1
+		info.backlogHistLen = len(master.backlog.buf)
+	}
+	now := time.Now()
+	for _, slave := range master.slaves {
+		info.replicas = append(info.replicas, replicaInfo{
+			ip:     slave.ip,
+			port:   slave.listeningPort,
+			state:  slave.state,
+			offset: slave.ackOffset,
+			lag:    int64(now.Sub(slave.ackTime).Seconds()),
+		})
+	}
+	return info
+}
+
+// slaveInfo 从节点复制状态的快照
+type slaveInfo struct {
+	masterHost    string
+	masterPort    int
+	state         string
+	replId        string
+	offset        int64
+	lastIOTime    time.Time
+	linkDownSince time.Time
+	syncErr       string
+}
+
+func (slave *slaveStatus) info() *slaveInfo {
+	slave.mu.Lock()
+	defer slave.mu.Unlock()
+	info := &slaveInfo{
+		masterHost:    slave.masterHost,
+		masterPort:    slave.masterPort,
+		state:         slave.state,
+		replId:        slave.replId,
+		offset:        slave.offset,
+		lastIOTime:    slave.lastIOTime,
+		linkDownSince: slave.linkDownSince,
+		syncErr:       slave.syncErr,
+	}
+	if slave.replId == "" {
+		// 尚未完成第一次同步
+		info.offset = -1
+	}
+	return info
+}
+
+// execRole 返回当前节点的角色
+// 主节点返回复制偏移量以及所有的从节点，从节点返回主节点的地址、连接状态以及复制偏移量
+func execRole(mdb *MultiDB) redis.Reply {
+	if mdb.isSlave() {
+		info := mdb.slave.info()
+		return protocol.MakeMultiRawReply([]redis.Reply{
+			protocol.MakeBulkReply([]byte("slave")),
+			protocol.MakeBulkReply([]byte(info.masterHost)),
+			protocol.MakeIntReply(int64(info.masterPort)),
+			protocol.MakeBulkReply([]byte(info.state)),
+			protocol.MakeIntReply(info.offset),
+		})
+	}
+	info := mdb.master.info()
+	replicas := make([]redis.Reply, 0, len(info.replicas))
+	for _, replica := range info.replicas {
+		replicas = append(replicas, protocol.MakeMultiBulkReply([][]byte{
+			[]byte(replica.ip),
+			[]byte(strconv.Itoa(replica.port)),
+			[]byte(strconv.FormatInt(replica.offset, 10)),
+		}))
+	}
+	return protocol.MakeMultiRawReply([]redis.Reply{
+		protocol.MakeBulkReply([]byte("master")),
+		protocol.MakeIntReply(info.offset),
+		protocol.MakeMultiRawReply(replicas),
+	})
+}
+
+func genReplicationInfo(mdb *MultiDB) string {
+	buf := &bytes.Buffer{}
+	if mdb.isSlave() {
+		info := mdb.slave.info()
+		linkStatus := "down"
+		if info.state == replStateConnected {
+			linkStatus = "up"
+		}
+		lastIO := int64(-1)
+		if !info.lastIOTime.IsZero() {
+			lastIO = int64(time.Since(info.lastIOTime).Seconds())
+		}
+		buf.WriteString("role:slave\r\n")
+		buf.WriteString(fmt.Sprintf("master_host:%s\r\n", info.masterHost))
+		buf.WriteString(fmt.Sprintf("master_port:%d\r\n", info.masterPort))
+		buf.WriteString(fmt.Sprintf("master_link_status:%s\r\n", linkStatus))
+		buf.WriteString(fmt.Sprintf("master_last_io_seconds_ago:%d\r\n", lastIO))
+		buf.WriteString(fmt.Sprintf("master_sync_in_progress:%d\r\n", boolToInt(info.state == replStateSync)))
+		buf.WriteString(fmt.Sprintf("slave_repl_offset:%d\r\n", info.offset))
+		if linkStatus == "down" {
+			buf.WriteString(fmt.Sprintf("master_link_down_since_seconds:%d\r\n", int64(time.Since(info.linkDownSince).Seconds())))
+		}
+		if info.syncErr != "" {
+			buf.WriteString(fmt.Sprintf("master_sync_last_error:%s\r\n", info.syncErr))
+		}
+		buf.WriteString("slave_read_only:1\r\n")
+		buf.WriteString("connected_slaves:0\r\n")
+		buf.WriteString(fmt.Sprintf("master_replid:%s\r\n", info.replId))
+		buf.WriteString(fmt.Sprintf("master_repl_offset:%d\r\n", info.offset))
+		return buf.String()
+	}
+	info := mdb.master.info()
+	buf.WriteString("role:master\r\n")
+	buf.WriteString(fmt.Sprintf("connected_slaves:%d\r\n", len(info.replicas)))
+	for i, replica := range info.replicas {
+		buf.WriteString(fmt.Sprintf("slave%d:ip=%s,port=%d,state=%s,offset=%d,lag=%d\r\n",
+			i, replica.ip, replica.port, replica.state, replica.offset, replica.lag))
+	}
+	buf.WriteString(fmt.Sprintf("master_replid:%s\r\n", info.replId))
+	buf.WriteString(fmt.Sprintf("master_repl_offset:%d\r\n", info.offset))
+	buf.WriteString(fmt.Sprintf("repl_backlog_active:%d\r\n", boolToInt(info.backlogActive)))
+	buf.WriteString(fmt.Sprintf("repl_backlog_size:%d\r\n", info.backlogSize))
+	buf.WriteString(fmt.Sprintf("repl_backlog_first_byte_offset:%d\r\n", info.backlogBegin))
+	buf.WriteString(fmt.Sprintf("repl_backlog_histlen:%d\r\n", info.backlogHistLen))
+	return buf.String()
+}
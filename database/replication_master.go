@@ -0,0 +1,489 @@
+package database
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"gedis/aof"
+	"gedis/config"
+	"gedis/interface/redis"
+	"gedis/lib/logger"
+	"gedis/lib/timewheel"
+	"gedis/lib/utils"
+	"gedis/redis/protocol"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultBacklogSize 未配置repl-backlog-size时积压缓冲区的大小
+	defaultBacklogSize = 1 << 20
+	// replPingPeriod 有从节点时主节点在复制流中写入ping的间隔，从节点据此判断连接是否存活
+	replPingPeriod  = 10 * time.Second
+	replPingTaskKey = "repl:ping"
+)
+
+// replBacklog 复制积压缓冲区，保存最近写入复制流的数据
+// 偏移量从0开始计数，代表复制流中的字节位置
+type replBacklog struct {
+	// buf中第一个字节在复制流中的偏移量
+	beginOffset int64
+	buf         []byte
+	size        int
+}
+
+func makeReplBacklog(size int, beginOffset int64) *replBacklog {
+	return &replBacklog{
+		beginOffset: beginOffset,
+		size:        size,
+	}
+}
+
+// endOffset 复制流的总长度，即主节点的复制偏移量
+func (backlog *replBacklog) endOffset() int64 {
+	return backlog.beginOffset + int64(len(backlog.buf))
+}
+
+func (backlog *replBacklog) append(data []byte) {
+	backlog.buf = append(backlog.buf, data...)
+	// 超过两倍容量时才丢弃旧的数据，避免每次写入都需要拷贝
+	if len(backlog.buf) > 2*backlog.size {
+		drop := len(backlog.buf) - backlog.size
+		buf := make([]byte, backlog.size, 2*backlog.size)
+		copy(buf, backlog.buf[drop:])
+		backlog.buf = buf
+		backlog.beginOffset += int64(drop)
+	}
+}
+
+// readFrom 返回从offset开始到末尾的数据，offset不在缓冲区中时返回false
+func (backlog *replBacklog) readFrom(offset int64) ([]byte, bool) {
+	if offset < backlog.beginOffset || offset > backlog.endOffset() {
+		return nil, false
+	}
+	data := backlog.buf[offset-backlog.beginOffset:]
+	result := make([]byte, len(data))
+	copy(result, data)
+	return result, true
+}
+
+// 主节点上从节点的状态，与redis的INFO replication一致
+const (
+	slaveStateSendBulk = "send_bulk"
+	slaveStateOnline   = "online"
+)
+
+// slaveClient 主节点上一个从节点的连接，offset、state以及ack相关的字段由masterStatus的mu保护
+type slaveClient struct {
+	conn redis.Connection
+	// 从节点的ip以及通过replconf告知的监听端口
+	ip            string
+	listeningPort int
+	// 下一个需要发送给从节点的字节在复制流中的偏移量
+	offset int64
+	state  string
+	// 从节点通过replconf ack确认已经处理的复制偏移量，以及最近一次确认的时间
+	ackOffset int64
+	ackTime   time.Time
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// masterStatus 主节点的复制状态，所有字段由mu保护
+type masterStatus struct {
+	mu     sync.Mutex
+	replId string
+	// 第一个从节点连接时才创建，作为从节点运行时为nil
+	backlog *replBacklog
+	// 上一条写入复制流的命令所在的数据库，-1代表下一条命令之前需要写入select
+	lastDBIndex int
+	slaves      map[redis.Connection]*slaveClient
+	// 从节点在psync之前通过replconf告知的监听端口
+	listeningPorts map[redis.Connection]int
+	// 每次写入复制流之后关闭并替换，唤醒所有等待数据的从节点
+	notify chan struct{}
+	// 每次收到从节点的ack之后关闭并替换，唤醒执行wait的客户端
+	ackNotify chan struct{}
+}
+
+func makeMasterStatus() *masterStatus {
+	return &masterStatus{
+		replId:         genReplId(),
+		lastDBIndex:    -1,
+		slaves:         make(map[redis.Connection]*slaveClient),
+		listeningPorts: make(map[redis.Connection]int),
+		notify:         make(chan struct{}),
+		ackNotify:      make(chan struct{}),
+	}
+}
+
+// genReplId 生成40位十六进制的随机复制id
+func genReplId() string {
+	b := make([]byte, 20)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func backlogSize() int {
+	size, err := config.ParseSize(config.Properties.ReplBacklogSize)
+	if err != nil || size <= 0 {
+		return defaultBacklogSize
+	}
+	return int(size)
+}
+
+// feed 将一条执行成功的写命令写入复制流，dbIndex小于0代表与数据库无关的命令
+func (master *masterStatus) feed(dbIndex int, cmdLine CmdLine) {
+	master.mu.Lock()
+	defer master.mu.Unlock()
+	if master.backlog == nil {
+		return
+	}
+	if dbIndex >= 0 && dbIndex != master.lastDBIndex {
+		selectCmd := utils.ToCmdLine("SELECT", strconv.Itoa(dbIndex))
+		master.backlog.append(protocol.MakeMultiBulkReply(selectCmd).ToBytes())
+		master.lastDBIndex = dbIndex
+	}
+	master.backlog.append(protocol.MakeMultiBulkReply(cmdLine).ToBytes())
+	close(master.notify)
+	master.notify = make(chan struct{})
+}
+
+// ensureBacklog 调用方需要持有mu
+func (master *masterStatus) ensureBacklog() {
+	if master.backlog == nil {
+		master.backlog = makeReplBacklog(backlogSize(), 0)
+		master.lastDBIndex = -1
+	}
+}
+
+// reset 作为主节点重新开始复制，使用新的复制id，复制流从offset继续
+func (master *masterStatus) reset(offset int64) {
+	master.mu.Lock()
+	defer master.mu.Unlock()
+	master.replId = genReplId()
+	master.backlog = makeReplBacklog(backlogSize(), offset)
+	master.lastDBIndex = -1
+}
+
+// stop 成为从节点时断开所有的从节点，并停止记录复制流
+func (master *masterStatus) stop() {
+	master.mu.Lock()
+	slaves := make([]*slaveClient, 0, len(master.slaves))
+	for _, slave := range master.slaves {
+		slaves = append(slaves, slave)
+	}
+	master.backlog = nil
+	master.mu.Unlock()
+	for _, slave := range slaves {
+		master.removeSlave(slave)
+	}
+}
+
+// newSlaveClient 为完成psync的连接创建从节点
+func (master *masterStatus) newSlaveClient(c redis.Connection, offset int64, state string) *slaveClient {
+	slave := &slaveClient{
+		conn:      c,
+		offset:    offset,
+		state:     state,
+		ackOffset: offset,
+		ackTime:   time.Now(),
+		closed:    make(chan struct{}),
+	}
+	if addr, ok := c.(interface{ RemoteAddr() net.Addr }); ok {
+		if tcpAddr, ok := addr.RemoteAddr().(*net.TCPAddr); ok {
+			slave.ip = tcpAddr.IP.String()
+		}
+	}
+	master.mu.Lock()
+	slave.listeningPort = master.listeningPorts[c]
+	master.mu.Unlock()
+	return slave
+}
+
+func (master *masterStatus) addSlave(slave *slaveClient) {
+	master.mu.Lock()
+	defer master.mu.Unlock()
+	if old, ok := master.slaves[slave.conn]; ok {
+		old.closeOnce.Do(func() { close(old.closed) })
+	}
+	master.slaves[slave.conn] = slave
+}
+
+// removeSlave 移除从节点并关闭连接，从节点会重新连接并同步
+func (master *masterStatus) removeSlave(slave *slaveClient) {
+	master.mu.Lock()
+	if master.slaves[slave.conn] == slave {
+		delete(master.slaves, slave.conn)
+		delete(master.listeningPorts, slave.conn)
+	}
+	master.mu.Unlock()
+	slave.closeOnce.Do(func() {
+		close(slave.closed)
+		_ = slave.conn.Close()
+	})
+}
+
+func (master *masterStatus) slaveCount() int {
+	master.mu.Lock()
+	defer master.mu.Unlock()
+	return len(master.slaves)
+}
+
+// serveSlave 持续将复制流中的数据发送给从节点
+// 从节点落后太多，需要的数据已经被移出积压缓冲区时断开连接，从节点重连后进行全量同步
+func (master *masterStatus) serveSlave(slave *slaveClient) {
+	for {
+		master.mu.Lock()
+		var data []byte
+		ok := false
+		if master.backlog != nil {
+			data, ok = master.backlog.readFrom(slave.offset)
+		}
+		notify := master.notify
+		slave.state = slaveStateOnline
+		master.mu.Unlock()
+		if !ok {
+			logger.Warn("replica fell behind the replication backlog, disconnecting")
+			master.removeSlave(slave)
+			return
+		}
+		if len(data) > 0 {
+			if err := slave.conn.Write(data); err != nil {
+				master.removeSlave(slave)
+				return
+			}
+			master.mu.Lock()
+			slave.offset += int64(len(data))
+			master.mu.Unlock()
+		}
+		select {
+		case <-notify:
+		case <-slave.closed:
+			return
+		}
+	}
+}
+
+// startReplPing 有从节点时定期在复制流中写入ping，保持连接活跃
+func (mdb *MultiDB) startReplPing() {
+	mdb.pingTaskKey = replPingTaskKey + ":" + genReplId()
+	var ping func()
+	ping = func() {
+		if mdb.closed.Get() {
+			return
+		}
+		if !mdb.isSlave() && mdb.master.slaveCount() > 0 {
+			mdb.master.feed(-1, utils.ToCmdLine("PING"))
+		}
+		timewheel.Delay(replPingPeriod, mdb.pingTaskKey, ping)
+	}
+	timewheel.Delay(replPingPeriod, mdb.pingTaskKey, ping)
+}
+
+// execPSync 处理从节点的psync请求
+// 复制id相同且需要的数据仍在积压缓冲区中时进行部分同步，否则发送rdb快照进行全量同步
+// 命令需要获取pausing的写锁，必须在获取读锁之前调用
+func execPSync(mdb *MultiDB, c redis.Connection, args [][]byte) redis.Reply {
+	if mdb.isSlave() {
+		return protocol.MakeErrReply("ERR Can't SYNC while this instance is a replica")
+	}
+	replId := string(args[0])
+	// psync的偏移量为从节点需要的下一个字节，从1开始计数
+	psyncOffset, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return protocol.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	master := mdb.master
+
+	master.mu.Lock()
+	master.ensureBacklog()
+	if replId == master.replId && psyncOffset > 0 {
+		if _, ok := master.backlog.readFrom(psyncOffset - 1); ok {
+			master.mu.Unlock()
+			return continueSync(master, c, psyncOffset-1)
+		}
+	}
+	master.mu.Unlock()
+	return fullSync(mdb, c)
+}
+
+func continueSync(master *masterStatus, c redis.Connection, offset int64) redis.Reply {
+	slave := master.newSlaveClient(c, offset, slaveStateOnline)
+	master.mu.Lock()
+	replId := master.replId
+	master.mu.Unlock()
+	if err := c.Write([]byte("+CONTINUE " + replId + protocol.CRLF)); err != nil {
+		return &protocol.NoReply{}
+	}
+	logger.Info(fmt.Sprintf("partial resynchronization accepted, offset %d", offset))
+	master.addSlave(slave)
+	go master.serveSlave(slave)
+	return &protocol.NoReply{}
+}
+
+// fullSync 暂停命令复制一份快照并记录此时的复制偏移量，在后台编码rdb发送给从节点，之后从该偏移量开始发送复制流
+func fullSync(mdb *MultiDB, c redis.Connection) redis.Reply {
+	master := mdb.master
+	mdb.pause()
+	master.mu.Lock()
+	master.ensureBacklog()
+	offset := master.backlog.endOffset()
+	replId := master.replId
+	// 快照之后的第一条命令之前需要写入select
+	master.lastDBIndex = -1
+	master.mu.Unlock()
+	snapshot := mdb.snapshot()
+	mdb.resume()
+
+	header := "+FULLRESYNC " + replId + " " + strconv.FormatInt(offset, 10) + protocol.CRLF
+	if err := c.Write([]byte(header)); err != nil {
+		return &protocol.NoReply{}
+	}
+	slave := master.newSlaveClient(c, offset, slaveStateSendBulk)
+	master.addSlave(slave)
+	go func() {
+		buf := &bytes.Buffer{}
+		if err := aof.WriteRDB(buf, snapshot); err != nil {
+			logger.Error("encode rdb for replica failed: " + err.Error())
+			master.removeSlave(slave)
+			return
+		}
+		// rdb以bulk的格式发送，但是结尾没有CRLF
+		payload := make([]byte, 0, buf.Len()+32)
+		payload = append(payload, '$')
+		payload = append(payload, strconv.Itoa(buf.Len())...)
+		payload = append(payload, protocol.CRLF...)
+		payload = append(payload, buf.Bytes()...)
+		if err := c.Write(payload); err != nil {
+			master.removeSlave(slave)
+			return
+		}
+		logger.Info(fmt.Sprintf("full resynchronization finished, sent %d bytes of rdb", buf.Len()))
+		master.serveSlave(slave)
+	}()
+	return &protocol.NoReply{}
+}
+
+// execReplConf 处理从节点在握手阶段发送的配置
+func execReplConf(mdb *MultiDB, c redis.Connection, args [][]byte) redis.Reply {
+	if len(args)%2 != 0 {
+		return protocol.MakeSyntaxErrReply()
+	}
+	for i := 0; i < len(args); i += 2 {
+		switch strings.ToLower(string(args[i])) {
+		case "listening-port":
+			port, err := strconv.Atoi(string(args[i+1]))
+			if err != nil {
+				return protocol.MakeErrReply("ERR value is not an integer or out of range")
+			}
+			mdb.master.mu.Lock()
+			mdb.master.listeningPorts[c] = port
+			mdb.master.mu.Unlock()
+		case "ack":
+			offset, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil {
+				return &protocol.NoReply{}
+			}
+			mdb.master.ack(c, offset)
+			// 从节点不会读取ack的回复
+			return &protocol.NoReply{}
+		case "getack":
+			// 只出现在复制流中，由从节点处理
+			return &protocol.NoReply{}
+		case "ip-address", "capa":
+		default:
+			return protocol.MakeErrReply("ERR Unrecognized REPLCONF option: " + string(args[i]))
+		}
+	}
+	return protocol.MakeOkReply()
+}
+
+// ack 记录从节点确认的复制偏移量，并唤醒等待的客户端
+func (master *masterStatus) ack(c redis.Connection, offset int64) {
+	master.mu.Lock()
+	defer master.mu.Unlock()
+	slave, ok := master.slaves[c]
+	if !ok {
+		return
+	}
+	if offset > slave.ackOffset {
+		slave.ackOffset = offset
+	}
+	slave.ackTime = time.Now()
+	close(master.ackNotify)
+	master.ackNotify = make(chan struct{})
+}
+
+// currentOffset 返回主节点当前的复制偏移量
+func (master *masterStatus) currentOffset() int64 {
+	master.mu.Lock()
+	defer master.mu.Unlock()
+	if master.backlog == nil {
+		return 0
+	}
+	return master.backlog.endOffset()
+}
+
+// countAcked 返回确认的偏移量不小于offset的从节点数量，以及之后有新的ack时会被关闭的通道
+func (master *masterStatus) countAcked(offset int64) (int, <-chan struct{}) {
+	master.mu.Lock()
+	defer master.mu.Unlock()
+	count := 0
+	for _, slave := range master.slaves {
+		if slave.ackOffset >= offset {
+			count++
+		}
+	}
+	return count, master.ackNotify
+}
+
+// execWait 阻塞客户端，直到至少numReplicas个从节点确认了该客户端最后一次写入时的复制偏移量，或者超时
+// timeout的单位为毫秒，为0时一直等待，客户端断开时停止等待。返回确认的从节点数量
+// 等待期间不能持有pausing的读锁，否则全量同步无法获取快照
+func execWait(mdb *MultiDB, c redis.Connection, args [][]byte) redis.Reply {
+	if mdb.isSlave() {
+		return protocol.MakeErrReply("ERR WAIT cannot be used with replica instances.")
+	}
+	numReplicas, err := strconv.Atoi(string(args[0]))
+	if err != nil {
+		return protocol.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	timeoutMs, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil || timeoutMs < 0 {
+		return protocol.MakeErrReply("ERR timeout is not an integer or out of range")
+	}
+	master := mdb.master
+	offset := c.GetWriteOffset()
+	count, notify := master.countAcked(offset)
+	if count >= numReplicas {
+		return protocol.MakeIntReply(int64(count))
+	}
+	// 要求从节点立即确认，而不是等待每秒一次的ack
+	master.feed(-1, utils.ToCmdLine("REPLCONF", "GETACK", "*"))
+	var deadline <-chan time.Time
+	if timeoutMs > 0 {
+		timer := time.NewTimer(time.Duration(timeoutMs) * time.Millisecond)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	for {
+		select {
+		case <-notify:
+		case <-deadline:
+			count, _ = master.countAcked(offset)
+			return protocol.MakeIntReply(int64(count))
+		case <-c.Closed():
+			count, _ = master.countAcked(offset)
+			return protocol.MakeIntReply(int64(count))
+		}
+		count, notify = master.countAcked(offset)
+		if count >= numReplicas {
+			return protocol.MakeIntReply(int64(count))
+		}
+	}
+}
@@ -0,0 +1,436 @@
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"gedis/config"
+	"gedis/interface/redis"
+	"gedis/lib/logger"
+	"gedis/redis/connection"
+	"gedis/redis/parser"
+	"gedis/redis/protocol"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	rdb "github.com/hdt3213/rdb/parser"
+)
+
+const (
+	roleMaster int32 = iota
+	roleSlave
+)
+
+// 从节点与主节点之间连接的状态，与redis的ROLE命令一致
+const (
+	replStateConnect    = "connect"
+	replStateConnecting = "connecting"
+	replStateSync       = "sync"
+	replStateConnected  = "connected"
+)
+
+const (
+	// replDialTimeout 连接主节点的超时时间
+	replDialTimeout = 5 * time.Second
+	// replTimeout 超过该时间没有收到主节点的任何数据时认为连接已经断开
+	replTimeout = 60 * time.Second
+	// replRetryDelay 与主节点的连接断开之后重新连接的间隔
+	replRetryDelay = time.Second
+	// replAckPeriod 从节点向主节点确认复制偏移量的间隔
+	replAckPeriod = time.Second
+)
+
+// slaveStatus 从节点的复制状态，所有字段由mu保护
+type slaveStatus struct {
+	mu sync.Mutex
+	// 每次执行replicaof之后递增，旧的同步协程发现版本变化之后退出
+	configVersion int64
+	masterHost    string
+	masterPort    int
+	masterConn    net.Conn
+	// 主节点的复制id以及已经处理的复制流的字节数
+	replId string
+	offset int64
+	// 执行复制流中命令的连接，保存复制流中select的数据库
+	dbConn *connection.FakeConn
+	state  string
+	// 最近一次收到主节点数据的时间，以及连接断开的时间
+	lastIOTime    time.Time
+	linkDownSince time.Time
+	// 最近一次全量同步加载rdb失败的原因，同步成功之后清空
+	syncErr string
+}
+
+// setState 调用方需要持有mu
+func (slave *slaveStatus) setState(state string) {
+	if state != replStateConnected && slave.state == replStateConnected {
+		slave.linkDownSince = time.Now()
+	}
+	slave.state = state
+}
+
+func (mdb *MultiDB) isSlave() bool {
+	return atomic.LoadInt32(&mdb.role) == roleSlave
+}
+
+// execReplicaOf 处理 replicaof host port 以及 replicaof no one
+// 命令需要获取pausing的写锁，必须在获取读锁之前调用
+func execReplicaOf(mdb *MultiDB, args [][]byte) redis.Reply {
+	if strings.ToLower(string(args[0])) == "no" && strings.ToLower(string(args[1])) == "one" {
+		mdb.stopReplication()
+		return protocol.MakeOkReply()
+	}
+	host := string(args[0])
+	port, err := strconv.Atoi(string(args[1]))
+	if err != nil || port <= 0 || port > 65535 {
+		return protocol.MakeErrReply("ERR Invalid master port")
+	}
+	slave := mdb.slave
+	slave.mu.Lock()
+	if mdb.isSlave() && slave.masterHost == host && slave.masterPort == port {
+		slave.mu.Unlock()
+		return protocol.MakeStatusReply("OK Already connected to specified master")
+	}
+	slave.mu.Unlock()
+	mdb.startReplication(host, port)
+	return protocol.MakeOkReply()
+}
+
+// startReplication 成为host:port的从节点，断开自己的从节点并在后台与主节点同步
+func (mdb *MultiDB) startReplication(host string, port int) {
+	slave := mdb.slave
+	slave.mu.Lock()
+	slave.configVersion++
+	version := slave.configVersion
+	slave.masterHost = host
+	slave.masterPort = port
+	if slave.masterConn != nil {
+		_ = slave.masterConn.Close()
+		slave.masterConn = nil
+	}
+	// 更换主节点之后复制id不再有效，需要全量同步
+	slave.replId = ""
+	slave.offset = 0
+	slave.state = replStateConnect
+	slave.linkDownSince = time.Now()
+	atomic.StoreInt32(&mdb.role, roleSlave)
+	slave.mu.Unlock()
+
+	mdb.master.stop()
+	logger.Info(fmt.Sprintf("connecting to master %s:%d", host, port))
+	go mdb.syncLoop(version)
+}
+
+// stopReplication 断开与主节点的连接，以当前的数据成为主节点
+func (mdb *MultiDB) stopReplication() {
+	slave := mdb.slave
+	slave.mu.Lock()
+	defer slave.mu.Unlock()
+	if !mdb.isSlave() {
+		return
+	}
+	slave.configVersion++
+	if slave.masterConn != nil {
+		_ = slave.masterConn.Close()
+		slave.masterConn = nil
+	}
+	slave.masterHost = ""
+	slave.masterPort = 0
+	slave.state = ""
+	// 复制流从已经处理的位置继续，使用新的复制id
+	mdb.master.reset(slave.offset)
+	atomic.StoreInt32(&mdb.role, roleMaster)
+	logger.Info("replication stopped, this instance is now a master")
+}
+
+// syncLoop 与主节点保持同步，连接断开之后不断重试，直到执行了新的replicaof
+func (mdb *MultiDB) syncLoop(version int64) {
+	for {
+		err := mdb.syncWithMaster(version)
+		if !mdb.isCurrentReplication(version) {
+			return
+		}
+		mdb.slave.mu.Lock()
+		mdb.slave.setState(replStateConnect)
+		mdb.slave.mu.Unlock()
+		if err != nil {
+			logger.Warn("replication from master failed: " + err.Error())
+		}
+		time.Sleep(replRetryDelay)
+	}
+}
+
+func (mdb *MultiDB) isCurrentReplication(version int64) bool {
+	mdb.slave.mu.Lock()
+	defer mdb.slave.mu.Unlock()
+	return mdb.slave.configVersion == version && !mdb.closed.Get()
+}
+
+// syncWithMaster 完成一次握手与同步，然后持续执行主节点发送的命令，直到连接断开
+func (mdb *MultiDB) syncWithMaster(version int64) error {
+	slave := mdb.slave
+	slave.mu.Lock()
+	if slave.configVersion != version {
+		slave.mu.Unlock()
+		return nil
+	}
+	addr := net.JoinHostPort(slave.masterHost, strconv.Itoa(slave.masterPort))
+	slave.setState(replStateConnecting)
+	slave.mu.Unlock()
+
+	conn, err := net.DialTimeout("tcp", addr, replDialTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	slave.mu.Lock()
+	if slave.configVersion != version {
+		slave.mu.Unlock()
+		return nil
+	}
+	slave.masterConn = conn
+	psyncId, psyncOffset := "?", "-1"
+	if slave.replId != "" {
+		psyncId = slave.replId
+		psyncOffset = strconv.FormatInt(slave.offset+1, 10)
+	}
+	slave.mu.Unlock()
+
+	_ = conn.SetDeadline(time.Now().Add(replTimeout))
+	reader := bufio.NewReader(conn)
+	if config.Properties.MasterAuth != "" {
+		if err := handshake(conn, reader, "AUTH", config.Properties.MasterAuth); err != nil {
+			return err
+		}
+	}
+	if err := handshake(conn, reader, "REPLCONF", "listening-port", strconv.Itoa(config.Properties.Port)); err != nil {
+		return err
+	}
+	if _, err := conn.Write(makeCmd("PSYNC", psyncId, psyncOffset)); err != nil {
+		return err
+	}
+	line, err := readReplLine(reader)
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(line)
+	switch {
+	case len(fields) == 3 && fields[0] == "+FULLRESYNC":
+		offset, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return errors.New("invalid FULLRESYNC reply: " + line)
+		}
+		if err := mdb.receiveRDB(version, reader, fields[1], offset); err != nil {
+			return err
+		}
+	case len(fields) >= 1 && fields[0] == "+CONTINUE":
+		slave.mu.Lock()
+		if len(fields) == 2 {
+			slave.replId = fields[1]
+		}
+		slave.mu.Unlock()
+		logger.Info("partial resynchronization with master succeeded")
+	default:
+		return errors.New("unexpected PSYNC reply: " + line)
+	}
+	return mdb.receiveCommands(version, conn, reader)
+}
+
+// receiveRDB 读取主节点发送的rdb快照，替换当前所有的数据
+func (mdb *MultiDB) receiveRDB(version int64, reader *bufio.Reader, replId string, offset int64) error {
+	// 主节点生成rdb期间可能会发送空行保持连接
+	line, err := readReplLine(reader)
+	if err != nil {
+		return err
+	}
+	slave := mdb.slave
+	slave.mu.Lock()
+	slave.setState(replStateSync)
+	slave.mu.Unlock()
+	if len(line) == 0 || line[0] != '$' {
+		return errors.New("unexpected rdb header: " + line)
+	}
+	size, err := strconv.ParseInt(line[1:], 10, 64)
+	if err != nil || size < 0 {
+		return errors.New("invalid rdb size: " + line)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return err
+	}
+
+	if !mdb.isCurrentReplication(version) {
+		return errors.New("replication config changed")
+	}
+	if err := mdb.loadMasterRDB(data); err != nil {
+		return err
+	}
+	slave.mu.Lock()
+	defer slave.mu.Unlock()
+	slave.replId = replId
+	slave.offset = offset
+	slave.syncErr = ""
+	slave.dbConn = connection.NewFakeConn()
+	slave.dbConn.SetPassword(config.Properties.RequirePass)
+	slave.dbConn.SetMaster()
+	logger.Info(fmt.Sprintf("full resynchronization with master finished, loaded %d bytes of rdb", size))
+	return nil
+}
+
+// loadMasterRDB 清空所有的数据库并加载主节点的快照
+// 开启aof时以加载之后的数据重写aof，保证重启之后数据一致
+func (mdb *MultiDB) loadMasterRDB(data []byte) error {
+	mdb.pause()
+	defer mdb.resume()
+	for _, db := range mdb.dbSet {
+		db.Flush()
+	}
+	if err := mdb.LoadRDB(rdb.NewDecoder(bytes.NewReader(data))); err != nil {
+		// 数据已经被清空，不能再以原来的复制id部分同步，下次连接时重新全量同步
+		slave := mdb.slave
+		slave.mu.Lock()
+		slave.replId = ""
+		slave.offset = 0
+		slave.syncErr = err.Error()
+		slave.mu.Unlock()
+		return err
+	}
+	mdb.addDirty(1)
+	if mdb.persister == nil {
+		return nil
+	}
+	// 持有pausing的写锁，重写期间数据不会被修改
+	if err := mdb.persister.RewriteFrom(mdb); err != nil {
+		logger.Error("rewrite aof after full resynchronization failed: " + err.Error())
+	}
+	return nil
+}
+
+// receiveCommands 执行主节点发送的复制流，并累加复制偏移量
+func (mdb *MultiDB) receiveCommands(version int64, conn net.Conn, reader *bufio.Reader) error {
+	ch := parser.ParseStream(reader)
+	defer func() {
+		// 连接关闭之后解析协程还会发送错误，需要取走
+		_ = conn.Close()
+		go func() {
+			for range ch {
+			}
+		}()
+	}()
+	slave := mdb.slave
+	slave.mu.Lock()
+	slave.setState(replStateConnected)
+	slave.lastIOTime = time.Now()
+	dbConn := slave.dbConn
+	slave.mu.Unlock()
+
+	// 定时确认复制偏移量，收到getack时立即确认，两者会并发写入连接
+	var writeMu sync.Mutex
+	sendAck := func() error {
+		slave.mu.Lock()
+		offset := slave.offset
+		slave.mu.Unlock()
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		_, err := conn.Write(makeCmd("REPLCONF", "ACK", strconv.FormatInt(offset, 10)))
+		return err
+	}
+	stopAck := make(chan struct{})
+	defer close(stopAck)
+	go func() {
+		ticker := time.NewTicker(replAckPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if sendAck() != nil {
+					return
+				}
+			case <-stopAck:
+				return
+			}
+		}
+	}()
+	_ = sendAck()
+
+	for payload := range ch {
+		if payload.Err != nil {
+			return payload.Err
+		}
+		cmd, ok := payload.Data.(*protocol.MultiBulkReply)
+		if !ok {
+			return errors.New("unexpected data in replication stream")
+		}
+		_ = conn.SetDeadline(time.Now().Add(replTimeout))
+		if !mdb.isCurrentReplication(version) {
+			return nil
+		}
+		getAck := isGetAck(cmd.Args)
+		if !getAck {
+			result := mdb.Exec(dbConn, cmd.Args)
+			if protocol.IsErrorReply(result) {
+				logger.Warn(fmt.Sprintf("execute command from master failed: %s", string(result.ToBytes())))
+			}
+		}
+		slave.mu.Lock()
+		slave.offset += int64(len(cmd.ToBytes()))
+		slave.lastIOTime = time.Now()
+		slave.mu.Unlock()
+		if getAck {
+			if err := sendAck(); err != nil {
+				return err
+			}
+		}
+	}
+	return io.EOF
+}
+
+// isGetAck 是否为主节点要求立即确认复制偏移量的 replconf getack
+func isGetAck(cmdLine CmdLine) bool {
+	return len(cmdLine) >= 2 &&
+		strings.ToLower(string(cmdLine[0])) == "replconf" &&
+		strings.ToLower(string(cmdLine[1])) == "getack"
+}
+
+func makeCmd(args ...string) []byte {
+	cmdLine := make([][]byte, len(args))
+	for i, arg := range args {
+		cmdLine[i] = []byte(arg)
+	}
+	return protocol.MakeMultiBulkReply(cmdLine).ToBytes()
+}
+
+// handshake 发送一条命令并要求主节点返回非错误的回复
+func handshake(conn net.Conn, reader *bufio.Reader, args ...string) error {
+	if _, err := conn.Write(makeCmd(args...)); err != nil {
+		return err
+	}
+	line, err := readReplLine(reader)
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(line, "-") {
+		return fmt.Errorf("master rejected %s: %s", args[0], line[1:])
+	}
+	return nil
+}
+
+// readReplLine 读取一行非空的回复，去掉结尾的CRLF
+func readReplLine(reader *bufio.Reader) (string, error) {
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line != "" {
+			return line, nil
+		}
+	}
+}
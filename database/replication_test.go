@@ -0,0 +1,296 @@
+package database
+
+import (
+	"bytes"
+	"gedis/aof"
+	"gedis/interface/database"
+	"gedis/redis/connection"
+	"gedis/redis/parser"
+	"gedis/redis/protocol"
+	"github.com/hdt3213/rdb/encoder"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startReplica 创建masterAddr的从节点，等待全量同步完成
+func startReplica(t *testing.T, masterAddr string) *MultiDB {
+	replica := makeTestServer(t)
+	host, port, err := net.SplitHostPort(masterAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertReply(t, execString(replica, connection.NewFakeConn(), "REPLICAOF", host, port), "+OK\r\n")
+	waitCondition(t, "replica connected", func() bool {
+		return replica.slave.info().state == replStateConnected
+	})
+	return replica
+}
+
+// waitCondition 等待cond返回true，超时之后测试失败
+func waitCondition(t *testing.T, desc string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for " + desc)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWait(t *testing.T) {
+	master := makeTestServer(t)
+	c := connection.NewFakeConn()
+	assertReply(t, execString(master, c, "WAIT", "0", "0"), ":0\r\n")
+	start := time.Now()
+	assertReply(t, execString(master, c, "WAIT", "1", "100"), ":0\r\n")
+	if time.Since(start) < 100*time.Millisecond {
+		t.Error("expect WAIT to block until timeout")
+	}
+	assertReply(t, execString(master, c, "WAIT", "1"), "-ERR wrong number of arguments for 'wait' command\r\n")
+	assertReply(t, execString(master, c, "WAIT", "x", "0"), "-ERR value is not an integer or out of range\r\n")
+
+	// 事务中的WAIT不能阻塞，直接拒绝
+	assertReply(t, execString(master, c, "MULTI"), "+OK\r\n")
+	assertReply(t, execString(master, c, "WAIT", "1", "0"), "-ERR command 'Wait' cannot be used in MULTI\r\n")
+	assertReply(t, execString(master, c, "SET", "k", "v"), "+QUEUED\r\n")
+	assertReply(t, execString(master, c, "EXEC"), "*1\r\n+OK\r\n")
+
+	replica := startReplica(t, serveTestServer(t, master))
+	assertReply(t, execString(master, c, "SET", "k", "v2"), "+OK\r\n")
+	// 从节点收到GETACK之后立即确认，不需要等待超时
+	assertReply(t, execString(master, c, "WAIT", "1", "0"), ":1\r\n")
+	assertReply(t, execString(replica, connection.NewFakeConn(), "GET", "k"), "$2\r\nv2\r\n")
+	assertReply(t, execString(replica, connection.NewFakeConn(), "WAIT", "1", "0"),
+		"-ERR WAIT cannot be used with replica instances.\r\n")
+
+	// 没有足够的从节点时一直等待，直到客户端断开
+	server, client := net.Pipe()
+	defer client.Close()
+	conn := connection.NewConn(server)
+	done := make(chan string, 1)
+	go func() {
+		done <- string(master.Exec(conn, [][]byte{[]byte("WAIT"), []byte("2"), []byte("0")}).ToBytes())
+	}()
+	select {
+	case reply := <-done:
+		t.Fatalf("expect WAIT blocked actually %q", reply)
+	case <-time.After(100 * time.Millisecond):
+	}
+	_ = conn.Close()
+	assertReply(t, waitReply(t, "WAIT", done), ":1\r\n")
+}
+
+func TestReplConfAck(t *testing.T) {
+	master := makeTestServer(t)
+	c := connection.NewFakeConn()
+	// 不是从节点的连接发送的ack被忽略，ack没有回复
+	assertReply(t, execString(master, c, "REPLCONF", "ACK", "100"), "")
+	assertReply(t, execString(master, c, "REPLCONF", "listening-port", "6380"), "+OK\r\n")
+	assertReply(t, execString(master, c, "REPLCONF", "ACK"), "-Err syntax error\r\n")
+	assertReply(t, execString(master, c, "REPLCONF", "foo", "bar"), "-ERR Unrecognized REPLCONF option: foo\r\n")
+
+	startReplica(t, serveTestServer(t, master))
+	assertReply(t, execString(master, c, "SET", "k", "v"), "+OK\r\n")
+	offset := master.master.currentOffset()
+	// 从节点每秒发送一次ack，主节点记录确认的偏移量
+	waitCondition(t, "replica ack", func() bool {
+		replicas := master.master.info().replicas
+		return len(replicas) == 1 && replicas[0].offset == offset
+	})
+}
+
+func TestReplication(t *testing.T) {
+	master := makeTestServer(t)
+	c := connection.NewFakeConn()
+	assertReply(t, execString(master, c, "SET", "a", "1"), "+OK\r\n")
+	assertReply(t, execString(master, c, "RPUSH", "list", "x", "y"), ":2\r\n")
+	assertReply(t, execString(master, c, "SELECT", "1"), "+OK\r\n")
+	assertReply(t, execString(master, c, "SET", "b", "1"), "+OK\r\n")
+	addr := serveTestServer(t, master)
+	_, port, _ := net.SplitHostPort(addr)
+
+	// 全量同步
+	replica := startReplica(t, addr)
+	rc := connection.NewFakeConn()
+	assertReply(t, execString(replica, rc, "GET", "a"), "$1\r\n1\r\n")
+	assertReply(t, execString(replica, rc, "LLEN", "list"), ":2\r\n")
+	assertReply(t, execString(replica, rc, "SELECT", "1"), "+OK\r\n")
+	assertReply(t, execString(replica, rc, "GET", "b"), "$1\r\n1\r\n")
+	assertReply(t, execString(replica, rc, "SET", "b", "2"), "-READONLY You can't write against a read only replica\r\n")
+
+	// 复制流，从节点的偏移量与主节点一致
+	assertReply(t, execString(master, c, "SET", "b", "2"), "+OK\r\n")
+	assertReply(t, execString(master, c, "SET", "ttl", "v", "PX", "500"), "+OK\r\n")
+	waitSynced := func() {
+		t.Helper()
+		waitCondition(t, "replica offset", func() bool {
+			return replica.slave.info().offset == master.master.currentOffset()
+		})
+	}
+	waitSynced()
+	assertReply(t, execString(replica, rc, "GET", "b"), "$1\r\n2\r\n")
+	// 积压缓冲区保存了从第一个字节开始的整个复制流
+	info := master.master.info()
+	if !info.backlogActive || int64(info.backlogHistLen) != info.offset {
+		t.Errorf("unexpected backlog histlen %d offset %d", info.backlogHistLen, info.offset)
+	}
+	if first := infoField(t, master, "replication", "repl_backlog_first_byte_offset"); first != "1" {
+		t.Errorf("expect repl_backlog_first_byte_offset 1 actually %s", first)
+	}
+	if histLen := infoField(t, master, "replication", "repl_backlog_histlen"); histLen != strconv.FormatInt(info.offset, 10) {
+		t.Errorf("expect repl_backlog_histlen %d actually %s", info.offset, histLen)
+	}
+
+	// 主节点上的key过期之后以DEL传播到从节点
+	offset := master.master.currentOffset()
+	waitCondition(t, "expired key propagated", func() bool {
+		return master.master.currentOffset() > offset
+	})
+	waitSynced()
+	if _, ok := replica.dbSet[1].data.Get("ttl"); ok {
+		t.Error("expect expired key deleted on replica")
+	}
+
+	// ROLE与INFO replication
+	role := execString(replica, rc, "ROLE")
+	expect := "*5\r\n$5\r\nslave\r\n$9\r\n127.0.0.1\r\n:" + port + "\r\n$9\r\nconnected\r\n:"
+	if !strings.HasPrefix(role, expect) {
+		t.Errorf("expect %q actually %q", expect, role)
+	}
+	if role = execString(master, c, "ROLE"); !strings.HasPrefix(role, "*3\r\n$6\r\nmaster\r\n") || !strings.Contains(role, "*1\r\n*3\r\n") {
+		t.Errorf("unexpected ROLE of master %q", role)
+	}
+	assertReply(t, infoField(t, master, "replication", "connected_slaves"), "1")
+	assertReply(t, infoField(t, replica, "replication", "master_link_status"), "up")
+	assertReply(t, infoField(t, replica, "replication", "master_replid"), info.replId)
+
+	// 连接断开之后从积压缓冲区部分同步，不会清空从节点的数据
+	replica.dbSet[0].PutEntity("marker", &database.DataEntity{Data: []byte("1")})
+	replica.slave.mu.Lock()
+	_ = replica.slave.masterConn.Close()
+	replica.slave.mu.Unlock()
+	assertReply(t, execString(master, c, "SET", "c", "1"), "+OK\r\n")
+	waitCondition(t, "partial resynchronization", func() bool {
+		return replica.slave.info().state == replStateConnected && replica.slave.info().offset == master.master.currentOffset()
+	})
+	assertReply(t, execString(replica, rc, "GET", "c"), "$1\r\n1\r\n")
+	assertReply(t, execString(replica, connection.NewFakeConn(), "GET", "marker"), "$1\r\n1\r\n")
+}
+
+func TestReplicaAofFullResync(t *testing.T) {
+	master := makeTestServer(t)
+	c := connection.NewFakeConn()
+	assertReply(t, execString(master, c, "SET", "a", "1"), "+OK\r\n")
+	assertReply(t, execString(master, c, "SET", "ttl", "1", "EX", "1000"), "+OK\r\n")
+	addr := serveTestServer(t, master)
+
+	filename := filepath.Join(t.TempDir(), "appendonly.aof")
+	replica := makeAofServer(t, filename, aof.FsyncEverySec)
+	defer replica.Close()
+	host, port, _ := net.SplitHostPort(addr)
+	// 同步之前的数据会被主节点的数据替换
+	assertReply(t, execString(replica, connection.NewFakeConn(), "SET", "old", "1"), "+OK\r\n")
+	assertReply(t, execString(replica, connection.NewFakeConn(), "REPLICAOF", host, port), "+OK\r\n")
+	waitCondition(t, "replica connected", func() bool {
+		return replica.slave.info().state == replStateConnected
+	})
+	// 再次全量同步，aof被替换而不是追加
+	assertReply(t, execString(master, c, "SET", "b", "1"), "+OK\r\n")
+	replica.slave.mu.Lock()
+	replica.slave.replId = ""
+	_ = replica.slave.masterConn.Close()
+	replica.slave.mu.Unlock()
+	waitCondition(t, "full resynchronization", func() bool {
+		info := replica.slave.info()
+		return info.state == replStateConnected && info.offset == master.master.currentOffset()
+	})
+	assertReply(t, execString(master, c, "SET", "d", "1"), "+OK\r\n")
+	waitCondition(t, "replica offset", func() bool {
+		return replica.slave.info().offset == master.master.currentOffset()
+	})
+	replica.Close()
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("FLUSHALL")) || bytes.Count(data, []byte("\r\na\r\n")) != 1 {
+		t.Errorf("expect aof rewritten after full resync actually %q", data)
+	}
+	reloaded := makeAofServer(t, filename, aof.FsyncEverySec)
+	defer reloaded.Close()
+	rc := connection.NewFakeConn()
+	assertReply(t, execString(reloaded, rc, "EXISTS", "a", "b", "d", "ttl", "old"), ":4\r\n")
+	if ttl := execString(reloaded, rc, "TTL", "ttl"); !strings.HasPrefix(ttl, ":99") {
+		t.Errorf("expect ttl kept actually %q", ttl)
+	}
+}
+
+func TestReplicaLoadRDBFailed(t *testing.T) {
+	// 主节点发送的rdb中包含无法解析的类型
+	buf := &bytes.Buffer{}
+	enc := encoder.NewEncoder(buf)
+	if err := enc.WriteHeader(); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.WriteDBHeader(0, 2, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.WriteStringObject("k", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	buf.Write([]byte{15, 1, 's'})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for payload := range parser.ParseStream(conn) {
+					args, ok := payload.Data.(*protocol.MultiBulkReply)
+					if payload.Err != nil || !ok {
+						return
+					}
+					if strings.ToUpper(string(args.Args[0])) != "PSYNC" {
+						_, _ = conn.Write([]byte("+OK\r\n"))
+						continue
+					}
+					_, _ = conn.Write([]byte("+FULLRESYNC " + genReplId() + " 0\r\n$" + strconv.Itoa(buf.Len()) + "\r\n"))
+					_, _ = conn.Write(buf.Bytes())
+				}
+			}()
+		}
+	}()
+
+	replica := makeTestServer(t)
+	c := connection.NewFakeConn()
+	assertReply(t, execString(replica, c, "SET", "old", "1"), "+OK\r\n")
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	assertReply(t, execString(replica, c, "REPLICAOF", host, port), "+OK\r\n")
+	waitCondition(t, "sync error", func() bool {
+		return strings.Contains(execString(replica, c, "INFO", "replication"), "master_sync_last_error:")
+	})
+	reason := infoField(t, replica, "replication", "master_sync_last_error")
+	if !strings.Contains(reason, "unsupported rdb object type") {
+		t.Errorf("unexpected sync error %q", reason)
+	}
+	// 加载失败之后不能部分同步，复制偏移量未知
+	info := replica.slave.info()
+	if info.replId != "" || info.offset != -1 {
+		t.Errorf("expect full resync next time actually %s %d", info.replId, info.offset)
+	}
+	assertReply(t, infoField(t, replica, "replication", "master_link_status"), "down")
+}
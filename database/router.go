@@ -41,3 +41,27 @@ func RegisterCommand(name string, executor ExecFunc, prepare PreFunc, rollback U
 	}
 
 }
+
+// GetRelatedKeys 通过命令的prepare函数返回命令涉及的所有key
+// 命令不存在或者参数个数错误时返回false，集群据此决定由哪个节点执行命令
+func GetRelatedKeys(cmdLine CmdLine) ([]string, bool) {
+	write, read, ok := GetWriteReadKeys(cmdLine)
+	if !ok {
+		return nil, false
+	}
+	keys := make([]string, 0, len(write)+len(read))
+	keys = append(keys, write...)
+	keys = append(keys, read...)
+	return keys, true
+}
+
+// GetWriteReadKeys 分别返回命令的写key与读key，集群的分布式事务据此为key加锁
+func GetWriteReadKeys(cmdLine CmdLine) ([]string, []string, bool) {
+	cmdName := strings.ToLower(string(cmdLine[0]))
+	cmd, ok := cmdTable[cmdName]
+	if !ok || cmd.prepare == nil || !validateArity(cmd.arity, cmdLine) {
+		return nil, nil, false
+	}
+	write, read := cmd.prepare(cmdLine[1:])
+	return write, read, true
+}
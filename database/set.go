@@ -99,6 +99,42 @@ func execSRem(db *DB, args [][]byte) redis.Reply {
 	return protocol.MakeIntReply(int64(counter))
 }
 
+// execSMove moves a member from source set to destination set
+func execSMove(db *DB, args [][]byte) redis.Reply {
+	src := string(args[0])
+	dest := string(args[1])
+	member := string(args[2])
+
+	srcSet, errReply := db.getAsSet(src)
+	if errReply != nil {
+		return errReply
+	}
+	// 先检查dest的类型，避免从src删除之后无法加入dest
+	if _, errReply = db.getAsSet(dest); errReply != nil {
+		return errReply
+	}
+	if srcSet == nil || !srcSet.Has(member) {
+		return protocol.MakeIntReply(0)
+	}
+	srcSet.Remove(member)
+	if srcSet.Len() == 0 {
+		db.Remove(src)
+	}
+	destSet, _, _ := db.getOrInitSet(dest)
+	destSet.Add(member)
+	return protocol.MakeIntReply(1)
+}
+
+func prepareSMove(args [][]byte) ([]string, []string) {
+	return []string{string(args[0]), string(args[1])}, nil
+}
+
+func undoSMove(db *DB, args [][]byte) []CmdLine {
+	member := string(args[2])
+	undoCmdLines := rollbackSetMembers(db, string(args[0]), member)
+	return append(undoCmdLines, rollbackSetMembers(db, string(args[1]), member)...)
+}
+
 // execSPop removes one or more random members from set
 func execSPop(db *DB, args [][]byte) redis.Reply {
 	if len(args) != 1 && len(args) != 2 {
@@ -161,7 +197,7 @@ func execSMembers(db *DB, args [][]byte) redis.Reply {
 		return errReply
 	}
 	if set == nil {
-		return &protocol.EmptyMultiBulkReply{}
+		return protocol.MakeSetReply(nil)
 	}
 
 	arr := make([][]byte, set.Len())
@@ -171,7 +207,7 @@ func execSMembers(db *DB, args [][]byte) redis.Reply {
 		i++
 		return true
 	})
-	return protocol.MakeMultiBulkReply(arr)
+	return protocol.MakeSetReply(arr)
 }
 
 // execSInter intersect multiple sets
@@ -188,7 +224,7 @@ func execSInter(db *DB, args [][]byte) redis.Reply {
 			return errReply
 		}
 		if set == nil {
-			return &protocol.EmptyMultiBulkReply{}
+			return protocol.MakeSetReply(nil)
 		}
 
 		if result == nil {
@@ -198,7 +234,7 @@ func execSInter(db *DB, args [][]byte) redis.Reply {
 			result = result.Intersect(set)
 			if result.Len() == 0 {
 				// early termination
-				return &protocol.EmptyMultiBulkReply{}
+				return protocol.MakeSetReply(nil)
 			}
 		}
 	}
@@ -210,7 +246,7 @@ func execSInter(db *DB, args [][]byte) redis.Reply {
 		i++
 		return true
 	})
-	return protocol.MakeMultiBulkReply(arr)
+	return protocol.MakeSetReply(arr)
 }
 
 // execSInterStore intersects multiple sets and store the result in a key
@@ -280,7 +316,7 @@ func execSUnion(db *DB, args [][]byte) redis.Reply {
 
 	if result == nil {
 		// all keys are empty set
-		return &protocol.EmptyMultiBulkReply{}
+		return protocol.MakeSetReply(nil)
 	}
 	arr := make([][]byte, result.Len())
 	i := 0
@@ -289,7 +325,7 @@ func execSUnion(db *DB, args [][]byte) redis.Reply {
 		i++
 		return true
 	})
-	return protocol.MakeMultiBulkReply(arr)
+	return protocol.MakeSetReply(arr)
 }
 
 // execSUnionStore adds multiple sets and store the result in a key
@@ -348,7 +384,7 @@ func execSDiff(db *DB, args [][]byte) redis.Reply {
 		if set == nil {
 			if i == 0 {
 				// early termination
-				return &protocol.EmptyMultiBulkReply{}
+				return protocol.MakeSetReply(nil)
 			}
 			continue
 		}
@@ -359,14 +395,14 @@ func execSDiff(db *DB, args [][]byte) redis.Reply {
 			result = result.Diff(set)
 			if result.Len() == 0 {
 				// early termination
-				return &protocol.EmptyMultiBulkReply{}
+				return protocol.MakeSetReply(nil)
 			}
 		}
 	}
 
 	if result == nil {
 		// all keys are nil
-		return &protocol.EmptyMultiBulkReply{}
+		return protocol.MakeSetReply(nil)
 	}
 	arr := make([][]byte, result.Len())
 	i := 0
@@ -375,7 +411,7 @@ func execSDiff(db *DB, args [][]byte) redis.Reply {
 		i++
 		return true
 	})
-	return protocol.MakeMultiBulkReply(arr)
+	return protocol.MakeSetReply(arr)
 }
 
 // execSDiffStore subtracts multiple sets and store the result in a key
@@ -474,6 +510,7 @@ func init() {
 	RegisterCommand("SIsMember", execSIsMember, readFirstKey, nil, 3)
 	RegisterCommand("SRem", execSRem, writeFirstKey, undoSetChange, -3)
 	RegisterCommand("SPop", execSPop, writeFirstKey, undoSetChange, -2)
+	RegisterCommand("SMove", execSMove, prepareSMove, undoSMove, 4)
 	RegisterCommand("SCard", execSCard, readFirstKey, nil, 2)
 	RegisterCommand("SMembers", execSMembers, readFirstKey, nil, 2)
 	RegisterCommand("SInter", execSInter, prepareSetCalculate, nil, -2)
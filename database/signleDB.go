@@ -1,12 +1,14 @@
 package database
 
 import (
+	"fmt"
 	"gedis/datastruct/dict"
 	"gedis/datastruct/lock"
 	"gedis/interface/database"
 	"gedis/interface/redis"
 	"gedis/lib/logger"
 	"gedis/lib/timewheel"
+	"gedis/lib/utils"
 	"gedis/redis/protocol"
 	"strings"
 	"sync"
@@ -33,6 +35,15 @@ type DB struct {
 	locker *lock.Locks
 	// 停止所有的数据更新
 	stopWorld sync.WaitGroup
+	// 将执行成功的写命令追加到aof
+	addAof func(CmdLine)
+	// 将执行成功的写命令写入复制积压缓冲区，发送给从节点
+	addBacklog func(CmdLine)
+	// 累加自上次保存rdb以来的修改次数
+	addDirty func(int)
+	// aof重写等场景中临时创建的DB只在ttlMap中记录过期时间，不注册也不取消过期的定时任务
+	// 定时任务以key区分，否则会覆盖正在运行的DB中同名key的任务，并且使临时的数据无法被回收
+	noExpireTask bool
 }
 
 // MakeDB 创建一个DB
@@ -42,6 +53,9 @@ func MakeDB() *DB {
 		ttlMap:     dict.MakeConcurrent(ttlDicSize),
 		versionMap: dict.MakeConcurrent(dataDicSize),
 		locker:     lock.Make(lockerSize),
+		addAof:     func(line CmdLine) {},
+		addBacklog: func(line CmdLine) {},
+		addDirty:   func(n int) {},
 	}
 }
 
@@ -51,7 +65,11 @@ func makeBasicDB() *DB {
 		ttlMap:     dict.MakeSimple(),
 		versionMap: dict.MakeSimple(),
 		// 单机模式下，locker不需要锁住，所以使用最小的lockerSize
-		locker: lock.Make(1),
+		locker:       lock.Make(1),
+		addAof:       func(line CmdLine) {},
+		addBacklog:   func(line CmdLine) {},
+		addDirty:     func(n int) {},
+		noExpireTask: true,
 	}
 }
 
@@ -73,7 +91,7 @@ func (db *DB) Exec(c redis.Connection, cmdLine [][]byte) redis.Reply {
 		}
 		return execMulti(db, c)
 	} else if cmdName == "watch" {
-		if validateArity(-2, cmdLine) {
+		if !validateArity(-2, cmdLine) {
 			return protocol.MakeArgNumErrReply(cmdName)
 		}
 		return Watch(db, c, cmdLine[1:])
@@ -84,7 +102,10 @@ func (db *DB) Exec(c redis.Connection, cmdLine [][]byte) redis.Reply {
 		if c.InMultiState() {
 			return protocol.MakeErrReply("ERR command 'FlushDB' cannot be used in MULTI")
 		}
-		return execFlushDB(db, cmdLine[1:])
+		db.addDirty(db.data.Len())
+		result := execFlushDB(db, cmdLine[1:])
+		db.propagate(cmdLine)
+		return result
 	}
 	// 事务状态时候，暂时入队
 	if c != nil && c.InMultiState() {
@@ -111,7 +132,21 @@ func (db *DB) execNormalCommand(cmdLine [][]byte) redis.Reply {
 	// 为写keys刷新version
 	defer db.RWUnLocks(write, read)
 
-	return cmd.executor(db, cmdLine[1:])
+	result := cmd.executor(db, cmdLine[1:])
+	// 持有锁的情况下写入aof，保证同一个key的命令顺序与执行顺序一致
+	if len(write) > 0 && !protocol.IsErrorReply(result) {
+		db.addDirty(len(write))
+		for _, line := range toAofCmdLines(db, cmdLine, result) {
+			db.propagate(line)
+		}
+	}
+	return result
+}
+
+// propagate 将执行成功的写命令写入aof以及复制积压缓冲区
+func (db *DB) propagate(cmdLine CmdLine) {
+	db.addAof(cmdLine)
+	db.addBacklog(cmdLine)
 }
 
 // validateArity 表示检测一个命令的所需要参数（包括命令本身，例如lpop key 的参数是2），arity为正代表参数固定，arity代表参数是至少-arity的意思
@@ -143,6 +178,10 @@ func (db *DB) GetUndoLogs(cmdLine [][]byte) []CmdLine {
 		return nil
 	}
 	undo := cmd.undo
+	// 只读命令没有undo函数
+	if undo == nil {
+		return nil
+	}
 	return undo(db, cmdLine[1:])
 }
 
@@ -181,7 +220,10 @@ func (db *DB) Remove(key string) {
 	db.stopWorld.Wait()
 	db.data.Remove(key)
 	db.ttlMap.Remove(key)
-	taskKey := genExpireTask(key)
+	if db.noExpireTask {
+		return
+	}
+	taskKey := db.genExpireTask(key)
 	// 取消轮训
 	timewheel.Cancel(taskKey)
 }
@@ -205,8 +247,7 @@ func (db *DB) Flush() {
 	defer db.stopWorld.Done()
 	db.data.Clear()
 	db.ttlMap.Clear()
-	// 防止部分
-	db.locker = lock.Make(lockerSize)
+	// 不能替换locker，其他协程以及分布式事务可能正持有其中的锁，替换之后会解锁新的locker
 }
 
 /*---加锁操作---*/
@@ -219,14 +260,23 @@ func (db *DB) RWUnLocks(writeKeys []string, readKeys []string) {
 	db.locker.RWUnLocks(writeKeys, readKeys)
 }
 
-func genExpireTask(key string) string {
-	return "expire:" + key
+// genExpireTask 时间轮中的任务是全局的，不同的数据库中可能有同名的key，任务key需要包含数据库
+func (db *DB) genExpireTask(key string) string {
+	return fmt.Sprintf("expire:%p:%s", db, key)
 }
 
 func (db *DB) Expire(key string, expireTime time.Time) {
 	db.stopWorld.Wait()
 	db.ttlMap.Put(key, expireTime)
-	taskKey := genExpireTask(key)
+	if db.noExpireTask {
+		return
+	}
+	db.scheduleExpire(key, expireTime)
+}
+
+// scheduleExpire 在时间轮上添加key的过期任务
+func (db *DB) scheduleExpire(key string, expireTime time.Time) {
+	taskKey := db.genExpireTask(key)
 	timewheel.At(expireTime, taskKey, func() {
 		keys := []string{key}
 		db.RWLocks(keys, nil)
@@ -241,6 +291,11 @@ func (db *DB) Expire(key string, expireTime time.Time) {
 		expired := time.Now().After(expireTime)
 		if expired {
 			db.Remove(key)
+			// 以del命令的形式传播过期，保证从节点以及aof与主节点一致
+			db.propagate(utils.ToCmdLine("DEL", key))
+		} else {
+			// 时间轮的精度为秒，任务可能在过期时间之前执行，重新添加任务
+			db.scheduleExpire(key, expireTime)
 		}
 	})
 }
@@ -259,11 +314,25 @@ func (db *DB) IsExpired(key string) bool {
 	return expired
 }
 
+// cancelExpireTasks 取消所有的过期任务，关闭之后时间轮不再持有db
+func (db *DB) cancelExpireTasks() {
+	if db.noExpireTask {
+		return
+	}
+	db.ttlMap.ForEach(func(key string, val interface{}) bool {
+		timewheel.Cancel(db.genExpireTask(key))
+		return true
+	})
+}
+
 // Persist 删除一个键的过期时间
 func (db *DB) Persist(key string) {
 	db.stopWorld.Wait()
 	db.ttlMap.Remove(key)
-	taskKey := genExpireTask(key)
+	if db.noExpireTask {
+		return
+	}
+	taskKey := db.genExpireTask(key)
 	timewheel.Cancel(taskKey)
 }
 
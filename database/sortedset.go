@@ -102,8 +102,7 @@ func execZScore(db *DB, args [][]byte) redis.Reply {
 	if !exists {
 		return &protocol.NullBulkReply{}
 	}
-	value := strconv.FormatFloat(element.Score, 'f', -1, 64)
-	return protocol.MakeBulkReply([]byte(value))
+	return protocol.MakeDoubleReply(element.Score)
 }
 
 // execZRank gets index of a member in sortedset, ascending order, start from 0
@@ -252,16 +251,7 @@ func range0(db *DB, key string, start int64, stop int64, withScores bool, desc b
 	// assert: start in [0, size - 1], stop in [start, size]
 	slice := sortedSet.Range(start, stop, desc)
 	if withScores {
-		result := make([][]byte, len(slice)*2)
-		i := 0
-		for _, element := range slice {
-			result[i] = []byte(element.Member)
-			i++
-			scoreStr := strconv.FormatFloat(element.Score, 'f', -1, 64)
-			result[i] = []byte(scoreStr)
-			i++
-		}
-		return protocol.MakeMultiBulkReply(result)
+		return makeScoredMembersReply(slice)
 	}
 	result := make([][]byte, len(slice))
 	i := 0
@@ -298,6 +288,17 @@ func execZCount(db *DB, args [][]byte) redis.Reply {
 	return protocol.MakeIntReply(sortedSet.Count(min, max))
 }
 
+// makeScoredMembersReply WITHSCORES的结果，RESP3中每个成员与分数组成一个数组
+func makeScoredMembersReply(slice []*SortedSet.Element) redis.Reply {
+	members := make([][]byte, len(slice))
+	scores := make([]float64, len(slice))
+	for i, element := range slice {
+		members[i] = []byte(element.Member)
+		scores[i] = element.Score
+	}
+	return protocol.MakeScoredMembersReply(members, scores)
+}
+
 /*
  * param limit: limit < 0 means no limit
  */
@@ -313,16 +314,7 @@ func rangeByScore0(db *DB, key string, min *SortedSet.ScoreBorder, max *SortedSe
 
 	slice := sortedSet.RangeByScore(min, max, offset, limit, desc)
 	if withScores {
-		result := make([][]byte, len(slice)*2)
-		i := 0
-		for _, element := range slice {
-			result[i] = []byte(element.Member)
-			i++
-			scoreStr := strconv.FormatFloat(element.Score, 'f', -1, 64)
-			result[i] = []byte(scoreStr)
-			i++
-		}
-		return protocol.MakeMultiBulkReply(result)
+		return makeScoredMembersReply(slice)
 	}
 	result := make([][]byte, len(slice))
 	i := 0
@@ -562,15 +554,13 @@ func execZIncrBy(db *DB, args [][]byte) redis.Reply {
 		return errReply
 	}
 
-	element, exists := sortedSet.Get(field)
-	if !exists {
-		sortedSet.Add(field, delta)
-		return protocol.MakeBulkReply(args[1])
+	score := delta
+	if element, exists := sortedSet.Get(field); exists {
+		score += element.Score
 	}
-	score := element.Score + delta
 	sortedSet.Add(field, score)
-	bytes := []byte(strconv.FormatFloat(score, 'f', -1, 64))
-	return protocol.MakeBulkReply(bytes)
+	// RESP3中为浮点数
+	return protocol.MakeDoubleReply(score)
 }
 
 func undoZIncr(db *DB, args [][]byte) []CmdLine {
@@ -1,9 +1,12 @@
 package database
 
 import (
+	"bytes"
 	"gedis/config"
 	"gedis/interface/redis"
 	"gedis/redis/protocol"
+	"strconv"
+	"strings"
 )
 
 // Ping the server
@@ -33,6 +36,78 @@ func Auth(c redis.Connection, args [][]byte) redis.Reply {
 	return &protocol.OkReply{}
 }
 
+// Hello 协商协议版本，同时可以鉴权以及设置客户端名称，返回服务端信息
+// HELLO [protover [AUTH username password] [SETNAME clientname]]
+func Hello(mdb *MultiDB, c redis.Connection, args [][]byte) redis.Reply {
+	version := c.GetProtocol()
+	if len(args) > 0 {
+		v, err := strconv.Atoi(string(args[0]))
+		if err != nil {
+			return protocol.MakeErrReply("ERR Protocol version is not an integer or out of range")
+		}
+		if v != protocol.RESP2 && v != protocol.RESP3 {
+			return protocol.MakeErrReply("NOPROTO unsupported protocol version")
+		}
+		version = v
+	}
+	var name []byte
+	for i := 1; i < len(args); i++ {
+		switch strings.ToLower(string(args[i])) {
+		case "auth":
+			if i+2 >= len(args) {
+				return protocol.MakeErrReply("ERR Syntax error in HELLO option 'auth'")
+			}
+			// 只有default用户，密码为requirepass
+			username, password := string(args[i+1]), string(args[i+2])
+			if config.Properties.RequirePass == "" {
+				return protocol.MakeErrReply("ERR Client sent AUTH, but no password is set")
+			}
+			if username != "default" || password != config.Properties.RequirePass {
+				return protocol.MakeErrReply("WRONGPASS invalid username-password pair or user is disabled.")
+			}
+			c.SetPassword(password)
+			i += 2
+		case "setname":
+			if i+1 >= len(args) {
+				return protocol.MakeErrReply("ERR Syntax error in HELLO option 'setname'")
+			}
+			name = args[i+1]
+			if bytes.ContainsAny(name, " \n") {
+				return protocol.MakeErrReply("ERR Client names cannot contain spaces, newlines or special characters.")
+			}
+			i++
+		default:
+			return protocol.MakeErrReply("ERR Syntax error in HELLO option '" + string(args[i]) + "'")
+		}
+	}
+	if !isAuthenticated(c) {
+		return protocol.MakeErrReply("NOAUTH HELLO must be called with the client already authenticated, " +
+			"otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and " +
+			"select the RESP protocol version at the same time")
+	}
+	if name != nil {
+		c.SetName(string(name))
+	}
+	c.SetProtocol(version)
+
+	mode := "standalone"
+	if mdb.cluster != nil {
+		mode = "cluster"
+	}
+	role := "master"
+	if mdb.isSlave() {
+		role = "replica"
+	}
+	return protocol.MakeMapReply([]redis.Reply{
+		protocol.MakeBulkReply([]byte("server")), protocol.MakeBulkReply([]byte("redis")),
+		protocol.MakeBulkReply([]byte("version")), protocol.MakeBulkReply([]byte(redisVersion)),
+		protocol.MakeBulkReply([]byte("proto")), protocol.MakeIntReply(int64(version)),
+		protocol.MakeBulkReply([]byte("mode")), protocol.MakeBulkReply([]byte(mode)),
+		protocol.MakeBulkReply([]byte("role")), protocol.MakeBulkReply([]byte(role)),
+		protocol.MakeBulkReply([]byte("modules")), protocol.MakeEmptyMultiBulkReply(),
+	})
+}
+
 func isAuthenticated(c redis.Connection) bool {
 	if config.Properties.RequirePass == "" {
 		return true
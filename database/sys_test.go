@@ -0,0 +1,99 @@
+package database
+
+import (
+	"gedis/config"
+	"gedis/lib/utils"
+	"gedis/redis/connection"
+	"gedis/redis/protocol"
+	"strconv"
+	"testing"
+)
+
+// execEncoded 执行命令并按照连接协商的协议版本编码回复
+func execEncoded(mdb *MultiDB, c *connection.FakeConn, args ...string) string {
+	return string(protocol.Encode(mdb.Exec(c, utils.ToCmdLine(args...)), c.GetProtocol()))
+}
+
+func TestHello(t *testing.T) {
+	mdb := makeTestServer(t)
+	c := connection.NewFakeConn()
+	bulk := func(s string) string {
+		return "$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n"
+	}
+	serverInfo := func(prefix string, proto string) string {
+		return prefix + bulk("server") + bulk("redis") + bulk("version") + bulk(redisVersion) +
+			bulk("proto") + ":" + proto + "\r\n" + bulk("mode") + bulk("standalone") +
+			bulk("role") + bulk("master") + bulk("modules") + "*0\r\n"
+	}
+
+	// 不带参数时保持当前的版本，RESP2中服务端信息为数组
+	assertReply(t, execEncoded(mdb, c, "HELLO"), serverInfo("*12\r\n", "2"))
+	assertReply(t, execEncoded(mdb, c, "HELLO", "x"), "-ERR Protocol version is not an integer or out of range\r\n")
+	assertReply(t, execEncoded(mdb, c, "HELLO", "4"), "-NOPROTO unsupported protocol version\r\n")
+	assertReply(t, execEncoded(mdb, c, "HELLO", "3", "foo"), "-ERR Syntax error in HELLO option 'foo'\r\n")
+	if c.GetProtocol() != protocol.RESP2 {
+		t.Fatalf("failed HELLO changed protocol to %d", c.GetProtocol())
+	}
+	assertReply(t, execEncoded(mdb, c, "HELLO", "3", "SETNAME", "cli"), serverInfo("%6\r\n", "3"))
+	if c.GetName() != "cli" {
+		t.Errorf("expect name cli actually %q", c.GetName())
+	}
+	assertReply(t, execEncoded(mdb, c, "HELLO", "3", "SETNAME", "a b"), "-ERR Client names cannot contain spaces, newlines or special characters.\r\n")
+	assertReply(t, execEncoded(mdb, c, "HELLO", "2"), serverInfo("*12\r\n", "2"))
+}
+
+func TestHelloAuth(t *testing.T) {
+	mdb := makeTestServer(t)
+	config.Properties.RequirePass = "secret"
+	t.Cleanup(func() {
+		config.Properties.RequirePass = ""
+	})
+	c := connection.NewFakeConn()
+
+	assertReply(t, execEncoded(mdb, c, "GET", "k"), "-NOAUTH Authentication required\r\n")
+	reply := execEncoded(mdb, c, "HELLO", "3")
+	if reply[:7] != "-NOAUTH" || c.GetProtocol() != protocol.RESP2 {
+		t.Errorf("expect NOAUTH actually %q with protocol %d", reply, c.GetProtocol())
+	}
+	assertReply(t, execEncoded(mdb, c, "HELLO", "3", "AUTH", "default", "wrong"), "-WRONGPASS invalid username-password pair or user is disabled.\r\n")
+	assertReply(t, execEncoded(mdb, c, "HELLO", "3", "AUTH", "admin", "secret"), "-WRONGPASS invalid username-password pair or user is disabled.\r\n")
+	assertReply(t, execEncoded(mdb, c, "HELLO", "3", "AUTH", "default"), "-ERR Syntax error in HELLO option 'auth'\r\n")
+	// 鉴权与协商版本同时完成
+	if reply := execEncoded(mdb, c, "HELLO", "3", "AUTH", "default", "secret"); reply[0] != '%' {
+		t.Errorf("expect map reply actually %q", reply)
+	}
+	assertReply(t, execEncoded(mdb, c, "GET", "k"), "_\r\n")
+}
+
+func TestResp3Replies(t *testing.T) {
+	mdb := makeTestServer(t)
+	c := connection.NewFakeConn()
+	assertReply(t, execEncoded(mdb, c, "HELLO", "3")[:3], "%6\r")
+
+	assertReply(t, execEncoded(mdb, c, "HSET", "h", "f", "v"), ":1\r\n")
+	assertReply(t, execEncoded(mdb, c, "HGETALL", "h"), "%1\r\n$1\r\nf\r\n$1\r\nv\r\n")
+	assertReply(t, execEncoded(mdb, c, "HGETALL", "none"), "%0\r\n")
+	assertReply(t, execEncoded(mdb, c, "SADD", "s", "m"), ":1\r\n")
+	assertReply(t, execEncoded(mdb, c, "SMEMBERS", "s"), "~1\r\n$1\r\nm\r\n")
+	assertReply(t, execEncoded(mdb, c, "ZADD", "z", "1.5", "a"), ":1\r\n")
+	assertReply(t, execEncoded(mdb, c, "ZSCORE", "z", "a"), ",1.5\r\n")
+	assertReply(t, execEncoded(mdb, c, "ZSCORE", "z", "none"), "_\r\n")
+	assertReply(t, execEncoded(mdb, c, "ZINCRBY", "z", "2", "a"), ",3.5\r\n")
+	assertReply(t, execEncoded(mdb, c, "ZINCRBY", "z", "1.50", "b"), ",1.5\r\n")
+	assertReply(t, execEncoded(mdb, c, "ZRANGE", "z", "0", "-1", "WITHSCORES"), "*2\r\n*2\r\n$1\r\nb\r\n,1.5\r\n*2\r\n$1\r\na\r\n,3.5\r\n")
+	assertReply(t, execEncoded(mdb, c, "GET", "none"), "_\r\n")
+	if reply := execEncoded(mdb, c, "INFO", "server"); reply[0] != '=' || reply[len(reply)-2:] != "\r\n" {
+		t.Errorf("expect verbatim string actually %q", reply)
+	}
+
+	// RESP2客户端收到的仍然是数组与字符串
+	c2 := connection.NewFakeConn()
+	assertReply(t, execEncoded(mdb, c2, "HGETALL", "h"), "*2\r\n$1\r\nf\r\n$1\r\nv\r\n")
+	assertReply(t, execEncoded(mdb, c2, "ZINCRBY", "z", "1", "b"), "$3\r\n2.5\r\n")
+	assertReply(t, execEncoded(mdb, c2, "ZSCORE", "z", "b"), "$3\r\n2.5\r\n")
+	// 两种协议中无穷大以及较大的分数的格式与redis一致
+	assertReply(t, execEncoded(mdb, c2, "ZINCRBY", "z", "+inf", "c"), "$3\r\ninf\r\n")
+	assertReply(t, execEncoded(mdb, c, "ZSCORE", "z", "c"), ",inf\r\n")
+	assertReply(t, execEncoded(mdb, c2, "ZINCRBY", "z", "1e20", "d"), "$5\r\n1e+20\r\n")
+	assertReply(t, execEncoded(mdb, c2, "ZRANGE", "z", "-1", "-1", "WITHSCORES"), "*2\r\n$1\r\nc\r\n$3\r\ninf\r\n")
+}
@@ -107,18 +107,30 @@ func (db *DB) ExecMulti(watching map[string]uint32, cmdLines []CmdLine) redis.Re
 	//  一个操作的undo可能需要多次
 	undoQueue := make([][]CmdLine, 0, len(cmdLines))
 	for _, cmdLine := range cmdLines {
+		// undo日志需要在命令执行之前计算，记录的是修改之前的值
+		undoLogs := db.GetUndoLogs(cmdLine)
 		result := db.execWithLock(cmdLine)
 		if protocol.IsErrorReply(result) {
 			aborted = true
 			break
 		}
-		undoQueue = append(undoQueue, db.GetUndoLogs(cmdLine))
+		undoQueue = append(undoQueue, undoLogs)
 		resultQueue = append(resultQueue, result)
 	}
 	// 成功执行
 	if !aborted {
 		// 太详细了
 		db.AddVersion(writeKeys...)
+		db.addDirty(len(writeKeys))
+		// 事务整体成功之后才写入aof
+		for i, cmdLine := range cmdLines {
+			if !isWriteCommand(cmdLine) {
+				continue
+			}
+			for _, line := range toAofCmdLines(db, cmdLine, resultQueue[i]) {
+				db.propagate(line)
+			}
+		}
 		return protocol.MakeMultiRawReply(resultQueue)
 	}
 	// 倒序执行undo
@@ -0,0 +1,47 @@
+package database
+
+import (
+	"gedis/lib/utils"
+	"gedis/redis/connection"
+	"reflect"
+	"testing"
+)
+
+func TestWatchArity(t *testing.T) {
+	mdb := makeTestServer(t)
+	c := connection.NewFakeConn()
+	assertReply(t, execString(mdb, c, "WATCH"), "-ERR wrong number of arguments for 'watch' command\r\n")
+	assertReply(t, execString(mdb, c, "WATCH", "a", "b"), "+OK\r\n")
+	assertReply(t, execString(mdb, c, "SET", "a", "1"), "+OK\r\n")
+	assertReply(t, execString(mdb, c, "MULTI"), "+OK\r\n")
+	assertReply(t, execString(mdb, c, "SET", "b", "1"), "+QUEUED\r\n")
+	// watch的key被修改，事务不执行
+	assertReply(t, execString(mdb, c, "EXEC"), "*0\r\n")
+	assertReply(t, execString(mdb, c, "EXISTS", "b"), ":0\r\n")
+}
+
+func TestExecMultiRollback(t *testing.T) {
+	mdb := makeTestServer(t)
+	c := connection.NewFakeConn()
+	assertReply(t, execString(mdb, c, "SET", "a", "old"), "+OK\r\n")
+	assertReply(t, execString(mdb, c, "MULTI"), "+OK\r\n")
+	assertReply(t, execString(mdb, c, "SET", "a", "new"), "+QUEUED\r\n")
+	assertReply(t, execString(mdb, c, "RPUSH", "list", "x"), "+QUEUED\r\n")
+	assertReply(t, execString(mdb, c, "INCR", "a"), "+QUEUED\r\n")
+	assertReply(t, execString(mdb, c, "EXEC"), "-EXECABORT Transaction discarded because of previous errors.\r\n")
+	// undo日志在命令执行之前生成，回滚到事务之前的值
+	assertReply(t, execString(mdb, c, "GET", "a"), "$3\r\nold\r\n")
+	assertReply(t, execString(mdb, c, "EXISTS", "list"), ":0\r\n")
+}
+
+func TestRenameLocksBothKeys(t *testing.T) {
+	// RENAME会删除src，src与dest都需要加写锁
+	write, read, ok := GetWriteReadKeys(utils.ToCmdLine("RENAME", "src", "dest"))
+	if !ok || !reflect.DeepEqual(write, []string{"src", "dest"}) || len(read) != 0 {
+		t.Errorf("expect write lock on src and dest actually write %v read %v", write, read)
+	}
+	write, read, ok = GetWriteReadKeys(utils.ToCmdLine("RENAMENX", "src", "dest"))
+	if !ok || !reflect.DeepEqual(write, []string{"src", "dest"}) || len(read) != 0 {
+		t.Errorf("expect write lock on src and dest actually write %v read %v", write, read)
+	}
+}
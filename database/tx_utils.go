@@ -1,6 +1,7 @@
 package database
 
 import (
+	"gedis/aof"
 	"gedis/lib/utils"
 	"strconv"
 )
@@ -44,16 +45,19 @@ func rollbackFirstKey(db *DB, args [][]byte) []CmdLine {
 func rollbackGivenKeys(db *DB, keys ...string) []CmdLine {
 	var undoCmdLines [][][]byte
 	for _, key := range keys {
-		_, ok := db.GetEntity(key)
+		entity, ok := db.GetEntity(key)
 		if !ok {
 			undoCmdLines = append(undoCmdLines,
 				utils.ToCmdLine("DEL", key),
 			)
-		} else {
-			undoCmdLines = append(undoCmdLines,
-				utils.ToCmdLine("DEL", key), // clean existed first
-				toTTLCmd(db, key).Args,
-			)
+			continue
+		}
+		undoCmdLines = append(undoCmdLines,
+			utils.ToCmdLine("DEL", key), // clean existed first
+		)
+		// 重建key原来的值以及过期时间
+		if cmd := aof.EntityToCmd(key, entity); cmd != nil {
+			undoCmdLines = append(undoCmdLines, cmd.Args, toTTLCmd(db, key).Args)
 		}
 	}
 	return undoCmdLines
@@ -231,7 +231,7 @@ func (l *LinkedList) ForEach(consumer func(int, interface{}) bool) {
 	l.isNil()
 	n := l.first
 	for i := 0; n != nil; i++ {
-		ok := consumer(i, n)
+		ok := consumer(i, n.val)
 		if !ok {
 			break
 		}
@@ -2,6 +2,8 @@ package database
 
 import (
 	"gedis/interface/redis"
+	"github.com/hdt3213/rdb/core"
+	"time"
 )
 
 // CmdLine 是给[][]byte起的alias，因为后面过程中会将[][]byte多次当做命令发送
@@ -9,6 +11,28 @@ type CmdLine = [][]byte
 
 type DB interface {
 	Exec(client redis.Connection, cmdline CmdLine) redis.Reply
+	// AfterClientClose 客户端断开连接之后调用，清理连接相关的状态
+	AfterClientClose(c redis.Connection)
+	// Close 关闭数据库，释放aof文件等资源
+	Close()
+}
+
+// DBEngine 可以遍历内部数据的数据库，aof重写等持久化操作需要使用
+type DBEngine interface {
+	DB
+	ForEach(dbIndex int, cb func(key string, data *DataEntity, expiration *time.Time) bool)
+	// GetDBSize 返回数据库中key的数量以及设置了过期时间的key的数量
+	GetDBSize(dbIndex int) (int, int)
+	// LoadRDB 从rdb解码器中恢复数据
+	LoadRDB(dec *core.Decoder) error
+
+	// 以下方法供集群的分布式事务使用，调用方先为key加锁，再执行命令或者计算undo日志
+	RWLocks(dbIndex int, writeKeys []string, readKeys []string)
+	RWUnLocks(dbIndex int, writeKeys []string, readKeys []string)
+	GetUndoLogs(dbIndex int, cmdLines []CmdLine) []CmdLine
+	ExecWithLock(c redis.Connection, cmdLine CmdLine) redis.Reply
+	GetEntity(dbIndex int, key string) (*DataEntity, bool)
+	GetExpiration(dbIndex int, key string) *time.Time
 }
 
 type DataEntity struct {
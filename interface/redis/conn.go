@@ -4,6 +4,9 @@ package redis
 type Connection interface {
 	// 鉴权和订阅中使用
 	Write([]byte) error
+	Close() error
+	// 连接关闭之后返回的通道被关闭，阻塞的命令通过它得知客户端已经断开
+	Closed() <-chan struct{}
 	SetPassword(string)
 	GetPassword() string
 
@@ -18,4 +21,22 @@ type Connection interface {
 	// 选择数据库和设置数据
 	GetDBIndex() int
 	SelectDB(int)
+
+	// 主从复制
+	IsMaster() bool
+	SetWriteOffset(int64)
+	GetWriteOffset() int64
+
+	// 集群模式，ASKING之后的下一条命令允许访问正在迁入的slot
+	SetAsking(bool)
+	IsAsking() bool
+	// 集群模式，其他节点的连接握手之后被标记，只有这类连接可以发送Prepare等事务命令
+	SetPeer()
+	IsPeer() bool
+
+	// HELLO协商的协议版本以及客户端名称
+	GetProtocol() int
+	SetProtocol(int)
+	GetName() string
+	SetName(string)
 }
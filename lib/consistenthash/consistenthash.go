@@ -0,0 +1,83 @@
+package consistenthash
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// HashFunc 将数据映射到哈希环上
+type HashFunc func(data []byte) uint32
+
+// Map 一致性哈希环，每个节点在环上有replicas个虚拟节点
+type Map struct {
+	hashFunc HashFunc
+	replicas int
+	// 排好序的虚拟节点哈希值
+	keys []int
+	// 虚拟节点哈希值->节点
+	hashMap map[int]string
+}
+
+// New 创建一致性哈希环，fn为nil时使用crc32
+func New(replicas int, fn HashFunc) *Map {
+	m := &Map{
+		replicas: replicas,
+		hashFunc: fn,
+		hashMap:  make(map[int]string),
+	}
+	if m.hashFunc == nil {
+		m.hashFunc = crc32.ChecksumIEEE
+	}
+	return m
+}
+
+// IsEmpty 环上是否没有节点
+func (m *Map) IsEmpty() bool {
+	return len(m.keys) == 0
+}
+
+// AddNode 将节点加入哈希环
+func (m *Map) AddNode(nodes ...string) {
+	for _, node := range nodes {
+		if node == "" {
+			continue
+		}
+		for i := 0; i < m.replicas; i++ {
+			hash := int(m.hashFunc([]byte(strconv.Itoa(i) + node)))
+			m.keys = append(m.keys, hash)
+			m.hashMap[hash] = node
+		}
+	}
+	sort.Ints(m.keys)
+}
+
+// getPartitionKey 支持hash tag，key中包含{tag}时只使用tag计算哈希，使相关的key分布在同一个节点上
+func getPartitionKey(key string) string {
+	beg := strings.Index(key, "{")
+	if beg == -1 {
+		return key
+	}
+	end := strings.Index(key[beg+1:], "}")
+	if end <= 0 {
+		return key
+	}
+	return key[beg+1 : beg+1+end]
+}
+
+// PickNode 返回key所属的节点，即环上顺时针方向的第一个虚拟节点
+func (m *Map) PickNode(key string) string {
+	if m.IsEmpty() {
+		return ""
+	}
+	partitionKey := getPartitionKey(key)
+	hash := int(m.hashFunc([]byte(partitionKey)))
+	idx := sort.Search(len(m.keys), func(i int) bool {
+		return m.keys[i] >= hash
+	})
+	if idx == len(m.keys) {
+		idx = 0
+	}
+	return m.hashMap[m.keys[idx]]
+}
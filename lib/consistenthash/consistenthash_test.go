@@ -0,0 +1,49 @@
+package consistenthash
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestHash(t *testing.T) {
+	m := New(3, func(data []byte) uint32 {
+		// 虚拟节点为 "<i><node>"，节点名为数字时哈希值即为该数字
+		n, _ := strconv.Atoi(string(data))
+		return uint32(n)
+	})
+	if m.PickNode("1") != "" {
+		t.Error("expect empty node on empty ring")
+	}
+	// 虚拟节点: 2 12 22, 4 14 24, 6 16 26
+	m.AddNode("6", "4", "2")
+	cases := map[string]string{
+		"2":  "2",
+		"11": "2",
+		"23": "4",
+		"27": "2",
+	}
+	for key, node := range cases {
+		if actual := m.PickNode(key); actual != node {
+			t.Errorf("key %s: expect %s actually %s", key, node, actual)
+		}
+	}
+	// 加入8之后，27顺时针方向的第一个虚拟节点为28
+	m.AddNode("8")
+	if actual := m.PickNode("27"); actual != "8" {
+		t.Errorf("key 27: expect 8 actually %s", actual)
+	}
+}
+
+func TestHashTag(t *testing.T) {
+	m := New(10, nil)
+	m.AddNode("a", "b", "c", "d")
+	if m.PickNode("{user1000}.following") != m.PickNode("{user1000}.followers") {
+		t.Error("keys with same hash tag should be on the same node")
+	}
+	if getPartitionKey("foo{}{bar}") != "foo{}{bar}" {
+		t.Error("empty hash tag should be ignored")
+	}
+	if getPartitionKey("foo{bar}") != "bar" {
+		t.Error("expect hash tag bar")
+	}
+}
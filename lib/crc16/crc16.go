@@ -0,0 +1,28 @@
+// Package crc16 实现redis cluster使用的CRC16算法(XMODEM)，用于计算key所属的slot
+package crc16
+
+// 多项式0x1021的查找表
+var table [256]uint16
+
+func init() {
+	for i := 0; i < 256; i++ {
+		crc := uint16(i) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+}
+
+// Checksum 返回data的CRC16校验值
+func Checksum(data []byte) uint16 {
+	crc := uint16(0)
+	for _, b := range data {
+		crc = crc<<8 ^ table[byte(crc>>8)^b]
+	}
+	return crc
+}
@@ -0,0 +1,23 @@
+package crc16
+
+import "testing"
+
+func TestChecksum(t *testing.T) {
+	// redis源码crc16.c中给出的测试值
+	if actual := Checksum([]byte("123456789")); actual != 0x31C3 {
+		t.Errorf("expect 0x31C3 actually %#x", actual)
+	}
+	// 与redis CLUSTER KEYSLOT的结果一致
+	cases := map[string]uint16{
+		"":       0,
+		"foo":    12182,
+		"bar":    5061,
+		"hello":  866,
+		"user:1": 10778,
+	}
+	for key, slot := range cases {
+		if actual := Checksum([]byte(key)) % 16384; actual != slot {
+			t.Errorf("key %q: expect slot %d actually %d", key, slot, actual)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package pool
+
+import (
+	"errors"
+	"sync"
+)
+
+var (
+	// ErrClosed 连接池已经关闭
+	ErrClosed = errors.New("pool closed")
+)
+
+// createToken 交给等待的请求，表示其可以自行创建新的对象
+type createToken struct{}
+
+// Config 连接池的配置
+type Config struct {
+	// 最多保留的空闲对象
+	MaxIdle uint
+	// 同时借出的最大对象数量，达到上限之后Get会阻塞等待归还
+	MaxActive uint
+}
+
+// Pool 通用的对象池，用于复用与其他节点之间的连接
+type Pool struct {
+	Config
+
+	factory   func() (interface{}, error)
+	finalizer func(x interface{})
+	idles     chan interface{}
+	// 等待借出对象的请求
+	waitingReqs []chan interface{}
+	activeCount uint
+	mu          sync.Mutex
+	closed      bool
+}
+
+// New 创建对象池，factory用于创建新的对象，finalizer用于销毁对象
+func New(factory func() (interface{}, error), finalizer func(x interface{}), cfg Config) *Pool {
+	return &Pool{
+		Config:    cfg,
+		factory:   factory,
+		finalizer: finalizer,
+		idles:     make(chan interface{}, cfg.MaxIdle),
+	}
+}
+
+// getOnNoIdle 没有空闲对象时创建新的对象，借出的对象达到上限时等待其他对象归还
+// 调用方需要持有mu，函数返回之前会释放mu
+func (pool *Pool) getOnNoIdle() (interface{}, error) {
+	if pool.activeCount >= pool.MaxActive {
+		req := make(chan interface{}, 1)
+		pool.waitingReqs = append(pool.waitingReqs, req)
+		pool.mu.Unlock()
+		x, ok := <-req
+		if !ok {
+			return nil, ErrClosed
+		}
+		if _, create := x.(createToken); !create {
+			return x, nil
+		}
+		// 其他对象被丢弃之后让出的名额
+		return pool.create()
+	}
+	pool.activeCount++
+	pool.mu.Unlock()
+	return pool.create()
+}
+
+// create 创建新的对象，调用方已经占用了activeCount的名额
+func (pool *Pool) create() (interface{}, error) {
+	x, err := pool.factory()
+	if err != nil {
+		// 创建失败时归还名额
+		pool.mu.Lock()
+		pool.releaseSlot()
+		pool.mu.Unlock()
+		return nil, err
+	}
+	return x, nil
+}
+
+// releaseSlot 释放一个借出对象的名额，有等待的请求时将名额转交给它，由其重新创建对象
+// 调用方需要持有mu
+func (pool *Pool) releaseSlot() {
+	if !pool.closed && len(pool.waitingReqs) > 0 {
+		req := pool.waitingReqs[0]
+		copy(pool.waitingReqs, pool.waitingReqs[1:])
+		pool.waitingReqs = pool.waitingReqs[:len(pool.waitingReqs)-1]
+		req <- createToken{}
+		return
+	}
+	pool.activeCount--
+}
+
+// Get 借出一个对象，使用完毕之后需要调用Put归还或者调用Discard丢弃
+func (pool *Pool) Get() (interface{}, error) {
+	pool.mu.Lock()
+	if pool.closed {
+		pool.mu.Unlock()
+		return nil, ErrClosed
+	}
+	select {
+	case item := <-pool.idles:
+		pool.mu.Unlock()
+		return item, nil
+	default:
+		return pool.getOnNoIdle()
+	}
+}
+
+// Put 归还对象，优先交给正在等待的请求，空闲对象过多时直接销毁
+func (pool *Pool) Put(x interface{}) {
+	pool.mu.Lock()
+	if pool.closed {
+		pool.mu.Unlock()
+		pool.finalizer(x)
+		return
+	}
+	if len(pool.waitingReqs) > 0 {
+		req := pool.waitingReqs[0]
+		copy(pool.waitingReqs, pool.waitingReqs[1:])
+		pool.waitingReqs = pool.waitingReqs[:len(pool.waitingReqs)-1]
+		req <- x
+		pool.mu.Unlock()
+		return
+	}
+	select {
+	case pool.idles <- x:
+		pool.mu.Unlock()
+	default:
+		pool.activeCount--
+		pool.mu.Unlock()
+		pool.finalizer(x)
+	}
+}
+
+// Discard 销毁一个借出的已经损坏的对象，例如断开的连接
+func (pool *Pool) Discard(x interface{}) {
+	pool.finalizer(x)
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	pool.releaseSlot()
+}
+
+// Close 关闭对象池并销毁所有空闲对象，借出的对象归还时销毁
+func (pool *Pool) Close() {
+	pool.mu.Lock()
+	if pool.closed {
+		pool.mu.Unlock()
+		return
+	}
+	pool.closed = true
+	close(pool.idles)
+	for _, req := range pool.waitingReqs {
+		close(req)
+	}
+	pool.waitingReqs = nil
+	pool.mu.Unlock()
+
+	for x := range pool.idles {
+		pool.finalizer(x)
+	}
+}
@@ -0,0 +1,89 @@
+package pool
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+type mockConn struct {
+	open bool
+}
+
+func TestPool(t *testing.T) {
+	factory := func() (interface{}, error) {
+		return &mockConn{open: true}, nil
+	}
+	finalizer := func(x interface{}) {
+		x.(*mockConn).open = false
+	}
+	pool := New(factory, finalizer, Config{MaxIdle: 2, MaxActive: 4})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			x, err := pool.Get()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			time.Sleep(time.Millisecond)
+			pool.Put(x)
+		}()
+	}
+	wg.Wait()
+	if pool.activeCount > 4 {
+		t.Errorf("too many active objects: %d", pool.activeCount)
+	}
+	if len(pool.idles) > 2 {
+		t.Errorf("too many idle objects: %d", len(pool.idles))
+	}
+
+	x, _ := pool.Get()
+	pool.Close()
+	if _, err := pool.Get(); err != ErrClosed {
+		t.Error("expect ErrClosed")
+	}
+	pool.Put(x)
+	if x.(*mockConn).open {
+		t.Error("object put back after close should be finalized")
+	}
+}
+
+func TestPoolDiscard(t *testing.T) {
+	fail := false
+	factory := func() (interface{}, error) {
+		if fail {
+			return nil, errors.New("mock error")
+		}
+		return &mockConn{open: true}, nil
+	}
+	pool := New(factory, func(x interface{}) {}, Config{MaxIdle: 1, MaxActive: 1})
+	x, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		// 名额已满，等待归还
+		_, err := pool.Get()
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	fail = true
+	pool.Discard(x)
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("expect factory error")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("waiting request is not woken up")
+	}
+	if pool.activeCount != 0 {
+		t.Errorf("expect no active object, actually %d", pool.activeCount)
+	}
+}
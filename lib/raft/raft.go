@@ -0,0 +1,893 @@
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"gedis/lib/logger"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+raft一致性协议，所有节点的日志按照相同的顺序提交，提交之后由状态机执行：
+1. follower超过选举超时没有收到leader的心跳时成为candidate，任期加一之后请求投票，获得多数票之后成为leader
+2. leader将提议的命令追加到日志并复制给follower，多数节点写入之后提交
+3. 每个节点按顺序将已提交的日志交给状态机执行，提议者在命令执行之后得到结果
+4. 已执行的日志超过阈值时对状态机生成快照并删除快照之前的日志，落后太多的follower直接安装快照
+*/
+
+const (
+	stateFollower = iota
+	stateCandidate
+	stateLeader
+)
+
+var stateNames = []string{"follower", "candidate", "leader"}
+
+// maxEntriesPerRequest 每次AppendEntries最多发送的日志数量
+const maxEntriesPerRequest = 512
+
+var (
+	// ErrStopped 节点已经停止
+	ErrStopped = errors.New("raft node stopped")
+	// ErrLeadershipLost 提议的日志提交之前失去了leader身份，被新的leader覆盖
+	ErrLeadershipLost = errors.New("leadership lost before the proposal was committed")
+	// ErrProposalTimeout 提议在超时时间内没有提交
+	ErrProposalTimeout = errors.New("proposal timeout")
+
+	errCorruptSnapshot = errors.New("corrupt raft snapshot")
+)
+
+// NotLeaderError 只有leader可以接受提议，Leader为当前已知的leader，未知时为空
+type NotLeaderError struct {
+	Leader string
+}
+
+func (e *NotLeaderError) Error() string {
+	if e.Leader == "" {
+		return "not leader, no leader elected"
+	}
+	return "not leader, leader is " + e.Leader
+}
+
+// Entry 一条日志，Data为空的日志是leader当选时追加的空操作
+type Entry struct {
+	Index uint64 `json:"index"`
+	Term  uint64 `json:"term"`
+	Data  []byte `json:"data,omitempty"`
+}
+
+// StateMachine 执行已提交的日志，同一时刻只会有一个方法被调用
+type StateMachine interface {
+	// Apply 执行一条日志，返回值交给提议者
+	Apply(index uint64, data []byte) interface{}
+	// Snapshot 生成包含所有已执行日志的快照
+	Snapshot() ([]byte, error)
+	// Restore 丢弃当前状态，从快照恢复
+	Restore(data []byte) error
+}
+
+// Config 节点的配置
+type Config struct {
+	// 当前节点的id
+	ID string
+	// 所有节点的id，包括当前节点
+	Peers []string
+	// 持久化目录
+	Dir string
+	// 选举超时的下限，实际的超时时间在[ElectionTimeout, 2*ElectionTimeout)中随机
+	ElectionTimeout time.Duration
+	// leader发送心跳的间隔，需要远小于选举超时
+	HeartbeatInterval time.Duration
+	// 快照之后执行的日志超过该数量时生成新的快照，0代表不生成快照
+	SnapshotThreshold uint64
+}
+
+// proposal 等待日志执行结果的提议者
+type proposal struct {
+	term   uint64
+	result chan interface{}
+}
+
+// Node raft节点
+type Node struct {
+	mu        sync.Mutex
+	cfg       Config
+	sm        StateMachine
+	transport Transport
+	storage   *storage
+
+	// 持久化状态
+	term     uint64
+	votedFor string
+	// log[0]为快照对应的位置，只使用其Index与Term
+	log []Entry
+
+	state       int
+	leader      string
+	commitIndex uint64
+	lastApplied uint64
+	// 选举超时的截止时间，收到leader的心跳或者投票之后重置
+	electionDeadline time.Time
+
+	// leader状态，当选之后初始化
+	nextIndex  map[string]uint64
+	matchIndex map[string]uint64
+	// 最近一次收到每个follower回复的时间，用于发现自己已经与多数节点失联
+	lastContact map[string]time.Time
+	// 通知每个follower的复制协程有新的日志
+	replicateCh map[string]chan struct{}
+
+	// 日志index->等待结果的提议者
+	proposals map[uint64]*proposal
+	// 收到的待安装快照，由执行协程交给状态机
+	pendingSnapshot *InstallSnapshotArgs
+	applyCond       *sync.Cond
+
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closed   bool
+	stopCh   chan struct{}
+	wg       sync.WaitGroup
+}
+
+// NewNode 从cfg.Dir中恢复持久化的状态，快照会立即交给状态机恢复
+// 调用Start之后开始选举，Serve处理其他节点的rpc
+func NewNode(cfg Config, sm StateMachine, transport Transport) (*Node, error) {
+	if cfg.HeartbeatInterval <= 0 || cfg.ElectionTimeout <= cfg.HeartbeatInterval {
+		return nil, errors.New("raft election timeout must be greater than heartbeat interval")
+	}
+	s, err := openStorage(cfg.Dir)
+	if err != nil {
+		return nil, err
+	}
+	n := &Node{
+		cfg:         cfg,
+		sm:          sm,
+		transport:   transport,
+		storage:     s,
+		log:         []Entry{{}},
+		proposals:   make(map[uint64]*proposal),
+		replicateCh: make(map[string]chan struct{}),
+		conns:       make(map[net.Conn]struct{}),
+		stopCh:      make(chan struct{}),
+	}
+	n.applyCond = sync.NewCond(&n.mu)
+	if err := n.restore(); err != nil {
+		_ = s.close()
+		return nil, err
+	}
+	return n, nil
+}
+
+// restore 从磁盘恢复任期、投票、快照以及日志
+func (n *Node) restore() error {
+	state, err := n.storage.loadState()
+	if err != nil {
+		return err
+	}
+	n.term = state.Term
+	n.votedFor = state.VotedFor
+	meta, data, err := n.storage.loadSnapshot()
+	if err != nil {
+		return err
+	}
+	if meta != nil {
+		if err := n.sm.Restore(data); err != nil {
+			return fmt.Errorf("restore raft snapshot failed: %v", err)
+		}
+		n.log[0] = Entry{Index: meta.Index, Term: meta.Term}
+		n.commitIndex = meta.Index
+		n.lastApplied = meta.Index
+	}
+	entries, err := n.storage.loadLog(n.log[0].Index)
+	if err != nil {
+		return err
+	}
+	// 日志需要与快照首尾相接，否则说明文件被破坏
+	for i, entry := range entries {
+		if entry.Index != n.log[0].Index+uint64(i)+1 {
+			return fmt.Errorf("raft log is not continuous at index %d", entry.Index)
+		}
+	}
+	n.log = append(n.log, entries...)
+	return nil
+}
+
+// Start 开始选举计时以及执行已提交的日志
+func (n *Node) Start() {
+	n.mu.Lock()
+	n.resetElectionTimer()
+	n.mu.Unlock()
+	n.wg.Add(2)
+	go n.ticker()
+	go n.applier()
+}
+
+// Stop 停止节点，正在等待的提议返回ErrStopped
+func (n *Node) Stop() {
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return
+	}
+	n.closed = true
+	close(n.stopCh)
+	if n.listener != nil {
+		_ = n.listener.Close()
+	}
+	for conn := range n.conns {
+		_ = conn.Close()
+	}
+	for index, p := range n.proposals {
+		p.result <- ErrStopped
+		delete(n.proposals, index)
+	}
+	n.applyCond.Broadcast()
+	n.mu.Unlock()
+	n.wg.Wait()
+	_ = n.transport.Close()
+	n.mu.Lock()
+	_ = n.storage.close()
+	n.mu.Unlock()
+}
+
+/*---日志位置的换算，调用方需要持有锁---*/
+
+func (n *Node) snapshotIndex() uint64 {
+	return n.log[0].Index
+}
+
+func (n *Node) lastIndex() uint64 {
+	return n.log[len(n.log)-1].Index
+}
+
+func (n *Node) lastTerm() uint64 {
+	return n.log[len(n.log)-1].Term
+}
+
+// entryAt 返回index处的日志，index需要在[snapshotIndex, lastIndex]中
+func (n *Node) entryAt(index uint64) *Entry {
+	return &n.log[index-n.snapshotIndex()]
+}
+
+func (n *Node) quorum() int {
+	return len(n.cfg.Peers)/2 + 1
+}
+
+// persistState 持久化任期与投票，失败时无法保证安全性，只能停止服务
+func (n *Node) persistState() {
+	if err := n.storage.saveState(hardState{Term: n.term, VotedFor: n.votedFor}); err != nil {
+		panic("save raft state failed: " + err.Error())
+	}
+}
+
+func (n *Node) resetElectionTimer() {
+	timeout := n.cfg.ElectionTimeout + time.Duration(rand.Int63n(int64(n.cfg.ElectionTimeout)))
+	n.electionDeadline = time.Now().Add(timeout)
+}
+
+// becomeFollower 发现更大的任期时退回follower
+func (n *Node) becomeFollower(term uint64, leader string) {
+	if term > n.term {
+		n.term = term
+		n.votedFor = ""
+		n.persistState()
+	}
+	if n.state != stateFollower {
+		logger.Info(fmt.Sprintf("raft %s becomes follower in term %d", n.cfg.ID, n.term))
+	}
+	n.state = stateFollower
+	n.leader = leader
+}
+
+/*---选举---*/
+
+func (n *Node) ticker() {
+	defer n.wg.Done()
+	ticker := time.NewTicker(n.cfg.HeartbeatInterval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.stopCh:
+			return
+		case <-ticker.C:
+		}
+		n.mu.Lock()
+		if n.closed {
+			n.mu.Unlock()
+			return
+		}
+		if n.state == stateLeader {
+			n.checkQuorum()
+		} else if time.Now().After(n.electionDeadline) {
+			n.startElection()
+		}
+		n.mu.Unlock()
+	}
+}
+
+// startElection 任期加一并向其他节点请求投票，调用方需要持有锁
+func (n *Node) startElection() {
+	n.term++
+	n.state = stateCandidate
+	n.votedFor = n.cfg.ID
+	n.leader = ""
+	n.persistState()
+	n.resetElectionTimer()
+	term := n.term
+	logger.Info(fmt.Sprintf("raft %s starts election in term %d", n.cfg.ID, term))
+	args := &RequestVoteArgs{
+		Term:         term,
+		CandidateID:  n.cfg.ID,
+		LastLogIndex: n.lastIndex(),
+		LastLogTerm:  n.lastTerm(),
+	}
+	votes := 1
+	if votes >= n.quorum() {
+		n.becomeLeader()
+		return
+	}
+	for _, peer := range n.cfg.Peers {
+		if peer == n.cfg.ID {
+			continue
+		}
+		go func(peer string) {
+			reply := &RequestVoteReply{}
+			if err := n.transport.Call(peer, "RequestVote", args, reply); err != nil {
+				return
+			}
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if n.closed {
+				return
+			}
+			if reply.Term > n.term {
+				n.becomeFollower(reply.Term, "")
+				return
+			}
+			if n.state != stateCandidate || n.term != term || !reply.VoteGranted {
+				return
+			}
+			votes++
+			if votes >= n.quorum() {
+				n.becomeLeader()
+			}
+		}(peer)
+	}
+}
+
+// becomeLeader 当选之后追加一条空日志，提交它之后之前任期的日志也随之提交，调用方需要持有锁
+func (n *Node) becomeLeader() {
+	n.state = stateLeader
+	n.leader = n.cfg.ID
+	logger.Info(fmt.Sprintf("raft %s becomes leader in term %d", n.cfg.ID, n.term))
+	n.appendLocal(nil)
+	n.nextIndex = make(map[string]uint64)
+	n.matchIndex = make(map[string]uint64)
+	n.lastContact = make(map[string]time.Time)
+	for _, peer := range n.cfg.Peers {
+		if peer == n.cfg.ID {
+			continue
+		}
+		n.nextIndex[peer] = n.lastIndex()
+		n.matchIndex[peer] = 0
+		n.lastContact[peer] = time.Now()
+		ch := make(chan struct{}, 1)
+		n.replicateCh[peer] = ch
+		n.wg.Add(1)
+		go n.replicate(peer, n.term, ch)
+	}
+	n.advanceCommitIndex()
+}
+
+// checkQuorum leader超过选举超时没有收到多数节点的回复时退回follower，
+// 避免被网络隔离的leader继续接受请求，调用方需要持有锁
+func (n *Node) checkQuorum() {
+	contacted := 1
+	for _, t := range n.lastContact {
+		if time.Since(t) < n.cfg.ElectionTimeout {
+			contacted++
+		}
+	}
+	if contacted < n.quorum() {
+		logger.Warn(fmt.Sprintf("raft %s lost contact with the majority, steps down", n.cfg.ID))
+		n.becomeFollower(n.term, "")
+		n.resetElectionTimer()
+	}
+}
+
+func (n *Node) handleRequestVote(args *RequestVoteArgs, reply *RequestVoteReply) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		return ErrStopped
+	}
+	if args.Term > n.term {
+		n.becomeFollower(args.Term, "")
+	}
+	reply.Term = n.term
+	if args.Term < n.term {
+		return nil
+	}
+	if n.votedFor != "" && n.votedFor != args.CandidateID {
+		return nil
+	}
+	// 候选人的日志至少与自己一样新才能获得投票
+	upToDate := args.LastLogTerm > n.lastTerm() ||
+		(args.LastLogTerm == n.lastTerm() && args.LastLogIndex >= n.lastIndex())
+	if !upToDate {
+		return nil
+	}
+	n.votedFor = args.CandidateID
+	n.persistState()
+	n.resetElectionTimer()
+	reply.VoteGranted = true
+	return nil
+}
+
+/*---日志复制---*/
+
+// Propose 提议一条命令，提交并执行之后返回状态机的执行结果
+// 当前节点不是leader时返回*NotLeaderError
+func (n *Node) Propose(data []byte, timeout time.Duration) (interface{}, error) {
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return nil, ErrStopped
+	}
+	if n.state != stateLeader {
+		leader := n.leader
+		n.mu.Unlock()
+		return nil, &NotLeaderError{Leader: leader}
+	}
+	index := n.appendLocal(data)
+	p := &proposal{
+		term:   n.term,
+		result: make(chan interface{}, 1),
+	}
+	n.proposals[index] = p
+	for _, ch := range n.replicateCh {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+	// 单节点时追加之后即可提交
+	n.advanceCommitIndex()
+	n.mu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case result := <-p.result:
+		if err, ok := result.(error); ok && (err == ErrStopped || err == ErrLeadershipLost) {
+			return nil, err
+		}
+		return result, nil
+	case <-timer.C:
+		n.mu.Lock()
+		delete(n.proposals, index)
+		n.mu.Unlock()
+		return nil, ErrProposalTimeout
+	}
+}
+
+// appendLocal leader在本地追加一条日志，调用方需要持有锁
+func (n *Node) appendLocal(data []byte) uint64 {
+	entry := Entry{
+		Index: n.lastIndex() + 1,
+		Term:  n.term,
+		Data:  data,
+	}
+	if err := n.storage.appendEntries([]Entry{entry}); err != nil {
+		panic("append raft log failed: " + err.Error())
+	}
+	n.log = append(n.log, entry)
+	return entry.Index
+}
+
+// replicate leader向一个follower复制日志的协程，失去leader身份之后退出
+func (n *Node) replicate(peer string, term uint64, notify chan struct{}) {
+	defer n.wg.Done()
+	ticker := time.NewTicker(n.cfg.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		n.mu.Lock()
+		if n.closed || n.state != stateLeader || n.term != term {
+			n.mu.Unlock()
+			return
+		}
+		if n.nextIndex[peer] <= n.snapshotIndex() {
+			n.sendSnapshot(peer, term)
+		} else {
+			n.sendEntries(peer, term)
+		}
+		n.mu.Unlock()
+		// follower落后时不等待心跳，继续发送之后的日志
+		n.mu.Lock()
+		lagging := n.state == stateLeader && n.term == term && n.nextIndex[peer] <= n.lastIndex()
+		n.mu.Unlock()
+		if lagging {
+			continue
+		}
+		select {
+		case <-n.stopCh:
+			return
+		case <-ticker.C:
+		case <-notify:
+		}
+	}
+}
+
+// sendEntries 发送nextIndex之后的日志，等待回复期间释放锁，调用方需要持有锁
+func (n *Node) sendEntries(peer string, term uint64) {
+	next := n.nextIndex[peer]
+	prev := n.entryAt(next - 1)
+	pending := n.log[next-n.snapshotIndex():]
+	if len(pending) > maxEntriesPerRequest {
+		pending = pending[:maxEntriesPerRequest]
+	}
+	entries := make([]Entry, len(pending))
+	copy(entries, pending)
+	args := &AppendEntriesArgs{
+		Term:         term,
+		LeaderID:     n.cfg.ID,
+		PrevLogIndex: prev.Index,
+		PrevLogTerm:  prev.Term,
+		Entries:      entries,
+		LeaderCommit: n.commitIndex,
+	}
+	n.mu.Unlock()
+	reply := &AppendEntriesReply{}
+	err := n.transport.Call(peer, "AppendEntries", args, reply)
+	n.mu.Lock()
+	if err != nil || n.state != stateLeader || n.term != term {
+		if err != nil {
+			n.waitRetry()
+		}
+		return
+	}
+	if reply.Term > n.term {
+		n.becomeFollower(reply.Term, "")
+		return
+	}
+	n.lastContact[peer] = time.Now()
+	if reply.Success {
+		match := args.PrevLogIndex + uint64(len(args.Entries))
+		if match > n.matchIndex[peer] {
+			n.matchIndex[peer] = match
+		}
+		n.nextIndex[peer] = n.matchIndex[peer] + 1
+		n.advanceCommitIndex()
+		return
+	}
+	if reply.ConflictIndex > 0 && reply.ConflictIndex <= n.lastIndex() {
+		n.nextIndex[peer] = reply.ConflictIndex
+	} else if next > 1 {
+		n.nextIndex[peer] = next - 1
+	}
+}
+
+// sendSnapshot follower需要的日志已经被压缩，发送快照，调用方需要持有锁
+func (n *Node) sendSnapshot(peer string, term uint64) {
+	_, data, err := n.storage.loadSnapshot()
+	if err != nil || data == nil {
+		logger.Warn(fmt.Sprintf("raft %s load snapshot for %s failed: %v", n.cfg.ID, peer, err))
+		n.waitRetry()
+		return
+	}
+	args := &InstallSnapshotArgs{
+		Term:              term,
+		LeaderID:          n.cfg.ID,
+		LastIncludedIndex: n.log[0].Index,
+		LastIncludedTerm:  n.log[0].Term,
+		Data:              data,
+	}
+	n.mu.Unlock()
+	reply := &InstallSnapshotReply{}
+	err = n.transport.Call(peer, "InstallSnapshot", args, reply)
+	n.mu.Lock()
+	if err != nil || n.state != stateLeader || n.term != term {
+		if err != nil {
+			n.waitRetry()
+		}
+		return
+	}
+	if reply.Term > n.term {
+		n.becomeFollower(reply.Term, "")
+		return
+	}
+	n.lastContact[peer] = time.Now()
+	if args.LastIncludedIndex > n.matchIndex[peer] {
+		n.matchIndex[peer] = args.LastIncludedIndex
+	}
+	n.nextIndex[peer] = n.matchIndex[peer] + 1
+	n.advanceCommitIndex()
+}
+
+// waitRetry 与follower通信失败之后等待一个心跳间隔再重试，调用方需要持有锁
+func (n *Node) waitRetry() {
+	n.mu.Unlock()
+	select {
+	case <-n.stopCh:
+	case <-time.After(n.cfg.HeartbeatInterval):
+	}
+	n.mu.Lock()
+}
+
+// advanceCommitIndex 多数节点已经写入的当前任期的日志可以提交，调用方需要持有锁
+func (n *Node) advanceCommitIndex() {
+	if n.state != stateLeader {
+		return
+	}
+	matches := make([]uint64, 0, len(n.cfg.Peers))
+	matches = append(matches, n.lastIndex())
+	for _, match := range n.matchIndex {
+		matches = append(matches, match)
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i] > matches[j]
+	})
+	committed := matches[n.quorum()-1]
+	// 只能直接提交当前任期的日志，之前任期的日志随之间接提交
+	if committed > n.commitIndex && committed > n.snapshotIndex() && n.entryAt(committed).Term == n.term {
+		n.commitIndex = committed
+		n.applyCond.Broadcast()
+	}
+}
+
+func (n *Node) handleAppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		return ErrStopped
+	}
+	reply.Term = n.term
+	if args.Term < n.term {
+		return nil
+	}
+	n.becomeFollower(args.Term, args.LeaderID)
+	reply.Term = n.term
+	n.resetElectionTimer()
+
+	// 快照之前的日志已经提交，与leader一致，从快照处开始比较
+	if args.PrevLogIndex < n.snapshotIndex() {
+		skip := n.snapshotIndex() - args.PrevLogIndex
+		if skip >= uint64(len(args.Entries)) {
+			reply.Success = true
+			return nil
+		}
+		args.Entries = args.Entries[skip:]
+		args.PrevLogIndex = n.snapshotIndex()
+		args.PrevLogTerm = n.log[0].Term
+	}
+	if args.PrevLogIndex > n.lastIndex() {
+		reply.ConflictIndex = n.lastIndex() + 1
+		return nil
+	}
+	if prevTerm := n.entryAt(args.PrevLogIndex).Term; prevTerm != args.PrevLogTerm {
+		// 跳过整个冲突的任期，减少来回的次数
+		conflict := args.PrevLogIndex
+		for conflict > n.snapshotIndex()+1 && n.entryAt(conflict-1).Term == prevTerm {
+			conflict--
+		}
+		reply.ConflictIndex = conflict
+		return nil
+	}
+
+	// 找到第一条与本地日志不一致的日志，之后的本地日志全部删除
+	for i, entry := range args.Entries {
+		if entry.Index > n.lastIndex() {
+			n.appendEntries(args.Entries[i:])
+			break
+		}
+		if n.entryAt(entry.Index).Term != entry.Term {
+			if entry.Index <= n.commitIndex {
+				panic(fmt.Sprintf("raft %s: committed entry %d conflicts with leader", n.cfg.ID, entry.Index))
+			}
+			n.log = n.log[:entry.Index-n.snapshotIndex()]
+			if err := n.storage.rewriteLog(n.log[1:]); err != nil {
+				panic("rewrite raft log failed: " + err.Error())
+			}
+			n.appendEntries(args.Entries[i:])
+			break
+		}
+	}
+	if args.LeaderCommit > n.commitIndex {
+		lastNew := args.PrevLogIndex + uint64(len(args.Entries))
+		commit := args.LeaderCommit
+		if lastNew < commit {
+			commit = lastNew
+		}
+		if commit > n.commitIndex {
+			n.commitIndex = commit
+			n.applyCond.Broadcast()
+		}
+	}
+	reply.Success = true
+	return nil
+}
+
+// appendEntries follower追加leader发送的日志，调用方需要持有锁
+func (n *Node) appendEntries(entries []Entry) {
+	if err := n.storage.appendEntries(entries); err != nil {
+		panic("append raft log failed: " + err.Error())
+	}
+	n.log = append(n.log, entries...)
+}
+
+/*---执行日志与快照---*/
+
+// applier 按顺序将已提交的日志交给状态机执行，执行时不持有锁
+func (n *Node) applier() {
+	defer n.wg.Done()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for {
+		for !n.closed && n.pendingSnapshot == nil &&
+			(n.lastApplied >= n.commitIndex || n.lastApplied >= n.lastIndex()) {
+			n.applyCond.Wait()
+		}
+		if n.closed {
+			return
+		}
+		if snapshot := n.pendingSnapshot; snapshot != nil {
+			n.pendingSnapshot = nil
+			n.installSnapshot(snapshot)
+			continue
+		}
+		end := n.commitIndex
+		if end > n.lastIndex() {
+			end = n.lastIndex()
+		}
+		entries := make([]Entry, end-n.lastApplied)
+		copy(entries, n.log[n.lastApplied+1-n.snapshotIndex():end+1-n.snapshotIndex()])
+		n.mu.Unlock()
+		results := make([]interface{}, len(entries))
+		for i, entry := range entries {
+			if entry.Data != nil {
+				results[i] = n.sm.Apply(entry.Index, entry.Data)
+			}
+		}
+		n.mu.Lock()
+		for i, entry := range entries {
+			if p, ok := n.proposals[entry.Index]; ok {
+				delete(n.proposals, entry.Index)
+				// 同一位置的日志被新的leader覆盖，提议没有被执行
+				if p.term != entry.Term {
+					p.result <- ErrLeadershipLost
+				} else {
+					p.result <- results[i]
+				}
+			}
+		}
+		n.lastApplied = end
+		n.maybeSnapshot()
+	}
+}
+
+// installSnapshot 状态机从leader发送的快照恢复，调用方需要持有锁，恢复期间释放锁
+func (n *Node) installSnapshot(args *InstallSnapshotArgs) {
+	// 等待期间可能已经执行到了快照之后
+	if args.LastIncludedIndex <= n.lastApplied {
+		return
+	}
+	n.mu.Unlock()
+	err := n.sm.Restore(args.Data)
+	n.mu.Lock()
+	if err != nil {
+		logger.Error(fmt.Sprintf("raft %s restore snapshot failed: %v", n.cfg.ID, err))
+		return
+	}
+	n.lastApplied = args.LastIncludedIndex
+	logger.Info(fmt.Sprintf("raft %s installed snapshot at index %d", n.cfg.ID, args.LastIncludedIndex))
+}
+
+// maybeSnapshot 快照之后执行的日志超过阈值时生成快照，调用方需要持有锁，生成快照期间释放锁
+// 只有执行协程会调用状态机，释放锁期间状态机的状态仍然对应lastApplied
+func (n *Node) maybeSnapshot() {
+	if n.cfg.SnapshotThreshold == 0 || n.pendingSnapshot != nil ||
+		n.lastApplied < n.snapshotIndex()+n.cfg.SnapshotThreshold {
+		return
+	}
+	index := n.lastApplied
+	n.mu.Unlock()
+	data, err := n.sm.Snapshot()
+	n.mu.Lock()
+	if err != nil {
+		logger.Error(fmt.Sprintf("raft %s snapshot failed: %v", n.cfg.ID, err))
+		return
+	}
+	// 释放锁期间可能安装了leader的快照
+	if index <= n.snapshotIndex() || index > n.lastIndex() {
+		return
+	}
+	n.compact(index, n.entryAt(index).Term, data)
+}
+
+// compact 保存快照并删除index之前的日志，调用方需要持有锁
+func (n *Node) compact(index uint64, term uint64, data []byte) {
+	if err := n.storage.saveSnapshot(snapshotMeta{Index: index, Term: term}, data); err != nil {
+		logger.Error(fmt.Sprintf("raft %s save snapshot failed: %v", n.cfg.ID, err))
+		return
+	}
+	remaining := make([]Entry, 0, 1)
+	remaining = append(remaining, Entry{Index: index, Term: term})
+	if index < n.lastIndex() && index >= n.snapshotIndex() {
+		remaining = append(remaining, n.log[index+1-n.snapshotIndex():]...)
+	}
+	n.log = remaining
+	if err := n.storage.rewriteLog(n.log[1:]); err != nil {
+		panic("rewrite raft log failed: " + err.Error())
+	}
+}
+
+func (n *Node) handleInstallSnapshot(args *InstallSnapshotArgs, reply *InstallSnapshotReply) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		return ErrStopped
+	}
+	reply.Term = n.term
+	if args.Term < n.term {
+		return nil
+	}
+	n.becomeFollower(args.Term, args.LeaderID)
+	reply.Term = n.term
+	n.resetElectionTimer()
+	if args.LastIncludedIndex <= n.snapshotIndex() || args.LastIncludedIndex <= n.lastApplied {
+		return nil
+	}
+	// 本地有快照位置的日志并且任期相同时保留之后的日志，否则全部丢弃
+	if args.LastIncludedIndex > n.lastIndex() || n.entryAt(args.LastIncludedIndex).Term != args.LastIncludedTerm {
+		n.log = n.log[:1]
+	}
+	n.compact(args.LastIncludedIndex, args.LastIncludedTerm, args.Data)
+	if args.LastIncludedIndex > n.commitIndex {
+		n.commitIndex = args.LastIncludedIndex
+	}
+	n.pendingSnapshot = args
+	n.applyCond.Broadcast()
+	return nil
+}
+
+/*---状态查询---*/
+
+// Status 节点当前的状态
+type Status struct {
+	ID            string
+	State         string
+	Term          uint64
+	Leader        string
+	CommitIndex   uint64
+	LastApplied   uint64
+	LastIndex     uint64
+	SnapshotIndex uint64
+}
+
+// Status 返回节点当前的状态
+func (n *Node) Status() Status {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return Status{
+		ID:            n.cfg.ID,
+		State:         stateNames[n.state],
+		Term:          n.term,
+		Leader:        n.leader,
+		CommitIndex:   n.commitIndex,
+		LastApplied:   n.lastApplied,
+		LastIndex:     n.lastIndex(),
+		SnapshotIndex: n.snapshotIndex(),
+	}
+}
+
+// Leader 返回当前节点是否为leader以及已知的leader
+func (n *Node) Leader() (bool, string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.state == stateLeader, n.leader
+}
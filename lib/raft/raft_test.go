@@ -0,0 +1,280 @@
+package raft
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// kvMachine 测试用的状态机，日志为 "key=value"
+type kvMachine struct {
+	mu   sync.Mutex
+	data map[string]string
+}
+
+func newKVMachine() *kvMachine {
+	return &kvMachine{data: make(map[string]string)}
+}
+
+func (m *kvMachine) Apply(index uint64, data []byte) interface{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	kv := strings.SplitN(string(data), "=", 2)
+	m.data[kv[0]] = kv[1]
+	return index
+}
+
+func (m *kvMachine) Snapshot() ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return json.Marshal(m.data)
+}
+
+func (m *kvMachine) Restore(data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.data = make(map[string]string)
+	return json.Unmarshal(data, &m.data)
+}
+
+func (m *kvMachine) get(key string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.data[key]
+}
+
+type testCluster struct {
+	t        *testing.T
+	dir      string
+	ids      []string
+	addrs    map[string]string
+	nodes    map[string]*Node
+	machines map[string]*kvMachine
+	snapshot uint64
+}
+
+func makeTestCluster(t *testing.T, size int, snapshotThreshold uint64) *testCluster {
+	dir, err := ioutil.TempDir("", "raft")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &testCluster{
+		t:        t,
+		dir:      dir,
+		addrs:    make(map[string]string),
+		nodes:    make(map[string]*Node),
+		machines: make(map[string]*kvMachine),
+		snapshot: snapshotThreshold,
+	}
+	// 先确定所有节点的地址，重启的节点继续使用原来的地址
+	listeners := make([]net.Listener, size)
+	for i := 0; i < size; i++ {
+		id := fmt.Sprintf("n%d", i)
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.ids = append(c.ids, id)
+		c.addrs[id] = listener.Addr().String()
+		listeners[i] = listener
+	}
+	for i, id := range c.ids {
+		c.startWithListener(id, listeners[i])
+	}
+	return c
+}
+
+func (c *testCluster) start(id string) {
+	listener, err := net.Listen("tcp", c.addrs[id])
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.startWithListener(id, listener)
+}
+
+func (c *testCluster) startWithListener(id string, listener net.Listener) {
+	transport := NewTCPTransport(func(peer string) string {
+		return c.addrs[peer]
+	}, 200*time.Millisecond)
+	machine := newKVMachine()
+	node, err := NewNode(Config{
+		ID:                id,
+		Peers:             c.ids,
+		Dir:               filepath.Join(c.dir, id),
+		ElectionTimeout:   300 * time.Millisecond,
+		HeartbeatInterval: 30 * time.Millisecond,
+		SnapshotThreshold: c.snapshot,
+	}, machine, transport)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.nodes[id] = node
+	c.machines[id] = machine
+	go func() {
+		_ = node.Serve(listener)
+	}()
+	node.Start()
+}
+
+func (c *testCluster) stop(id string) {
+	c.nodes[id].Stop()
+	delete(c.nodes, id)
+}
+
+func (c *testCluster) close() {
+	for id := range c.nodes {
+		c.stop(id)
+	}
+	_ = os.RemoveAll(c.dir)
+}
+
+// waitLeader 等待运行中的节点选出唯一的leader
+func (c *testCluster) waitLeader() string {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		leaders := make(map[uint64]string)
+		for id, node := range c.nodes {
+			status := node.Status()
+			if status.State == "leader" {
+				leaders[status.Term] = id
+			}
+		}
+		if len(leaders) == 1 {
+			for _, id := range leaders {
+				return id
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	c.t.Fatal("no leader elected")
+	return ""
+}
+
+// waitValue 等待所有运行中的节点执行到key=value
+func (c *testCluster) waitValue(key string, value string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		done := true
+		for id := range c.nodes {
+			if c.machines[id].get(key) != value {
+				done = false
+			}
+		}
+		if done {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	c.t.Fatalf("%s=%s is not applied on all nodes", key, value)
+}
+
+func (c *testCluster) propose(leader string, data string) {
+	if _, err := c.nodes[leader].Propose([]byte(data), 2*time.Second); err != nil {
+		c.t.Fatalf("propose %s failed: %v", data, err)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	c := makeTestCluster(t, 3, 0)
+	defer c.close()
+	leader := c.waitLeader()
+	for i := 0; i < 20; i++ {
+		c.propose(leader, fmt.Sprintf("k%d=v%d", i, i))
+	}
+	// 提议返回时leader已经执行
+	if c.machines[leader].get("k19") != "v19" {
+		t.Error("proposal returned before applied")
+	}
+	c.waitValue("k19", "v19")
+
+	for id, node := range c.nodes {
+		if id == leader {
+			continue
+		}
+		_, err := node.Propose([]byte("x=y"), time.Second)
+		notLeader, ok := err.(*NotLeaderError)
+		if !ok || notLeader.Leader != leader {
+			t.Errorf("expect NotLeaderError with leader %s, got %v", leader, err)
+		}
+	}
+}
+
+func TestFailover(t *testing.T) {
+	c := makeTestCluster(t, 3, 0)
+	defer c.close()
+	leader := c.waitLeader()
+	c.propose(leader, "a=1")
+	c.waitValue("a", "1")
+
+	c.stop(leader)
+	newLeader := c.waitLeader()
+	if newLeader == leader {
+		t.Fatal("stopped node is still leader")
+	}
+	c.propose(newLeader, "a=2")
+	c.propose(newLeader, "b=2")
+
+	// 重启之后从磁盘恢复日志，并从新的leader补齐缺失的日志
+	c.start(leader)
+	c.waitValue("a", "2")
+	c.waitValue("b", "2")
+}
+
+func TestMinorityCannotCommit(t *testing.T) {
+	c := makeTestCluster(t, 3, 0)
+	defer c.close()
+	leader := c.waitLeader()
+	for _, id := range c.ids {
+		if id != leader {
+			c.stop(id)
+		}
+	}
+	if _, err := c.nodes[leader].Propose([]byte("a=1"), 500*time.Millisecond); err == nil {
+		t.Error("proposal committed without majority")
+	}
+	if c.machines[leader].get("a") != "" {
+		t.Error("uncommitted entry applied")
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	c := makeTestCluster(t, 3, 10)
+	defer c.close()
+	leader := c.waitLeader()
+	var follower string
+	for _, id := range c.ids {
+		if id != leader {
+			follower = id
+			break
+		}
+	}
+	c.stop(follower)
+	for i := 0; i < 50; i++ {
+		c.propose(leader, fmt.Sprintf("k%d=v%d", i, i))
+	}
+	status := c.nodes[leader].Status()
+	if status.SnapshotIndex == 0 || status.LastIndex-status.SnapshotIndex > 20 {
+		t.Errorf("log is not compacted: %+v", status)
+	}
+
+	// 落后的follower需要的日志已经被压缩，通过安装快照追上
+	c.start(follower)
+	c.waitValue("k49", "v49")
+	c.waitValue("k0", "v0")
+
+	// 重启之后从快照以及快照之后的日志恢复
+	c.stop(follower)
+	c.start(follower)
+	if c.machines[follower].get("k0") != "v0" {
+		t.Error("snapshot is not restored on restart")
+	}
+	c.propose(c.waitLeader(), "k50=v50")
+	c.waitValue("k50", "v50")
+}
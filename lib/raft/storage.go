@@ -0,0 +1,197 @@
+package raft
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+/*
+持久化的内容分为三个文件：
+state    当前任期与投票对象，每次修改时整体重写
+log      快照之后的日志，每行一条json，追加写入，截断或者压缩时整体重写
+snapshot 第一行为快照对应的日志位置，之后为状态机的快照数据
+*/
+
+const (
+	stateFilename    = "state"
+	logFilename      = "log"
+	snapshotFilename = "snapshot"
+)
+
+type hardState struct {
+	Term     uint64 `json:"term"`
+	VotedFor string `json:"votedFor"`
+}
+
+type snapshotMeta struct {
+	Index uint64 `json:"index"`
+	Term  uint64 `json:"term"`
+}
+
+// storage 将raft需要持久化的状态写入dir，调用方需要持有Node的锁
+type storage struct {
+	dir     string
+	logFile *os.File
+}
+
+func openStorage(dir string) (*storage, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	logFile, err := os.OpenFile(filepath.Join(dir, logFilename), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &storage{
+		dir:     dir,
+		logFile: logFile,
+	}, nil
+}
+
+// writeFileAtomic 先写入临时文件再重命名，避免进程崩溃时留下不完整的文件
+func writeFileAtomic(filename string, data []byte) error {
+	tmpFile := filename + ".tmp"
+	file, err := os.OpenFile(tmpFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, filename)
+}
+
+func (s *storage) saveState(state hardState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(s.dir, stateFilename), data)
+}
+
+func (s *storage) loadState() (hardState, error) {
+	var state hardState
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, stateFilename))
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	err = json.Unmarshal(data, &state)
+	return state, err
+}
+
+func encodeEntries(entries []Entry) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	for i := range entries {
+		if err := enc.Encode(&entries[i]); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// appendEntries 将新的日志追加到文件末尾，返回之前刷入磁盘
+func (s *storage) appendEntries(entries []Entry) error {
+	data, err := encodeEntries(entries)
+	if err != nil {
+		return err
+	}
+	if _, err := s.logFile.Write(data); err != nil {
+		return err
+	}
+	return s.logFile.Sync()
+}
+
+// rewriteLog 截断冲突的日志或者压缩日志之后，使用剩余的日志重写整个文件
+func (s *storage) rewriteLog(entries []Entry) error {
+	data, err := encodeEntries(entries)
+	if err != nil {
+		return err
+	}
+	filename := filepath.Join(s.dir, logFilename)
+	if err := writeFileAtomic(filename, data); err != nil {
+		return err
+	}
+	logFile, err := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_ = s.logFile.Close()
+	s.logFile = logFile
+	return nil
+}
+
+// loadLog 读取快照之后的日志，崩溃时可能残留已经被快照包含的日志，需要跳过
+func (s *storage) loadLog(snapshotIndex uint64) ([]Entry, error) {
+	file, err := os.Open(filepath.Join(s.dir, logFilename))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	entries := make([]Entry, 0)
+	reader := bufio.NewReader(file)
+	dec := json.NewDecoder(reader)
+	for dec.More() {
+		var entry Entry
+		if err := dec.Decode(&entry); err != nil {
+			// 最后一条日志写入时进程崩溃，丢弃不完整的部分，这条日志没有被确认过
+			break
+		}
+		if entry.Index <= snapshotIndex {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (s *storage) saveSnapshot(meta snapshotMeta, data []byte) error {
+	header, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	content := make([]byte, 0, len(header)+1+len(data))
+	content = append(content, header...)
+	content = append(content, '\n')
+	content = append(content, data...)
+	return writeFileAtomic(filepath.Join(s.dir, snapshotFilename), content)
+}
+
+// loadSnapshot 读取快照，快照不存在时返回nil
+func (s *storage) loadSnapshot() (*snapshotMeta, []byte, error) {
+	content, err := ioutil.ReadFile(filepath.Join(s.dir, snapshotFilename))
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	i := bytes.IndexByte(content, '\n')
+	if i < 0 {
+		return nil, nil, errCorruptSnapshot
+	}
+	meta := &snapshotMeta{}
+	if err := json.Unmarshal(content[:i], meta); err != nil {
+		return nil, nil, errCorruptSnapshot
+	}
+	return meta, content[i+1:], nil
+}
+
+func (s *storage) close() error {
+	return s.logFile.Close()
+}
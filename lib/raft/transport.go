@@ -0,0 +1,203 @@
+package raft
+
+import (
+	"errors"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+// RequestVoteArgs 候选人请求投票
+type RequestVoteArgs struct {
+	Term         uint64
+	CandidateID  string
+	LastLogIndex uint64
+	LastLogTerm  uint64
+}
+
+// RequestVoteReply 投票结果
+type RequestVoteReply struct {
+	Term        uint64
+	VoteGranted bool
+}
+
+// AppendEntriesArgs leader复制日志，Entries为空时作为心跳
+type AppendEntriesArgs struct {
+	Term         uint64
+	LeaderID     string
+	PrevLogIndex uint64
+	PrevLogTerm  uint64
+	Entries      []Entry
+	LeaderCommit uint64
+}
+
+// AppendEntriesReply 日志不匹配时ConflictIndex为leader下一次发送的起点
+type AppendEntriesReply struct {
+	Term          uint64
+	Success       bool
+	ConflictIndex uint64
+}
+
+// InstallSnapshotArgs leader已经压缩掉follower需要的日志时，直接发送快照
+type InstallSnapshotArgs struct {
+	Term              uint64
+	LeaderID          string
+	LastIncludedIndex uint64
+	LastIncludedTerm  uint64
+	Data              []byte
+}
+
+// InstallSnapshotReply 安装快照的结果
+type InstallSnapshotReply struct {
+	Term uint64
+}
+
+// Transport 向其他节点发送rpc，method为RequestVote、AppendEntries或者InstallSnapshot
+type Transport interface {
+	Call(peer string, method string, args interface{}, reply interface{}) error
+	Close() error
+}
+
+// ErrTimeout rpc在超时时间内没有返回
+var ErrTimeout = errors.New("raft rpc timeout")
+
+// TCPTransport 通过net/rpc与其他节点通信，每个节点复用一个连接
+type TCPTransport struct {
+	// 节点id->rpc地址
+	resolve func(peer string) string
+	timeout time.Duration
+	mu      sync.Mutex
+	clients map[string]*rpc.Client
+}
+
+// NewTCPTransport 创建tcp传输层，resolve将节点id转换为对方的rpc地址
+func NewTCPTransport(resolve func(peer string) string, timeout time.Duration) *TCPTransport {
+	return &TCPTransport{
+		resolve: resolve,
+		timeout: timeout,
+		clients: make(map[string]*rpc.Client),
+	}
+}
+
+func (t *TCPTransport) getClient(peer string) (*rpc.Client, error) {
+	t.mu.Lock()
+	client, ok := t.clients[peer]
+	t.mu.Unlock()
+	if ok {
+		return client, nil
+	}
+	conn, err := net.DialTimeout("tcp", t.resolve(peer), t.timeout)
+	if err != nil {
+		return nil, err
+	}
+	client = rpc.NewClient(conn)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	// 并发建立连接时保留先建立的连接
+	if existing, ok := t.clients[peer]; ok {
+		_ = client.Close()
+		return existing, nil
+	}
+	t.clients[peer] = client
+	return client, nil
+}
+
+// dropClient 连接出错之后关闭，下一次调用时重新建立
+func (t *TCPTransport) dropClient(peer string, client *rpc.Client) {
+	t.mu.Lock()
+	if t.clients[peer] == client {
+		delete(t.clients, peer)
+	}
+	t.mu.Unlock()
+	_ = client.Close()
+}
+
+// Call 调用peer的rpc，超时或者连接出错时返回错误
+func (t *TCPTransport) Call(peer string, method string, args interface{}, reply interface{}) error {
+	client, err := t.getClient(peer)
+	if err != nil {
+		return err
+	}
+	call := client.Go(rpcServiceName+"."+method, args, reply, make(chan *rpc.Call, 1))
+	timer := time.NewTimer(t.timeout)
+	defer timer.Stop()
+	select {
+	case <-call.Done:
+		if call.Error != nil {
+			if _, ok := call.Error.(rpc.ServerError); !ok {
+				t.dropClient(peer, client)
+			}
+		}
+		return call.Error
+	case <-timer.C:
+		t.dropClient(peer, client)
+		return ErrTimeout
+	}
+}
+
+// Close 关闭所有连接
+func (t *TCPTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for peer, client := range t.clients {
+		_ = client.Close()
+		delete(t.clients, peer)
+	}
+	return nil
+}
+
+const rpcServiceName = "Raft"
+
+// rpcService 将Node的rpc处理函数以net/rpc要求的形式导出
+type rpcService struct {
+	node *Node
+}
+
+func (s *rpcService) RequestVote(args *RequestVoteArgs, reply *RequestVoteReply) error {
+	return s.node.handleRequestVote(args, reply)
+}
+
+func (s *rpcService) AppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply) error {
+	return s.node.handleAppendEntries(args, reply)
+}
+
+func (s *rpcService) InstallSnapshot(args *InstallSnapshotArgs, reply *InstallSnapshotReply) error {
+	return s.node.handleInstallSnapshot(args, reply)
+}
+
+// Serve 在listener上处理其他节点的rpc，listener关闭之后返回
+func (n *Node) Serve(listener net.Listener) error {
+	server := rpc.NewServer()
+	if err := server.RegisterName(rpcServiceName, &rpcService{node: n}); err != nil {
+		return err
+	}
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return ErrStopped
+	}
+	n.listener = listener
+	n.mu.Unlock()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		// 停止时关闭所有连接，其他节点重新连接到重启之后的节点
+		n.mu.Lock()
+		if n.closed {
+			n.mu.Unlock()
+			_ = conn.Close()
+			continue
+		}
+		n.conns[conn] = struct{}{}
+		n.mu.Unlock()
+		go func() {
+			server.ServeConn(conn)
+			n.mu.Lock()
+			delete(n.conns, conn)
+			n.mu.Unlock()
+		}()
+	}
+}
@@ -18,3 +18,15 @@ func (b *Boolean) Set(v bool) {
 		atomic.StoreUint32((*uint32)(b), 0)
 	}
 }
+
+// CompareAndSet 当前值为old时设置为new，返回是否设置成功
+func (b *Boolean) CompareAndSet(old, new bool) bool {
+	var o, n uint32
+	if old {
+		o = 1
+	}
+	if new {
+		n = 1
+	}
+	return atomic.CompareAndSwapUint32((*uint32)(b), o, n)
+}
@@ -162,11 +162,12 @@ func (tw *TimeWheel) removeTask(key string) {
 	l := tw.slots[position]
 	for e := l.Front(); e != nil; {
 		task := e.Value.(*task)
+		// Remove之后e.Next()返回nil，需要提前取得下一个元素
+		next := e.Next()
 		if task.key == key {
 			delete(tw.timer, task.key)
 			l.Remove(e)
 		}
-
-		e = e.Next()
+		e = next
 	}
 }
@@ -34,9 +34,20 @@ func main() {
 		config.SetupConfig(configFileName)
 	}
 
-	err := tcp.ListenAndServeWithSignal(&tcp.Config{
-		Address: fmt.Sprintf("%s:%d", config.Properties.Bind, config.Properties.Port),
-	}, server.MakeHandler())
+	tcpConfig := &tcp.Config{
+		TLSCertFile:    config.Properties.TLSCertFile,
+		TLSKeyFile:     config.Properties.TLSKeyFile,
+		TLSCACertFile:  config.Properties.TLSCACertFile,
+		TLSAuthClients: config.Properties.TLSAuthClients,
+	}
+	// port为0时只监听TLS端口
+	if config.Properties.Port > 0 {
+		tcpConfig.Address = fmt.Sprintf("%s:%d", config.Properties.Bind, config.Properties.Port)
+	}
+	if config.Properties.TLSPort > 0 {
+		tcpConfig.TLSAddress = fmt.Sprintf("%s:%d", config.Properties.Bind, config.Properties.TLSPort)
+	}
+	err := tcp.ListenAndServeWithSignal(tcpConfig, server.MakeHandler())
 
 	if err != nil {
 		logger.Error(err)
@@ -0,0 +1,213 @@
+package client
+
+import (
+	"gedis/interface/redis"
+	"gedis/lib/pool"
+	"net"
+	"time"
+)
+
+// Config 客户端配置，没有设置的字段使用默认值
+type Config struct {
+	Addr string
+	// Username不为空时发送 AUTH username password
+	Username string
+	Password string
+	DB       int
+	// 认证并选择数据库之后在新建立的连接上发送的命令，任意命令出错时建立连接失败
+	InitCmdLines [][][]byte
+
+	DialTimeout time.Duration
+	// 等待回复的超时时间，为负数时不限制，例如阻塞命令
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// 连接池中最多保留的空闲连接
+	MaxIdle uint
+	// 同时使用的最大连接数量
+	MaxActive uint
+
+	// 建立连接失败或者命令没有发送时的最大重试次数，为负数时不重试
+	MaxRetries int
+	// 重试之间的等待时间从MinRetryBackoff开始翻倍，不超过MaxRetryBackoff
+	MinRetryBackoff time.Duration
+	MaxRetryBackoff time.Duration
+}
+
+const (
+	defaultDialTimeout     = 3 * time.Second
+	defaultReadTimeout     = 3 * time.Second
+	defaultMaxIdle         = 8
+	defaultMaxActive       = 64
+	defaultMaxRetries      = 3
+	defaultMinRetryBackoff = 8 * time.Millisecond
+	defaultMaxRetryBackoff = 512 * time.Millisecond
+)
+
+func (cfg Config) withDefaults() Config {
+	if cfg.DialTimeout == 0 {
+		cfg.DialTimeout = defaultDialTimeout
+	}
+	if cfg.ReadTimeout == 0 {
+		cfg.ReadTimeout = defaultReadTimeout
+	}
+	if cfg.WriteTimeout == 0 {
+		cfg.WriteTimeout = cfg.ReadTimeout
+	}
+	if cfg.MaxIdle == 0 {
+		cfg.MaxIdle = defaultMaxIdle
+	}
+	if cfg.MaxActive == 0 {
+		cfg.MaxActive = defaultMaxActive
+	}
+	if cfg.MaxRetries == 0 {
+		cfg.MaxRetries = defaultMaxRetries
+	}
+	if cfg.MinRetryBackoff == 0 {
+		cfg.MinRetryBackoff = defaultMinRetryBackoff
+	}
+	if cfg.MaxRetryBackoff == 0 {
+		cfg.MaxRetryBackoff = defaultMaxRetryBackoff
+	}
+	return cfg
+}
+
+// Client 通过连接池访问服务端，可以被多个协程同时使用
+type Client struct {
+	cfg  Config
+	pool *pool.Pool
+}
+
+// New 创建客户端，连接在第一次使用时建立
+func New(cfg Config) *Client {
+	cfg = cfg.withDefaults()
+	return &Client{
+		cfg: cfg,
+		pool: pool.New(func() (interface{}, error) {
+			return Dial(cfg)
+		}, func(x interface{}) {
+			x.(*Conn).Close()
+		}, pool.Config{
+			MaxIdle:   cfg.MaxIdle,
+			MaxActive: cfg.MaxActive,
+		}),
+	}
+}
+
+// Addr 服务端地址
+func (client *Client) Addr() string {
+	return client.cfg.Addr
+}
+
+// Do 执行一条命令，服务端返回的错误作为回复返回而不是error
+func (client *Client) Do(cmdLine [][]byte) (redis.Reply, error) {
+	replies, err := client.pipeline([][][]byte{cmdLine})
+	if err != nil {
+		return nil, err
+	}
+	return replies[0], nil
+}
+
+// pipeline 借出一个连接执行多条命令，建立连接失败或者命令没有发送时等待一段时间之后重试
+// 命令已经发送之后出错不会重试，避免重复执行非幂等的命令
+func (client *Client) pipeline(cmdLines [][][]byte) ([]redis.Reply, error) {
+	for attempt := 0; ; attempt++ {
+		replies, err := client.tryPipeline(cmdLines)
+		if err == nil {
+			return replies, nil
+		}
+		if !retryable(err) || attempt >= client.cfg.MaxRetries {
+			return nil, err
+		}
+		time.Sleep(client.backoff(attempt))
+	}
+}
+
+func (client *Client) tryPipeline(cmdLines [][][]byte) ([]redis.Reply, error) {
+	conn, err := client.getConn()
+	if err != nil {
+		return nil, err
+	}
+	replies, err := conn.Pipeline(cmdLines)
+	if conn.Broken() {
+		client.pool.Discard(conn)
+	} else {
+		client.pool.Put(conn)
+	}
+	return replies, err
+}
+
+// getConn 借出一个连接，跳过空闲时被服务端关闭的连接
+func (client *Client) getConn() (*Conn, error) {
+	for {
+		raw, err := client.pool.Get()
+		if err != nil {
+			return nil, err
+		}
+		conn := raw.(*Conn)
+		if !conn.Broken() {
+			return conn, nil
+		}
+		client.pool.Discard(conn)
+	}
+}
+
+// retryable 连接池中的空闲连接已经被服务端关闭，或者无法建立连接
+func retryable(err error) bool {
+	if err == ErrClosed {
+		return true
+	}
+	if opErr, ok := err.(*net.OpError); ok && opErr.Op == "dial" {
+		return true
+	}
+	return false
+}
+
+// backoff 第attempt次重试之前的等待时间
+func (client *Client) backoff(attempt int) time.Duration {
+	backoff := client.cfg.MinRetryBackoff
+	for i := 0; i < attempt && backoff < client.cfg.MaxRetryBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > client.cfg.MaxRetryBackoff {
+		backoff = client.cfg.MaxRetryBackoff
+	}
+	return backoff
+}
+
+// Pipeline 创建流水线，命令在Exec时一次发送
+func (client *Client) Pipeline() *Pipeline {
+	return &Pipeline{client: client}
+}
+
+// Close 关闭所有连接
+func (client *Client) Close() {
+	client.pool.Close()
+}
+
+// Pipeline 收集多条命令，在同一个连接上一次写入，减少往返次数
+type Pipeline struct {
+	client   *Client
+	cmdLines [][][]byte
+}
+
+// Do 加入一条命令
+func (p *Pipeline) Do(cmdLine [][]byte) *Pipeline {
+	p.cmdLines = append(p.cmdLines, cmdLine)
+	return p
+}
+
+// Len 尚未执行的命令数量
+func (p *Pipeline) Len() int {
+	return len(p.cmdLines)
+}
+
+// Exec 发送所有命令，按顺序返回回复，之后流水线可以继续使用
+func (p *Pipeline) Exec() ([]redis.Reply, error) {
+	cmdLines := p.cmdLines
+	p.cmdLines = nil
+	if len(cmdLines) == 0 {
+		return nil, nil
+	}
+	return p.client.pipeline(cmdLines)
+}
@@ -0,0 +1,266 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"gedis/redis/parser"
+	"gedis/redis/protocol"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeServer 按照handle返回的原始字节回复收到的命令，并记录所有的命令
+// handle返回空字符串时不回复，close为true时回复之后关闭连接
+type fakeServer struct {
+	listener net.Listener
+	handle   func(args []string) (reply string, close bool)
+
+	mu       sync.Mutex
+	commands []string
+}
+
+func startFakeServer(t *testing.T, handle func(args []string) (string, bool)) *fakeServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &fakeServer{handle: handle}
+	server.serve(listener)
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	return server
+}
+
+func (server *fakeServer) serve(listener net.Listener) {
+	server.listener = listener
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serveConn(conn)
+		}
+	}()
+}
+
+func (server *fakeServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+	for payload := range parser.ParseStream(conn) {
+		multiBulk, ok := payload.Data.(*protocol.MultiBulkReply)
+		if payload.Err != nil || !ok {
+			return
+		}
+		args := make([]string, len(multiBulk.Args))
+		for i, arg := range multiBulk.Args {
+			args[i] = string(arg)
+		}
+		server.mu.Lock()
+		server.commands = append(server.commands, strings.Join(args, " "))
+		server.mu.Unlock()
+		reply, closeConn := server.handle(args)
+		if reply != "" {
+			if _, err := conn.Write([]byte(reply)); err != nil {
+				return
+			}
+		}
+		if closeConn {
+			return
+		}
+	}
+}
+
+func (server *fakeServer) addr() string {
+	return server.listener.Addr().String()
+}
+
+func (server *fakeServer) received() []string {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return append([]string(nil), server.commands...)
+}
+
+// echoHandler ECHO返回参数，BLOCK不回复，CLOSE不回复并关闭连接，其余命令返回OK
+func echoHandler(args []string) (string, bool) {
+	switch strings.ToUpper(args[0]) {
+	case "ECHO":
+		return string(protocol.MakeBulkReply([]byte(args[1])).ToBytes()), false
+	case "BLOCK":
+		return "", false
+	case "CLOSE":
+		return "", true
+	}
+	return "+OK\r\n", false
+}
+
+func TestPipelineOrder(t *testing.T) {
+	server := startFakeServer(t, echoHandler)
+	conn, err := Dial(Config{Addr: server.addr()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	cmdLines := make([][][]byte, 100)
+	for i := range cmdLines {
+		cmdLines[i] = toCmdLine("ECHO", fmt.Sprintf("v%d", i))
+	}
+	replies, err := conn.Pipeline(cmdLines)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, reply := range replies {
+		if actual, _ := String(reply, nil); actual != fmt.Sprintf("v%d", i) {
+			t.Fatalf("reply %d: expect v%d actually %q", i, i, actual)
+		}
+	}
+
+	// 多个协程共用一个连接，每个协程收到的都是自己的回复
+	var wg sync.WaitGroup
+	errs := make(chan error, 50)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			expect := fmt.Sprintf("g%d", i)
+			actual, err := String(conn.Do(toCmdLine("ECHO", expect)))
+			if err != nil || actual != expect {
+				errs <- fmt.Errorf("expect %s actually %q %v", expect, actual, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestReadTimeoutClosesConn(t *testing.T) {
+	server := startFakeServer(t, echoHandler)
+	conn, err := Dial(Config{Addr: server.addr(), ReadTimeout: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Do(toCmdLine("BLOCK")); err != ErrTimeout {
+		t.Fatalf("expect timeout actually %v", err)
+	}
+	// 之后到达的回复无法确定属于哪个请求，连接已经关闭
+	if !conn.Broken() {
+		t.Error("expect connection closed after timeout")
+	}
+	if _, err := conn.Do(toCmdLine("ECHO", "v")); err != ErrClosed {
+		t.Errorf("expect closed actually %v", err)
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	dialErr := &net.OpError{Op: "dial", Err: errors.New("connection refused")}
+	readErr := &net.OpError{Op: "read", Err: errors.New("connection reset")}
+	cases := map[error]bool{
+		ErrClosed:    true,
+		dialErr:      true,
+		ErrTimeout:   false,
+		errConnLost:  false,
+		readErr:      false,
+		Error("ERR"): false,
+	}
+	for err, expect := range cases {
+		if retryable(err) != expect {
+			t.Errorf("%v: expect retryable %v", err, expect)
+		}
+	}
+}
+
+func TestRetryOnDial(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	_ = listener.Close()
+	server := &fakeServer{handle: echoHandler}
+	started := make(chan net.Listener, 1)
+	// 服务端稍后才开始监听，客户端重试建立连接
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		listener, err := net.Listen("tcp", addr)
+		if err == nil {
+			server.serve(listener)
+		}
+		started <- listener
+	}()
+	defer func() {
+		if listener := <-started; listener != nil {
+			_ = listener.Close()
+		}
+	}()
+	client := New(Config{Addr: addr, MaxRetries: 10, MinRetryBackoff: 20 * time.Millisecond, MaxRetryBackoff: 50 * time.Millisecond})
+	defer client.Close()
+	if actual, err := String(client.Do(toCmdLine("ECHO", "v"))); err != nil || actual != "v" {
+		t.Fatalf("expect v actually %q %v", actual, err)
+	}
+
+	// 不重试时直接返回建立连接的错误
+	noRetry := New(Config{Addr: "127.0.0.1:1", MaxRetries: -1})
+	defer noRetry.Close()
+	if _, err := noRetry.Do(toCmdLine("PING")); !retryable(err) {
+		t.Errorf("expect dial error actually %v", err)
+	}
+}
+
+func TestNoRetryAfterSent(t *testing.T) {
+	server := startFakeServer(t, echoHandler)
+	client := New(Config{Addr: server.addr(), MinRetryBackoff: time.Millisecond})
+	defer client.Close()
+	// 命令已经发送之后连接断开，命令可能已经执行，不能重试
+	if _, err := client.Do(toCmdLine("CLOSE")); err != errConnLost {
+		t.Fatalf("expect connection lost actually %v", err)
+	}
+	if commands := server.received(); !reflect.DeepEqual(commands, []string{"CLOSE"}) {
+		t.Errorf("expect CLOSE sent once actually %q", commands)
+	}
+	// 断开的连接不会放回连接池
+	if actual, err := String(client.Do(toCmdLine("ECHO", "v"))); err != nil || actual != "v" {
+		t.Errorf("expect v actually %q %v", actual, err)
+	}
+}
+
+func TestDialAuthSelect(t *testing.T) {
+	server := startFakeServer(t, func(args []string) (string, bool) {
+		if strings.ToUpper(args[0]) == "AUTH" && args[len(args)-1] != "pw" {
+			return "-WRONGPASS invalid username-password pair\r\n", false
+		}
+		return echoHandler(args)
+	})
+	conn, err := Dial(Config{Addr: server.addr(), Password: "pw", DB: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	conn, err = Dial(Config{Addr: server.addr(), Username: "user", Password: "pw"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	// 不需要认证以及使用0号数据库时不发送命令
+	conn, err = Dial(Config{Addr: server.addr()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	expect := []string{"AUTH pw", "SELECT 3", "AUTH user pw"}
+	if commands := server.received(); !reflect.DeepEqual(commands, expect) {
+		t.Errorf("expect %q actually %q", expect, commands)
+	}
+
+	_, err = Dial(Config{Addr: server.addr(), Password: "wrong"})
+	if _, ok := err.(Error); !ok || !strings.HasPrefix(err.Error(), "WRONGPASS") {
+		t.Errorf("expect WRONGPASS actually %v", err)
+	}
+}
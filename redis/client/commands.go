@@ -0,0 +1,546 @@
+package client
+
+import (
+	"gedis/interface/redis"
+	"gedis/lib/utils"
+	"strconv"
+)
+
+/*
+常用命令的类型化封装，参数与返回值与命令一一对应
+1. 过期时间等参数与命令相同，以秒或者毫秒为单位的整数
+2. key不存在等情况下返回ErrNil，服务端返回的错误转换为Error
+*/
+
+func toCmdLine(args ...string) [][]byte {
+	return utils.ToCmdLine(args...)
+}
+
+func formatInt(n int64) string {
+	return strconv.FormatInt(n, 10)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func (client *Client) exec(args ...string) (redis.Reply, error) {
+	return client.Do(toCmdLine(args...))
+}
+
+/* ---- keys ---- */
+
+// Ping 返回PONG
+func (client *Client) Ping() (string, error) {
+	return String(client.exec("PING"))
+}
+
+// Del 删除key，返回删除的数量
+func (client *Client) Del(keys ...string) (int64, error) {
+	return Int64(client.exec(append([]string{"DEL"}, keys...)...))
+}
+
+// Exists 返回存在的key的数量
+func (client *Client) Exists(keys ...string) (int64, error) {
+	return Int64(client.exec(append([]string{"EXISTS"}, keys...)...))
+}
+
+// Expire 设置以秒为单位的过期时间，key不存在时返回false
+func (client *Client) Expire(key string, seconds int64) (bool, error) {
+	return Bool(client.exec("EXPIRE", key, formatInt(seconds)))
+}
+
+// PExpire 设置以毫秒为单位的过期时间
+func (client *Client) PExpire(key string, milliseconds int64) (bool, error) {
+	return Bool(client.exec("PEXPIRE", key, formatInt(milliseconds)))
+}
+
+// ExpireAt 在unix时间戳timestamp(秒)过期
+func (client *Client) ExpireAt(key string, timestamp int64) (bool, error) {
+	return Bool(client.exec("EXPIREAT", key, formatInt(timestamp)))
+}
+
+// PExpireAt 在unix时间戳timestamp(毫秒)过期
+func (client *Client) PExpireAt(key string, timestamp int64) (bool, error) {
+	return Bool(client.exec("PEXPIREAT", key, formatInt(timestamp)))
+}
+
+// Persist 取消过期时间
+func (client *Client) Persist(key string) (bool, error) {
+	return Bool(client.exec("PERSIST", key))
+}
+
+// TTL 剩余的秒数，没有过期时间时为-1，key不存在时为-2
+func (client *Client) TTL(key string) (int64, error) {
+	return Int64(client.exec("TTL", key))
+}
+
+// PTTL 剩余的毫秒数
+func (client *Client) PTTL(key string) (int64, error) {
+	return Int64(client.exec("PTTL", key))
+}
+
+// Type 返回key的类型，不存在时为none
+func (client *Client) Type(key string) (string, error) {
+	return String(client.exec("TYPE", key))
+}
+
+// Rename 重命名key
+func (client *Client) Rename(key string, newKey string) error {
+	return Status(client.exec("RENAME", key, newKey))
+}
+
+// RenameNX newKey不存在时重命名
+func (client *Client) RenameNX(key string, newKey string) (bool, error) {
+	return Bool(client.exec("RENAMENX", key, newKey))
+}
+
+// Keys 返回匹配pattern的所有key
+func (client *Client) Keys(pattern string) ([]string, error) {
+	return Strings(client.exec("KEYS", pattern))
+}
+
+// Dump 序列化key的值
+func (client *Client) Dump(key string) (string, error) {
+	return String(client.exec("DUMP", key))
+}
+
+// Restore 使用Dump的结果重建key，ttl为毫秒，为0时不过期
+func (client *Client) Restore(key string, ttl int64, value string, replace bool) error {
+	args := []string{"RESTORE", key, formatInt(ttl), value}
+	if replace {
+		args = append(args, "REPLACE")
+	}
+	return Status(client.exec(args...))
+}
+
+// FlushDB 清空当前数据库
+func (client *Client) FlushDB() error {
+	return Status(client.exec("FLUSHDB"))
+}
+
+/* ---- string ---- */
+
+// Get key不存在时返回ErrNil
+func (client *Client) Get(key string) (string, error) {
+	return String(client.exec("GET", key))
+}
+
+// Set 设置key的值
+func (client *Client) Set(key string, value string) error {
+	return Status(client.exec("SET", key, value))
+}
+
+// SetNX key不存在时设置，返回是否设置成功
+func (client *Client) SetNX(key string, value string) (bool, error) {
+	return Bool(client.exec("SETNX", key, value))
+}
+
+// SetEX 设置值以及以秒为单位的过期时间
+func (client *Client) SetEX(key string, seconds int64, value string) error {
+	return Status(client.exec("SETEX", key, formatInt(seconds), value))
+}
+
+// PSetEX 设置值以及以毫秒为单位的过期时间
+func (client *Client) PSetEX(key string, milliseconds int64, value string) error {
+	return Status(client.exec("PSETEX", key, formatInt(milliseconds), value))
+}
+
+// GetSet 设置新的值并返回旧的值
+func (client *Client) GetSet(key string, value string) (string, error) {
+	return String(client.exec("GETSET", key, value))
+}
+
+// MGet 不存在的key对应的元素为nil
+func (client *Client) MGet(keys ...string) ([][]byte, error) {
+	return ByteSlices(client.exec(append([]string{"MGET"}, keys...)...))
+}
+
+// MSet pairs为 key value key value ...
+func (client *Client) MSet(pairs ...string) error {
+	return Status(client.exec(append([]string{"MSET"}, pairs...)...))
+}
+
+// MSetNX 所有的key都不存在时设置
+func (client *Client) MSetNX(pairs ...string) (bool, error) {
+	return Bool(client.exec(append([]string{"MSETNX"}, pairs...)...))
+}
+
+// Incr 加1之后的值
+func (client *Client) Incr(key string) (int64, error) {
+	return Int64(client.exec("INCR", key))
+}
+
+// IncrBy 加上delta之后的值
+func (client *Client) IncrBy(key string, delta int64) (int64, error) {
+	return Int64(client.exec("INCRBY", key, formatInt(delta)))
+}
+
+// IncrByFloat 加上浮点数delta之后的值
+func (client *Client) IncrByFloat(key string, delta float64) (float64, error) {
+	return Float64(client.exec("INCRBYFLOAT", key, formatFloat(delta)))
+}
+
+// Decr 减1之后的值
+func (client *Client) Decr(key string) (int64, error) {
+	return Int64(client.exec("DECR", key))
+}
+
+// DecrBy 减去delta之后的值
+func (client *Client) DecrBy(key string, delta int64) (int64, error) {
+	return Int64(client.exec("DECRBY", key, formatInt(delta)))
+}
+
+// StrLen 字符串的长度
+func (client *Client) StrLen(key string) (int64, error) {
+	return Int64(client.exec("STRLEN", key))
+}
+
+// Append 追加之后字符串的长度
+func (client *Client) Append(key string, value string) (int64, error) {
+	return Int64(client.exec("APPEND", key, value))
+}
+
+// SetRange 从offset开始覆盖，返回修改之后字符串的长度
+func (client *Client) SetRange(key string, offset int64, value string) (int64, error) {
+	return Int64(client.exec("SETRANGE", key, formatInt(offset), value))
+}
+
+// GetRange 返回[start, end]之间的子串
+func (client *Client) GetRange(key string, start int64, end int64) (string, error) {
+	return String(client.exec("GETRANGE", key, formatInt(start), formatInt(end)))
+}
+
+// SetBit 设置offset位置的bit，返回原来的值
+func (client *Client) SetBit(key string, offset int64, value int) (int64, error) {
+	return Int64(client.exec("SETBIT", key, formatInt(offset), strconv.Itoa(value)))
+}
+
+// GetBit 返回offset位置的bit
+func (client *Client) GetBit(key string, offset int64) (int64, error) {
+	return Int64(client.exec("GETBIT", key, formatInt(offset)))
+}
+
+// BitCount 值为1的bit数量
+func (client *Client) BitCount(key string) (int64, error) {
+	return Int64(client.exec("BITCOUNT", key))
+}
+
+// BitPos 第一个值为bit的位置
+func (client *Client) BitPos(key string, bit int) (int64, error) {
+	return Int64(client.exec("BITPOS", key, strconv.Itoa(bit)))
+}
+
+/* ---- list ---- */
+
+// LPush 返回插入之后列表的长度
+func (client *Client) LPush(key string, values ...string) (int64, error) {
+	return Int64(client.exec(append([]string{"LPUSH", key}, values...)...))
+}
+
+// RPush 返回插入之后列表的长度
+func (client *Client) RPush(key string, values ...string) (int64, error) {
+	return Int64(client.exec(append([]string{"RPUSH", key}, values...)...))
+}
+
+// LPushX 列表存在时插入
+func (client *Client) LPushX(key string, values ...string) (int64, error) {
+	return Int64(client.exec(append([]string{"LPUSHX", key}, values...)...))
+}
+
+// RPushX 列表存在时插入
+func (client *Client) RPushX(key string, values ...string) (int64, error) {
+	return Int64(client.exec(append([]string{"RPUSHX", key}, values...)...))
+}
+
+// LPop 列表为空时返回ErrNil
+func (client *Client) LPop(key string) (string, error) {
+	return String(client.exec("LPOP", key))
+}
+
+// RPop 列表为空时返回ErrNil
+func (client *Client) RPop(key string) (string, error) {
+	return String(client.exec("RPOP", key))
+}
+
+// RPopLPush 弹出source的最后一个元素插入到destination的头部
+func (client *Client) RPopLPush(source string, destination string) (string, error) {
+	return String(client.exec("RPOPLPUSH", source, destination))
+}
+
+// LLen 列表的长度
+func (client *Client) LLen(key string) (int64, error) {
+	return Int64(client.exec("LLEN", key))
+}
+
+// LIndex 下标越界时返回ErrNil
+func (client *Client) LIndex(key string, index int64) (string, error) {
+	return String(client.exec("LINDEX", key, formatInt(index)))
+}
+
+// LSet 设置下标为index的元素
+func (client *Client) LSet(key string, index int64, value string) error {
+	return Status(client.exec("LSET", key, formatInt(index), value))
+}
+
+// LRem 删除count个等于value的元素，返回删除的数量
+func (client *Client) LRem(key string, count int64, value string) (int64, error) {
+	return Int64(client.exec("LREM", key, formatInt(count), value))
+}
+
+// LRange 返回[start, stop]之间的元素
+func (client *Client) LRange(key string, start int64, stop int64) ([]string, error) {
+	return Strings(client.exec("LRANGE", key, formatInt(start), formatInt(stop)))
+}
+
+/* ---- hash ---- */
+
+// HSet 返回新增的field数量
+func (client *Client) HSet(key string, field string, value string) (int64, error) {
+	return Int64(client.exec("HSET", key, field, value))
+}
+
+// HSetNX field不存在时设置
+func (client *Client) HSetNX(key string, field string, value string) (bool, error) {
+	return Bool(client.exec("HSETNX", key, field, value))
+}
+
+// HMSet 设置多个field
+func (client *Client) HMSet(key string, fields map[string]string) error {
+	args := make([]string, 0, 2+len(fields)*2)
+	args = append(args, "HMSET", key)
+	for field, value := range fields {
+		args = append(args, field, value)
+	}
+	return Status(client.exec(args...))
+}
+
+// HGet field不存在时返回ErrNil
+func (client *Client) HGet(key string, field string) (string, error) {
+	return String(client.exec("HGET", key, field))
+}
+
+// HMGet 不存在的field对应的元素为nil
+func (client *Client) HMGet(key string, fields ...string) ([][]byte, error) {
+	return ByteSlices(client.exec(append([]string{"HMGET", key}, fields...)...))
+}
+
+// HExists field是否存在
+func (client *Client) HExists(key string, field string) (bool, error) {
+	return Bool(client.exec("HEXISTS", key, field))
+}
+
+// HDel 返回删除的field数量
+func (client *Client) HDel(key string, fields ...string) (int64, error) {
+	return Int64(client.exec(append([]string{"HDEL", key}, fields...)...))
+}
+
+// HLen field的数量
+func (client *Client) HLen(key string) (int64, error) {
+	return Int64(client.exec("HLEN", key))
+}
+
+// HGetAll 所有的field及其值
+func (client *Client) HGetAll(key string) (map[string]string, error) {
+	return StringMap(client.exec("HGETALL", key))
+}
+
+// HKeys 所有的field
+func (client *Client) HKeys(key string) ([]string, error) {
+	return Strings(client.exec("HKEYS", key))
+}
+
+// HVals 所有的值
+func (client *Client) HVals(key string) ([]string, error) {
+	return Strings(client.exec("HVALS", key))
+}
+
+// HIncrBy 加上delta之后的值
+func (client *Client) HIncrBy(key string, field string, delta int64) (int64, error) {
+	return Int64(client.exec("HINCRBY", key, field, formatInt(delta)))
+}
+
+// HIncrByFloat 加上浮点数delta之后的值
+func (client *Client) HIncrByFloat(key string, field string, delta float64) (float64, error) {
+	return Float64(client.exec("HINCRBYFLOAT", key, field, formatFloat(delta)))
+}
+
+/* ---- set ---- */
+
+// SAdd 返回新增的元素数量
+func (client *Client) SAdd(key string, members ...string) (int64, error) {
+	return Int64(client.exec(append([]string{"SADD", key}, members...)...))
+}
+
+// SRem 返回删除的元素数量
+func (client *Client) SRem(key string, members ...string) (int64, error) {
+	return Int64(client.exec(append([]string{"SREM", key}, members...)...))
+}
+
+// SIsMember member是否在集合中
+func (client *Client) SIsMember(key string, member string) (bool, error) {
+	return Bool(client.exec("SISMEMBER", key, member))
+}
+
+// SCard 集合的大小
+func (client *Client) SCard(key string) (int64, error) {
+	return Int64(client.exec("SCARD", key))
+}
+
+// SMembers 集合中的所有元素
+func (client *Client) SMembers(key string) ([]string, error) {
+	return Strings(client.exec("SMEMBERS", key))
+}
+
+// SPop 随机弹出一个元素，集合为空时返回ErrNil
+func (client *Client) SPop(key string) (string, error) {
+	return String(client.exec("SPOP", key))
+}
+
+// SRandMember 随机返回count个元素，count为负数时可能重复
+func (client *Client) SRandMember(key string, count int64) ([]string, error) {
+	return Strings(client.exec("SRANDMEMBER", key, formatInt(count)))
+}
+
+// SMove 将member从source移动到destination
+func (client *Client) SMove(source string, destination string, member string) (bool, error) {
+	return Bool(client.exec("SMOVE", source, destination, member))
+}
+
+// SInter 交集
+func (client *Client) SInter(keys ...string) ([]string, error) {
+	return Strings(client.exec(append([]string{"SINTER"}, keys...)...))
+}
+
+// SUnion 并集
+func (client *Client) SUnion(keys ...string) ([]string, error) {
+	return Strings(client.exec(append([]string{"SUNION"}, keys...)...))
+}
+
+// SDiff 第一个集合与其他集合的差集
+func (client *Client) SDiff(keys ...string) ([]string, error) {
+	return Strings(client.exec(append([]string{"SDIFF"}, keys...)...))
+}
+
+// SInterStore 交集保存到destination，返回结果的大小
+func (client *Client) SInterStore(destination string, keys ...string) (int64, error) {
+	return Int64(client.exec(append([]string{"SINTERSTORE", destination}, keys...)...))
+}
+
+// SUnionStore 并集保存到destination，返回结果的大小
+func (client *Client) SUnionStore(destination string, keys ...string) (int64, error) {
+	return Int64(client.exec(append([]string{"SUNIONSTORE", destination}, keys...)...))
+}
+
+// SDiffStore 差集保存到destination，返回结果的大小
+func (client *Client) SDiffStore(destination string, keys ...string) (int64, error) {
+	return Int64(client.exec(append([]string{"SDIFFSTORE", destination}, keys...)...))
+}
+
+/* ---- sorted set ---- */
+
+// Z 有序集合中的元素及其分数
+type Z struct {
+	Score  float64
+	Member string
+}
+
+// ZAdd 返回新增的元素数量
+func (client *Client) ZAdd(key string, members ...Z) (int64, error) {
+	args := make([]string, 0, 2+len(members)*2)
+	args = append(args, "ZADD", key)
+	for _, z := range members {
+		args = append(args, formatFloat(z.Score), z.Member)
+	}
+	return Int64(client.exec(args...))
+}
+
+// ZScore member不存在时返回ErrNil
+func (client *Client) ZScore(key string, member string) (float64, error) {
+	return Float64(client.exec("ZSCORE", key, member))
+}
+
+// ZIncrBy 加上delta之后的分数
+func (client *Client) ZIncrBy(key string, delta float64, member string) (float64, error) {
+	return Float64(client.exec("ZINCRBY", key, formatFloat(delta), member))
+}
+
+// ZCard 有序集合的大小
+func (client *Client) ZCard(key string) (int64, error) {
+	return Int64(client.exec("ZCARD", key))
+}
+
+// ZCount 分数在[min, max]之间的元素数量，min与max的格式与命令相同，例如 (1 或者 -inf
+func (client *Client) ZCount(key string, min string, max string) (int64, error) {
+	return Int64(client.exec("ZCOUNT", key, min, max))
+}
+
+// ZRank 按分数从小到大的排名，member不存在时返回ErrNil
+func (client *Client) ZRank(key string, member string) (int64, error) {
+	return Int64(client.exec("ZRANK", key, member))
+}
+
+// ZRevRank 按分数从大到小的排名
+func (client *Client) ZRevRank(key string, member string) (int64, error) {
+	return Int64(client.exec("ZREVRANK", key, member))
+}
+
+// ZRange 按分数从小到大返回排名在[start, stop]之间的元素
+func (client *Client) ZRange(key string, start int64, stop int64) ([]string, error) {
+	return Strings(client.exec("ZRANGE", key, formatInt(start), formatInt(stop)))
+}
+
+// ZRangeWithScores 与ZRange相同，同时返回分数
+func (client *Client) ZRangeWithScores(key string, start int64, stop int64) ([]Z, error) {
+	return zSlice(client.exec("ZRANGE", key, formatInt(start), formatInt(stop), "WITHSCORES"))
+}
+
+// ZRevRange 按分数从大到小返回排名在[start, stop]之间的元素
+func (client *Client) ZRevRange(key string, start int64, stop int64) ([]string, error) {
+	return Strings(client.exec("ZREVRANGE", key, formatInt(start), formatInt(stop)))
+}
+
+// ZRangeByScore 按分数从小到大返回分数在[min, max]之间的元素
+func (client *Client) ZRangeByScore(key string, min string, max string) ([]string, error) {
+	return Strings(client.exec("ZRANGEBYSCORE", key, min, max))
+}
+
+// ZRevRangeByScore 按分数从大到小返回分数在[min, max]之间的元素
+func (client *Client) ZRevRangeByScore(key string, max string, min string) ([]string, error) {
+	return Strings(client.exec("ZREVRANGEBYSCORE", key, max, min))
+}
+
+// ZRem 返回删除的元素数量
+func (client *Client) ZRem(key string, members ...string) (int64, error) {
+	return Int64(client.exec(append([]string{"ZREM", key}, members...)...))
+}
+
+// ZRemRangeByRank 删除排名在[start, stop]之间的元素
+func (client *Client) ZRemRangeByRank(key string, start int64, stop int64) (int64, error) {
+	return Int64(client.exec("ZREMRANGEBYRANK", key, formatInt(start), formatInt(stop)))
+}
+
+// ZRemRangeByScore 删除分数在[min, max]之间的元素
+func (client *Client) ZRemRangeByScore(key string, min string, max string) (int64, error) {
+	return Int64(client.exec("ZREMRANGEBYSCORE", key, min, max))
+}
+
+// zSlice WITHSCORES的结果，元素与分数交替出现
+func zSlice(reply redis.Reply, err error) ([]Z, error) {
+	values, err := Strings(reply, err)
+	if err != nil {
+		return nil, err
+	}
+	if len(values)%2 != 0 {
+		return nil, unexpectedReply(reply, "pairs")
+	}
+	result := make([]Z, 0, len(values)/2)
+	for i := 0; i < len(values); i += 2 {
+		score, err := strconv.ParseFloat(values[i+1], 64)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, Z{Member: values[i], Score: score})
+	}
+	return result, nil
+}
@@ -0,0 +1,221 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"gedis/interface/redis"
+	"gedis/lib/sync/atomic"
+	"gedis/redis/parser"
+	"gedis/redis/protocol"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrClosed 连接已经关闭，命令没有发送，可以在其他连接上重试
+	ErrClosed = errors.New("gedis: connection closed")
+	// ErrTimeout 没有在ReadTimeout之内收到回复，连接已经关闭，命令可能已经执行
+	ErrTimeout = errors.New("gedis: i/o timeout")
+	// errConnLost 等待回复时连接断开，命令可能已经执行
+	errConnLost = errors.New("gedis: connection lost")
+)
+
+// pendingQueueSize 已经发送等待回复的请求队列长度，队列满时发送方阻塞
+const pendingQueueSize = 1024
+
+// request 一条已经发送的命令，收到回复或者连接断开之后关闭done
+type request struct {
+	reply redis.Reply
+	err   error
+	done  chan struct{}
+}
+
+/*
+Conn 与服务端之间的一个连接，支持多个协程同时发送命令
+1. 发送时持有写锁，先将请求加入等待队列再写入连接，保证队列的顺序与服务端收到命令的顺序相同
+2. 读取协程按顺序把回复交给队列中的请求，服务端按照收到命令的顺序返回回复
+3. 等待回复超时之后无法再确定后续回复对应哪个请求，直接关闭连接
+*/
+type Conn struct {
+	conn net.Conn
+	cfg  Config
+
+	mu      sync.Mutex
+	pending chan *request
+	closed  atomic.Boolean
+	// 连接关闭之后关闭，用于结束读取协程
+	stopped chan struct{}
+}
+
+// Dial 建立连接，按照配置发送AUTH和SELECT
+func Dial(cfg Config) (*Conn, error) {
+	cfg = cfg.withDefaults()
+	netConn, err := net.DialTimeout("tcp", cfg.Addr, cfg.DialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn := &Conn{
+		conn:    netConn,
+		cfg:     cfg,
+		pending: make(chan *request, pendingQueueSize),
+		stopped: make(chan struct{}),
+	}
+	go conn.readLoop(parser.ParseStream(netConn))
+	if err := conn.init(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// init 认证并选择数据库，然后发送InitCmdLines
+func (conn *Conn) init() error {
+	var cmdLines [][][]byte
+	if conn.cfg.Password != "" {
+		if conn.cfg.Username != "" {
+			cmdLines = append(cmdLines, toCmdLine("AUTH", conn.cfg.Username, conn.cfg.Password))
+		} else {
+			cmdLines = append(cmdLines, toCmdLine("AUTH", conn.cfg.Password))
+		}
+	}
+	if conn.cfg.DB != 0 {
+		cmdLines = append(cmdLines, toCmdLine("SELECT", formatInt(int64(conn.cfg.DB))))
+	}
+	cmdLines = append(cmdLines, conn.cfg.InitCmdLines...)
+	if len(cmdLines) == 0 {
+		return nil
+	}
+	replies, err := conn.Pipeline(cmdLines)
+	if err != nil {
+		return err
+	}
+	for _, reply := range replies {
+		if err := replyError(reply); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Do 发送一条命令并等待回复
+func (conn *Conn) Do(cmdLine [][]byte) (redis.Reply, error) {
+	replies, err := conn.Pipeline([][][]byte{cmdLine})
+	if err != nil {
+		return nil, err
+	}
+	return replies[0], nil
+}
+
+// Pipeline 一次写入多条命令，按顺序返回所有的回复
+func (conn *Conn) Pipeline(cmdLines [][][]byte) ([]redis.Reply, error) {
+	reqs, err := conn.send(cmdLines)
+	if err != nil {
+		return nil, err
+	}
+	replies := make([]redis.Reply, len(reqs))
+	var timeout <-chan time.Time
+	if conn.cfg.ReadTimeout > 0 {
+		timer := time.NewTimer(conn.cfg.ReadTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for i, req := range reqs {
+		select {
+		case <-req.done:
+		case <-timeout:
+			conn.Close()
+			return nil, ErrTimeout
+		}
+		if req.err != nil {
+			return nil, req.err
+		}
+		replies[i] = req.reply
+	}
+	return replies, nil
+}
+
+// send 将命令加入等待队列并写入连接，返回ErrClosed时没有写入任何命令
+func (conn *Conn) send(cmdLines [][][]byte) ([]*request, error) {
+	buf := &bytes.Buffer{}
+	reqs := make([]*request, len(cmdLines))
+	for i, cmdLine := range cmdLines {
+		buf.Write(protocol.MakeMultiBulkReply(cmdLine).ToBytes())
+		reqs[i] = &request{done: make(chan struct{})}
+	}
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if conn.closed.Get() {
+		return nil, ErrClosed
+	}
+	for _, req := range reqs {
+		select {
+		case conn.pending <- req:
+		case <-conn.stopped:
+			// 读取协程已经退出，队列不会再被消费
+			return nil, errConnLost
+		}
+	}
+	if conn.cfg.WriteTimeout > 0 {
+		_ = conn.conn.SetWriteDeadline(time.Now().Add(conn.cfg.WriteTimeout))
+	}
+	if _, err := conn.conn.Write(buf.Bytes()); err != nil {
+		// 部分命令可能已经写入，连接的状态无法确定
+		conn.Close()
+		return nil, err
+	}
+	return reqs, nil
+}
+
+// readLoop 按顺序将回复交给等待队列中的请求，连接断开之后通知所有等待的请求
+func (conn *Conn) readLoop(replies <-chan *parser.Payload) {
+	for payload := range replies {
+		if payload.Err != nil {
+			// 协议错误之后无法确定后续的回复对应哪个请求
+			conn.Close()
+			break
+		}
+		var req *request
+		select {
+		case req = <-conn.pending:
+		default:
+			// 没有请求却收到了回复
+			conn.Close()
+		}
+		if req == nil {
+			break
+		}
+		req.reply = payload.Data
+		close(req.done)
+	}
+	conn.Close()
+	// 解析协程在连接关闭之后还会发送错误，需要取走
+	for range replies {
+	}
+	close(conn.stopped)
+	// 不再有新的请求加入队列
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	for {
+		select {
+		case req := <-conn.pending:
+			req.err = errConnLost
+			close(req.done)
+		default:
+			return
+		}
+	}
+}
+
+// Broken 连接已经关闭，不能继续使用
+func (conn *Conn) Broken() bool {
+	return conn.closed.Get()
+}
+
+// Close 关闭连接，等待回复的请求返回错误
+// 不需要持有mu，发送方可能持有mu等待读取协程消费队列
+func (conn *Conn) Close() {
+	if conn.closed.CompareAndSet(false, true) {
+		_ = conn.conn.Close()
+	}
+}
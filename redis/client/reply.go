@@ -0,0 +1,211 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"gedis/interface/redis"
+	"gedis/redis/protocol"
+	"strconv"
+)
+
+// ErrNil 服务端返回了空值，例如GET不存在的key
+var ErrNil = errors.New("gedis: nil reply")
+
+// Error 服务端返回的错误回复
+type Error string
+
+func (e Error) Error() string {
+	return string(e)
+}
+
+/*
+以下函数将Do的返回值转换为具体的类型，例如 client.String(c.Do(cmdLine))
+1. err不为空时直接返回err
+2. 错误回复转换为Error，空值返回ErrNil
+*/
+
+// replyError 错误回复转换为Error
+func replyError(reply redis.Reply) error {
+	if errReply, ok := reply.(protocol.ErrorReply); ok {
+		return Error(errReply.Error())
+	}
+	return nil
+}
+
+func unexpectedReply(reply redis.Reply, expect string) error {
+	return fmt.Errorf("gedis: unexpected reply %q, expect %s", reply.ToBytes(), expect)
+}
+
+// String 字符串、状态以及整数回复转换为字符串
+func String(reply redis.Reply, err error) (string, error) {
+	if err != nil {
+		return "", err
+	}
+	if err := replyError(reply); err != nil {
+		return "", err
+	}
+	switch r := reply.(type) {
+	case *protocol.BulkReply:
+		return string(r.Arg), nil
+	case *protocol.StatusReply:
+		return r.Status, nil
+	case *protocol.IntReply:
+		return strconv.FormatInt(r.Code, 10), nil
+	case *protocol.NullBulkReply:
+		return "", ErrNil
+	}
+	return "", unexpectedReply(reply, "string")
+}
+
+// Status 命令执行成功时返回的状态，例如OK
+func Status(reply redis.Reply, err error) error {
+	if err != nil {
+		return err
+	}
+	if err := replyError(reply); err != nil {
+		return err
+	}
+	switch reply.(type) {
+	case *protocol.StatusReply, *protocol.OkReply:
+		return nil
+	}
+	return unexpectedReply(reply, "status")
+}
+
+// Int64 整数回复或者内容为整数的字符串
+func Int64(reply redis.Reply, err error) (int64, error) {
+	if err != nil {
+		return 0, err
+	}
+	if err := replyError(reply); err != nil {
+		return 0, err
+	}
+	switch r := reply.(type) {
+	case *protocol.IntReply:
+		return r.Code, nil
+	case *protocol.BulkReply:
+		return strconv.ParseInt(string(r.Arg), 10, 64)
+	case *protocol.NullBulkReply:
+		return 0, ErrNil
+	}
+	return 0, unexpectedReply(reply, "integer")
+}
+
+// Float64 内容为浮点数的字符串或者整数回复
+func Float64(reply redis.Reply, err error) (float64, error) {
+	if err != nil {
+		return 0, err
+	}
+	if err := replyError(reply); err != nil {
+		return 0, err
+	}
+	switch r := reply.(type) {
+	case *protocol.BulkReply:
+		return strconv.ParseFloat(string(r.Arg), 64)
+	case *protocol.IntReply:
+		return float64(r.Code), nil
+	case *protocol.NullBulkReply:
+		return 0, ErrNil
+	}
+	return 0, unexpectedReply(reply, "float")
+}
+
+// Bool 整数回复不为0、状态回复以及非空值为true，空值为false，例如 SET key value NX
+func Bool(reply redis.Reply, err error) (bool, error) {
+	if err != nil {
+		return false, err
+	}
+	if err := replyError(reply); err != nil {
+		return false, err
+	}
+	switch r := reply.(type) {
+	case *protocol.IntReply:
+		return r.Code != 0, nil
+	case *protocol.StatusReply, *protocol.OkReply, *protocol.BulkReply:
+		return true, nil
+	case *protocol.NullBulkReply:
+		return false, nil
+	}
+	return false, unexpectedReply(reply, "boolean")
+}
+
+// ByteSlices 数组回复，空值元素为nil，例如MGET
+func ByteSlices(reply redis.Reply, err error) ([][]byte, error) {
+	values, err := Values(reply, err)
+	if err != nil {
+		return nil, err
+	}
+	result := make([][]byte, len(values))
+	for i, value := range values {
+		switch r := value.(type) {
+		case *protocol.BulkReply:
+			result[i] = r.Arg
+		case *protocol.NullBulkReply:
+		default:
+			s, err := String(value, nil)
+			if err != nil {
+				return nil, err
+			}
+			result[i] = []byte(s)
+		}
+	}
+	return result, nil
+}
+
+// Strings 数组回复，空值元素为空字符串
+func Strings(reply redis.Reply, err error) ([]string, error) {
+	values, err := ByteSlices(reply, err)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]string, len(values))
+	for i, value := range values {
+		result[i] = string(value)
+	}
+	return result, nil
+}
+
+// StringMap 由键值对组成的数组回复，例如HGETALL
+func StringMap(reply redis.Reply, err error) (map[string]string, error) {
+	values, err := Strings(reply, err)
+	if err != nil {
+		return nil, err
+	}
+	if len(values)%2 != 0 {
+		return nil, unexpectedReply(reply, "pairs")
+	}
+	result := make(map[string]string, len(values)/2)
+	for i := 0; i < len(values); i += 2 {
+		result[values[i]] = values[i+1]
+	}
+	return result, nil
+}
+
+// Values 数组回复的每个元素
+func Values(reply redis.Reply, err error) ([]redis.Reply, error) {
+	if err != nil {
+		return nil, err
+	}
+	if err := replyError(reply); err != nil {
+		return nil, err
+	}
+	switch r := reply.(type) {
+	case *protocol.MultiBulkReply:
+		values := make([]redis.Reply, len(r.Args))
+		for i, arg := range r.Args {
+			if arg == nil {
+				values[i] = protocol.MakeNullBulkReply()
+			} else {
+				values[i] = protocol.MakeBulkReply(arg)
+			}
+		}
+		return values, nil
+	case *protocol.MultiRawReply:
+		return r.Replies, nil
+	case *protocol.EmptyMultiBulkReply:
+		return []redis.Reply{}, nil
+	case *protocol.NullBulkReply:
+		return nil, ErrNil
+	}
+	return nil, unexpectedReply(reply, "array")
+}
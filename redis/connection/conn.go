@@ -1,6 +1,7 @@
 package connection
 
 import (
+	"bytes"
 	"gedis/interface/database"
 	"gedis/lib/sync/wait"
 	"net"
@@ -12,6 +13,8 @@ import (
 
 type Connection struct {
 	conn net.Conn
+	// 尚未发送的回复，由mu保护
+	replyBuf bytes.Buffer
 	// 封装的sync.waitGroup
 	waitingReply wait.Wait
 	// 当服务器发送消息的时候锁住
@@ -25,6 +28,21 @@ type Connection struct {
 
 	// selected db
 	selectedDB int
+	// 从节点上与主节点之间的复制连接
+	isMaster bool
+	// 最近一次写命令执行之后主节点的复制偏移量，wait命令等待从节点确认该偏移量
+	writeOffset int64
+	// 集群模式下是否执行过ASKING
+	asking bool
+	// 集群模式下是否为其他节点的连接
+	isPeer bool
+	// HELLO协商的协议版本，0表示没有协商过，使用RESP2
+	protoVer int
+	name     string
+
+	// 连接关闭时被关闭
+	closed    chan struct{}
+	closeOnce sync.Once
 }
 
 // RemoteAddr 获取远端地址
@@ -36,17 +54,29 @@ func (c *Connection) Close() error {
 	// 等待数据发送完毕
 	c.waitingReply.WaitWithTimeout(10 * time.Second)
 	_ = c.conn.Close()
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
 	return nil
 }
 
+// Closed 返回连接关闭时被关闭的通道，FakeConn返回nil，永远不会被关闭
+func (c *Connection) Closed() <-chan struct{} {
+	return c.closed
+}
+
 // NewConn 返回建立的链接
 func NewConn(conn net.Conn) *Connection {
 	return &Connection{
-		conn: conn,
+		conn:   conn,
+		closed: make(chan struct{}),
 	}
 }
 
-// Write 通过tcp向client远端写入数据
+// replyFlushThreshold 缓冲的回复超过该大小时立即发送
+const replyFlushThreshold = 64 * 1024
+
+// Write 通过tcp向client远端写入数据，缓冲区中的回复先发送，保证顺序
 func (c *Connection) Write(b []byte) error {
 	if len(b) == 0 {
 		return nil
@@ -58,10 +88,56 @@ func (c *Connection) Write(b []byte) error {
 		c.waitingReply.Done()
 		c.mu.Unlock()
 	}()
+	if c.replyBuf.Len() > 0 {
+		if err := c.flushLocked(); err != nil {
+			return err
+		}
+	}
 	_, err := c.conn.Write(b)
 	return err
 }
 
+// BufferWrite 将回复写入缓冲区，流水线中的多条回复合并为一次发送
+// 缓冲区超过阈值时立即发送，较大的回复不复制到缓冲区
+func (c *Connection) BufferWrite(b []byte) error {
+	if len(b) == 0 {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.replyBuf.Len()+len(b) < replyFlushThreshold {
+		c.replyBuf.Write(b)
+		return nil
+	}
+	c.waitingReply.Add(1)
+	defer c.waitingReply.Done()
+	if c.replyBuf.Len() > 0 {
+		if err := c.flushLocked(); err != nil {
+			return err
+		}
+	}
+	_, err := c.conn.Write(b)
+	return err
+}
+
+// Flush 发送缓冲区中的回复
+func (c *Connection) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.replyBuf.Len() == 0 {
+		return nil
+	}
+	c.waitingReply.Add(1)
+	defer c.waitingReply.Done()
+	return c.flushLocked()
+}
+
+func (c *Connection) flushLocked() error {
+	_, err := c.conn.Write(c.replyBuf.Bytes())
+	c.replyBuf.Reset()
+	return err
+}
+
 /****负责订阅的函数****/
 
 /*func (c *Connection) Subscribe(channel string) {
@@ -145,9 +221,52 @@ func (c *Connection) ClearQueuedCmds() {
 
 // GetWatching 返回监视键的版本号，CAS算法实现？
 func (c *Connection) GetWatching() map[string]uint32 {
+	if c.watching == nil {
+		c.watching = make(map[string]uint32)
+	}
 	return c.watching
 }
 
+// SetMaster 标记为主节点发送复制流的连接
+func (c *Connection) SetMaster() {
+	c.isMaster = true
+}
+
+// IsMaster 是否为主节点发送复制流的连接，只读的从节点允许这类连接写入
+func (c *Connection) IsMaster() bool {
+	return c.isMaster
+}
+
+// SetWriteOffset 记录写命令执行之后的复制偏移量
+func (c *Connection) SetWriteOffset(offset int64) {
+	c.writeOffset = offset
+}
+
+// GetWriteOffset 返回最近一次写命令执行之后的复制偏移量
+func (c *Connection) GetWriteOffset() int64 {
+	return c.writeOffset
+}
+
+// SetAsking 设置ASKING标记
+func (c *Connection) SetAsking(asking bool) {
+	c.asking = asking
+}
+
+// IsAsking 是否执行过ASKING
+func (c *Connection) IsAsking() bool {
+	return c.asking
+}
+
+// SetPeer 标记为集群中其他节点的连接
+func (c *Connection) SetPeer() {
+	c.isPeer = true
+}
+
+// IsPeer 是否为集群中其他节点的连接
+func (c *Connection) IsPeer() bool {
+	return c.isPeer
+}
+
 // GetDBIndex returns selected db
 func (c *Connection) GetDBIndex() int {
 	return c.selectedDB
@@ -157,3 +276,26 @@ func (c *Connection) GetDBIndex() int {
 func (c *Connection) SelectDB(dbNum int) {
 	c.selectedDB = dbNum
 }
+
+// GetProtocol 返回协议版本，默认为RESP2
+func (c *Connection) GetProtocol() int {
+	if c.protoVer == 0 {
+		return 2
+	}
+	return c.protoVer
+}
+
+// SetProtocol 设置HELLO协商的协议版本
+func (c *Connection) SetProtocol(version int) {
+	c.protoVer = version
+}
+
+// GetName 返回客户端名称
+func (c *Connection) GetName() string {
+	return c.name
+}
+
+// SetName 设置客户端名称
+func (c *Connection) SetName(name string) {
+	c.name = name
+}
@@ -0,0 +1,43 @@
+package connection
+
+import (
+	"bytes"
+	"net"
+)
+
+// FakeConn 不绑定真实的tcp连接，用于aof加载等服务器内部执行命令的场景
+type FakeConn struct {
+	Connection
+	buf bytes.Buffer
+}
+
+// NewFakeConn 返回一个假的连接
+func NewFakeConn() *FakeConn {
+	return &FakeConn{}
+}
+
+// Write 将数据写入内部缓冲区
+func (c *FakeConn) Write(b []byte) error {
+	c.buf.Write(b)
+	return nil
+}
+
+// Clean 清空缓冲区
+func (c *FakeConn) Clean() {
+	c.buf.Reset()
+}
+
+// Bytes 返回写入的数据
+func (c *FakeConn) Bytes() []byte {
+	return c.buf.Bytes()
+}
+
+// RemoteAddr 假连接没有远端地址
+func (c *FakeConn) RemoteAddr() net.Addr {
+	return nil
+}
+
+// Close 假连接没有需要释放的资源
+func (c *FakeConn) Close() error {
+	return nil
+}
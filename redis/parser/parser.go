@@ -2,14 +2,16 @@ package parser
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
+	"fmt"
 	"gedis/interface/redis"
 	"gedis/lib/logger"
 	"gedis/redis/protocol"
 	"io"
+	"math"
 	"runtime/debug"
 	"strconv"
-	"strings"
 )
 
 type Payload struct {
@@ -17,30 +19,67 @@ type Payload struct {
 	Err  error
 }
 
-// readState 读取状态，在负责读取multiBulk起关键作用
-type readState struct {
-	// 是否正在读取*数组类型数据
-	readingMultiLine bool
-	// 期待的参数数量，也就是 * 后面的值
-	expectedArgsCount int
-	// 消息的类型 消息两种类型之一 * $
-	msgType byte
-	// 读取到的参数，例如set heqi 1,args应该值为[set][heqi][1]
-	args [][]byte
-	// 下一个读取安全二进制字符串的长度,例如读取set时候应该bulkLen为3
-	bulkLen int64
+// protocolError 数据不符合协议，区别于连接中断等io异常
+type protocolError struct {
+	msg string
 }
 
+func (e *protocolError) Error() string {
+	return "Protocol error: " + e.msg
+}
+
+func makeProtocolError(msg []byte) error {
+	return &protocolError{msg: string(msg)}
+}
+
+// IsProtocolError 数据不符合协议，而不是连接中断等io异常
+func IsProtocolError(err error) bool {
+	_, ok := err.(*protocolError)
+	return ok
+}
+
+// Limits 解析客户端请求时的限制，为0的字段不限制
+type Limits struct {
+	// 单个参数的最大长度
+	MaxBulkLen int64
+	// 一条命令的最大参数数量
+	MaxMultiBulkLen int64
+}
+
+const (
+	// payloadBufferSize 解析完成但还没有被取走的数值数量
+	payloadBufferSize = 128
+	// maxRequestLineLen 请求中内联命令以及长度行的最大长度，与redis一致
+	maxRequestLineLen = 64 * 1024
+	// bigBulkLen 超过该长度的字符串随着数据到达逐步分配内存
+	bigBulkLen = 32 * 1024
+	// maxPreallocArgs 数组预先分配的最大元素数量
+	maxPreallocArgs = 1024
+)
+
+var errLineTooLong = errors.New("line too long")
+
 // ParseStream 从conn的reader中读取数值，并且返回可读channel，这里的通道使用是关键
 func ParseStream(reader io.Reader) <-chan *Payload {
+	return parseStream(reader, nil)
+}
+
+// ParseRequestStream 解析客户端发送的命令，与redis一样只接受字符串数组以及内联命令
+// 超出limits或者不符合协议时发送协议错误，之后的数据无法确定边界，调用方应当关闭连接
+func ParseRequestStream(reader io.Reader, limits Limits) <-chan *Payload {
+	return parseStream(reader, &limits)
+}
+
+func parseStream(reader io.Reader, limits *Limits) <-chan *Payload {
 	// 使用指针避免内存拷贝
-	ch := make(chan *Payload)
-	go parse0(reader, ch)
+	// 带缓冲的通道使得流水线中的命令可以在前面的命令执行时提前解析
+	ch := make(chan *Payload, payloadBufferSize)
+	go parse0(reader, ch, limits)
 	return ch
 }
 
-// 读取核心
-func parse0(reader io.Reader, ch chan<- *Payload) {
+// 读取核心，limits为nil时解析任意类型的数值，例如服务端的回复以及aof文件
+func parse0(reader io.Reader, ch chan<- *Payload, limits *Limits) {
 	defer func() {
 		// 遇到
 		if err := recover(); err != nil {
@@ -48,203 +87,236 @@ func parse0(reader io.Reader, ch chan<- *Payload) {
 		}
 	}()
 	bufReader := bufio.NewReader(reader)
-	var state readState
-	var err error
-	var msg []byte
-	var ioErr bool
 	for {
-		msg, ioErr, err = readLine(bufReader, &state)
+		result, err := readPayload(bufReader, limits)
 		if err != nil {
-			if ioErr {
-				ch <- &Payload{
-					Err: err,
-				}
-				// 在io异常下必须强制关闭这个ch
-				close(ch)
-				return
-			}
 			ch <- &Payload{
 				Err: err,
 			}
-			state = readState{}
+			// 在io异常下必须强制关闭这个ch
+			if !IsProtocolError(err) {
+				close(ch)
+				return
+			}
 			continue
 		}
+		// 空行以及空数组直接跳过
+		if result == nil {
+			continue
+		}
+		ch <- &Payload{
+			Data: result,
+		}
+	}
+}
 
-		// 刚刚开始准备读取multiline
-		if !state.readingMultiLine {
-			if msg[0] == '*' {
-				err = parseMultiBulkHeader(msg, &state)
-				if err != nil {
-					ch <- &Payload{
-						Err: errors.New("protocol error: " + string(msg)),
-					}
-					state = readState{}
-					continue
-				}
-				if state.expectedArgsCount == 0 {
-					ch <- &Payload{
-						Data: &protocol.EmptyMultiBulkReply{},
-					}
-					state = readState{} // reset state
-					continue
-				}
-			} else if msg[0] == '$' {
-				err = parseBulkHeader(msg, &state)
-				if err != nil {
-					ch <- &Payload{
-						Err: err,
-					}
-					state = readState{} // reset state
-					continue
-				}
-				// 对接bulkLen为-1抛出的异常
-				if state.bulkLen == -1 {
-					ch <- &Payload{
-						Data: &protocol.NullBulkReply{},
-					}
-					state = readState{}
-					continue
-				}
-			} else {
-				result, err := parseSingleReply(msg)
-				ch <- &Payload{
-					Data: result,
-					Err:  err,
-				}
-				state = readState{} // reset state
-				continue
-			}
-		} else {
-			// 接受multiBulk剩下的值
-			err = readBody(msg, &state)
-			if err != nil {
-				ch <- &Payload{
-					Err: errors.New("protocol error: " + string(msg)),
-				}
-				state = readState{} // reset state
-				continue
-			}
-			// 判断是否读取结束
-			if state.finished() {
-				var result redis.Reply
-				if state.msgType == '*' {
-					result = protocol.MakeMultiBulkReply(state.args)
-				} else if state.msgType == '$' {
-					result = protocol.MakeBulkReply(state.args[0])
-				}
-				ch <- &Payload{
-					Data: result,
-					Err:  err,
-				}
-				// 情况状态
-				state = readState{}
-			}
+// readPayload 读取一个完整的数值或者内联命令
+func readPayload(bufReader *bufio.Reader, limits *Limits) (redis.Reply, error) {
+	// 内联命令允许只以\n结尾，因此第一行先不检查\r
+	msg, err := readLine(bufReader, limits)
+	if err == errLineTooLong {
+		if msg[0] == '*' {
+			return nil, &protocolError{msg: "too big mbulk count string"}
 		}
+		return nil, &protocolError{msg: "too big inline request"}
 	}
+	if err != nil {
+		return nil, err
+	}
+	if limits != nil {
+		if msg[0] == '*' {
+			return readArray(bufReader, msg, limits)
+		}
+		return parseInlineCommand(msg)
+	}
+	switch msg[0] {
+	case '*', '$', '+', '-', ':':
+		return readReply(bufReader, msg, nil)
+	}
+	// 不以类型符号开头的一行是telnet等工具发送的内联命令
+	return parseInlineCommand(msg)
 }
 
 /*-----工具函数------*/
 
-// 返回读取是否完成
-func (s *readState) finished() bool {
-	return s.expectedArgsCount > 0 && len(s.args) == s.expectedArgsCount
-}
-
-// readLine读取输入流的一行，包含对二进制安全字符串的处理
-func readLine(bufReader *bufio.Reader, state *readState) ([]byte, bool, error) {
-	var (
-		msg []byte
-		err error
-	)
-	// if bulkLen = = 0 is true represent should read a safeBinary string
-	if state.bulkLen == 0 {
-		msg, err = bufReader.ReadBytes('\n')
-		if err != nil {
-			return nil, true, err
+// readLine 读取以\n结尾的一行，解析请求时超过maxRequestLineLen返回errLineTooLong
+func readLine(bufReader *bufio.Reader, limits *Limits) ([]byte, error) {
+	if limits == nil {
+		return bufReader.ReadBytes('\n')
+	}
+	var line []byte
+	for {
+		chunk, err := bufReader.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > maxRequestLineLen {
+			return line, errLineTooLong
 		}
-		if len(msg) == 0 || msg[len(msg)-2] != '\r' {
-			return nil, false, errors.New("protocol error: " + string(msg))
+		if err == nil {
+			return line, nil
 		}
-	} else {
-		// 对于语句中间的，需要添加\r\n字符串的长度
-		msg = make([]byte, state.bulkLen+2)
-		_, err = io.ReadFull(bufReader, msg)
-		if len(msg) == 0 ||
-			msg[len(msg)-2] != '\r' ||
-			msg[len(msg)-1] != '\n' {
-			return nil, false, errors.New("protocol error: " + string(msg))
+		if err != bufio.ErrBufferFull {
+			return nil, err
 		}
-		state.bulkLen = 0
 	}
-	return msg, false, nil
 }
 
-func parseMultiBulkHeader(msg []byte, state *readState) error {
-	var err error
-	var expectedLine int64
-	// 这里的ParseInt返回int64是需要向下兼容其他的int类型
-	expectedLine, err = strconv.ParseInt(string(msg[1:len(msg)-2]), 10, 32)
-	if err != nil {
-		return errors.New("protocol error: " + string(msg))
+// hasCRLF 除内联命令以外的行必须以\r\n结尾
+func hasCRLF(msg []byte) bool {
+	return len(msg) >= 2 && msg[len(msg)-2] == '\r'
+}
+
+// parseLength 解析*或者$之后的长度
+func parseLength(msg []byte) (int64, bool) {
+	if !hasCRLF(msg) {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(string(msg[1:len(msg)-2]), 10, 64)
+	return n, err == nil
+}
+
+// requestError 解析请求时使用与redis一致的错误信息，不回显客户端发送的数据
+func requestError(limits *Limits, msg []byte, requestMsg string) error {
+	if limits != nil {
+		return &protocolError{msg: requestMsg}
 	}
-	if expectedLine == 0 {
-		state.expectedArgsCount = 0
-		return nil
-	} else if expectedLine > 0 {
-		// msg[0]代表了消息类型
-		state.msgType = msg[0]
-		// 代表已经开始读取数组元素
-		state.readingMultiLine = true
-		state.expectedArgsCount = int(expectedLine)
-		// 设置args的初始容量大小0，cap增长量为expectedLine
-		state.args = make([][]byte, 0, expectedLine)
-		return nil
+	return makeProtocolError(msg)
+}
+
+// readReply 根据已经读取的第一行解析一个完整的回复，数组的元素递归读取
+func readReply(bufReader *bufio.Reader, msg []byte, limits *Limits) (redis.Reply, error) {
+	switch msg[0] {
+	case '*':
+		return readArray(bufReader, msg, limits)
+	case '$':
+		return readBulk(bufReader, msg, limits)
+	case '+', '-', ':':
+		return parseSingleReply(msg)
 	}
-	return errors.New("protocol error: " + string(msg))
+	return nil, makeProtocolError(msg)
 }
 
-// 读取一个二进制安全的头
-func parseBulkHeader(msg []byte, state *readState) error {
-	var err error
-	state.bulkLen, err = strconv.ParseInt(string(msg[1:len(msg)-2]), 10, 32)
+// readBulk 读取二进制安全字符串，$-1为空值
+func readBulk(bufReader *bufio.Reader, msg []byte, limits *Limits) (redis.Reply, error) {
+	bulkLen, ok := parseLength(msg)
+	if limits != nil {
+		if !ok || bulkLen < 0 || (limits.MaxBulkLen > 0 && bulkLen > limits.MaxBulkLen) {
+			return nil, &protocolError{msg: "invalid bulk length"}
+		}
+	} else if !ok || bulkLen < -1 {
+		return nil, makeProtocolError(msg)
+	}
+	if bulkLen == -1 {
+		return &protocol.NullBulkReply{}, nil
+	}
+	// 连接中断或者文件被截断
+	body, err := readBulkBody(bufReader, bulkLen)
 	if err != nil {
-		return errors.New("protocol error: " + string(msg))
+		return nil, err
 	}
-	if state.bulkLen == -1 {
-		return nil
-	} else if state.bulkLen > 0 {
-		state.msgType = msg[0]
-		state.readingMultiLine = true
-		state.expectedArgsCount = 1
-		state.args = make([][]byte, 0, 1)
-		return nil
-	} else {
-		return errors.New("protocol error: " + string(msg))
+	if body[len(body)-2] != '\r' || body[len(body)-1] != '\n' {
+		return nil, requestError(limits, body, "bulk string is not terminated by CRLF")
+	}
+	return protocol.MakeBulkReply(body[:bulkLen]), nil
+}
+
+// readBulkBody 读取字符串内容以及之后的\r\n
+// 较长的字符串随着数据到达逐步扩容，避免只发送了长度的请求占用大量内存
+func readBulkBody(bufReader *bufio.Reader, bulkLen int64) ([]byte, error) {
+	total := int(bulkLen + 2)
+	if bulkLen <= bigBulkLen {
+		body := make([]byte, total)
+		_, err := io.ReadFull(bufReader, body)
+		return body, err
+	}
+	body := make([]byte, 0, bigBulkLen)
+	for len(body) < total {
+		if len(body) == cap(body) {
+			newCap := cap(body) * 2
+			if newCap > total {
+				newCap = total
+			}
+			grown := make([]byte, len(body), newCap)
+			copy(grown, body)
+			body = grown
+		}
+		n, err := bufReader.Read(body[len(body):cap(body)])
+		body = body[:len(body)+n]
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
 	}
+	return body, nil
 }
 
-// 读取数组或者字符串的非第一行
-func readBody(msg []byte, state *readState) error {
-	line := msg[0 : len(msg)-2]
-	var err error
-	// $是二进制安全字符串的开头
-	if line[0] == '$' {
-		state.bulkLen, err = strconv.ParseInt(string(line[1:]), 10, 64)
+// readArray 读取数组，元素全部为字符串时返回MultiBulkReply，否则返回MultiRawReply
+// 解析请求时元素只能是字符串，空数组返回nil
+func readArray(bufReader *bufio.Reader, msg []byte, limits *Limits) (redis.Reply, error) {
+	count, ok := parseLength(msg)
+	if limits != nil {
+		if !ok || (limits.MaxMultiBulkLen > 0 && count > limits.MaxMultiBulkLen) {
+			return nil, &protocolError{msg: "invalid multibulk length"}
+		}
+		if count <= 0 {
+			return nil, nil
+		}
+	} else if !ok || count < -1 || count > math.MaxInt32 {
+		return nil, makeProtocolError(msg)
+	}
+	if count == -1 {
+		return &protocol.NullBulkReply{}, nil
+	}
+	if count == 0 {
+		return &protocol.EmptyMultiBulkReply{}, nil
+	}
+	prealloc := count
+	if prealloc > maxPreallocArgs {
+		prealloc = maxPreallocArgs
+	}
+	replies := make([]redis.Reply, 0, prealloc)
+	allBulk := true
+	for i := int64(0); i < count; i++ {
+		line, err := readLine(bufReader, limits)
+		if err == errLineTooLong {
+			return nil, &protocolError{msg: "too big bulk count string"}
+		}
 		if err != nil {
-			return errors.New("protocol error: " + string(msg))
+			return nil, err
 		}
-		if state.bulkLen <= 0 { // 空内容或过长
-			state.args = append(state.args, []byte{})
-			state.bulkLen = 0
+		if limits != nil && line[0] != '$' {
+			return nil, &protocolError{msg: fmt.Sprintf("expected '$', got '%c'", line[0])}
 		}
-	} else {
-		state.args = append(state.args, line)
+		reply, err := readReply(bufReader, line, limits)
+		if err != nil {
+			return nil, err
+		}
+		switch reply.(type) {
+		case *protocol.BulkReply, *protocol.NullBulkReply:
+		default:
+			allBulk = false
+		}
+		replies = append(replies, reply)
 	}
-	return nil
+	if !allBulk {
+		return protocol.MakeMultiRawReply(replies), nil
+	}
+	args := make([][]byte, len(replies))
+	for i, reply := range replies {
+		// null bulk，与空字符串区分
+		if bulk, ok := reply.(*protocol.BulkReply); ok {
+			args[i] = bulk.Arg
+		}
+	}
+	return protocol.MakeMultiBulkReply(args), nil
 }
 
 func parseSingleReply(msg []byte) (redis.Reply, error) {
-	str := strings.TrimSuffix(string(msg), "\r\n")
+	if !hasCRLF(msg) {
+		return nil, makeProtocolError(msg)
+	}
+	str := string(msg[:len(msg)-2])
 	var result redis.Reply
 	switch msg[0] {
 	case '+':
@@ -254,18 +326,125 @@ func parseSingleReply(msg []byte) (redis.Reply, error) {
 	case ':':
 		val, err := strconv.ParseInt(str[1:], 10, 64)
 		if err != nil {
-			return nil, errors.New("protocol error: " + string(msg))
+			return nil, makeProtocolError(msg)
 		}
 		result = protocol.MakeIntReply(val)
-	default:
-		strs := strings.Split(str, " ")
-		args := make([][]byte, len(strs))
-		for i, s := range strs {
-			args[i] = []byte(s)
-		}
-		result = protocol.MakeMultiBulkReply(args)
-
 	}
 	return result, nil
+}
+
+// parseInlineCommand 以空白分隔的内联命令，例如telnet中输入的 SET foo "hello world"
+// 空行返回nil
+func parseInlineCommand(msg []byte) (redis.Reply, error) {
+	line := bytes.TrimSuffix(msg, []byte{'\n'})
+	line = bytes.TrimSuffix(line, []byte{'\r'})
+	args, err := splitInlineArgs(line)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		return nil, nil
+	}
+	return protocol.MakeMultiBulkReply(args), nil
+}
 
+/*
+splitInlineArgs 与redis拆分内联命令的规则一致
+1. 参数之间以空白分隔
+2. 双引号中支持 \n \r \t \b \a \xHH 转义，其余字符前的反斜杠被去掉
+3. 单引号中只支持 \' 转义
+4. 引号没有闭合，或者闭合的引号之后紧跟其他字符时返回错误
+*/
+func splitInlineArgs(line []byte) ([][]byte, error) {
+	args := make([][]byte, 0)
+	i := 0
+	for {
+		for i < len(line) && isInlineSpace(line[i]) {
+			i++
+		}
+		if i == len(line) {
+			return args, nil
+		}
+		arg := make([]byte, 0)
+		inDoubleQuotes, inSingleQuotes := false, false
+		for done := false; !done; i++ {
+			if i == len(line) {
+				if inDoubleQuotes || inSingleQuotes {
+					return nil, errUnbalancedQuotes
+				}
+				break
+			}
+			c := line[i]
+			switch {
+			case inDoubleQuotes:
+				if c == '\\' && i+3 < len(line) && line[i+1] == 'x' {
+					if b, err := strconv.ParseUint(string(line[i+2:i+4]), 16, 8); err == nil {
+						arg = append(arg, byte(b))
+						i += 3
+						continue
+					}
+				}
+				if c == '\\' && i+1 < len(line) {
+					i++
+					arg = append(arg, unescapeInline(line[i]))
+				} else if c == '"' {
+					if i+1 < len(line) && !isInlineSpace(line[i+1]) {
+						return nil, errUnbalancedQuotes
+					}
+					done = true
+				} else {
+					arg = append(arg, c)
+				}
+			case inSingleQuotes:
+				if c == '\\' && i+1 < len(line) && line[i+1] == '\'' {
+					i++
+					arg = append(arg, '\'')
+				} else if c == '\'' {
+					if i+1 < len(line) && !isInlineSpace(line[i+1]) {
+						return nil, errUnbalancedQuotes
+					}
+					done = true
+				} else {
+					arg = append(arg, c)
+				}
+			default:
+				switch c {
+				case '"':
+					inDoubleQuotes = true
+				case '\'':
+					inSingleQuotes = true
+				default:
+					if isInlineSpace(c) {
+						done = true
+					} else {
+						arg = append(arg, c)
+					}
+				}
+			}
+		}
+		args = append(args, arg)
+	}
+}
+
+var errUnbalancedQuotes = &protocolError{msg: "unbalanced quotes in request"}
+
+func isInlineSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n' || c == 0
+}
+
+// unescapeInline 双引号中反斜杠之后的字符
+func unescapeInline(c byte) byte {
+	switch c {
+	case 'n':
+		return '\n'
+	case 'r':
+		return '\r'
+	case 't':
+		return '\t'
+	case 'b':
+		return '\b'
+	case 'a':
+		return '\a'
+	}
+	return c
 }
@@ -0,0 +1,226 @@
+package parser
+
+import (
+	"bytes"
+	"gedis/interface/redis"
+	"gedis/redis/protocol"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// parseAll 解析input中的所有回复，遇到错误时终止测试
+func parseAll(t *testing.T, input string) []redis.Reply {
+	t.Helper()
+	replies := make([]redis.Reply, 0)
+	for payload := range ParseStream(bytes.NewReader([]byte(input))) {
+		if payload.Err != nil {
+			if _, ok := payload.Err.(*protocolError); ok {
+				t.Fatalf("%q: %v", input, payload.Err)
+			}
+			break
+		}
+		replies = append(replies, payload.Data)
+	}
+	return replies
+}
+
+func TestEmptyAndNullBulk(t *testing.T) {
+	// 空字符串编码为$0，只有nil编码为空值
+	cases := []struct {
+		reply  redis.Reply
+		expect string
+	}{
+		{protocol.MakeBulkReply([]byte{}), "$0\r\n\r\n"},
+		{protocol.MakeBulkReply(nil), "$-1\r\n"},
+		{protocol.MakeNullBulkReply(), "$-1\r\n"},
+		{protocol.MakeMultiBulkReply([][]byte{{}, nil, []byte("a")}), "*3\r\n$0\r\n\r\n$-1\r\n$1\r\na\r\n"},
+	}
+	for _, c := range cases {
+		if actual := string(c.reply.ToBytes()); actual != c.expect {
+			t.Errorf("expect %q actually %q", c.expect, actual)
+		}
+	}
+
+	replies := parseAll(t, "$0\r\n\r\n$-1\r\n*3\r\n$0\r\n\r\n$-1\r\n$1\r\na\r\n")
+	if len(replies) != 3 {
+		t.Fatalf("expect 3 replies actually %d", len(replies))
+	}
+	if bulk, ok := replies[0].(*protocol.BulkReply); !ok || bulk.Arg == nil || len(bulk.Arg) != 0 {
+		t.Errorf("expect empty bulk actually %#v", replies[0])
+	}
+	if _, ok := replies[1].(*protocol.NullBulkReply); !ok {
+		t.Errorf("expect null bulk actually %#v", replies[1])
+	}
+	multi, ok := replies[2].(*protocol.MultiBulkReply)
+	if !ok || len(multi.Args) != 3 {
+		t.Fatalf("expect multi bulk actually %#v", replies[2])
+	}
+	if multi.Args[0] == nil || len(multi.Args[0]) != 0 || multi.Args[1] != nil || string(multi.Args[2]) != "a" {
+		t.Errorf("unexpected args %q", multi.Args)
+	}
+}
+
+func TestParseNestedArray(t *testing.T) {
+	// 元素中包含数组、整数或状态时不能转换为MultiBulkReply，编码之后与输入一致
+	input := "*4\r\n:1\r\n*2\r\n$1\r\na\r\n*1\r\n+OK\r\n$-1\r\n*0\r\n"
+	replies := parseAll(t, input)
+	if len(replies) != 1 {
+		t.Fatalf("expect 1 reply actually %d", len(replies))
+	}
+	raw, ok := replies[0].(*protocol.MultiRawReply)
+	if !ok || len(raw.Replies) != 4 {
+		t.Fatalf("expect multi raw reply actually %#v", replies[0])
+	}
+	if _, ok := raw.Replies[0].(*protocol.IntReply); !ok {
+		t.Errorf("expect int reply actually %#v", raw.Replies[0])
+	}
+	nested, ok := raw.Replies[1].(*protocol.MultiRawReply)
+	if !ok || len(nested.Replies) != 2 {
+		t.Fatalf("expect nested array actually %#v", raw.Replies[1])
+	}
+	if _, ok := nested.Replies[1].(*protocol.MultiRawReply); !ok {
+		t.Errorf("expect nested array actually %#v", nested.Replies[1])
+	}
+	if _, ok := raw.Replies[3].(*protocol.EmptyMultiBulkReply); !ok {
+		t.Errorf("expect empty array actually %#v", raw.Replies[3])
+	}
+	if actual := string(raw.ToBytes()); actual != input {
+		t.Errorf("expect %q actually %q", input, actual)
+	}
+
+	// 数组之后的命令不受影响
+	replies = parseAll(t, "*2\r\n*1\r\n$1\r\nx\r\n:2\r\n*1\r\n$4\r\nPING\r\n")
+	if len(replies) != 2 {
+		t.Fatalf("expect 2 replies actually %d", len(replies))
+	}
+	if multi, ok := replies[1].(*protocol.MultiBulkReply); !ok || string(multi.Args[0]) != "PING" {
+		t.Errorf("expect PING actually %#v", replies[1])
+	}
+}
+
+func TestParseInlineCommand(t *testing.T) {
+	cases := []struct {
+		line   string
+		expect []string
+	}{
+		{"SET foo bar\r\n", []string{"SET", "foo", "bar"}},
+		{"PING\n", []string{"PING"}},
+		{"  get\t foo  \r\n", []string{"get", "foo"}},
+		{`SET foo "hello world"` + "\r\n", []string{"SET", "foo", "hello world"}},
+		{`SET foo "a\"b\\c\n\x41\xzz"` + "\r\n", []string{"SET", "foo", "a\"b\\c\nAxzz"}},
+		{`SET foo 'it\'s \n'` + "\r\n", []string{"SET", "foo", `it's \n`}},
+		{`SET foo ""` + "\r\n", []string{"SET", "foo", ""}},
+		{`SET k"ey" v` + "\r\n", []string{"SET", "key", "v"}},
+	}
+	for _, c := range cases {
+		reply, err := parseInlineCommand([]byte(c.line))
+		if err != nil {
+			t.Errorf("%q: %v", c.line, err)
+			continue
+		}
+		args := make([]string, 0)
+		for _, arg := range reply.(*protocol.MultiBulkReply).Args {
+			args = append(args, string(arg))
+		}
+		if !reflect.DeepEqual(args, c.expect) {
+			t.Errorf("%q: expect %q actually %q", c.line, c.expect, args)
+		}
+	}
+
+	// 空行
+	for _, line := range []string{"\r\n", "\n", "   \r\n"} {
+		if reply, err := parseInlineCommand([]byte(line)); reply != nil || err != nil {
+			t.Errorf("%q: expect nil actually %v %v", line, reply, err)
+		}
+	}
+
+	// 引号没有闭合
+	for _, line := range []string{`SET foo "bar` + "\r\n", `SET foo 'bar` + "\r\n", `SET foo "bar"baz` + "\r\n"} {
+		if _, err := parseInlineCommand([]byte(line)); err != errUnbalancedQuotes {
+			t.Errorf("%q: expect unbalanced quotes actually %v", line, err)
+		}
+	}
+}
+
+func TestParseStreamMixed(t *testing.T) {
+	// 内联命令与multi bulk混合，空行被跳过，引号错误之后继续解析
+	input := "SET a 1\r\n\r\n*2\r\n$3\r\nGET\r\n$1\r\na\r\nSET b \"x\r\nPING\n"
+	expect := [][]string{{"SET", "a", "1"}, {"GET", "a"}, nil, {"PING"}}
+	actual := make([][]string, 0)
+	for payload := range ParseStream(bytes.NewReader([]byte(input))) {
+		if payload.Err != nil {
+			if _, ok := payload.Err.(*protocolError); ok {
+				actual = append(actual, nil)
+			}
+			continue
+		}
+		args := make([]string, 0)
+		for _, arg := range payload.Data.(*protocol.MultiBulkReply).Args {
+			args = append(args, string(arg))
+		}
+		actual = append(actual, args)
+	}
+	if !reflect.DeepEqual(actual, expect) {
+		t.Errorf("expect %q actually %q", expect, actual)
+	}
+}
+
+func TestParseRequestStreamLimits(t *testing.T) {
+	limits := Limits{MaxBulkLen: 16, MaxMultiBulkLen: 4}
+	cases := map[string]string{
+		"*2\r\n$3\r\nGET\r\n$17\r\n": "invalid bulk length",
+		"*5\r\n":                     "invalid multibulk length",
+		"*x\r\n":                     "invalid multibulk length",
+		"*2\r\n$3\r\nGET\r\n:1\r\n":  "expected '$', got ':'",
+		"*1\r\n$-1\r\n":              "invalid bulk length",
+		"*1\r\n$3\r\nGETXX\r\n":      "bulk string is not terminated by CRLF",
+		strings.Repeat("a", maxRequestLineLen+1) + "\r\n":     "too big inline request",
+		"*" + strings.Repeat("1", maxRequestLineLen) + "\r\n": "too big mbulk count string",
+	}
+	for input, expect := range cases {
+		payload := <-ParseRequestStream(bytes.NewReader([]byte(input)), limits)
+		if payload.Err == nil || payload.Err.Error() != "Protocol error: "+expect {
+			t.Errorf("%.20q: expect %q actually %v", input, expect, payload.Err)
+		}
+	}
+
+	// 空数组被跳过，不以*开头的请求都是内联命令，长度在限制之内的参数正常解析
+	input := "*0\r\n+PING\r\n*2\r\n$3\r\nGET\r\n$16\r\n" + strings.Repeat("k", 16) + "\r\n"
+	ch := ParseRequestStream(bytes.NewReader([]byte(input)), limits)
+	for _, expect := range []string{"+PING", "GET " + strings.Repeat("k", 16)} {
+		payload := <-ch
+		if payload.Err != nil {
+			t.Fatal(payload.Err)
+		}
+		args := make([]string, 0)
+		for _, arg := range payload.Data.(*protocol.MultiBulkReply).Args {
+			args = append(args, string(arg))
+		}
+		if actual := strings.Join(args, " "); actual != expect {
+			t.Errorf("expect %q actually %q", expect, actual)
+		}
+	}
+}
+
+func TestReadBigBulk(t *testing.T) {
+	// 较长的字符串逐步扩容，结果的容量与内容一致
+	value := strings.Repeat("v", bigBulkLen*3+7)
+	input := "$" + strconv.Itoa(len(value)) + "\r\n" + value + "\r\n"
+	payload := <-ParseStream(bytes.NewReader([]byte(input)))
+	if payload.Err != nil {
+		t.Fatal(payload.Err)
+	}
+	arg := payload.Data.(*protocol.BulkReply).Arg
+	if string(arg) != value || cap(arg) != len(value)+2 {
+		t.Errorf("expect %d bytes actually %d bytes with cap %d", len(value), len(arg), cap(arg))
+	}
+
+	// 数据不完整
+	payload = <-ParseStream(bytes.NewReader([]byte(input[:len(input)-10])))
+	if payload.Err != io.ErrUnexpectedEOF {
+		t.Errorf("expect unexpected EOF actually %v", payload.Err)
+	}
+}
@@ -7,8 +7,7 @@ import (
 )
 
 var (
-	nullBulkReplyBytes = []byte("$-1")
-	CRLF               = "\r\n"
+	CRLF = "\r\n"
 )
 
 /* ---- Bulk Reply ---- */
@@ -25,8 +24,9 @@ func MakeBulkReply(arg []byte) *BulkReply {
 }
 
 func (r *BulkReply) ToBytes() []byte {
-	if len(r.Arg) == 0 {
-		return nullBulkReplyBytes
+	// nil为空值，与空字符串区分
+	if r.Arg == nil {
+		return nullBulkBytes
 	}
 	return []byte("$" + strconv.Itoa(len(r.Arg)) + CRLF + string(r.Arg) + CRLF)
 }
@@ -0,0 +1,394 @@
+package protocol
+
+import (
+	"bytes"
+	"gedis/interface/redis"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+/*
+RESP3协议的回复
+1. 客户端通过HELLO 3协商RESP3之后，服务端按照RESP3编码实现了RESP3Reply的回复
+2. ToBytes始终返回RESP2的编码，保证没有协商RESP3的客户端以及内部使用回复的地方不受影响
+*/
+
+// RESP2、RESP3 协议版本
+const (
+	RESP2 = 2
+	RESP3 = 3
+)
+
+// RESP3Reply 在RESP3下有不同编码的回复
+type RESP3Reply interface {
+	redis.Reply
+	ToRESP3Bytes() []byte
+}
+
+// Encode 按照协议版本编码回复，数组等类型中的元素同样按照该版本编码
+func Encode(reply redis.Reply, version int) []byte {
+	if version == RESP3 {
+		if r, ok := reply.(RESP3Reply); ok {
+			return r.ToRESP3Bytes()
+		}
+	}
+	return reply.ToBytes()
+}
+
+var nullBytes = []byte("_\r\n")
+
+// ToRESP3Bytes RESP3中只有一种空值
+func (r *NullBulkReply) ToRESP3Bytes() []byte {
+	return nullBytes
+}
+
+// ToRESP3Bytes 数组中的空值编码为RESP3的空值
+func (r *MultiBulkReply) ToRESP3Bytes() []byte {
+	var buf bytes.Buffer
+	buf.WriteString("*" + strconv.Itoa(len(r.Args)) + CRLF)
+	for _, arg := range r.Args {
+		if arg == nil {
+			buf.Write(nullBytes)
+		} else {
+			buf.WriteString("$" + strconv.Itoa(len(arg)) + CRLF + string(arg) + CRLF)
+		}
+	}
+	return buf.Bytes()
+}
+
+// ToRESP3Bytes 每个元素按照RESP3编码，例如事务中HGETALL的结果
+func (r *MultiRawReply) ToRESP3Bytes() []byte {
+	return encodeAggregate('*', r.Replies, RESP3)
+}
+
+// encodeAggregate 编码数组、集合、推送等由多个回复组成的类型
+func encodeAggregate(prefix byte, replies []redis.Reply, version int) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(prefix)
+	buf.WriteString(strconv.Itoa(len(replies)) + CRLF)
+	for _, reply := range replies {
+		buf.Write(Encode(reply, version))
+	}
+	return buf.Bytes()
+}
+
+/* ---- Null Reply ---- */
+
+// NullReply 空值，RESP2中编码为 $-1
+type NullReply struct{}
+
+// MakeNullReply 创建空值
+func MakeNullReply() *NullReply {
+	return &NullReply{}
+}
+
+func (r *NullReply) ToBytes() []byte {
+	return nullBulkBytes
+}
+
+func (r *NullReply) ToRESP3Bytes() []byte {
+	return nullBytes
+}
+
+/* ---- Map Reply ---- */
+
+// MapReply 有序的键值对，RESP2中编码为键值交替出现的数组
+type MapReply struct {
+	// 键值交替出现，长度为偶数
+	Pairs []redis.Reply
+}
+
+// MakeMapReply 创建键值对，pairs中键值交替出现
+func MakeMapReply(pairs []redis.Reply) *MapReply {
+	return &MapReply{
+		Pairs: pairs,
+	}
+}
+
+// MakeBulkMapReply 键与值都是字符串的键值对，例如HGETALL
+func MakeBulkMapReply(pairs [][]byte) *MapReply {
+	replies := make([]redis.Reply, len(pairs))
+	for i, arg := range pairs {
+		replies[i] = MakeBulkReply(arg)
+	}
+	return MakeMapReply(replies)
+}
+
+func (r *MapReply) ToBytes() []byte {
+	return encodeAggregate('*', r.Pairs, RESP2)
+}
+
+func (r *MapReply) ToRESP3Bytes() []byte {
+	var buf bytes.Buffer
+	buf.WriteString("%" + strconv.Itoa(len(r.Pairs)/2) + CRLF)
+	for _, reply := range r.Pairs {
+		buf.Write(Encode(reply, RESP3))
+	}
+	return buf.Bytes()
+}
+
+/* ---- Set Reply ---- */
+
+// SetReply 无序且不重复的字符串集合，RESP2中编码为数组
+type SetReply struct {
+	Members [][]byte
+}
+
+// MakeSetReply 创建集合
+func MakeSetReply(members [][]byte) *SetReply {
+	return &SetReply{
+		Members: members,
+	}
+}
+
+func (r *SetReply) ToBytes() []byte {
+	return MakeMultiBulkReply(r.Members).ToBytes()
+}
+
+func (r *SetReply) ToRESP3Bytes() []byte {
+	out := MakeMultiBulkReply(r.Members).ToRESP3Bytes()
+	out[0] = '~'
+	return out
+}
+
+/* ---- Double Reply ---- */
+
+// DoubleReply 浮点数，RESP2中编码为字符串
+type DoubleReply struct {
+	Value float64
+}
+
+// MakeDoubleReply 创建浮点数
+func MakeDoubleReply(value float64) *DoubleReply {
+	return &DoubleReply{
+		Value: value,
+	}
+}
+
+func (r *DoubleReply) ToBytes() []byte {
+	return MakeBulkReply([]byte(FormatDouble(r.Value))).ToBytes()
+}
+
+func (r *DoubleReply) ToRESP3Bytes() []byte {
+	return []byte("," + FormatDouble(r.Value) + CRLF)
+}
+
+// FormatDouble 与redis一致地格式化浮点数，两种协议中的分数使用相同的格式
+// 无穷大为inf与-inf，使用最短的有效数字，整数部分过长或者小数部分前导零过多时使用科学计数法，例如1e+20
+func FormatDouble(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "inf"
+	case math.IsInf(value, -1):
+		return "-inf"
+	case math.IsNaN(value):
+		return "nan"
+	case value == 0:
+		return "0"
+	}
+	sign := ""
+	if value < 0 {
+		sign = "-"
+		value = -value
+	}
+	// 'e'格式给出最短的有效数字d.ddd以及指数
+	str := strconv.FormatFloat(value, 'e', -1, 64)
+	mantissa, rawExp := str[:strings.IndexByte(str, 'e')], str[strings.IndexByte(str, 'e')+1:]
+	digits := strings.Replace(mantissa, ".", "", 1)
+	exp, _ := strconv.Atoi(rawExp)
+	// 最后一位有效数字的十进制位置
+	k := exp - (len(digits) - 1)
+	absExp := exp
+	if absExp < 0 {
+		absExp = -absExp
+	}
+	switch {
+	case k >= 0 && absExp < len(digits)+7:
+		// 整数
+		return sign + digits + strings.Repeat("0", k)
+	case k < 0 && (k > -7 || absExp < 4):
+		// 不使用科学计数法的小数
+		offset := len(digits) + k
+		if offset <= 0 {
+			return sign + "0." + strings.Repeat("0", -offset) + digits
+		}
+		return sign + digits[:offset] + "." + digits[offset:]
+	}
+	expSign := "+"
+	if exp < 0 {
+		expSign = "-"
+	}
+	return sign + mantissa + "e" + expSign + strconv.Itoa(absExp)
+}
+
+/* ---- Boolean Reply ---- */
+
+// BooleanReply 布尔值，RESP2中编码为整数1或者0
+type BooleanReply struct {
+	Value bool
+}
+
+// MakeBooleanReply 创建布尔值
+func MakeBooleanReply(value bool) *BooleanReply {
+	return &BooleanReply{
+		Value: value,
+	}
+}
+
+var (
+	trueBytes  = []byte("#t\r\n")
+	falseBytes = []byte("#f\r\n")
+)
+
+func (r *BooleanReply) ToBytes() []byte {
+	if r.Value {
+		return MakeIntReply(1).ToBytes()
+	}
+	return MakeIntReply(0).ToBytes()
+}
+
+func (r *BooleanReply) ToRESP3Bytes() []byte {
+	if r.Value {
+		return trueBytes
+	}
+	return falseBytes
+}
+
+/* ---- Big Number Reply ---- */
+
+// BigNumberReply 超出64位整数范围的整数，RESP2中编码为字符串
+type BigNumberReply struct {
+	Value *big.Int
+}
+
+// MakeBigNumberReply 创建大整数
+func MakeBigNumberReply(value *big.Int) *BigNumberReply {
+	return &BigNumberReply{
+		Value: value,
+	}
+}
+
+func (r *BigNumberReply) ToBytes() []byte {
+	return MakeBulkReply([]byte(r.Value.String())).ToBytes()
+}
+
+func (r *BigNumberReply) ToRESP3Bytes() []byte {
+	return []byte("(" + r.Value.String() + CRLF)
+}
+
+/* ---- Verbatim String Reply ---- */
+
+// VerbatimStringReply 带有格式的文本，例如INFO的结果，RESP2中编码为字符串
+type VerbatimStringReply struct {
+	// 三个字符的格式，txt为纯文本，mkd为markdown
+	Format string
+	Text   []byte
+}
+
+// MakeVerbatimStringReply 创建带有格式的文本
+func MakeVerbatimStringReply(format string, text []byte) *VerbatimStringReply {
+	return &VerbatimStringReply{
+		Format: format,
+		Text:   text,
+	}
+}
+
+func (r *VerbatimStringReply) ToBytes() []byte {
+	return MakeBulkReply(r.Text).ToBytes()
+}
+
+func (r *VerbatimStringReply) ToRESP3Bytes() []byte {
+	// 长度包含格式以及之后的冒号
+	return []byte("=" + strconv.Itoa(len(r.Format)+1+len(r.Text)) + CRLF + r.Format + ":" + string(r.Text) + CRLF)
+}
+
+/* ---- Push Reply ---- */
+
+// PushReply 服务端主动推送的消息，RESP2中编码为数组
+type PushReply struct {
+	Replies []redis.Reply
+}
+
+// MakePushReply 创建推送消息，第一个元素为消息的类型
+func MakePushReply(replies []redis.Reply) *PushReply {
+	return &PushReply{
+		Replies: replies,
+	}
+}
+
+func (r *PushReply) ToBytes() []byte {
+	return encodeAggregate('*', r.Replies, RESP2)
+}
+
+func (r *PushReply) ToRESP3Bytes() []byte {
+	return encodeAggregate('>', r.Replies, RESP3)
+}
+
+/* ---- Attribute Reply ---- */
+
+// AttributeReply 附带了辅助信息的回复，RESP2中只发送回复本身
+type AttributeReply struct {
+	// 键值交替出现的辅助信息
+	Attributes []redis.Reply
+	Reply      redis.Reply
+}
+
+// MakeAttributeReply 创建附带辅助信息的回复
+func MakeAttributeReply(attributes []redis.Reply, reply redis.Reply) *AttributeReply {
+	return &AttributeReply{
+		Attributes: attributes,
+		Reply:      reply,
+	}
+}
+
+func (r *AttributeReply) ToBytes() []byte {
+	return r.Reply.ToBytes()
+}
+
+func (r *AttributeReply) ToRESP3Bytes() []byte {
+	var buf bytes.Buffer
+	buf.WriteString("|" + strconv.Itoa(len(r.Attributes)/2) + CRLF)
+	for _, attribute := range r.Attributes {
+		buf.Write(Encode(attribute, RESP3))
+	}
+	buf.Write(Encode(r.Reply, RESP3))
+	return buf.Bytes()
+}
+
+/* ---- Scored Members Reply ---- */
+
+// ScoredMembersReply 有序集合WITHSCORES的结果
+// RESP2中成员与分数交替出现，RESP3中每个成员与其分数组成一个数组，分数为浮点数
+type ScoredMembersReply struct {
+	Members [][]byte
+	Scores  []float64
+}
+
+// MakeScoredMembersReply 创建带有分数的成员列表
+func MakeScoredMembersReply(members [][]byte, scores []float64) *ScoredMembersReply {
+	return &ScoredMembersReply{
+		Members: members,
+		Scores:  scores,
+	}
+}
+
+func (r *ScoredMembersReply) ToBytes() []byte {
+	args := make([][]byte, 0, len(r.Members)*2)
+	for i, member := range r.Members {
+		args = append(args, member, []byte(FormatDouble(r.Scores[i])))
+	}
+	return MakeMultiBulkReply(args).ToBytes()
+}
+
+func (r *ScoredMembersReply) ToRESP3Bytes() []byte {
+	var buf bytes.Buffer
+	buf.WriteString("*" + strconv.Itoa(len(r.Members)) + CRLF)
+	for i, member := range r.Members {
+		buf.WriteString("*2" + CRLF)
+		buf.Write(MakeBulkReply(member).ToBytes())
+		buf.Write(MakeDoubleReply(r.Scores[i]).ToRESP3Bytes())
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,72 @@
+package protocol
+
+import (
+	"gedis/interface/redis"
+	"math"
+	"math/big"
+	"testing"
+)
+
+func TestResp3Encode(t *testing.T) {
+	bigNumber, _ := new(big.Int).SetString("3492890328409238509324850943850943825024385", 10)
+	cases := []struct {
+		name  string
+		reply redis.Reply
+		resp2 string
+		resp3 string
+	}{
+		{"null", MakeNullReply(), "$-1\r\n", "_\r\n"},
+		{"null bulk", MakeNullBulkReply(), "$-1\r\n", "_\r\n"},
+		{"multi bulk with nil", MakeMultiBulkReply([][]byte{[]byte("a"), nil}), "*2\r\n$1\r\na\r\n$-1\r\n", "*2\r\n$1\r\na\r\n_\r\n"},
+		{"map", MakeBulkMapReply([][]byte{[]byte("k"), []byte("v")}), "*2\r\n$1\r\nk\r\n$1\r\nv\r\n", "%1\r\n$1\r\nk\r\n$1\r\nv\r\n"},
+		{"empty map", MakeMapReply(nil), "*0\r\n", "%0\r\n"},
+		{"set", MakeSetReply([][]byte{[]byte("m")}), "*1\r\n$1\r\nm\r\n", "~1\r\n$1\r\nm\r\n"},
+		{"empty set", MakeSetReply(nil), "*0\r\n", "~0\r\n"},
+		{"double", MakeDoubleReply(1.5), "$3\r\n1.5\r\n", ",1.5\r\n"},
+		{"double inf", MakeDoubleReply(math.Inf(-1)), "$4\r\n-inf\r\n", ",-inf\r\n"},
+		{"double exponent", MakeDoubleReply(1e20), "$5\r\n1e+20\r\n", ",1e+20\r\n"},
+		{"boolean", MakeBooleanReply(true), ":1\r\n", "#t\r\n"},
+		{"boolean false", MakeBooleanReply(false), ":0\r\n", "#f\r\n"},
+		{"big number", MakeBigNumberReply(bigNumber), "$43\r\n" + bigNumber.String() + "\r\n", "(" + bigNumber.String() + "\r\n"},
+		{"verbatim", MakeVerbatimStringReply("txt", []byte("hi")), "$2\r\nhi\r\n", "=6\r\ntxt:hi\r\n"},
+		{"push", MakePushReply([]redis.Reply{MakeBulkReply([]byte("p")), MakeNullReply()}), "*2\r\n$1\r\np\r\n$-1\r\n", ">2\r\n$1\r\np\r\n_\r\n"},
+		{"attribute", MakeAttributeReply([]redis.Reply{MakeBulkReply([]byte("ttl")), MakeIntReply(1)}, MakeOkReply()), "+OK\r\n", "|1\r\n$3\r\nttl\r\n:1\r\n+OK\r\n"},
+		{"scored members", MakeScoredMembersReply([][]byte{[]byte("a")}, []float64{2}), "*2\r\n$1\r\na\r\n$1\r\n2\r\n", "*1\r\n*2\r\n$1\r\na\r\n,2\r\n"},
+		{"scored members inf", MakeScoredMembersReply([][]byte{[]byte("a")}, []float64{math.Inf(1)}), "*2\r\n$1\r\na\r\n$3\r\ninf\r\n", "*1\r\n*2\r\n$1\r\na\r\n,inf\r\n"},
+		{"nested", MakeMultiRawReply([]redis.Reply{MakeSetReply(nil), MakeDoubleReply(0.5)}), "*2\r\n*0\r\n$3\r\n0.5\r\n", "*2\r\n~0\r\n,0.5\r\n"},
+		{"status", MakeOkReply(), "+OK\r\n", "+OK\r\n"},
+	}
+	for _, c := range cases {
+		if actual := string(Encode(c.reply, RESP2)); actual != c.resp2 {
+			t.Errorf("%s: expect RESP2 %q actually %q", c.name, c.resp2, actual)
+		}
+		if actual := string(Encode(c.reply, RESP3)); actual != c.resp3 {
+			t.Errorf("%s: expect RESP3 %q actually %q", c.name, c.resp3, actual)
+		}
+	}
+}
+
+func TestFormatDouble(t *testing.T) {
+	// 与redis的输出一致
+	cases := map[float64]string{
+		0:                  "0",
+		1.5:                "1.5",
+		-2.5:               "-2.5",
+		100:                "100",
+		1234567:            "1234567",
+		1e7:                "10000000",
+		1e8:                "1e+8",
+		1e20:               "1e+20",
+		0.1:                "0.1",
+		0.0001:             "0.0001",
+		1.25e-7:            "1.25e-7",
+		123456789012345678: "123456789012345680",
+		math.Inf(1):        "inf",
+		math.Inf(-1):       "-inf",
+	}
+	for value, expect := range cases {
+		if actual := FormatDouble(value); actual != expect {
+			t.Errorf("%v: expect %q actually %q", value, expect, actual)
+		}
+	}
+}
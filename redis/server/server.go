@@ -2,14 +2,18 @@ package server
 
 import (
 	"context"
+	"gedis/cluster"
+	"gedis/config"
 	database2 "gedis/database"
 	"gedis/interface/database"
+	"gedis/interface/redis"
 	"gedis/lib/logger"
 	"gedis/lib/sync/atomic"
 	"gedis/redis/connection"
 	"gedis/redis/parser"
 	"gedis/redis/protocol"
 	"net"
+	"strings"
 	"sync"
 )
 
@@ -23,14 +27,28 @@ type Handler struct {
 	db         database.DB
 	// 原子操作
 	closing atomic.Boolean
+	// 解析客户端请求时的限制
+	limits parser.Limits
 }
 
 func MakeHandler() *Handler {
-	// 只需要初始化db
+	// 配置了peers时以集群模式运行，开启raft时peers为raft集群的成员
 	var db database.DB
-	db = database2.NewStandaloneServer()
+	if len(config.Properties.Peers) > 0 && !config.Properties.RaftEnabled {
+		db = cluster.MakeCluster()
+	} else {
+		db = database2.NewStandaloneServer()
+	}
+	maxBulkLen, err := config.ParseSize(config.Properties.ProtoMaxBulkLen)
+	if err != nil {
+		panic(err)
+	}
 	return &Handler{
 		db: db,
+		limits: parser.Limits{
+			MaxBulkLen:      maxBulkLen,
+			MaxMultiBulkLen: config.Properties.ProtoMaxMultiBulkLen,
+		},
 	}
 }
 
@@ -50,13 +68,28 @@ func (h *Handler) Handle(ctx context.Context, conn net.Conn) {
 	client := connection.NewConn(conn)
 	h.activeConn.Store(client, struct{}{})
 
-	ch := parser.ParseStream(conn)
+	ch := parser.ParseRequestStream(conn, h.limits)
 
-	// 对于ch返回的reply进行传导
-	for payload := range ch {
-		// 解析出现了错误，client传递了错误的值
+	// 执行阻塞命令期间读取到的请求
+	var pending []*parser.Payload
+	// 对于ch返回的reply进行传导，回复先写入缓冲区，没有立即可读的命令时再发送
+	for {
+		var payload *parser.Payload
+		ok := true
+		if len(pending) > 0 {
+			payload, pending = pending[0], pending[1:]
+		} else {
+			payload, ok = nextPayload(client, ch)
+		}
+		if !ok {
+			break
+		}
+		// 不符合协议时无法确定之后数据的边界，与redis一样回复错误之后关闭连接
 		if payload.Err != nil {
-
+			if parser.IsProtocolError(payload.Err) {
+				_ = client.BufferWrite(protocol.MakeErrReply("ERR " + payload.Err.Error()).ToBytes())
+			}
+			break
 		}
 		if payload.Data == nil {
 			logger.Error("empty payload")
@@ -71,13 +104,82 @@ func (h *Handler) Handle(ctx context.Context, conn net.Conn) {
 		}
 		/*使用conn作为reader流放入解析器parseStream中进行解析之后，返回reply接口实现类MultiBulkReply类*/
 
-		result := h.db.Exec(client, r.Args)
+		var result redis.Reply
+		// 可能长时间阻塞的命令执行之前先发送之前命令的回复，执行期间继续读取请求以便发现客户端断开
+		if len(r.Args) > 0 && blockingCommands[strings.ToLower(string(r.Args[0]))] {
+			_ = client.Flush()
+			done := make(chan struct{})
+			received := watchClient(client, ch, done)
+			result = h.db.Exec(client, r.Args)
+			close(done)
+			pending = append(pending, <-received...)
+		} else {
+			result = h.db.Exec(client, r.Args)
+		}
 		if result != nil {
-			_ = client.Write(result.ToBytes())
+			_ = client.BufferWrite(protocol.Encode(result, client.GetProtocol()))
 		} else {
-			_ = client.Write(unknownErrReplyBytes)
+			_ = client.BufferWrite(unknownErrReplyBytes)
 		}
 	}
+	// 客户端关闭写方向之后仍然可以收到之前命令的回复
+	_ = client.Flush()
+	// 连接已经断开
+	h.closeClient(client)
+	h.db.AfterClientClose(client)
+	// 提前退出时解析协程可能阻塞在发送上，连接关闭之后它会读取失败并关闭ch
+	for range ch {
+	}
+}
+
+// blockingCommands 执行时可能长时间阻塞的命令
+var blockingCommands = map[string]bool{
+	"wait": true,
+}
+
+// watchClient 在阻塞命令执行期间读取请求，直到done被关闭，返回读取到的请求
+// 连接中断时关闭连接，阻塞的命令通过Closed得知客户端已经断开
+func watchClient(client *connection.Connection, ch <-chan *parser.Payload, done <-chan struct{}) <-chan []*parser.Payload {
+	received := make(chan []*parser.Payload, 1)
+	go func() {
+		var payloads []*parser.Payload
+		defer func() {
+			received <- payloads
+		}()
+		for {
+			select {
+			case payload, ok := <-ch:
+				if !ok {
+					_ = client.Close()
+					return
+				}
+				payloads = append(payloads, payload)
+				// 协议错误之后不再读取，由调用方回复错误之后关闭连接
+				if payload.Err != nil {
+					if !parser.IsProtocolError(payload.Err) {
+						_ = client.Close()
+					}
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return received
+}
+
+// nextPayload 读取下一条命令，解析器没有已经就绪的命令时先发送缓冲区中的回复
+// 执行命令期间解析器会继续解析缓冲区中的数据，流水线中的后续命令通常已经就绪
+func nextPayload(client *connection.Connection, ch <-chan *parser.Payload) (*parser.Payload, bool) {
+	select {
+	case payload, ok := <-ch:
+		return payload, ok
+	default:
+	}
+	_ = client.Flush()
+	payload, ok := <-ch
+	return payload, ok
 }
 
 // Close 被TCPServer调用，完成redis的关闭
@@ -90,5 +192,6 @@ func (h *Handler) Close() error {
 		_ = client.Close()
 		return true
 	})
+	h.db.Close()
 	return nil
 }
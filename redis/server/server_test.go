@@ -0,0 +1,150 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"gedis/config"
+	"gedis/redis/protocol"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// startTestServer 在随机端口上启动不持久化的服务端
+func startTestServer(b testing.TB) (string, func()) {
+	config.Properties.Save = nil
+	config.Properties.AppendOnly = false
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	handler := MakeHandler()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go handler.Handle(context.Background(), conn)
+		}
+	}()
+	return listener.Addr().String(), func() {
+		_ = listener.Close()
+		_ = handler.Close()
+	}
+}
+
+// benchmarkPipeline 每次写入depth条命令再读取所有的回复，每条回复的长度都是replySize
+func benchmarkPipeline(b *testing.B, depth int, makeCmd func(i int) [][]byte, replySize int) {
+	addr, stop := startTestServer(b)
+	defer stop()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	// 预先写入GET读取的key
+	setup := make([]byte, 0)
+	for i := 0; i < 1000; i++ {
+		setup = append(setup, protocol.MakeMultiBulkReply([][]byte{
+			[]byte("SET"), []byte(fmt.Sprintf("key:%03d", i)), []byte("value"),
+		}).ToBytes()...)
+	}
+	if _, err := conn.Write(setup); err != nil {
+		b.Fatal(err)
+	}
+	if _, err := io.ReadFull(reader, make([]byte, 1000*len("+OK\r\n"))); err != nil {
+		b.Fatal(err)
+	}
+
+	batch := make([]byte, 0)
+	for i := 0; i < depth; i++ {
+		batch = append(batch, protocol.MakeMultiBulkReply(makeCmd(i)).ToBytes()...)
+	}
+	replies := make([]byte, depth*replySize)
+	b.SetBytes(int64(len(batch)))
+	b.ResetTimer()
+	start := time.Now()
+	for n := 0; n < b.N; n++ {
+		if _, err := conn.Write(batch); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := io.ReadFull(reader, replies); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(b.N*depth)/time.Since(start).Seconds(), "cmds/s")
+}
+
+var pipelineDepths = []int{1, 16, 128, 1024}
+
+func BenchmarkPipelineSet(b *testing.B) {
+	for _, depth := range pipelineDepths {
+		b.Run(fmt.Sprintf("depth=%d", depth), func(b *testing.B) {
+			benchmarkPipeline(b, depth, func(i int) [][]byte {
+				return [][]byte{[]byte("SET"), []byte(fmt.Sprintf("key:%03d", i%1000)), []byte("value")}
+			}, len("+OK\r\n"))
+		})
+	}
+}
+
+func BenchmarkPipelineGet(b *testing.B) {
+	for _, depth := range pipelineDepths {
+		b.Run(fmt.Sprintf("depth=%d", depth), func(b *testing.B) {
+			benchmarkPipeline(b, depth, func(i int) [][]byte {
+				return [][]byte{[]byte("GET"), []byte(fmt.Sprintf("key:%03d", i%1000))}
+			}, len("$5\r\nvalue\r\n"))
+		})
+	}
+}
+
+func TestWaitPipelined(t *testing.T) {
+	addr, closeServer := startTestServer(t)
+	defer closeServer()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// WAIT执行期间读取到的命令在它返回之后按顺序执行
+	if _, err := conn.Write([]byte("WAIT 1 200\r\nPING\r\nGET missing\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	expect := ":0\r\n+PONG\r\n$-1\r\n"
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	actual := make([]byte, len(expect))
+	if _, err := io.ReadFull(conn, actual); err != nil {
+		t.Fatal(err)
+	}
+	if string(actual) != expect {
+		t.Errorf("expect %q actually %q", expect, actual)
+	}
+}
+
+func TestWaitClientDisconnect(t *testing.T) {
+	config.Properties.Save = nil
+	config.Properties.AppendOnly = false
+	handler := MakeHandler()
+	defer handler.Close()
+	server, client := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		handler.Handle(context.Background(), server)
+		close(done)
+	}()
+	// 没有从节点，WAIT 1 0会一直等待，客户端断开之后停止
+	if _, err := client.Write([]byte("WAIT 1 0\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	_ = client.Close()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("WAIT still blocked after client disconnected")
+	}
+}
@@ -2,6 +2,8 @@ package tcp
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"gedis/interface/tcp"
 	"gedis/lib/logger"
@@ -14,14 +16,24 @@ import (
 )
 
 type Config struct {
+	// 明文监听的地址，为空时只监听TLSAddress
 	Address    string        `yaml:"address"`
 	MaxConnect uint32        `yaml:"max-connect"`
 	Timeout    time.Duration `yaml:"timeout"`
+
+	// TLS监听的地址，为空时不开启TLS，可以与Address同时监听
+	TLSAddress  string `yaml:"tls-address"`
+	TLSCertFile string `yaml:"tls-cert-file"`
+	TLSKeyFile  string `yaml:"tls-key-file"`
+	// 校验客户端证书使用的CA证书
+	TLSCACertFile string `yaml:"tls-ca-cert-file"`
+	// 是否要求客户端提供证书，yes|optional|no，为空时为yes
+	TLSAuthClients string `yaml:"tls-auth-clients"`
 }
 
 func ListenAndServeWithSignal(cfg *Config, handler tcp.Handler) error {
 	closeChan := make(chan struct{})
-	sigCh := make(chan os.Signal)
+	sigCh := make(chan os.Signal, 1)
 	// 这几类signal发送给sigch
 	signal.Notify(sigCh, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT)
 	go func() {
@@ -31,50 +43,108 @@ func ListenAndServeWithSignal(cfg *Config, handler tcp.Handler) error {
 			closeChan <- struct{}{}
 		}
 	}()
-	listener, err := net.Listen("tcp", cfg.Address)
+	listeners, err := listen(cfg)
 	if err != nil {
 		return err
 	}
-	logger.Info(fmt.Sprintf("bind: %s, start listening...", cfg.Address))
-	ListenAndServe(listener, handler, closeChan)
+	Serve(listeners, handler, closeChan)
 	return nil
 }
 
+// listen 监听明文以及TLS地址，其中一个失败时关闭已经开始监听的地址
+func listen(cfg *Config) ([]net.Listener, error) {
+	listeners := make([]net.Listener, 0, 2)
+	closeAll := func() {
+		for _, listener := range listeners {
+			_ = listener.Close()
+		}
+	}
+	if cfg.Address != "" {
+		listener, err := net.Listen("tcp", cfg.Address)
+		if err != nil {
+			return nil, err
+		}
+		logger.Info(fmt.Sprintf("bind: %s, start listening...", cfg.Address))
+		listeners = append(listeners, listener)
+	}
+	if cfg.TLSAddress != "" {
+		tlsConfig, err := MakeTLSConfig(cfg)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		listener, err := tls.Listen("tcp", cfg.TLSAddress, tlsConfig)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		logger.Info(fmt.Sprintf("bind: %s, start listening tls...", cfg.TLSAddress))
+		listeners = append(listeners, listener)
+	}
+	if len(listeners) == 0 {
+		return nil, errors.New("no address to listen")
+	}
+	return listeners, nil
+}
+
 func ListenAndServe(listener net.Listener, handler tcp.Handler, closeChan <-chan struct{}) {
+	Serve([]net.Listener{listener}, handler, closeChan)
+}
+
+// Serve 同时在多个地址上接受连接，任意一个地址停止监听时关闭所有地址
+func Serve(listeners []net.Listener, handler tcp.Handler, closeChan <-chan struct{}) {
+	closeAll := func() {
+		for _, listener := range listeners {
+			_ = listener.Close()
+		}
+	}
 	// channel含有数据之后进行关闭
 	go func() {
 		<-closeChan
 		logger.Info("shutting down...")
 		// 停止监听，listener.Accept()会立即返回 io.EOF
-		_ = listener.Close()
+		closeAll()
 		// 关闭应用层服务器
 		_ = handler.Close()
 	}()
 	// 异常退出之后释放资源
 	defer func() {
-		_ = listener.Close()
+		closeAll()
 		_ = handler.Close()
 	}()
 	ctx := context.Background()
 	var waitDone sync.WaitGroup
-	// tcp服务器开启循环监听
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			break
-		}
-		logger.Info("accept link")
-		waitDone.Add(1)
-		go func() {
-			defer func() {
-				waitDone.Done()
-			}()
-			handler.Handle(ctx, conn)
-
-		}()
-
+	var acceptDone sync.WaitGroup
+	for _, listener := range listeners {
+		acceptDone.Add(1)
+		go func(listener net.Listener) {
+			defer acceptDone.Done()
+			defer closeAll()
+			// tcp服务器开启循环监听
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					break
+				}
+				logger.Info("accept link")
+				waitDone.Add(1)
+				go func() {
+					defer func() {
+						waitDone.Done()
+					}()
+					if tlsConn, ok := conn.(*tls.Conn); ok {
+						if err := tlsHandshake(tlsConn); err != nil {
+							logger.Warn("tls handshake failed: " + err.Error())
+							_ = conn.Close()
+							return
+						}
+					}
+					handler.Handle(ctx, conn)
+				}()
+			}
+		}(listener)
 	}
+	acceptDone.Wait()
 	// 等待所有的处理结束
 	waitDone.Wait()
-
 }
@@ -0,0 +1,68 @@
+package tcp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// tlsHandshakeTimeout 建立TLS连接时完成握手的超时时间
+const tlsHandshakeTimeout = 10 * time.Second
+
+/*
+MakeTLSConfig 根据证书配置创建TLS监听的配置
+1. tls-auth-clients为yes时要求客户端提供由tls-ca-cert-file签发的证书，与redis一致这是默认值
+2. 为optional时客户端可以不提供证书，提供了则必须通过校验
+3. 为no时不校验客户端证书
+*/
+func MakeTLSConfig(cfg *Config) (*tls.Config, error) {
+	if cfg.TLSCertFile == "" || cfg.TLSKeyFile == "" {
+		return nil, errors.New("tls-cert-file and tls-key-file are required for tls-port")
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	switch strings.ToLower(cfg.TLSAuthClients) {
+	case "", "yes":
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	case "optional":
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	case "no":
+		tlsConfig.ClientAuth = tls.NoClientCert
+		return tlsConfig, nil
+	default:
+		return nil, errors.New("invalid tls-auth-clients: " + cfg.TLSAuthClients)
+	}
+	if cfg.TLSCACertFile == "" {
+		return nil, errors.New("tls-ca-cert-file is required to verify client certificates")
+	}
+	pem, err := ioutil.ReadFile(cfg.TLSCACertFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificate found in " + cfg.TLSCACertFile)
+	}
+	tlsConfig.ClientCAs = pool
+	return tlsConfig, nil
+}
+
+// tlsHandshake 在交给handler之前完成握手，握手失败或者客户端证书没有通过校验的连接直接关闭
+func tlsHandshake(conn *tls.Conn) error {
+	if err := conn.SetDeadline(time.Now().Add(tlsHandshakeTimeout)); err != nil {
+		return err
+	}
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+	return conn.SetDeadline(time.Time{})
+}
@@ -0,0 +1,213 @@
+package tcp
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// echoHandler 将收到的每一行原样返回
+type echoHandler struct{}
+
+func (h *echoHandler) Handle(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		if _, err := conn.Write(line); err != nil {
+			return
+		}
+	}
+}
+
+func (h *echoHandler) Close() error {
+	return nil
+}
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pair tls.Certificate
+}
+
+var serialNumber int64
+
+// makeCert 生成由parent签发的证书，parent为nil时生成自签名的CA证书
+func makeCert(t *testing.T, name string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serialNumber++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serialNumber),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{
+		cert: cert,
+		key:  key,
+		pair: tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key},
+	}
+}
+
+// writeCert 将证书以及私钥以PEM格式写入dir，返回文件路径
+func writeCert(t *testing.T, dir string, name string, c *testCert) (string, string) {
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw})
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := ioutil.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// echo 发送一行并读取回复，客户端证书没有通过校验时服务端在握手之后关闭连接，读取失败
+func echo(conn net.Conn) error {
+	_ = conn.SetDeadline(time.Now().Add(3 * time.Second))
+	if _, err := conn.Write([]byte("ping\n")); err != nil {
+		return err
+	}
+	_, err := bufio.NewReader(conn).ReadString('\n')
+	return err
+}
+
+func TestServeTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := makeCert(t, "gedis test ca", nil)
+	caFile, _ := writeCert(t, dir, "ca", ca)
+	certFile, keyFile := writeCert(t, dir, "server", makeCert(t, "gedis server", ca))
+	client := makeCert(t, "gedis client", ca)
+	// 由另外一个CA签发的客户端证书
+	rogue := makeCert(t, "rogue client", makeCert(t, "rogue ca", nil))
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	cases := []struct {
+		authClients string
+		cert        *testCert
+		ok          bool
+	}{
+		{"yes", client, true},
+		{"yes", nil, false},
+		{"yes", rogue, false},
+		{"optional", client, true},
+		{"optional", nil, true},
+		{"optional", rogue, false},
+		{"no", nil, true},
+	}
+	for _, c := range cases {
+		listeners, err := listen(&Config{
+			Address:        "127.0.0.1:0",
+			TLSAddress:     "127.0.0.1:0",
+			TLSCertFile:    certFile,
+			TLSKeyFile:     keyFile,
+			TLSCACertFile:  caFile,
+			TLSAuthClients: c.authClients,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		closeChan := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			Serve(listeners, &echoHandler{}, closeChan)
+			close(done)
+		}()
+
+		// 明文端口同时可用
+		plain, err := net.Dial("tcp", listeners[0].Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := echo(plain); err != nil {
+			t.Errorf("auth %s: plain port: %v", c.authClients, err)
+		}
+		_ = plain.Close()
+
+		tlsConfig := &tls.Config{RootCAs: roots}
+		if c.cert != nil {
+			// 始终发送证书，否则客户端不会发送不是由服务端接受的CA签发的证书
+			pair := c.cert.pair
+			tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				return &pair, nil
+			}
+		}
+		conn, err := tls.Dial("tcp", listeners[1].Addr().String(), tlsConfig)
+		if err == nil {
+			err = echo(conn)
+			_ = conn.Close()
+		}
+		if c.ok && err != nil {
+			t.Errorf("auth %s with cert %v: %v", c.authClients, c.cert != nil, err)
+		}
+		if !c.ok && err == nil {
+			t.Errorf("auth %s with cert %v: expect handshake failure", c.authClients, c.cert != nil)
+		}
+
+		close(closeChan)
+		<-done
+	}
+}
+
+func TestMakeTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	ca := makeCert(t, "gedis test ca", nil)
+	certFile, keyFile := writeCert(t, dir, "server", makeCert(t, "gedis server", ca))
+	invalid := []*Config{
+		{TLSKeyFile: keyFile},
+		{TLSCertFile: certFile, TLSKeyFile: keyFile},
+		{TLSCertFile: certFile, TLSKeyFile: keyFile, TLSAuthClients: "maybe"},
+		{TLSCertFile: certFile, TLSKeyFile: certFile, TLSAuthClients: "no"},
+		{TLSCertFile: certFile, TLSKeyFile: keyFile, TLSCACertFile: keyFile},
+	}
+	for i, cfg := range invalid {
+		if _, err := MakeTLSConfig(cfg); err == nil {
+			t.Errorf("case %d: expect error", i)
+		}
+	}
+}